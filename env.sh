@@ -2,3 +2,6 @@ PATH=/usr/local/bin:/home/isucon/.local/ruby/bin:/home/isucon/.local/node/bin:/h
 ISUCONP_DB_USER=isuconp
 ISUCONP_DB_PASSWORD=isuconp
 ISUCONP_DB_NAME=isuconp
+ISUCONP_IMAGE_ACCEL_REDIRECT=/internal/image/
+ISUCONP_BASE_URL=http://localhost
+ISUCONP_RATE_LIMIT=false
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	scopeRead    = "read"
+	scopePost    = "post"
+	scopeComment = "comment"
+	scopeAdmin   = "admin"
+
+	accessTokenPrefix        = "isup_"
+	accessTokenNameMaxLength = 64
+	maxAccessTokensPerUser   = 20
+	// last_used_at は毎回書かず、このくらい古くなったときだけ更新する
+	accessTokenTouchInterval = time.Minute
+)
+
+var accessTokenScopes = []string{scopeRead, scopePost, scopeComment, scopeAdmin}
+
+var templateTokens = template.Must(template.ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("tokens.html")),
+)
+
+// AccessToken は API クライアント用の個人アクセストークン。トークンそのものは保存せずハッシュだけ持つ
+type AccessToken struct {
+	ID         int          `db:"id"`
+	UserID     int          `db:"user_id"`
+	Name       string       `db:"name"`
+	TokenHash  string       `db:"token_hash"`
+	Scopes     string       `db:"scopes"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+	CreatedAt  time.Time    `db:"created_at"`
+}
+
+func (t AccessToken) ScopeList() []string {
+	if t.Scopes == "" {
+		return nil
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+func (t AccessToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type accessTokenAuth struct {
+	User  User
+	Token AccessToken
+}
+
+type accessTokenContextKey struct{}
+
+func accessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken は Authorization: Bearer のトークンを取り出す
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+func accessTokenFrom(r *http.Request) *accessTokenAuth {
+	auth, _ := r.Context().Value(accessTokenContextKey{}).(*accessTokenAuth)
+	return auth
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// withAccessToken は Bearer トークンを確かめ、リクエストのコンテキストに認証結果を入れる。
+// トークンを付けたリクエストではクッキーのセッションは見ない
+func withAccessToken(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		at := AccessToken{}
+		err := db.Get(&at, "SELECT * FROM `access_tokens` WHERE `token_hash` = ?", accessTokenHash(token))
+		if err != nil && err != sql.ErrNoRows {
+			log.Print(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var u User
+		if err == nil {
+			u, err = getUser(db, at.UserID)
+		}
+		if err != nil || u.DelFlg != 0 {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeJSONError(w, http.StatusUnauthorized, "invalid_token", "トークンが無効です")
+			return
+		}
+
+		now := time.Now()
+		if !at.LastUsedAt.Valid || now.Sub(at.LastUsedAt.Time) > accessTokenTouchInterval {
+			_, err := db.Exec("UPDATE `access_tokens` SET `last_used_at` = ? WHERE `id` = ?", now, at.ID)
+			if err != nil {
+				log.Print(err)
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), accessTokenContextKey{}, &accessTokenAuth{User: u, Token: at})
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getAuthUser はクッキーのセッションか、scope を持つトークンで認証したユーザーを返す
+func getAuthUser(r *http.Request, scope string) User {
+	if auth := accessTokenFrom(r); auth != nil {
+		if auth.Token.HasScope(scope) {
+			return auth.User
+		}
+		return User{}
+	}
+	return getSessionUser(r)
+}
+
+func insufficientScope(w http.ResponseWriter, scope string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+	writeJSONError(w, http.StatusForbidden, "insufficient_scope", "トークンに "+scope+" の権限がありません")
+}
+
+// requireAuthUser は getAuthUser でログインしていなければ /login に送る。
+// トークンの scope が足りないときは API クライアント向けに 403 を返す
+func requireAuthUser(w http.ResponseWriter, r *http.Request, scope string) (User, bool) {
+	if auth := accessTokenFrom(r); auth != nil && !auth.Token.HasScope(scope) {
+		insufficientScope(w, scope)
+		return User{}, false
+	}
+	me := getAuthUser(r, scope)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return me, false
+	}
+	return me, true
+}
+
+// validCSRF はフォームの csrf_token を確かめる。
+// トークンで認証したリクエストはブラウザが勝手に付けるクッキーに頼らないので確かめない
+func validCSRF(r *http.Request) bool {
+	if accessTokenFrom(r) != nil {
+		return true
+	}
+	return r.FormValue("csrf_token") == getCSRFToken(r)
+}
+
+// parseScopes は知っている scope だけを決まった順に並べる
+func parseScopes(values []string, me User) (string, bool) {
+	selected := map[string]bool{}
+	for _, v := range values {
+		selected[v] = true
+	}
+	scopes := []string{}
+	for _, s := range accessTokenScopes {
+		if !selected[s] {
+			continue
+		}
+		if s == scopeAdmin && me.Authority == 0 {
+			return "", false
+		}
+		scopes = append(scopes, s)
+		delete(selected, s)
+	}
+	return strings.Join(scopes, ","), len(selected) == 0 && len(scopes) > 0
+}
+
+func getUserAccessTokens(userID int) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := db.Select(&tokens, "SELECT * FROM `access_tokens` WHERE `user_id` = ? ORDER BY `created_at` DESC, `id` DESC", userID)
+	return tokens, err
+}
+
+func renderTokens(w http.ResponseWriter, r *http.Request, me User, newToken, notice string) {
+	tokens, err := getUserAccessTokens(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateTokens.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+		Tokens    []AccessToken
+		Scopes    []string
+		NewToken  string
+	}{me, getCSRFToken(r), notice, tokens, accessTokenScopes, newToken})
+}
+
+func getTokens(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	renderTokens(w, r, me, "", getFlash(w, r, "notice"))
+}
+
+func postTokens(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	fail := func(notice string) {
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/tokens", http.StatusFound)
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > accessTokenNameMaxLength {
+		fail("トークンの名前は1文字以上64文字以下にしてください")
+		return
+	}
+	err := r.ParseForm()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	scopes, ok := parseScopes(r.Form["scopes[]"], me)
+	if !ok {
+		fail("権限の指定が正しくありません")
+		return
+	}
+	// トークンでは確認コードを確かめられないので、admin を付けるときに作る人が二段階認証を通す
+	if (AccessToken{Scopes: scopes}).HasScope(scopeAdmin) {
+		if !me.TOTPEnabled {
+			fail(admin2FARequiredMsg)
+			return
+		}
+		if !useTOTPCode(me, r.FormValue("code")) {
+			fail("admin 権限のトークンを作るには確認コードを入力してください")
+			return
+		}
+	}
+
+	count := 0
+	err = db.Get(&count, "SELECT COUNT(*) FROM `access_tokens` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if count >= maxAccessTokensPerUser {
+		fail("これ以上トークンを作れません。使っていないトークンを削除してください")
+		return
+	}
+
+	token := accessTokenPrefix + secureRandomStr(20)
+	_, err = db.Exec(
+		"INSERT INTO `access_tokens` (`user_id`, `name`, `token_hash`, `scopes`, `created_at`) VALUES (?,?,?,?,?)",
+		me.ID, name, accessTokenHash(token), scopes, time.Now(),
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// トークンはこの画面で一度だけ見せる
+	renderTokens(w, r, me, token, "トークンを作成しました。この画面を離れると二度と表示されません")
+}
+
+func postTokensRevoke(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM `access_tokens` WHERE `id` = ? AND `user_id` = ?", r.FormValue("token_id"), me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = "トークンを削除しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/tokens", http.StatusFound)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var newTokenRegexp = regexp.MustCompile(`class="isu-token">(isup_[0-9a-f]+)<`)
+
+// createToken は画面からトークンを作り、一度だけ表示される平文を返す
+func (c *testClient) createToken(name string, scopes ...string) string {
+	c.t.Helper()
+	res := c.postForm("/tokens", url.Values{"name": {name}, "scopes[]": scopes, "csrf_token": {c.csrfToken()}})
+	assertStatus(c.t, res, http.StatusOK)
+	m := newTokenRegexp.FindStringSubmatch(res.Body)
+	if m == nil {
+		c.t.Fatal("token not shown")
+	}
+	return m[1]
+}
+
+func TestAccessTokens(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	assertRedirect(t, app.newClient().get("/tokens"), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	for _, form := range []url.Values{
+		{"name": {""}, "scopes[]": {"read"}},
+		{"name": {"cli"}},
+		{"name": {"cli"}, "scopes[]": {"read", "unknown"}},
+		{"name": {"cli"}, "scopes[]": {"admin"}},
+	} {
+		form.Set("csrf_token", token)
+		assertRedirect(t, c.postForm("/tokens", form), "/tokens")
+	}
+	if n := app.count("access_tokens"); n != 0 {
+		t.Fatalf("access_tokens = %d", n)
+	}
+
+	plain := c.createToken("cli", "comment", "read")
+	row := app.fake.tables["access_tokens"][0]
+	if fakeString(row["token_hash"]) == plain || fakeString(row["token_hash"]) != accessTokenHash(plain) {
+		t.Error("token is not stored hashed")
+	}
+	if fakeString(row["scopes"]) != "read,comment" {
+		t.Errorf("scopes = %v", row["scopes"])
+	}
+
+	res := c.get("/tokens")
+	if strings.Contains(res.Body, plain) {
+		t.Error("token is shown again")
+	}
+	if !strings.Contains(res.Body, "未使用") {
+		t.Error("unused token not marked")
+	}
+
+	api := app.newClient()
+	if !strings.Contains(api.get("/", "Authorization", "Bearer "+plain).Body, `<span class="isu-account-name">mary</span>`) {
+		t.Error("token is not accepted for read")
+	}
+	if row["last_used_at"] == nil {
+		t.Error("last_used_at is not recorded")
+	}
+
+	assertRedirect(t, c.postForm("/tokens/revoke", url.Values{"token_id": {fmt.Sprint(row["id"])}, "csrf_token": {token}}), "/tokens")
+	res = api.get("/", "Authorization", "Bearer "+plain)
+	assertStatus(t, res, http.StatusUnauthorized)
+	if !strings.Contains(res.Header.Get("WWW-Authenticate"), "invalid_token") {
+		t.Errorf("WWW-Authenticate = %q", res.Header.Get("WWW-Authenticate"))
+	}
+}
+
+func TestAccessTokenScopes(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	pid := app.addPost(mary, "post by mary", nil)
+
+	c := app.newClient()
+	c.login("mary")
+	readOnly := c.createToken("read only", "read")
+	commenter := c.createToken("commenter", "comment")
+
+	api := app.newClient()
+	form := url.Values{"post_id": {fmt.Sprint(pid)}, "comment": {"from api"}}
+
+	res := api.postForm("/comment", form, "Authorization", "Bearer "+readOnly)
+	assertStatus(t, res, http.StatusForbidden)
+	if !strings.Contains(res.Body, "insufficient_scope") {
+		t.Errorf("body = %q", res.Body)
+	}
+
+	// トークンで認証したリクエストは CSRF トークンがなくても通る
+	assertRedirect(t, api.postForm("/comment", form, "Authorization", "Bearer "+commenter), fmt.Sprintf("/posts/%d", pid))
+	if n := app.count("comments"); n != 1 {
+		t.Errorf("comments = %d", n)
+	}
+
+	// read のないトークンでは閲覧はログインしていない扱い
+	if strings.Contains(api.get("/", "Authorization", "Bearer "+commenter).Body, `href="/logout"`) {
+		t.Error("token without read scope is treated as logged in")
+	}
+
+	// クッキー専用の画面はトークンでは使えない
+	assertRedirect(t, api.get("/password", "Authorization", "Bearer "+readOnly), "/login")
+	assertRedirect(t, api.postForm("/tokens", url.Values{"name": {"x"}, "scopes[]": {"read"}}, "Authorization", "Bearer "+readOnly), "/login")
+
+	assertStatus(t, api.get("/", "Authorization", "Bearer isup_unknown"), http.StatusUnauthorized)
+
+	// BAN されたユーザーのトークンは使えない
+	app.fake.findOne("users", "id", int64(mary))["del_flg"] = int64(1)
+	invalidateUser(mary)
+	assertStatus(t, api.get("/", "Authorization", "Bearer "+readOnly), http.StatusUnauthorized)
+}
+
+func TestAccessTokenAdmin(t *testing.T) {
+	app := newTestApp(t)
+	adminID := app.addUser("admin", 1, 0)
+	bob := app.addUser("bob", 0, 0)
+
+	c := app.newClient()
+	c.loginAdmin(app, adminID, "admin")
+
+	// admin 権限のトークンは確認コードを入れないと作れない
+	for _, code := range []string{"", "000000"} {
+		res := c.postForm("/tokens", url.Values{"name": {"moderation"}, "scopes[]": {"admin"}, "code": {code}, "csrf_token": {c.csrfToken()}})
+		assertRedirect(t, res, "/tokens")
+		if !strings.Contains(c.get("/tokens").Body, "確認コードを入力してください") {
+			t.Errorf("code %q: flash not shown", code)
+		}
+	}
+	if n := app.count("access_tokens"); n != 0 {
+		t.Fatalf("access_tokens = %d", n)
+	}
+	res := c.postForm("/tokens", url.Values{
+		"name": {"moderation"}, "scopes[]": {"admin"},
+		"code": {app.nextTOTPCode(adminID, testTOTPSecret)}, "csrf_token": {c.csrfToken()},
+	})
+	assertStatus(t, res, http.StatusOK)
+	m := newTokenRegexp.FindStringSubmatch(res.Body)
+	if m == nil {
+		t.Fatal("token not shown")
+	}
+	plain := m[1]
+
+	api := app.newClient()
+	assertStatus(t, api.get("/admin/banned", "Authorization", "Bearer "+plain), http.StatusOK)
+	assertRedirect(t, api.postForm("/admin/banned", url.Values{"uid[]": {fmt.Sprint(bob)}}, "Authorization", "Bearer "+plain), "/admin/banned")
+	if row := app.fake.findOne("users", "id", int64(bob)); fakeInt(row["del_flg"]) != 1 {
+		t.Error("bob is not banned")
+	}
+
+	// 二段階認証をやめた管理者のトークンでは管理者ページは使えない
+	row := app.fake.findOne("users", "id", int64(adminID))
+	row["totp_enabled"] = false
+	invalidateUser(adminID)
+	res = api.get("/admin/banned", "Authorization", "Bearer "+plain)
+	assertStatus(t, res, http.StatusForbidden)
+	if !strings.Contains(res.Body, "two_factor_required") {
+		t.Errorf("body = %q", res.Body)
+	}
+	// 二段階認証を設定していない管理者は admin 権限のトークンを作れない
+	c2 := app.newClient()
+	c2.login("admin")
+	assertRedirect(t, c2.postForm("/tokens", url.Values{"name": {"again"}, "scopes[]": {"admin"}, "csrf_token": {c2.csrfToken()}}), "/tokens")
+	if n := app.count("access_tokens"); n != 1 {
+		t.Errorf("access_tokens = %d", n)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAccountDeletionGrace = 14 * 24 * time.Hour
+	accountDeletionInterval     = time.Minute
+	// 匿名化したユーザーの account_name。登録で使えない文字を入れて、誰とも重ならないようにする
+	deletedAccountNameFormat = "deleted-%d"
+)
+
+var templateAccount = template.Must(template.ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("account.html")),
+)
+
+func accountDeletionGrace() time.Duration {
+	return getEnvDuration("ISUCONP_ACCOUNT_DELETION_GRACE", defaultAccountDeletionGrace)
+}
+
+func getAccount(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	exports, err := getUserDataExports(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateAccount.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+		Exports   []DataExport
+		Now       time.Time
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), exports, time.Now()})
+}
+
+// postAccountDelete は退会を予約する。猶予期間のあいだはログインして取り消せる
+func postAccountDelete(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	// パスワードのないユーザーはアカウント名を打ってもらって確かめる
+	confirmed := false
+	if me.HasPassword {
+		confirmed = tryLogin(me.AccountName, r.FormValue("password")) != nil
+	} else {
+		confirmed = r.FormValue("account_name") == me.AccountName
+	}
+	if !confirmed {
+		session.Values["notice"] = "確認のための入力が間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+
+	scheduledAt := time.Now().Add(accountDeletionGrace())
+	_, err := db.Exec("UPDATE `users` SET `deletion_scheduled_at` = ? WHERE `id` = ? AND `deleted_at` IS NULL", scheduledAt, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUser(me.ID)
+	pinPrimary(w, r)
+
+	err = loadUserCredentials(&me)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if me.Email != "" {
+		err = mailer.Send(r.Context(), Mail{
+			To:      me.Email,
+			Subject: "Iscogram 退会の手続きを受け付けました",
+			Body: fmt.Sprintf(
+				"%sさん\n\n退会の手続きを受け付けました。%s にアカウントと投稿・コメントを削除します。\nそれまでにログインすればアカウント設定の画面から取り消せます。\n",
+				me.AccountName, scheduledAt.Format("2006-01-02 15:04"),
+			),
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	session.Values["notice"] = "退会を受け付けました。" + scheduledAt.Format("2006-01-02 15:04") + " までは取り消せます"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+func postAccountDeleteCancel(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `deletion_scheduled_at` = NULL WHERE `id` = ? AND `deleted_at` IS NULL", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUser(me.ID)
+	pinPrimary(w, r)
+
+	session := getSession(r)
+	session.Values["notice"] = "退会を取り消しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+// sweepAccountDeletions は猶予期間の過ぎた退会を定期的に実行する
+func sweepAccountDeletions(ctx context.Context) {
+	ticker := time.NewTicker(accountDeletionInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := deleteDueAccounts(ctx, time.Now()); err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+func deleteDueAccounts(ctx context.Context, now time.Time) error {
+	ids := []int{}
+	err := db.SelectContext(ctx, &ids, "SELECT `id` FROM `users` WHERE `deletion_scheduled_at` <= ? AND `deleted_at` IS NULL", now)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := deleteAccount(ctx, id, now); err != nil {
+			return fmt.Errorf("delete account %d: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func joinIDs(ids []int) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = fmt.Sprint(id)
+	}
+	return strings.Join(s, ",")
+}
+
+// deleteAccount はユーザーの投稿 (他人のコメントごと) とコメントを消し、ユーザーの行は匿名化して残す。
+// 行を残すのは ID を使い回さないためで、del_flg を立てて今までどおりどこにも出ないようにする。
+// 初期データの範囲の行 (seedMax*ID 以下) は /initialize で元に戻せるよう、account_name も含めて消さずに残す
+func deleteAccount(ctx context.Context, userID int, now time.Time) error {
+	u, err := getUser(db, userID)
+	if err != nil {
+		return err
+	}
+	posts := []imageMeta{}
+	err = db.SelectContext(ctx, &posts, "SELECT `id`, `mime` FROM `posts` WHERE `user_id` = ? AND `id` > ?", userID, seedMaxPostID)
+	if err != nil {
+		return err
+	}
+	commented := []int{}
+	err = db.SelectContext(ctx, &commented, "SELECT DISTINCT `post_id` FROM `comments` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+	exports := []DataExport{}
+	err = db.SelectContext(ctx, &exports, "SELECT * FROM `data_exports` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	postIDs := make([]int, len(posts))
+	own := make(map[int]bool, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.ID
+		own[p.ID] = true
+	}
+	images, err := getPostImages(db, postIDs)
+	if err != nil {
+		return err
+	}
+	videos, err := getPostVideos(db, postIDs)
+	if err != nil {
+		return err
+	}
+	accountName := fmt.Sprintf(deletedAccountNameFormat, userID)
+	if userID <= seedMaxUserID {
+		accountName = u.AccountName
+	}
+	// 自分の投稿は消えるので、件数を数え直すのは他人の投稿だけ
+	others := []int{}
+	for _, id := range commented {
+		if !own[id] {
+			others = append(others, id)
+		}
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 猶予期間のあいだに取り消されていたら何もしない
+	res, err := tx.ExecContext(ctx,
+		"UPDATE `users` SET `account_name` = ?, `display_name` = '', `bio` = '', `avatar_mime` = '', `avatar_hash` = '', `is_private` = 0, `passhash` = '', `email` = '', `totp_secret` = '', `totp_enabled` = 0, `totp_last_step` = 0, `del_flg` = 1, `deletion_scheduled_at` = NULL, `deleted_at` = ? WHERE `id` = ? AND `deletion_scheduled_at` <= ? AND `deleted_at` IS NULL",
+		accountName, now, userID, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	queries := []string{}
+	if len(postIDs) > 0 {
+		in := joinIDs(postIDs)
+		queries = append(queries,
+			fmt.Sprintf("DELETE FROM `comment_reactions` WHERE `comment_id` IN (SELECT `id` FROM `comments` WHERE `post_id` IN (%s))", in),
+			fmt.Sprintf("DELETE FROM `comments` WHERE `post_id` IN (%s)", in),
+			fmt.Sprintf("DELETE FROM `comment_count` WHERE `post_id` IN (%s)", in),
+			fmt.Sprintf("DELETE FROM `post_images` WHERE `post_id` IN (%s)", in),
+			fmt.Sprintf("DELETE FROM `post_videos` WHERE `post_id` IN (%s)", in),
+			fmt.Sprintf("DELETE FROM `bookmarks` WHERE `post_id` IN (%s)", in),
+			fmt.Sprintf("DELETE FROM `posts` WHERE `id` IN (%s)", in),
+		)
+	}
+	// 消えるコメントへの他人の返信は残し、トップレベルに上げる
+	queries = append(queries,
+		fmt.Sprintf("UPDATE `comments` AS r JOIN `comments` AS p ON p.`id` = r.`parent_id` SET r.`parent_id` = 0 WHERE p.`user_id` = %d AND p.`id` > %d", userID, seedMaxCommentID),
+		fmt.Sprintf("DELETE FROM `comment_reactions` WHERE `user_id` = %d OR `comment_id` IN (SELECT `id` FROM `comments` WHERE `user_id` = %d AND `id` > %d)", userID, userID, seedMaxCommentID),
+		fmt.Sprintf("DELETE FROM `comments` WHERE `user_id` = %d AND `id` > %d", userID, seedMaxCommentID),
+	)
+	if len(others) > 0 {
+		queries = append(queries, fmt.Sprintf(
+			"UPDATE `comment_count` AS cc SET cc.`count` = (SELECT COUNT(*) FROM `comments` AS c WHERE c.`post_id` = cc.`post_id`) WHERE cc.`post_id` IN (%s)",
+			joinIDs(others),
+		))
+	}
+	queries = append(queries,
+		fmt.Sprintf("DELETE FROM `follows` WHERE `follower_id` = %d OR `followee_id` = %d", userID, userID),
+		fmt.Sprintf("DELETE FROM `blocks` WHERE `blocker_id` = %d OR `blocked_id` = %d", userID, userID),
+		fmt.Sprintf("DELETE FROM `mutes` WHERE `muter_id` = %d OR `muted_id` = %d", userID, userID),
+	)
+	for _, table := range []string{"user_identities", "access_tokens", "recovery_codes", "password_resets", "email_verifications", "data_exports", "bookmarks", "bookmark_collections"} {
+		queries = append(queries, fmt.Sprintf("DELETE FROM `%s` WHERE `user_id` = %d", table, userID))
+	}
+	for _, q := range queries {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(userID, ""); err != nil {
+		log.Print(err)
+	}
+	files := []string{}
+	for _, p := range posts {
+		if len(images[p.ID]) == 0 {
+			files = append(files, imagePath(p.ID, p.Mime))
+		}
+		for _, img := range images[p.ID] {
+			files = append(files, postImagePath(p.ID, img.Position, img.Mime))
+		}
+		if v := videos[p.ID]; v != nil {
+			files = append(files, posterPath(p.ID, v.PosterMime))
+		}
+	}
+	if u.AvatarMime != "" {
+		files = append(files, avatarPath(userID, u.AvatarMime))
+	}
+	for _, ex := range exports {
+		if ex.FileName != "" {
+			files = append(files, exportPath(ex.FileName))
+		}
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+
+	invalidateUser(userID)
+	invalidateTimeline()
+	for _, id := range append(postIDs, others...) {
+		invalidatePostComments(id)
+	}
+	return nil
+}
+
+// DeletionPending は退会の予約が入っているかを返す
+func (u User) DeletionPending() bool {
+	return u.DeletionScheduledAt.Valid && !u.DeletedAt.Valid
+}
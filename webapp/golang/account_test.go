@@ -0,0 +1,236 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readZipFile(t *testing.T, zr *zip.Reader, name string) []byte {
+	t.Helper()
+	f, err := zr.Open(name)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDataExport(t *testing.T) {
+	app := newTestApp(t)
+	mails := useRecordingMailer(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.fake.findOne("users", "id", int64(mary))["email"] = "mary@example.com"
+	pid := app.addPost(mary, "my post", []byte("png data"))
+	other := app.addPost(bob, "bob post", []byte("bob png"))
+	app.addComment(other, mary, "nice")
+	app.addComment(pid, bob, "by bob")
+
+	assertRedirect(t, app.newClient().get("/account"), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	assertStatus(t, c.postForm("/account/exports", url.Values{"csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	assertRedirect(t, c.postForm("/account/exports", url.Values{"csrf_token": {token}}), "/account")
+	assertRedirect(t, c.postForm("/account/exports", url.Values{"csrf_token": {token}}), "/account")
+	if res := c.get("/account"); !strings.Contains(res.Body, "作成中です") {
+		t.Error("duplicate export is not rejected")
+	}
+	if n := app.count("data_exports"); n != 1 {
+		t.Fatalf("data_exports = %d, want 1", n)
+	}
+
+	if err := processDataExports(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	row := app.fake.tables["data_exports"][0]
+	if fakeString(row["status"]) != exportStatusDone {
+		t.Fatalf("export = %v", row)
+	}
+	if len(mails.mails) != 1 || mails.mails[0].To != "mary@example.com" {
+		t.Errorf("mails = %v", mails.mails)
+	}
+
+	path := fmt.Sprintf("/account/exports/%d", fakeInt(row["id"]))
+	if !strings.Contains(c.get("/account").Body, path) {
+		t.Error("download link is not shown")
+	}
+	bobClient := app.newClient()
+	bobClient.login("bob")
+	assertStatus(t, bobClient.get(path), http.StatusNotFound)
+
+	res := c.get(path)
+	assertStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Header.Get("Content-Disposition"), "attachment") {
+		t.Errorf("Content-Disposition = %q", res.Header.Get("Content-Disposition"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader([]byte(res.Body)), int64(len(res.Body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(readZipFile(t, zr, fmt.Sprintf("images/%d.png", pid))); got != "png data" {
+		t.Errorf("image = %q", got)
+	}
+	manifest := exportManifest{}
+	if err := json.Unmarshal(readZipFile(t, zr, "manifest.json"), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.UserID != mary || manifest.Counts["posts"] != 1 || manifest.Counts["comments"] != 1 || len(manifest.Files) != 4 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	posts := []exportPost{}
+	json.Unmarshal(readZipFile(t, zr, "posts.json"), &posts)
+	if len(posts) != 1 || posts[0].Body != "my post" {
+		t.Errorf("posts = %+v", posts)
+	}
+	comments := []exportComment{}
+	json.Unmarshal(readZipFile(t, zr, "comments.json"), &comments)
+	if len(comments) != 1 || comments[0].Comment != "nice" || comments[0].PostID != other {
+		t.Errorf("comments = %+v", comments)
+	}
+	profile := exportProfile{}
+	json.Unmarshal(readZipFile(t, zr, "profile.json"), &profile)
+	if profile.AccountName != "mary" || profile.Email != "mary@example.com" {
+		t.Errorf("profile = %+v", profile)
+	}
+
+	file := exportPath(fakeString(row["file_name"]))
+	if err := removeExpiredExports(context.Background(), time.Now().Add(defaultExportTTL+time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expired export remains: %v", err)
+	}
+	if n := app.count("data_exports"); n != 0 {
+		t.Errorf("data_exports = %d, want 0", n)
+	}
+	assertStatus(t, c.get(path), http.StatusNotFound)
+}
+
+func TestAccountDeletion(t *testing.T) {
+	app := newTestApp(t)
+	// ベンチマーク中に作られたユーザーとして扱わせる
+	app.fake.nextIDs["users"], app.fake.nextIDs["posts"], app.fake.nextIDs["comments"] = seedMaxUserID, seedMaxPostID, seedMaxCommentID
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	pid := app.addPost(mary, "my post", nil)
+	os.WriteFile(imagePath(pid, "image/png"), []byte("png"), 0644)
+	other := app.addPost(bob, "bob post", []byte("bob png"))
+	app.addComment(pid, bob, "on mary's post")
+	app.addComment(other, mary, "by mary")
+	app.addComment(other, bob, "by bob")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+	c.createToken("cli", "read")
+
+	assertRedirect(t, c.postForm("/account/delete", url.Values{"password": {"wrong"}, "csrf_token": {token}}), "/account")
+	if app.fake.findOne("users", "id", int64(mary))["deletion_scheduled_at"] != nil {
+		t.Fatal("deletion is scheduled with a wrong password")
+	}
+
+	assertRedirect(t, c.postForm("/account/delete", url.Values{"password": {"marymary"}, "csrf_token": {token}}), "/account")
+	if !strings.Contains(c.get("/account").Body, "退会を取り消す") {
+		t.Error("scheduled deletion is not shown")
+	}
+	assertRedirect(t, c.postForm("/account/delete/cancel", url.Values{"csrf_token": {token}}), "/account")
+	if app.fake.findOne("users", "id", int64(mary))["deletion_scheduled_at"] != nil {
+		t.Fatal("deletion is not cancelled")
+	}
+	assertRedirect(t, c.postForm("/account/delete", url.Values{"password": {"marymary"}, "csrf_token": {token}}), "/account")
+
+	// 猶予期間のあいだは何も消さない
+	if err := deleteDueAccounts(context.Background(), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if n := app.count("posts"); n != 2 {
+		t.Fatalf("posts = %d, want 2", n)
+	}
+
+	if err := deleteDueAccounts(context.Background(), time.Now().Add(defaultAccountDeletionGrace+time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	u := app.fake.findOne("users", "id", int64(mary))
+	if fakeString(u["account_name"]) != fmt.Sprintf("deleted-%d", mary) || fakeString(u["passhash"]) != "" || fakeInt(u["del_flg"]) != 1 || u["deleted_at"] == nil {
+		t.Errorf("user is not anonymized: %v", u)
+	}
+	if app.fake.findOne("posts", "id", int64(pid)) != nil || app.fake.findOne("comment_count", "post_id", int64(pid)) != nil {
+		t.Error("post is not deleted")
+	}
+	if n := len(app.fake.find("comments", func(r fakeRow) bool {
+		return fakeEqual(r["post_id"], int64(pid)) || fakeEqual(r["user_id"], int64(mary))
+	})); n != 0 {
+		t.Errorf("comments remain: %d", n)
+	}
+	if row := app.fake.findOne("comment_count", "post_id", int64(other)); fakeInt(row["count"]) != 1 {
+		t.Errorf("comment_count = %v, want 1", row["count"])
+	}
+	if n := app.count("access_tokens"); n != 0 {
+		t.Errorf("access_tokens = %d, want 0", n)
+	}
+	if _, err := os.Stat(imagePath(pid, "image/png")); !os.IsNotExist(err) {
+		t.Errorf("image remains: %v", err)
+	}
+
+	assertRedirect(t, c.get("/account"), "/login")
+	res := app.newClient().postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}})
+	assertRedirect(t, res, "/login")
+	if strings.Contains(app.newClient().get(fmt.Sprintf("/posts/%d", other)).Body, "by mary") {
+		t.Error("deleted user's comment is shown")
+	}
+}
+
+func TestSeedAccountDeletionIsRestoredOnInitialize(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	pid := app.addPost(mary, "seed post", nil)
+	app.addComment(pid, bob, "seed comment")
+	app.fake.insert("posts", fakeRow{"id": int64(seedMaxPostID + 1), "user_id": int64(mary), "mime": "image/png", "body": "new"})
+	app.fake.insert("comments", fakeRow{"id": int64(seedMaxCommentID + 1), "post_id": int64(pid), "user_id": int64(mary), "comment": "new"})
+
+	c := app.newClient()
+	c.login("mary")
+	assertRedirect(t, c.postForm("/account/delete", url.Values{"password": {"marymary"}, "csrf_token": {c.csrfToken()}}), "/account")
+	if err := deleteDueAccounts(context.Background(), time.Now().Add(defaultAccountDeletionGrace+time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	u := app.fake.findOne("users", "id", int64(mary))
+	if fakeString(u["account_name"]) != "mary" || fakeString(u["passhash"]) != "" || fakeInt(u["del_flg"]) != 1 || u["deleted_at"] == nil {
+		t.Errorf("seed user is not kept hidden: %v", u)
+	}
+	// 初期データの投稿とコメントは残り、ベンチマーク中に作られたものだけ消える
+	if app.fake.findOne("posts", "id", int64(pid)) == nil || app.fake.findOne("comments", "post_id", int64(pid)) == nil {
+		t.Error("seed rows are deleted")
+	}
+	if app.fake.findOne("posts", "id", int64(seedMaxPostID+1)) != nil || app.fake.findOne("comments", "id", int64(seedMaxCommentID+1)) != nil {
+		t.Error("new rows remain")
+	}
+	if strings.Contains(app.newClient().get("/").Body, "seed post") {
+		t.Error("deleted user's post is shown")
+	}
+
+	t.Setenv("ISUCONP_INITIALIZE_TOKEN", "secret")
+	assertStatus(t, app.newClient().get("/initialize", "X-Initialize-Token", "secret"), http.StatusOK)
+	if u["deleted_at"] != nil || fakeInt(u["del_flg"]) != 0 {
+		t.Errorf("seed user is not restored: %v", u)
+	}
+	app.newClient().login("mary")
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	crand "crypto/rand"
+	"database/sql"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,10 +15,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/bradfitz/gomemcache/memcache"
-	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
@@ -30,8 +29,9 @@ import (
 )
 
 var (
-	db    *sqlx.DB
-	store *gsm.MemcacheStore
+	db      *sqlx.DB
+	cluster *dbCluster
+	store   sessions.Store
 )
 
 var (
@@ -46,7 +46,11 @@ var (
 	)
 
 	fmap = template.FuncMap{
-		"imageURL": imageURL,
+		"imageURL":       imageURL,
+		"postImageURL":   postImageURL,
+		"posterURL":      posterURL,
+		"publishAtValue": publishAtValue,
+		"avatarURL":      avatarURL,
 	}
 	templateIndex = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 		getTemplPath("layout.html"),
@@ -86,68 +90,95 @@ const (
 )
 
 type User struct {
-	ID          int       `db:"id"`
-	AccountName string    `db:"account_name"`
-	Passhash    string    `db:"passhash"`
-	Authority   int       `db:"authority"`
-	DelFlg      int       `db:"del_flg"`
-	CreatedAt   time.Time `db:"created_at"`
+	ID                  int          `db:"id"`
+	AccountName         string       `db:"account_name"`
+	DisplayName         string       `db:"display_name"`
+	Bio                 string       `db:"bio"`
+	AvatarMime          string       `db:"avatar_mime"`
+	AvatarHash          string       `db:"avatar_hash"`
+	IsPrivate           bool         `db:"is_private"`
+	Passhash            string       `db:"passhash"`
+	Email               string       `db:"email"`
+	TOTPSecret          string       `db:"totp_secret"`
+	TOTPEnabled         bool         `db:"totp_enabled"`
+	TOTPLastStep        int64        `db:"totp_last_step"`
+	Authority           int          `db:"authority"`
+	DelFlg              int          `db:"del_flg"`
+	DeletionScheduledAt sql.NullTime `db:"deletion_scheduled_at"`
+	DeletedAt           sql.NullTime `db:"deleted_at"`
+	CreatedAt           time.Time    `db:"created_at"`
+	// HasPassword はキャッシュから読んだユーザーにも残す、パスワードが設定されているか
+	HasPassword bool
+}
+
+// withoutCredentials はキャッシュに入れるユーザー。キャッシュは他のプロセスからも読めるので、
+// パスワードのハッシュやメールアドレス、TOTP の秘密鍵は入れない。使うときは loadUserCredentials で読む
+func (u User) withoutCredentials() User {
+	u.HasPassword = u.HasPassword || u.Passhash != ""
+	u.Passhash = ""
+	u.Email = ""
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	return u
+}
+
+// loadUserCredentials は withoutCredentials で落とした列をプライマリから読み込む
+func loadUserCredentials(u *User) error {
+	return db.Get(u, "SELECT `passhash`, `email`, `totp_secret`, `totp_last_step` FROM `users` WHERE `id` = ?", u.ID)
 }
 
 type Post struct {
-	ID           int       `db:"id"`
-	UserID       int       `db:"user_id"`
-	Imgdata      []byte    `db:"imgdata"`
-	Body         string    `db:"body"`
-	Mime         string    `db:"mime"`
-	CreatedAt    time.Time `db:"created_at"`
+	ID           int          `db:"id"`
+	UserID       int          `db:"user_id"`
+	Imgdata      []byte       `db:"imgdata"`
+	Body         string       `db:"body"`
+	Mime         string       `db:"mime"`
+	ImageHash    string       `db:"image_hash"`
+	Visibility   string       `db:"visibility"`
+	Status       string       `db:"status"`
+	PublishAt    sql.NullTime `db:"publish_at"`
+	CreatedAt    time.Time    `db:"created_at"`
 	CommentCount int
+	Images       []PostImage
+	Video        *PostVideo
 	Comments     []Comment
 	User         User
 	CSRFToken    string
+	Bookmarked   bool
 }
 
 type Comment struct {
-	ID        int       `db:"id"`
-	PostID    int       `db:"post_id"`
-	UserID    int       `db:"user_id"`
-	Comment   string    `db:"comment"`
-	CreatedAt time.Time `db:"created_at"`
+	ID         int       `db:"id"`
+	PostID     int       `db:"post_id"`
+	UserID     int       `db:"user_id"`
+	ParentID   int       `db:"parent_id"`
+	Comment    string    `db:"comment"`
+	CreatedAt  time.Time `db:"created_at"`
+	ReplyCount int
+	// 以下は /posts/:id で返信の木にしたときだけ入る
+	Depth     int
+	ReplyTo   string
+	Replies   []Comment
+	CSRFToken string
+	// Reactions はキャッシュに入れず makePosts で毎回引く
+	Reactions []Reaction
 	User      User
 }
 
 func init() {
-	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
-	if memdAddr == "" {
-		memdAddr = "localhost:11211"
-	}
-	memcacheClient := memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	appCache = newCacheFromEnv()
+	registerCacheFlusher(appCache.Flush)
+	mailer = newMailSenderFromEnv()
+	oidcProviders = loadOIDCProvidersFromEnv()
+	rateLimitStore = newRateLimitStoreFromEnv()
+	if rateLimitStore != nil {
+		registerCacheFlusher(rateLimitStore.Flush)
+	}
+	loginLockoutStore = newLoginLockoutStoreFromEnv()
+	registerCacheFlusher(loginLockoutStore.Flush)
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-func dbInitialize() {
-	sqls := []string{
-		"DELETE FROM users WHERE id > 1000",
-		"DELETE FROM posts WHERE id > 10000",
-		"DELETE FROM comments WHERE id > 100000",
-		"UPDATE users SET del_flg = 0",
-		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
-	}
-
-	for _, sql := range sqls {
-		db.Exec(sql)
-	}
-
-	cmd := exec.Command("/home/isucon/private_isu/sql/init.sh")
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stderr
-	err := cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-	}
-}
-
 func tryLogin(accountName, password string) *User {
 	u := User{}
 	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
@@ -155,16 +186,27 @@ func tryLogin(accountName, password string) *User {
 		return nil
 	}
 
-	if calculatePasshash(u.AccountName, password) == u.Passhash {
-		return &u
-	} else {
+	// OIDC で登録したユーザーは passhash が空なので、パスワードではログインさせない
+	if u.Passhash == "" {
+		return nil
+	}
+	passhash, err := calculatePasshash(u.AccountName, password)
+	if err != nil {
+		log.Print(err)
 		return nil
 	}
+	if passhash != u.Passhash {
+		return nil
+	}
+	return &u
 }
 
 func validateUser(accountName, password string) bool {
-	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName) &&
-		regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
+	return validateAccountName(accountName) && validatePassword(password)
+}
+
+func validateAccountName(accountName string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{3,}\z`).MatchString(accountName)
 }
 
 // 今回のGo実装では言語側のエスケープの仕組みが使えないのでOSコマンドインジェクション対策できない
@@ -174,41 +216,68 @@ func escapeshellarg(arg string) string {
 	return "'" + strings.Replace(arg, "'", "'\\''", -1) + "'"
 }
 
-func digest(src string) string {
+// digest は失敗したときに空文字列を返さずエラーにする。空のハッシュが一致して通ってしまわないように
+func digest(src string) (string, error) {
 	// opensslのバージョンによっては (stdin)= というのがつくので取る
 	out, err := exec.Command("/bin/bash", "-c", `printf "%s" `+escapeshellarg(src)+` | openssl dgst -sha512 | sed 's/^.*= //'`).Output()
 	if err != nil {
-		log.Print(err)
-		return ""
+		return "", err
 	}
-
-	return strings.TrimSuffix(string(out), "\n")
+	sum := strings.TrimSuffix(string(out), "\n")
+	if sum == "" {
+		return "", fmt.Errorf("digest: empty output from openssl")
+	}
+	return sum, nil
 }
 
-func calculateSalt(accountName string) string {
+func calculateSalt(accountName string) (string, error) {
 	return digest(accountName)
 }
 
-func calculatePasshash(accountName, password string) string {
-	return digest(password + ":" + calculateSalt(accountName))
+func calculatePasshash(accountName, password string) (string, error) {
+	salt, err := calculateSalt(accountName)
+	if err != nil {
+		return "", err
+	}
+	return digest(password + ":" + salt)
 }
 
 func getSession(r *http.Request) *sessions.Session {
-	session, _ := store.Get(r, "isuconp-go.session")
+	session, _ := store.Get(r, sessionName)
 
 	return session
 }
 
+// sessionUserID はセッションの user_id を返す。登録直後は int64 で入っている
+func sessionUserID(session *sessions.Session) (int, bool) {
+	switch v := session.Values["user_id"].(type) {
+	case int:
+		return v, true
+	case int64:
+		return int(v), true
+	default:
+		return 0, false
+	}
+}
+
 func getSessionUser(r *http.Request) User {
+	// トークンで認証したリクエストはパスワード変更などクッキー専用の画面を使えない
+	if accessTokenFrom(r) != nil {
+		return User{}
+	}
+
 	session := getSession(r)
-	uid, ok := session.Values["user_id"]
-	if !ok || uid == nil {
+	uid, ok := sessionUserID(session)
+	if !ok {
 		return User{}
 	}
 
-	u := User{}
+	sid, _ := session.Values[sessionKeyUserSessionID].(string)
+	if !validUserSession(r, uid, sid) {
+		return User{}
+	}
 
-	err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid)
+	u, err := getUser(readDB(r), uid)
 	if err != nil {
 		return User{}
 	}
@@ -240,116 +309,300 @@ type CommentCount struct {
 	Count  int `db:"count"`
 }
 
-func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
-	var posts []Post
-	var err error
+// postComments はキャッシュする投稿ごとのコメント一覧
+type postComments struct {
+	Count    int
+	Comments []Comment
+}
 
-	postIDs := make([]string, len(results))
-	for i := range results {
-		postIDs[i] = fmt.Sprint(results[i].ID)
+func getUser(q sqlx.Queryer, id int) (User, error) {
+	u := User{}
+	err := cacheFetch(userCacheKey(id), userCacheTTL, &u, func() (interface{}, error) {
+		u := User{}
+		err := sqlx.Get(cacheFillDB(q), &u, "SELECT * FROM `users` WHERE `id` = ?", id)
+		return u.withoutCredentials(), err
+	})
+	return u, err
+}
+
+func getUsers(q sqlx.Queryer, ids []int) (map[int]*User, error) {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = userCacheKey(id)
 	}
+	epoch := atomic.LoadUint64(&cacheEpoch)
+	cached := appCache.GetMulti(keys)
 
-	var commentCounts []CommentCount
-	err = db.Select(&commentCounts, fmt.Sprintf("SELECT * FROM `comment_count` WHERE `post_id` IN (%s)", strings.Join(postIDs, ",")))
-	if err != nil {
-		return nil, err
+	userMap := make(map[int]*User, len(ids))
+	missing := []string{}
+	for i, id := range ids {
+		if _, ok := userMap[id]; ok {
+			continue
+		}
+		if b, ok := cached[keys[i]]; ok {
+			u := User{}
+			if decodeCacheValue(b, &u) == nil {
+				userMap[id] = &u
+				continue
+			}
+		}
+		userMap[id] = nil
+		missing = append(missing, fmt.Sprint(id))
 	}
-	countMap := make(map[int]int, len(commentCounts))
-	for _, c := range commentCounts {
-		countMap[c.PostID] = c.Count
+
+	if len(missing) > 0 {
+		var users []*User
+		err := sqlx.Select(cacheFillDB(q), &users, fmt.Sprintf("SELECT * FROM `users` WHERE `id` IN (%s)", strings.Join(missing, ",")))
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			*u = u.withoutCredentials()
+			userMap[u.ID] = u
+			if b, err := encodeCacheValue(u); err == nil {
+				cacheStore(userCacheKey(u.ID), b, userCacheTTL, epoch)
+			}
+		}
 	}
 
-	postUserIDs := make([]string, len(results))
-	for i := range results {
-		postUserIDs[i] = fmt.Sprint(results[i].UserID)
+	return userMap, nil
+}
+
+// getPostComments は投稿ごとのコメントを返す。
+// hidden のユーザーのコメントは、タイムラインの 3 件を選ぶ前に外れるよう SQL の段階で除く。
+// 結果が viewer ごとに変わるので、そのときはキャッシュを使わない
+func getPostComments(q sqlx.Queryer, postIDs []int, allComments bool, hidden []int) (map[int]postComments, error) {
+	if len(hidden) > 0 {
+		ids := make([]string, len(postIDs))
+		for i, id := range postIDs {
+			ids[i] = fmt.Sprint(id)
+		}
+		return queryPostComments(q, ids, allComments, hidden)
 	}
 
-	var postUsers []*User
-	err = db.Select(&postUsers, fmt.Sprintf("SELECT * FROM `users` WHERE `id` IN (%s)", strings.Join(postUserIDs, ",")))
+	keys := make([]string, len(postIDs))
+	for i, id := range postIDs {
+		keys[i] = commentsCacheKey(id, allComments)
+	}
+	epoch := atomic.LoadUint64(&cacheEpoch)
+	cached := appCache.GetMulti(keys)
+
+	commentsMap := make(map[int]postComments, len(postIDs))
+	missing := []string{}
+	for i, id := range postIDs {
+		if b, ok := cached[keys[i]]; ok {
+			pc := postComments{}
+			if decodeCacheValue(b, &pc) == nil {
+				commentsMap[id] = pc
+				continue
+			}
+		}
+		missing = append(missing, fmt.Sprint(id))
+	}
+	if len(missing) == 0 {
+		return commentsMap, nil
+	}
+
+	flightKey := cacheFlightKey(fmt.Sprintf("comments:%s:%t", strings.Join(missing, ","), allComments), epoch)
+	v, err, _ := cacheFlights.Do(flightKey, func() (interface{}, error) {
+		loaded, err := queryPostComments(cacheFillDB(q), missing, allComments, nil)
+		if err != nil {
+			return nil, err
+		}
+		for id, pc := range loaded {
+			if b, err := encodeCacheValue(pc); err == nil {
+				cacheStore(commentsCacheKey(id, allComments), b, commentsCacheTTL, epoch)
+			}
+		}
+		return loaded, nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	userMap := make(map[int]*User, len(postUsers))
-	for _, u := range postUsers {
-		userMap[u.ID] = u
+
+	for id, pc := range v.(map[int]postComments) {
+		commentsMap[id] = pc
 	}
+	return commentsMap, nil
+}
 
-	var commentUsers []*CommentUser
+func queryPostComments(q sqlx.Queryer, postIDs []string, allComments bool, hidden []int) (map[int]postComments, error) {
+	var commentCounts []CommentCount
+	err := sqlx.Select(q, &commentCounts, fmt.Sprintf("SELECT * FROM `comment_count` WHERE `post_id` IN (%s)", strings.Join(postIDs, ",")))
+	if err != nil {
+		return nil, err
+	}
 
-	query := fmt.Sprintf("SELECT p.`id` AS `post_id`, c.`id` AS `comment.id`, c.`post_id` AS `comment.post_id`, c.`user_id` AS `comment.user_id`, c.`comment` AS `comment.comment`, c.`created_at` AS `comment.created_at`, u.`id` AS `user.id`, u.`account_name` AS `user.account_name`, u.`passhash` AS `user.passhash`, u.`authority` AS `user.authority`, u.`del_flg` AS `user.del_flg`, u.`created_at` AS `user.created_at` FROM `comments` AS c JOIN `users` AS u ON c.`user_id` = u.`id` JOIN `posts` AS p ON p.`id` = c.`post_id` AND p.`id` IN (%s) ORDER BY c.`created_at` DESC", strings.Join(postIDs, ","))
-	if !allComments {
-		query += " LIMIT 3"
+	var commentUsers []*CommentUser
+	columns := "c.`post_id` AS `post_id`, c.`id` AS `comment.id`, c.`post_id` AS `comment.post_id`, c.`user_id` AS `comment.user_id`, c.`parent_id` AS `comment.parent_id`, c.`comment` AS `comment.comment`, c.`created_at` AS `comment.created_at`, u.`id` AS `user.id`, u.`account_name` AS `user.account_name`, u.`authority` AS `user.authority`, u.`del_flg` AS `user.del_flg`, u.`created_at` AS `user.created_at`"
+	var query string
+	if allComments {
+		where := ""
+		if len(hidden) > 0 {
+			where = fmt.Sprintf(" AND c.`user_id` NOT IN (%s)", joinIDs(hidden))
+		}
+		query = fmt.Sprintf("SELECT %s FROM `comments` AS c JOIN `users` AS u ON c.`user_id` = u.`id` WHERE c.`post_id` IN (%s)%s ORDER BY c.`created_at` DESC", columns, strings.Join(postIDs, ","), where)
+	} else {
+		where := ""
+		if len(hidden) > 0 {
+			where = fmt.Sprintf(" AND `user_id` NOT IN (%s)", joinIDs(hidden))
+		}
+		// タイムラインでは投稿ごとにトップレベルの新しい3件だけ
+		query = fmt.Sprintf("SELECT %s FROM (SELECT *, ROW_NUMBER() OVER (PARTITION BY `post_id` ORDER BY `created_at` DESC) AS `rn` FROM `comments` WHERE `post_id` IN (%s) AND `parent_id` = 0%s) AS c JOIN `users` AS u ON c.`user_id` = u.`id` WHERE c.`rn` <= 3 ORDER BY c.`created_at` DESC", columns, strings.Join(postIDs, ","), where)
 	}
-	err = db.Select(&commentUsers, query)
+	err = sqlx.Select(q, &commentUsers, query)
 	if err != nil {
 		return nil, err
 	}
-	postMap := make(map[int][]*CommentUser, len(commentUsers))
+
+	// 全件を引いたときは手元で数え、タイムラインでは表示する分だけ引く
+	replyCounts := map[int]int{}
+	if allComments {
+		for _, cu := range commentUsers {
+			if cu.Comment.ParentID != 0 {
+				replyCounts[cu.Comment.ParentID]++
+			}
+		}
+	} else {
+		ids := make([]int, len(commentUsers))
+		for i, cu := range commentUsers {
+			ids[i] = cu.Comment.ID
+		}
+		replyCounts, err = getReplyCounts(q, ids)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	commentsMap := make(map[int]postComments, len(postIDs))
+	for _, id := range postIDs {
+		pid, _ := strconv.Atoi(id)
+		commentsMap[pid] = postComments{Comments: []Comment{}}
+	}
+	for _, c := range commentCounts {
+		pc := commentsMap[c.PostID]
+		pc.Count = c.Count
+		commentsMap[c.PostID] = pc
+	}
 	for _, cu := range commentUsers {
-		if _, ok := postMap[cu.PostID]; !ok {
-			postMap[cu.PostID] = make([]*CommentUser, 0)
+		pc := commentsMap[cu.PostID]
+		comment := cu.Comment
+		comment.User = cu.User
+		comment.ReplyCount = replyCounts[comment.ID]
+		pc.Comments = append(pc.Comments, comment)
+		commentsMap[cu.PostID] = pc
+	}
+
+	// reverse
+	for id, pc := range commentsMap {
+		comments := pc.Comments
+		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
+			comments[i], comments[j] = comments[j], comments[i]
 		}
-		postMap[cu.PostID] = append(postMap[cu.PostID], cu)
+		commentsMap[id] = pc
 	}
 
-	for _, p := range results {
-		/*
-			err := db.Get(&p.CommentCount, "SELECT `count` FROM `comment_count` WHERE `post_id` = ?", p.ID)
-			if err != nil {
-				return nil, err
-			}
-		*/
-		p.CommentCount = countMap[p.ID]
+	return commentsMap, nil
+}
 
-		/*
-			query := "SELECT c.`id` AS `comment.id`, c.`post_id` AS `comment.post_id`, c.`user_id` AS `comment.user_id`, c.`comment` AS `comment.comment`, c.`created_at` AS `comment.created_at`, u.`id` AS `user.id`, u.`account_name` AS `user.account_name`, u.`passhash` AS `user.passhash`, u.`authority` AS `user.authority`, u.`del_flg` AS `user.del_flg`, u.`created_at` AS `user.created_at` FROM `comments` AS c JOIN `users` AS u ON c.`user_id` = u.`id` WHERE c.`post_id` = ? ORDER BY c.`created_at` DESC"
-			if !allComments {
-				query += " LIMIT 3"
-			}
-			var commentUsers []CommentUser
-			err = db.Select(&commentUsers, query, p.ID)
-			if err != nil {
-				return nil, err
-			}
+// makePosts は投稿にコメントと投稿者を付ける。viewer に見えない投稿はここでも落とす
+func makePosts(q sqlx.Queryer, results []Post, viewer *postViewer, csrfToken string, allComments bool) ([]Post, error) {
+	var posts []Post
 
-			comments := make([]Comment, len(commentUsers))
-			for i := range comments {
-				comments[i] = commentUsers[i].Comment
-				comments[i].User = commentUsers[i].User
-			}*/
-
-		postCU := postMap[p.ID]
-		comments := make([]Comment, len(postCU))
-		for i := range comments {
-			comments[i] = postCU[i].Comment
-			comments[i].User = postCU[i].User
-		}
+	if len(results) == 0 {
+		return posts, nil
+	}
 
-		/*
-			for i := 0; i < len(comments); i++ {
-				err := db.Get(&comments[i].User, "SELECT * FROM `users` WHERE `id` = ?", comments[i].UserID)
-				if err != nil {
-					return nil, err
-				}
-			}*/
+	postIDs := make([]int, len(results))
+	userIDs := make([]int, 0, len(results))
+	for i := range results {
+		postIDs[i] = results[i].ID
+		userIDs = append(userIDs, results[i].UserID)
+	}
 
-		// reverse
-		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
-			comments[i], comments[j] = comments[j], comments[i]
+	hidden, err := viewer.blockedUsers(q)
+	if err != nil {
+		return nil, err
+	}
+	commentsMap, err := getPostComments(q, postIDs, allComments, hidden)
+	if err != nil {
+		return nil, err
+	}
+	imagesMap, err := getPostImages(q, postIDs)
+	if err != nil {
+		return nil, err
+	}
+	videoIDs := []int{}
+	for i := range results {
+		if isVideo(results[i].Mime) {
+			videoIDs = append(videoIDs, results[i].ID)
 		}
+	}
+	videosMap, err := getPostVideos(q, videoIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		p.Comments = comments
+	// 表示名やアイコンはキャッシュしたコメントではなく、投稿者とまとめて引いたユーザーから使う
+	commentIDs := []int{}
+	for _, pc := range commentsMap {
+		for _, c := range pc.Comments {
+			userIDs = append(userIDs, c.UserID)
+			commentIDs = append(commentIDs, c.ID)
+		}
+	}
+	userMap, err := getUsers(q, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	reactionsMap, err := getCommentReactions(q, commentIDs, viewer.User)
+	if err != nil {
+		return nil, err
+	}
+	bookmarked, err := getBookmarkedIDs(q, viewer.User, postIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		/*
-			err = db.Get(&p.User, "SELECT * FROM `users` WHERE `id` = ?", p.UserID)
-			if err != nil {
-				return nil, err
-			}*/
-		p.User = *userMap[p.UserID]
+	for _, p := range results {
+		pc := commentsMap[p.ID]
+		p.CommentCount = pc.Count
+		p.Images = imagesMap[p.ID]
+		p.Video = videosMap[p.ID]
+		if len(p.Images) == 0 && p.Video == nil {
+			p.Images = []PostImage{{PostID: p.ID, Mime: p.Mime, ImageHash: p.ImageHash}}
+		}
+		// commentsMap は singleflight で他のリクエストと共有しているのでコピーしてから書き換える
+		p.Comments = make([]Comment, len(pc.Comments))
+		copy(p.Comments, pc.Comments)
+		for i := range p.Comments {
+			if cu := userMap[p.Comments[i].UserID]; cu != nil {
+				p.Comments[i].User = *cu
+			}
+			p.Comments[i].CSRFToken = csrfToken
+			p.Comments[i].Reactions = reactionsMap[p.Comments[i].ID]
+		}
+		if allComments {
+			p.Comments = threadComments(p.Comments, commentMaxDepth())
+		}
+
+		u := userMap[p.UserID]
+		if u == nil {
+			continue
+		}
+		p.User = *u
 
 		p.CSRFToken = csrfToken
+		p.Bookmarked = bookmarked[p.ID]
 
-		if p.User.DelFlg == 0 {
+		if p.User.DelFlg != 0 {
+			continue
+		}
+		visible, err := viewer.canViewPost(q, p.User, p.Visibility, p.Status)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
 			posts = append(posts, p)
 		}
 		if len(posts) >= postsPerPage {
@@ -368,9 +621,17 @@ func imageURL(p Post) string {
 		ext = ".png"
 	} else if p.Mime == "image/gif" {
 		ext = ".gif"
+	} else if p.Mime == "video/mp4" {
+		ext = ".mp4"
+	} else if p.Mime == "video/webm" {
+		ext = ".webm"
 	}
 
-	return "/image/" + strconv.Itoa(p.ID) + ext
+	u := "/image/" + strconv.Itoa(p.ID) + ext
+	if p.ImageHash != "" {
+		u += "?v=" + imageVersion(p.ImageHash)
+	}
+	return u
 }
 
 func isLogin(u User) bool {
@@ -394,6 +655,18 @@ func secureRandomStr(b int) string {
 	return fmt.Sprintf("%x", k)
 }
 
+// secureRandomLetters は英小文字だけのランダムな文字列を作る
+func secureRandomLetters(n int) string {
+	k := make([]byte, n)
+	if _, err := crand.Read(k); err != nil {
+		panic(err)
+	}
+	for i := range k {
+		k[i] = 'a' + k[i]%26
+	}
+	return string(k)
+}
+
 func getTemplPath(filename string) string {
 	return path.Join("templates", filename)
 }
@@ -406,40 +679,14 @@ func getExt(mime string) string {
 		ext = "png"
 	} else if mime == "image/gif" {
 		ext = "gif"
+	} else if mime == "video/mp4" {
+		ext = "mp4"
+	} else if mime == "video/webm" {
+		ext = "webm"
 	}
 	return ext
 }
 
-func getInitialize(w http.ResponseWriter, r *http.Request) {
-	dbInitialize()
-	/*
-		var posts []Post
-
-		err := db.Select(&posts, "SELECT * FROM posts")
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		for _, p := range posts {
-
-			ext := getExt(p.Mime)
-			file, err := os.Create(fmt.Sprintf("../public/img/%d.%s", p.ID, ext))
-			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			_, err = file.Write(p.Imgdata)
-			if err != nil {
-				file.Close()
-				w.WriteHeader(http.StatusInternalServerError)
-				return
-			}
-			file.Close()
-		}
-	*/
-	w.WriteHeader(http.StatusOK)
-}
-
 func getLogin(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
 
@@ -449,9 +696,10 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 	}
 
 	templateLogin.Execute(w, struct {
-		Me    User
-		Flash string
-	}{me, getFlash(w, r, "notice")})
+		Me        User
+		Flash     string
+		Providers []*oidcProvider
+	}{me, getFlash(w, r, "notice"), oidcProviders})
 }
 
 func postLogin(w http.ResponseWriter, r *http.Request) {
@@ -460,15 +708,25 @@ func postLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u := tryLogin(r.FormValue("account_name"), r.FormValue("password"))
+	accountName, ip := r.FormValue("account_name"), clientIP(r)
+	if !allowRequest(w, "login:ip", ip) {
+		return
+	}
+	// ロック中は正しいパスワードでも通さない
+	if d := loginLockedFor(accountName, ip, time.Now()); d > 0 {
+		tooManyRequests(w, d)
+		return
+	}
 
-	if u != nil {
-		session := getSession(r)
-		session.Values["user_id"] = u.ID
-		session.Values["csrf_token"] = secureRandomStr(16)
-		session.Save(r, w)
+	u := tryLogin(accountName, r.FormValue("password"))
+	if u == nil {
+		recordLoginFailure(accountName, ip, time.Now())
+	} else {
+		clearLoginFailures(accountName)
+	}
 
-		http.Redirect(w, r, "/", http.StatusFound)
+	if u != nil {
+		beginLogin(w, r, getSession(r), *u)
 	} else {
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名かパスワードが間違っています"
@@ -496,7 +754,12 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !allowRequest(w, "register:ip", clientIP(r)) {
+		return
+	}
+
 	accountName, password := r.FormValue("account_name"), r.FormValue("password")
+	email := strings.TrimSpace(r.FormValue("email"))
 
 	validated := validateUser(accountName, password)
 	if !validated {
@@ -508,6 +771,15 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !validateEmail(email) {
+		session := getSession(r)
+		session.Values["notice"] = "メールアドレスの形式が正しくありません"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/register", http.StatusFound)
+		return
+	}
+
 	exists := 0
 	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
 	db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
@@ -521,8 +793,13 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	passhash, err := calculatePasshash(accountName, password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	query := "INSERT INTO `users` (`account_name`, `passhash`, `email`) VALUES (?,?,?)"
+	result, err := db.Exec(query, accountName, passhash, email)
 	if err != nil {
 		log.Print(err)
 		return
@@ -534,34 +811,46 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
-	session.Values["user_id"] = uid
-	session.Values["csrf_token"] = secureRandomStr(16)
+	err = loginUser(r, session, int(uid))
+	if err != nil {
+		log.Print(err)
+		return
+	}
 	session.Save(r, w)
+	pinPrimary(w, r)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func getLogout(w http.ResponseWriter, r *http.Request) {
 	session := getSession(r)
+	if uid, ok := sessionUserID(session); ok {
+		if sid, ok := session.Values[sessionKeyUserSessionID].(string); ok {
+			if err := revokeUserSession(uid, sid); err != nil {
+				log.Print(err)
+			}
+		}
+	}
 	delete(session.Values, "user_id")
-	session.Options = &sessions.Options{MaxAge: -1}
+	delete(session.Values, sessionKeyUserSessionID)
+	session.Options.MaxAge = -1
 	session.Save(r, w)
 
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
 func getIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-
-	results := []Post{}
+	me := getAuthUser(r, scopeRead)
 
-	err := db.Select(&results, fmt.Sprintf("SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at` FROM `posts` AS p JOIN `users` AS u ON u.id = p.user_id AND u.del_flg = 0 ORDER BY p.`created_at` DESC LIMIT %d", postsPerPage))
+	rdb := readDB(r)
+	viewer := newPostViewer(me)
+	results, err := getTimelinePosts(rdb, viewer, "")
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(rdb, results, viewer, getCSRFToken(r), false)
 	if err != nil {
 		log.Print(err)
 		return
@@ -577,10 +866,11 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 
 func getAccountName(w http.ResponseWriter, r *http.Request) {
 	accountName := pat.Param(r, "accountName")
+	rdb := readDB(r)
 	user := User{}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
-	if err != nil {
+	err := rdb.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil && err != sql.ErrNoRows {
 		log.Print(err)
 		return
 	}
@@ -590,32 +880,70 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	me := getAuthUser(r, scopeRead)
+	viewer := newPostViewer(me)
 	results := []Post{}
 
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
+	condition, ok, err := userPostsVisibilityCondition(rdb, viewer, user)
 	if err != nil {
 		log.Print(err)
 		return
 	}
+	if ok {
+		err = rdb.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `image_hash`, `visibility`, `status`, `created_at` FROM `posts` WHERE `user_id` = ? AND `status` = 'published'"+condition+" ORDER BY `created_at` DESC", user.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(rdb, results, viewer, getCSRFToken(r), false)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	follow := ""
+	blocked, blocking, muting := false, false, false
+	if isLogin(me) && me.ID != user.ID {
+		follow, err = followStatus(rdb, me.ID, user.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		blocked, err = viewer.blocking(rdb, user.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if blocked {
+			// どちら向きのブロックかはここでだけ要るので別に引く
+			n := 0
+			err = rdb.Get(&n, "SELECT COUNT(*) FROM `blocks` WHERE `blocker_id` = ? AND `blocked_id` = ?", me.ID, user.ID)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+			blocking = n > 0
+		}
+		muting = viewer.muted[user.ID]
+	}
+
 	commentCount := 0
-	err = db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
+	err = rdb.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
+	// 投稿数とコメントされた数も、一覧と同じく viewer に見える投稿だけで数える
 	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
-	if err != nil {
-		log.Print(err)
-		return
+	if ok {
+		err = rdb.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ? AND `status` = 'published'"+condition, user.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
 	}
 	postCount := len(postIDs)
 
@@ -633,15 +961,13 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 			args[i] = v
 		}
 
-		err = db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
+		err = rdb.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
 		if err != nil {
 			log.Print(err)
 			return
 		}
 	}
 
-	me := getSessionUser(r)
-
 	templateAccountName.Execute(w, struct {
 		Posts          []Post
 		User           User
@@ -649,7 +975,13 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		CommentCount   int
 		CommentedCount int
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+		CSRFToken      string
+		Follow         string
+		Hidden         bool
+		Blocked        bool
+		Blocking       bool
+		Muting         bool
+	}{posts, user, postCount, commentCount, commentedCount, me, getCSRFToken(r), follow, !ok, blocked, blocking, muting})
 }
 
 func getPosts(w http.ResponseWriter, r *http.Request) {
@@ -670,14 +1002,15 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := []Post{}
-	err = db.Select(&results, fmt.Sprintf("SELECT p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`created_at` FROM `posts` AS p JOIN `users` AS u ON u.`id` = p.`user_id` AND u.`del_flg` = 0 WHERE p.`created_at` <= ? ORDER BY p.`created_at` DESC LIMIT %d", postsPerPage), t.Format(ISO8601Format))
+	rdb := readDB(r)
+	viewer := newPostViewer(getAuthUser(r, scopeRead))
+	results, err := getTimelinePosts(rdb, viewer, t.Format(ISO8601Format))
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	posts, err := makePosts(rdb, results, viewer, getCSRFToken(r), false)
 	if err != nil {
 		log.Print(err)
 		return
@@ -698,14 +1031,16 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	rdb := readDB(r)
 	results := []Post{}
-	err = db.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	err = rdb.Select(&results, "SELECT * FROM `posts` WHERE `id` = ?", pid)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), true)
+	me := getAuthUser(r, scopeRead)
+	posts, err := makePosts(rdb, results, newPostViewer(me), getCSRFToken(r), true)
 	if err != nil {
 		log.Print(err)
 		return
@@ -718,7 +1053,6 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 
 	p := posts[0]
 
-	me := getSessionUser(r)
 	templatePostID.Execute(w, struct {
 		Post Post
 		Me   User
@@ -726,56 +1060,58 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 }
 
 func postIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
+	me, ok := requireAuthUser(w, r, scopePost)
+	if !ok {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	if !allowRequest(w, "post:user", strconv.Itoa(me.ID)) {
+		return
+	}
+
+	images, err := readUploadedMedia(r, "file", MaxPostImages, UploadLimit, true)
+	var video *videoUpload
+	if err == nil && isVideo(images[0].Mime) {
+		video, err = prepareVideoUpload(r, images[0])
+	}
 	if err != nil {
+		notice := "画像が必須です"
+		if ue, ok := err.(uploadError); ok {
+			notice = string(ue)
+		} else if err != http.ErrMissingFile {
+			log.Print(err)
+			return
+		}
 		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
+		session.Values["notice"] = notice
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	mime := ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			session.Save(r, w)
-
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = visibilityPublic
 	}
+	if !validVisibility(visibility) {
+		session := getSession(r)
+		session.Values["notice"] = "公開範囲の指定が正しくありません"
+		session.Save(r, w)
 
-	filedata, err := io.ReadAll(file)
-	if err != nil {
-		log.Print(err)
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
 
-	if len(filedata) > UploadLimit {
+	status, publishAt, notice := postPublication(r, time.Now())
+	if notice != "" {
 		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
+		session.Values["notice"] = notice
 		session.Save(r, w)
 
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -789,12 +1125,18 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `body`) VALUES (?,?,?)"
+	// 0 枚目を表紙として posts にも持たせ、画像 1 枚だけを見ていたところはそのまま動くようにする
+	cover := images[0]
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `body`, `image_hash`, `visibility`, `status`, `publish_at`) VALUES (?,?,?,?,?,?,?)"
 	result, err := tx.Exec(
 		query,
 		me.ID,
-		mime,
+		cover.Mime,
 		r.FormValue("body"),
+		imageHash(cover.Data),
+		visibility,
+		status,
+		publishAt,
 	)
 	if err != nil {
 		log.Print(err)
@@ -812,70 +1154,141 @@ func postIndex(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
-	tx.Commit()
 
-	imagefile, err := os.Create(fmt.Sprintf("../public/img/%d.%s", pid, getExt(mime)))
+	if video != nil {
+		// 動画は posts の 1 本だけで、post_images には入れない
+		_, err = tx.Exec(
+			"INSERT INTO `post_videos` (`post_id`, `duration_ms`, `width`, `height`, `poster_mime`, `poster_hash`) VALUES (?,?,?,?,?,?)",
+			pid,
+			video.Info.Duration.Milliseconds(),
+			video.Info.Width,
+			video.Info.Height,
+			video.PosterMime,
+			imageHash(video.Poster),
+		)
+	} else {
+		placeholders := make([]string, len(images))
+		args := make([]interface{}, 0, len(images)*4)
+		for i, img := range images {
+			placeholders[i] = "(?,?,?,?)"
+			args = append(args, pid, i, img.Mime, imageHash(img.Data))
+		}
+		_, err = tx.Exec("INSERT INTO `post_images` (`post_id`, `position`, `mime`, `image_hash`) VALUES "+strings.Join(placeholders, ","), args...)
+	}
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	defer imagefile.Close()
-	imagefile.Write(filedata)
-
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
-}
-
-func getImage(w http.ResponseWriter, r *http.Request) {
-	pidStr := pat.Param(r, "id")
-	pid, err := strconv.Atoi(pidStr)
-	if err != nil {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	tx.Commit()
+	if status == postStatusPublished {
+		invalidateTimeline()
 	}
 
-	post := Post{}
-	err = db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
-	if err != nil {
-		log.Print(err)
-		return
+	for i, img := range images {
+		err = writeImageFile(postImagePath(int(pid), i, img.Mime), img.Data)
+		if err != nil {
+			log.Print(err)
+			return
+		}
 	}
-
-	ext := pat.Param(r, "ext")
-
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
-		w.Header().Set("Content-Type", post.Mime)
-		w.Header().Set("Cache-Control", "max-age=3600")
-		_, err := w.Write(post.Imgdata)
+	if video != nil {
+		err = writeImageFile(posterPath(int(pid), video.PosterMime), video.Poster)
 		if err != nil {
 			log.Print(err)
 			return
 		}
+	}
+
+	pinPrimary(w, r)
+
+	if status != postStatusPublished {
+		session := getSession(r)
+		session.Values["notice"] = publicationNotice(status, publishAt)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/drafts", http.StatusFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
 }
 
 func postComment(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
+	me, ok := requireAuthUser(w, r, scopeComment)
+	if !ok {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
+	if !allowRequest(w, "comment:user", strconv.Itoa(me.ID)) {
+		return
+	}
+
 	postID, err := strconv.Atoi(r.FormValue("post_id"))
 	if err != nil {
 		log.Print("post_idは整数のみです")
 		return
 	}
 
+	// 見えない投稿にはコメントさせない
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+	viewer := newPostViewer(me)
+	visible := false
+	if err == nil {
+		owner, err := getUser(db, post.UserID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible, err = viewer.canViewPost(db, owner, post.Visibility, post.Status)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible = visible && owner.DelFlg == 0
+	}
+	if !visible {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 返信先は同じ投稿の、ブロックの相手ではないコメントに限る
+	parentID := 0
+	if v := r.FormValue("parent_id"); v != "" && v != "0" {
+		parentID, err = strconv.Atoi(v)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		parent := Comment{}
+		err = db.Get(&parent, "SELECT `id`, `post_id`, `user_id` FROM `comments` WHERE `id` = ?", parentID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Print(err)
+			return
+		}
+		blocking := false
+		if err == nil {
+			blocking, err = viewer.blocking(db, parent.UserID)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+		}
+		if parent.ID == 0 || parent.PostID != postID || blocking {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
 	tx, err := db.Beginx()
 	if err != nil {
 		log.Print(err)
@@ -883,8 +1296,8 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-	_, err = tx.Exec(query, postID, me.ID, r.FormValue("comment"))
+	query := "INSERT INTO `comments` (`post_id`, `user_id`, `parent_id`, `comment`) VALUES (?,?,?,?)"
+	_, err = tx.Exec(query, postID, me.ID, parentID, r.FormValue("comment"))
 	if err != nil {
 		log.Print(err)
 		return
@@ -900,19 +1313,51 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
+	invalidatePostComments(postID)
+	pinPrimary(w, r)
 
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
 
-func getAdminBanned(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
+// requireAdmin は /admin/* の入口で管理者かどうかと二段階認証の設定を確かめる
+func requireAdmin(w http.ResponseWriter, r *http.Request) (User, bool) {
+	auth := accessTokenFrom(r)
+	if auth != nil && !auth.Token.HasScope(scopeAdmin) {
+		insufficientScope(w, scopeAdmin)
+		return User{}, false
+	}
+
+	me := getAuthUser(r, scopeAdmin)
 	if !isLogin(me) {
 		http.Redirect(w, r, "/", http.StatusFound)
-		return
+		return me, false
 	}
 
 	if me.Authority == 0 {
 		w.WriteHeader(http.StatusForbidden)
+		return me, false
+	}
+
+	// 二段階認証を有効にしたユーザーのセッションはすべて確認コードを通っている
+	if !me.TOTPEnabled && auth != nil {
+		writeJSONError(w, http.StatusForbidden, "two_factor_required", admin2FARequiredMsg)
+		return me, false
+	}
+	if !me.TOTPEnabled {
+		session := getSession(r)
+		session.Values["notice"] = admin2FARequiredMsg
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return me, false
+	}
+
+	return me, true
+}
+
+func getAdminBanned(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireAdmin(w, r)
+	if !ok {
 		return
 	}
 
@@ -931,18 +1376,12 @@ func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 }
 
 func postAdminBanned(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
-	}
-
-	if me.Authority == 0 {
-		w.WriteHeader(http.StatusForbidden)
+	_, ok := requireAdmin(w, r)
+	if !ok {
 		return
 	}
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
+	if !validCSRF(r) {
 		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
@@ -957,7 +1396,16 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 
 	for _, id := range r.Form["uid[]"] {
 		db.Exec(query, 1, id)
+		if uid, err := strconv.Atoi(id); err == nil {
+			invalidateUser(uid)
+			// BAN したユーザーは今ログインしている端末からも追い出す
+			if err := revokeUserSessions(uid, ""); err != nil {
+				log.Print(err)
+			}
+		}
 	}
+	invalidateTimeline()
+	pinPrimary(w, r)
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
 }
@@ -987,48 +1435,9 @@ func (reg *RegexpPattern) Match(r *http.Request) *http.Request {
 	return nil
 }
 
-func main() {
-	go func() {
-		log.Print(http.ListenAndServe("localhost:6060", nil))
-	}()
-	host := os.Getenv("ISUCONP_DB_HOST")
-	if host == "" {
-		host = "localhost"
-	}
-	port := os.Getenv("ISUCONP_DB_PORT")
-	if port == "" {
-		port = "3306"
-	}
-	_, err := strconv.Atoi(port)
-	if err != nil {
-		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
-	}
-	user := os.Getenv("ISUCONP_DB_USER")
-	if user == "" {
-		user = "root"
-	}
-	password := os.Getenv("ISUCONP_DB_PASSWORD")
-	dbname := os.Getenv("ISUCONP_DB_NAME")
-	if dbname == "" {
-		dbname = "isuconp"
-	}
-
-	dsn := fmt.Sprintf(
-		"%s:%s@tcp(%s:%s)/%s?interpolateParams=true&charset=utf8mb4&parseTime=true&loc=Local",
-		user,
-		password,
-		host,
-		port,
-		dbname,
-	)
-
-	db, err = sqlx.Open("mysql", dsn)
-	if err != nil {
-		log.Fatalf("Failed to connect to DB: %s.", err.Error())
-	}
-	defer db.Close()
-
+func newMux() *goji.Mux {
 	mux := goji.NewMux()
+	mux.Use(withAccessToken)
 
 	mux.HandleFunc(pat.Get("/initialize"), getInitialize)
 	mux.HandleFunc(pat.Get("/login"), getLogin)
@@ -1040,12 +1449,114 @@ func main() {
 	mux.HandleFunc(pat.Get("/posts"), getPosts)
 	mux.HandleFunc(pat.Get("/posts/:id"), getPostsID)
 	mux.HandleFunc(pat.Post("/"), postIndex)
+	mux.HandleFunc(pat.Get("/drafts"), getDrafts)
+	mux.HandleFunc(pat.Post("/drafts"), postDraft)
 	mux.HandleFunc(pat.Get("/image/:id.:ext"), getImage)
+	mux.HandleFunc(pat.Get("/image/:id/poster.:ext"), getVideoPoster)
+	mux.HandleFunc(pat.Get("/image/:id/:position.:ext"), getPostImage)
 	mux.HandleFunc(pat.Post("/comment"), postComment)
+	mux.HandleFunc(pat.Post("/comment/reaction"), postCommentReaction)
+	mux.HandleFunc(pat.Get("/bookmarks"), getBookmarks)
+	mux.HandleFunc(pat.Get("/bookmarks/posts"), getBookmarkPostsPage)
+	mux.HandleFunc(pat.Post("/bookmark"), postBookmark)
+	mux.HandleFunc(pat.Post("/bookmarks/collection"), postBookmarkCollection)
+	mux.HandleFunc(pat.Post("/bookmarks/collections"), postBookmarkCollectionsCreate)
+	mux.HandleFunc(pat.Post("/bookmarks/collections/delete"), postBookmarkCollectionsDelete)
+	mux.HandleFunc(pat.Get("/login/2fa"), getLogin2FA)
+	mux.HandleFunc(pat.Post("/login/2fa"), postLogin2FA)
+	mux.HandleFunc(pat.Get("/2fa"), getTwoFactor)
+	mux.HandleFunc(pat.Post("/2fa/enable"), postTwoFactorEnable)
+	mux.HandleFunc(pat.Post("/2fa/disable"), postTwoFactorDisable)
+	mux.HandleFunc(pat.Post("/2fa/recovery_codes"), postTwoFactorRecoveryCodes)
+	mux.HandleFunc(pat.Get("/auth/:provider"), getOIDCLogin)
+	mux.HandleFunc(pat.Post("/auth/:provider/link"), postOIDCLink)
+	mux.HandleFunc(pat.Get("/auth/:provider/callback"), getOIDCCallback)
+	mux.HandleFunc(pat.Get("/identities"), getIdentities)
+	mux.HandleFunc(pat.Post("/identities/unlink"), postIdentitiesUnlink)
+	mux.HandleFunc(pat.Get("/profile"), getProfile)
+	mux.HandleFunc(pat.Post("/profile"), postProfile)
+	mux.HandleFunc(pat.Get("/avatar/:id.:ext"), getAvatar)
+	mux.HandleFunc(pat.Get("/account"), getAccount)
+	mux.HandleFunc(pat.Post("/account/exports"), postAccountExport)
+	mux.HandleFunc(pat.Get("/account/exports/:id"), getAccountExport)
+	mux.HandleFunc(pat.Post("/account/delete"), postAccountDelete)
+	mux.HandleFunc(pat.Post("/account/delete/cancel"), postAccountDeleteCancel)
+	mux.HandleFunc(pat.Post("/follow"), postFollow)
+	mux.HandleFunc(pat.Post("/unfollow"), postUnfollow)
+	mux.HandleFunc(pat.Get("/followers"), getFollowers)
+	mux.HandleFunc(pat.Post("/followers/approve"), postFollowersApprove)
+	mux.HandleFunc(pat.Post("/followers/remove"), postFollowersRemove)
+	mux.HandleFunc(pat.Get("/blocks"), getBlocks)
+	mux.HandleFunc(pat.Post("/block"), postBlock)
+	mux.HandleFunc(pat.Post("/unblock"), postUnblock)
+	mux.HandleFunc(pat.Post("/mute"), postMute)
+	mux.HandleFunc(pat.Post("/unmute"), postUnmute)
+	mux.HandleFunc(pat.Get("/tokens"), getTokens)
+	mux.HandleFunc(pat.Post("/tokens"), postTokens)
+	mux.HandleFunc(pat.Post("/tokens/revoke"), postTokensRevoke)
+	mux.HandleFunc(pat.Get("/password"), getPassword)
+	mux.HandleFunc(pat.Post("/password"), postPassword)
+	mux.HandleFunc(pat.Get("/email"), getEmail)
+	mux.HandleFunc(pat.Post("/email"), postEmail)
+	mux.HandleFunc(pat.Get("/email/verify/:token"), getEmailVerify)
+	mux.HandleFunc(pat.Get("/password/reset"), getPasswordReset)
+	mux.HandleFunc(pat.Post("/password/reset"), postPasswordReset)
+	mux.HandleFunc(pat.Get("/password/reset/:token"), getPasswordResetConfirm)
+	mux.HandleFunc(pat.Post("/password/reset/:token"), postPasswordResetConfirm)
+	mux.HandleFunc(pat.Get("/sessions"), getSessions)
+	mux.HandleFunc(pat.Post("/sessions/revoke"), postSessionsRevoke)
+	mux.HandleFunc(pat.Post("/sessions/revoke_others"), postSessionsRevokeOthers)
 	mux.HandleFunc(pat.Get("/admin/banned"), getAdminBanned)
 	mux.HandleFunc(pat.Post("/admin/banned"), postAdminBanned)
 	mux.HandleFunc(Regexp(regexp.MustCompile(`^/@(?P<accountName>[a-zA-Z]+)$`)), getAccountName)
-	mux.Handle(pat.Get("/*"), http.FileServer(http.Dir("../public")))
+	mux.Handle(pat.Get("/*"), staticFiles(http.FileServer(http.Dir("../public"))))
+
+	return mux
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			os.Exit(runMigrate(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		case "seed":
+			os.Exit(runSeed(os.Args[2:]))
+		}
+	}
+
+	go func() {
+		log.Print(http.ListenAndServe("localhost:6060", nil))
+	}()
+	var err error
+	appBaseURL, err = loadBaseURL()
+	if err != nil {
+		log.Fatalf("Failed to read the base URL: %s.", err.Error())
+	}
+	cluster, err = newDBCluster(primaryDSN(), replicaDSNs())
+	if err != nil {
+		log.Fatalf("Failed to connect to DB: %s.", err.Error())
+	}
+	defer cluster.Close()
+	db = cluster.primary
+
+	store, err = newSessionStore(db)
+	if err != nil {
+		log.Fatalf("Failed to create session store: %s.", err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cluster.watchReplicas(ctx)
+	if s, ok := store.(*serverSessionStore); ok {
+		if b, ok := s.backend.(*mysqlSessionBackend); ok {
+			go b.sweepSessions(ctx)
+		}
+	}
+	go runExportWorker(ctx)
+	go sweepAccountDeletions(ctx)
+	go runPostScheduler(ctx)
 
-	log.Fatal(http.ListenAndServe(":8080", mux))
+	log.Fatal(http.ListenAndServe(":8080", newMux()))
 }
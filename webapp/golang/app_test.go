@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// fakeSessionStore はセッションをメモリ上に持つ sessions.Store
+type fakeSessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[interface{}]interface{}
+	seq      int
+}
+
+func newFakeSessionStore() *fakeSessionStore {
+	return &fakeSessionStore{sessions: map[string]map[interface{}]interface{}{}}
+}
+
+func (s *fakeSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *fakeSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Options = &sessions.Options{Path: "/"}
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values, ok := s.sessions[c.Value]
+	if !ok {
+		return session, nil
+	}
+	session.ID = c.Value
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *fakeSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		delete(s.sessions, session.ID)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		s.seq++
+		session.ID = fmt.Sprintf("session-%d", s.seq)
+	}
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	s.sessions[session.ID] = values
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+type testApp struct {
+	t      *testing.T
+	fake   *fakeDB
+	server *httptest.Server
+}
+
+// newTestApp はフェイクの DB・セッション・キャッシュでアプリを立ち上げる
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	fake := newFakeDB()
+	oldDB, oldCluster, oldStore, oldCache, oldImageDir, oldExportDir, oldRateLimit, oldLockout := db, cluster, store, appCache, imageDir, exportDir, rateLimitStore, loginLockoutStore
+	db = fake.sqlx()
+	cluster = nil
+	store = newFakeSessionStore()
+	appCache = newLRUCache(1000)
+	imageDir = t.TempDir()
+	exportDir = t.TempDir()
+	rateLimitStore = nil
+	loginLockoutStore = newMemoryRateLimitStore()
+
+	server := httptest.NewServer(newMux())
+	oldBaseURL := appBaseURL
+	appBaseURL = server.URL
+	t.Cleanup(func() {
+		server.Close()
+		db.Close()
+		db, cluster, store, appCache, imageDir, exportDir, rateLimitStore, loginLockoutStore = oldDB, oldCluster, oldStore, oldCache, oldImageDir, oldExportDir, oldRateLimit, oldLockout
+		appBaseURL = oldBaseURL
+	})
+
+	return &testApp{t: t, fake: fake, server: server}
+}
+
+func (a *testApp) addUser(accountName string, authority, delFlg int) int {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	return int(a.fake.insert("users", fakeRow{
+		"account_name": accountName,
+		"passhash":     seedPasshash(accountName, accountName+accountName),
+		"authority":    int64(authority),
+		"del_flg":      int64(delFlg),
+	}))
+}
+
+func (a *testApp) addPost(userID int, body string, imgdata []byte) int {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	pid := a.fake.insert("posts", fakeRow{
+		"user_id": int64(userID),
+		"mime":    "image/png",
+		"imgdata": imgdata,
+		"body":    body,
+	})
+	a.fake.insert("comment_count", fakeRow{"post_id": pid, "count": int64(0)})
+	return int(pid)
+}
+
+func (a *testApp) addComment(postID, userID int, comment string) {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	a.fake.insert("comments", fakeRow{"post_id": int64(postID), "user_id": int64(userID), "comment": comment})
+	row := a.fake.findOne("comment_count", "post_id", int64(postID))
+	row["count"] = fakeInt(row["count"]) + 1
+}
+
+func (a *testApp) count(table string) int {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	return len(a.fake.tables[table])
+}
+
+type testClient struct {
+	t      *testing.T
+	app    *testApp
+	client *http.Client
+}
+
+// newClient はリダイレクトを追わずにクッキーだけ保持するクライアントを作る
+func (a *testApp) newClient() *testClient {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+	return &testClient{
+		t:   a.t,
+		app: a,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type testResponse struct {
+	*http.Response
+	Body string
+}
+
+func (c *testClient) do(req *http.Request) *testResponse {
+	c.t.Helper()
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return &testResponse{Response: res, Body: string(body)}
+}
+
+func (c *testClient) get(path string, header ...string) *testResponse {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodGet, c.app.server.URL+path, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return c.do(req)
+}
+
+func (c *testClient) postForm(path string, form url.Values, header ...string) *testResponse {
+	c.t.Helper()
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	return c.do(req)
+}
+
+// postImage は画像つきの投稿フォームを送る。contentType が空ならファイルを付けない
+func (c *testClient) postImage(csrfToken, body, contentType string, data []byte) *testResponse {
+	c.t.Helper()
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("body", body)
+	mw.WriteField("csrf_token", csrfToken)
+	if contentType != "" {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+"/", buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func (c *testClient) login(accountName string) {
+	c.t.Helper()
+	res := c.postForm("/login", url.Values{"account_name": {accountName}, "password": {accountName + accountName}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/" {
+		c.t.Fatalf("login %s: status %d location %q", accountName, res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+var csrfTokenRegexp = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+func (c *testClient) csrfToken() string {
+	c.t.Helper()
+	res := c.get("/")
+	m := csrfTokenRegexp.FindStringSubmatch(res.Body)
+	if m == nil {
+		c.t.Fatal("csrf_token not found")
+	}
+	return m[1]
+}
+
+func assertStatus(t *testing.T, res *testResponse, status int) {
+	t.Helper()
+	if res.StatusCode != status {
+		t.Fatalf("%s %s: status %d, want %d", res.Request.Method, res.Request.URL.Path, res.StatusCode, status)
+	}
+}
+
+func assertRedirect(t *testing.T, res *testResponse, location string) {
+	t.Helper()
+	assertStatus(t, res, http.StatusFound)
+	if got := res.Header.Get("Location"); got != location {
+		t.Fatalf("%s %s: location %q, want %q", res.Request.Method, res.Request.URL.Path, got, location)
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	app := newTestApp(t)
+	uid := app.addUser("mary", 0, 0)
+	pid := app.addPost(uid, "seed", []byte("png"))
+	app.addComment(pid, uid, "hello")
+	app.fake.insert("users", fakeRow{"id": int64(seedMaxUserID + 1), "account_name": "bob", "passhash": ""})
+	// ベンチマーク中にパスワードやメールアドレス、2段階認証を変えられた初期データのユーザー
+	mary := app.fake.findOne("users", "id", int64(uid))
+	mary["passhash"], mary["email"], mary["totp_secret"], mary["totp_enabled"], mary["totp_last_step"] = "changed", "mary@example.com", "secret", true, int64(42)
+	app.fake.insert("password_resets", fakeRow{"user_id": int64(uid), "token_hash": "hash"})
+	app.fake.insert("recovery_codes", fakeRow{"user_id": int64(uid), "code_hash": "hash"})
+	app.fake.insert("posts", fakeRow{"id": int64(seedMaxPostID + 1), "user_id": int64(uid), "mime": "image/png", "body": "new"})
+	os.WriteFile(imagePath(seedMaxPostID+1, "image/png"), []byte("png"), 0644)
+	os.WriteFile(imagePath(pid, "image/png"), []byte("png"), 0644)
+
+	t.Setenv("ISUCONP_INITIALIZE_TOKEN", "secret")
+	c := app.newClient()
+
+	assertStatus(t, c.get("/initialize"), http.StatusForbidden)
+	assertStatus(t, c.get("/initialize?token=wrong"), http.StatusForbidden)
+
+	res := c.get("/initialize", "X-Initialize-Token", "secret")
+	assertStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Body, `"removed_images":1`) {
+		t.Errorf("unexpected result: %s", res.Body)
+	}
+	if n := app.count("users"); n != 1 {
+		t.Errorf("users = %d, want 1", n)
+	}
+	if n := app.count("posts"); n != 1 {
+		t.Errorf("posts = %d, want 1", n)
+	}
+	if _, err := os.Stat(imagePath(pid, "image/png")); err != nil {
+		t.Errorf("seed image removed: %v", err)
+	}
+	if _, err := os.Stat(imagePath(seedMaxPostID+1, "image/png")); !os.IsNotExist(err) {
+		t.Errorf("uploaded image remains: %v", err)
+	}
+	row := app.fake.findOne("comment_count", "post_id", int64(pid))
+	if row == nil || fakeInt(row["count"]) != 1 {
+		t.Errorf("comment_count = %v, want 1", row)
+	}
+	if mary["passhash"] != seedPasshash("mary", "marymary") || mary["email"] != "" || mary["totp_secret"] != "" || mary["totp_enabled"] != false || fakeInt(mary["totp_last_step"]) != 0 {
+		t.Errorf("credentials not reset: %v", mary)
+	}
+	if n := app.count("password_resets") + app.count("recovery_codes"); n != 0 {
+		t.Errorf("password_resets and recovery_codes = %d, want 0", n)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	app.addUser("banned", 0, 1)
+
+	tests := []struct {
+		name        string
+		accountName string
+		password    string
+		location    string
+	}{
+		{"success", "mary", "marymary", "/"},
+		{"wrong password", "mary", "wrongpass", "/login"},
+		{"unknown user", "nobody", "nobodynobody", "/login"},
+		{"banned user", "banned", "bannedbanned", "/login"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := app.newClient()
+			assertStatus(t, c.get("/login"), http.StatusOK)
+
+			res := c.postForm("/login", url.Values{"account_name": {tt.accountName}, "password": {tt.password}})
+			assertRedirect(t, res, tt.location)
+
+			if tt.location == "/login" {
+				res = c.get("/login")
+				if !strings.Contains(res.Body, "アカウント名かパスワードが間違っています") {
+					t.Error("flash message not shown")
+				}
+				return
+			}
+
+			// ログイン済みならログイン画面からトップに戻される
+			assertRedirect(t, c.get("/login"), "/")
+			assertRedirect(t, c.get("/logout"), "/")
+			assertStatus(t, c.get("/login"), http.StatusOK)
+		})
+	}
+}
+
+func TestTryLoginRejectsEmptyPasshash(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	oidc := app.addUser("carol", 0, 0)
+	app.fake.findOne("users", "id", int64(oidc))["passhash"] = ""
+
+	if u := tryLogin("carol", "anything"); u != nil {
+		t.Error("logged in to a user without a password")
+	}
+
+	// openssl が動かず空のハッシュしか作れなくても、パスワードのないユーザーにログインさせない
+	t.Setenv("PATH", "")
+	if u := tryLogin("carol", "anything"); u != nil {
+		t.Error("logged in to a user without a password while digest fails")
+	}
+	if u := tryLogin("mary", "marymary"); u != nil {
+		t.Error("logged in while digest fails")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	tests := []struct {
+		name        string
+		accountName string
+		password    string
+		location    string
+		notice      string
+	}{
+		{"success", "newuser", "password", "/", ""},
+		{"short account name", "ab", "password", "/register", "アカウント名は3文字以上"},
+		{"short password", "newuser", "pass", "/register", "パスワードは6文字以上"},
+		{"invalid character", "new-user", "password", "/register", "アカウント名は3文字以上"},
+		{"duplicate", "mary", "password", "/register", "アカウント名がすでに使われています"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := app.newClient()
+			assertStatus(t, c.get("/register"), http.StatusOK)
+
+			res := c.postForm("/register", url.Values{"account_name": {tt.accountName}, "password": {tt.password}})
+			assertRedirect(t, res, tt.location)
+
+			if tt.notice != "" {
+				res = c.get("/register")
+				if !strings.Contains(res.Body, tt.notice) {
+					t.Errorf("flash %q not shown", tt.notice)
+				}
+				return
+			}
+
+			res = c.get("/")
+			if !strings.Contains(res.Body, tt.accountName) {
+				t.Error("registered user is not logged in")
+			}
+			assertRedirect(t, c.get("/register"), "/")
+		})
+	}
+}
+
+func TestIndex(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	banned := app.addUser("banned", 0, 1)
+	pid := app.addPost(mary, "visible post", nil)
+	app.addPost(banned, "hidden post", nil)
+	for i := 0; i < 5; i++ {
+		app.addComment(pid, mary, fmt.Sprintf("comment%d", i))
+	}
+
+	c := app.newClient()
+	res := c.get("/")
+	assertStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Body, "visible post") {
+		t.Error("post is not shown")
+	}
+	if strings.Contains(res.Body, "hidden post") {
+		t.Error("post of banned user is shown")
+	}
+	// 一覧ではコメントは最新の 3 件だけ出す
+	for i, want := range []bool{false, false, true, true, true} {
+		if got := strings.Contains(res.Body, fmt.Sprintf("comment%d", i)); got != want {
+			t.Errorf("comment%d shown = %v, want %v", i, got, want)
+		}
+	}
+	if !strings.Contains(res.Body, "5") {
+		t.Error("comment count is not shown")
+	}
+}
+
+func TestPosts(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	for i := 0; i < postsPerPage+5; i++ {
+		app.addPost(mary, fmt.Sprintf("post%03d", i), nil)
+	}
+	c := app.newClient()
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		posts  int
+	}{
+		{"no max_created_at", "", http.StatusOK, 0},
+		{"invalid max_created_at", "?max_created_at=yesterday", http.StatusOK, 0},
+		{"future", "?max_created_at=" + url.QueryEscape(app.fake.now.Add(time.Hour).Format(ISO8601Format)), http.StatusOK, postsPerPage},
+		{"past", "?max_created_at=" + url.QueryEscape(app.fake.now.Add(-20*time.Second).Format(ISO8601Format)), http.StatusOK, 5},
+		{"before everything", "?max_created_at=" + url.QueryEscape("2000-01-01T00:00:00+09:00"), http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := c.get("/posts" + tt.query)
+			assertStatus(t, res, tt.status)
+			if n := strings.Count(res.Body, `class="isu-post"`); n != tt.posts {
+				t.Errorf("posts = %d, want %d", n, tt.posts)
+			}
+		})
+	}
+}
+
+func TestPostsID(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	banned := app.addUser("banned", 0, 1)
+	pid := app.addPost(mary, "visible post", nil)
+	hidden := app.addPost(banned, "hidden post", nil)
+	for i := 0; i < 5; i++ {
+		app.addComment(pid, mary, fmt.Sprintf("comment%d", i))
+	}
+	c := app.newClient()
+
+	res := c.get(fmt.Sprintf("/posts/%d", pid))
+	assertStatus(t, res, http.StatusOK)
+	// 投稿ページではすべてのコメントを出す
+	for i := 0; i < 5; i++ {
+		if !strings.Contains(res.Body, fmt.Sprintf("comment%d", i)) {
+			t.Errorf("comment%d is not shown", i)
+		}
+	}
+
+	assertStatus(t, c.get(fmt.Sprintf("/posts/%d", hidden)), http.StatusNotFound)
+	assertStatus(t, c.get("/posts/9999"), http.StatusNotFound)
+	assertStatus(t, c.get("/posts/abc"), http.StatusNotFound)
+}
+
+func TestPostIndex(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	anonymous := app.newClient()
+	assertRedirect(t, anonymous.postImage("", "body", "image/png", []byte("png")), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	assertStatus(t, c.postImage("wrong", "body", "image/png", []byte("png")), http.StatusUnprocessableEntity)
+
+	tests := []struct {
+		name        string
+		contentType string
+		notice      string
+	}{
+		{"no file", "", "画像が必須です"},
+		{"unsupported type", "image/bmp", "投稿できる形式はjpgとpngとgifとmp4とwebmだけです"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertRedirect(t, c.postImage(token, "body", tt.contentType, []byte("data")), "/")
+			if res := c.get("/"); !strings.Contains(res.Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if n := app.count("posts"); n != 0 {
+		t.Fatalf("posts = %d, want 0", n)
+	}
+
+	res := c.postImage(token, "uploaded post", "image/jpeg", []byte("jpeg data"))
+	assertRedirect(t, res, "/posts/1")
+	data, err := os.ReadFile(imagePath(1, "image/jpeg"))
+	if err != nil || string(data) != "jpeg data" {
+		t.Errorf("image file = %q, %v", data, err)
+	}
+	res = c.get("/")
+	if !strings.Contains(res.Body, "uploaded post") {
+		t.Error("timeline is not updated")
+	}
+	if !strings.Contains(res.Body, "/image/1.jpg?v="+imageVersion(imageHash([]byte("jpeg data")))) {
+		t.Error("image URL has no version")
+	}
+}
+
+func TestImage(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	pid := app.addPost(mary, "body", []byte("0123456789"))
+	c := app.newClient()
+	path := fmt.Sprintf("/image/%d.png", pid)
+
+	assertStatus(t, c.get(fmt.Sprintf("/image/%d.jpg", pid)), http.StatusNotFound)
+
+	res := c.get(path)
+	assertStatus(t, res, http.StatusOK)
+	if res.Body != "0123456789" {
+		t.Errorf("body = %q", res.Body)
+	}
+	etag := res.Header.Get("ETag")
+	if etag != `"`+imageHash([]byte("0123456789"))+`"` {
+		t.Errorf("ETag = %q", etag)
+	}
+	// ハッシュは初回のアクセスで保存される
+	if row := app.fake.findOne("posts", "id", int64(pid)); fakeString(row["image_hash"]) == "" {
+		t.Error("image_hash is not saved")
+	}
+
+	assertStatus(t, c.get(path, "If-None-Match", etag), http.StatusNotModified)
+
+	res = c.get(path, "Range", "bytes=2-4")
+	assertStatus(t, res, http.StatusPartialContent)
+	if res.Body != "234" {
+		t.Errorf("range body = %q", res.Body)
+	}
+
+	res = c.get(path + "?v=" + imageVersion(imageHash([]byte("0123456789"))))
+	if got := res.Header.Get("Cache-Control"); got != immutableImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+}
+
+func TestImageOfBannedUser(t *testing.T) {
+	app := newTestApp(t)
+	banned := app.addUser("banned", 0, 1)
+	pid := app.addPost(banned, "body", []byte("0123456789"))
+
+	assertStatus(t, app.newClient().get(fmt.Sprintf("/image/%d.png", pid)), http.StatusNotFound)
+}
+
+func TestPostComment(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	pid := app.addPost(mary, "body", nil)
+
+	anonymous := app.newClient()
+	assertRedirect(t, anonymous.postForm("/comment", url.Values{"post_id": {fmt.Sprint(pid)}, "comment": {"hi"}}), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	assertStatus(t, c.postForm("/comment", url.Values{"post_id": {fmt.Sprint(pid)}, "comment": {"hi"}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	assertStatus(t, c.postForm("/comment", url.Values{"post_id": {"abc"}, "comment": {"hi"}, "csrf_token": {token}}), http.StatusOK)
+	if n := app.count("comments"); n != 0 {
+		t.Fatalf("comments = %d, want 0", n)
+	}
+
+	// 一度表示してキャッシュに載せてからコメントする
+	c.get(fmt.Sprintf("/posts/%d", pid))
+	res := c.postForm("/comment", url.Values{"post_id": {fmt.Sprint(pid)}, "comment": {"nice picture"}, "csrf_token": {token}})
+	assertRedirect(t, res, fmt.Sprintf("/posts/%d", pid))
+
+	res = c.get(fmt.Sprintf("/posts/%d", pid))
+	if !strings.Contains(res.Body, "nice picture") {
+		t.Error("comment is not shown")
+	}
+	if row := app.fake.findOne("comment_count", "post_id", int64(pid)); fakeInt(row["count"]) != 1 {
+		t.Errorf("comment_count = %v, want 1", row["count"])
+	}
+}
+
+func TestAdminBanned(t *testing.T) {
+	app := newTestApp(t)
+	adminID := app.addUser("admin", 1, 0)
+	app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.addPost(bob, "post by bob", nil)
+
+	anonymous := app.newClient()
+	assertRedirect(t, anonymous.get("/admin/banned"), "/")
+
+	user := app.newClient()
+	user.login("mary")
+	assertStatus(t, user.get("/admin/banned"), http.StatusForbidden)
+	assertStatus(t, user.postForm("/admin/banned", url.Values{"uid[]": {fmt.Sprint(bob)}}), http.StatusForbidden)
+
+	admin := app.newClient()
+	admin.loginAdmin(app, adminID, "admin")
+	token := admin.csrfToken()
+	res := admin.get("/admin/banned")
+	assertStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Body, `data-account-name="bob"`) {
+		t.Error("bob is not listed")
+	}
+	if !strings.Contains(admin.get("/").Body, "post by bob") {
+		t.Fatal("post is not shown before ban")
+	}
+
+	assertStatus(t, admin.postForm("/admin/banned", url.Values{"uid[]": {fmt.Sprint(bob)}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	assertRedirect(t, admin.postForm("/admin/banned", url.Values{"uid[]": {fmt.Sprint(bob)}, "csrf_token": {token}}), "/admin/banned")
+
+	if strings.Contains(admin.get("/admin/banned").Body, `data-account-name="bob"`) {
+		t.Error("banned user is still listed")
+	}
+	if strings.Contains(admin.get("/").Body, "post by bob") {
+		t.Error("post of banned user is shown")
+	}
+	assertStatus(t, admin.get("/@bob"), http.StatusNotFound)
+}
+
+func TestAccountName(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	pid := app.addPost(mary, "post by mary", nil)
+	app.addPost(mary, "another post", nil)
+	app.addComment(pid, bob, "comment by bob")
+	c := app.newClient()
+
+	res := c.get("/@mary")
+	assertStatus(t, res, http.StatusOK)
+	if !strings.Contains(res.Body, "post by mary") {
+		t.Error("post is not shown")
+	}
+	for _, want := range []string{`<span class="isu-post-count">2</span>`, `<span class="isu-comment-count">0</span>`, `<span class="isu-commented-count">1</span>`} {
+		if !strings.Contains(res.Body, want) {
+			t.Errorf("%s not found", want)
+		}
+	}
+
+	assertStatus(t, c.get("/@nobody"), http.StatusNotFound)
+}
+
+func TestStatic(t *testing.T) {
+	app := newTestApp(t)
+	c := app.newClient()
+
+	assertStatus(t, c.get("/favicon.ico"), http.StatusOK)
+	assertStatus(t, c.get("/no-such-file"), http.StatusNotFound)
+}
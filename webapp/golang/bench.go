@@ -0,0 +1,995 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/textproto"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ベンチマークの得点。private-isu のベンチマーカーに近い重み付けにしている
+const (
+	benchScoreGet       = 1
+	benchScorePost      = 2
+	benchScoreUpload    = 5
+	benchPenaltyError   = 10
+	benchPenaltyTimeout = 20
+)
+
+var (
+	benchCSRFRegexp        = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+	benchPostIDRegexp      = regexp.MustCompile(`class="isu-post" id="pid_(\d+)" data-created-at="([^"]+)"`)
+	benchPostAccountRegexp = regexp.MustCompile(`class="isu-post-account-name">([0-9a-zA-Z_]+)</a>`)
+	benchImageRegexp       = regexp.MustCompile(`<img src="(/image/[^"]+)" class="isu-image">`)
+	benchCommentCntRegexp  = regexp.MustCompile(`comments: <b>(\d+)</b>`)
+	benchBannedUIDRegexp   = regexp.MustCompile(`value="(\d+)" data-account-name="([0-9a-zA-Z_]+)"`)
+	benchPostLocRegexp     = regexp.MustCompile(`\A/posts/(\d+)\z`)
+	benchTOTPSecretRegexp  = regexp.MustCompile(`class="isu-totp-secret">([A-Z2-7]+)<`)
+)
+
+type benchAccount struct {
+	AccountName string
+	Password    string
+	// TOTP は二段階認証を有効にしたアカウントだけ持つ
+	TOTP *benchTOTP
+}
+
+// benchTOTP は確認コードを作る。一度通ったステップは二度と使えないので、ワーカー間で順番に配る
+type benchTOTP struct {
+	mu   sync.Mutex
+	key  []byte
+	last int64
+}
+
+func newBenchTOTP(secret string) (*benchTOTP, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("invalid TOTP secret")
+	}
+	return &benchTOTP{key: key}, nil
+}
+
+// next はまだ使っていないステップのコードを返す。受け付けられる範囲を使い切っていたら次のステップまで待つ
+func (t *benchTOTP) next() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		current := totpStep(time.Now())
+		step := current
+		if step <= t.last {
+			step = t.last + 1
+		}
+		if step <= current+totpSkew {
+			t.last = step
+			return totpCode(t.key, step)
+		}
+		time.Sleep(time.Until(time.Unix((current+1)*totpPeriod, 0)))
+	}
+}
+
+type benchConfig struct {
+	target          *url.URL
+	duration        time.Duration
+	concurrency     int
+	timeout         time.Duration
+	initializeToken string
+	scenarios       map[string]int
+	accounts        []benchAccount
+	admin           *benchAccount
+}
+
+type benchSample struct {
+	label   string
+	latency time.Duration
+}
+
+// benchRecorder は全ワーカーの結果を集計する
+type benchRecorder struct {
+	mu       sync.Mutex
+	score    int
+	requests int
+	errors   map[string]int
+	samples  map[string][]time.Duration
+}
+
+func newBenchRecorder() *benchRecorder {
+	return &benchRecorder{errors: map[string]int{}, samples: map[string][]time.Duration{}}
+}
+
+func (rec *benchRecorder) success(s benchSample, point int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests++
+	rec.score += point
+	rec.samples[s.label] = append(rec.samples[s.label], s.latency)
+}
+
+func (rec *benchRecorder) fail(kind string, penalty int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.requests++
+	rec.score -= penalty
+	rec.errors[kind]++
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func (rec *benchRecorder) report(w io.Writer, elapsed time.Duration) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	score := rec.score
+	if score < 0 {
+		score = 0
+	}
+	errorCount := 0
+	for _, n := range rec.errors {
+		errorCount += n
+	}
+
+	fmt.Fprintf(w, "score: %d\n", score)
+	fmt.Fprintf(w, "requests: %d (%.1f req/s), errors: %d\n", rec.requests, float64(rec.requests)/elapsed.Seconds(), errorCount)
+
+	labels := make([]string, 0, len(rec.samples))
+	for label := range rec.samples {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	fmt.Fprintf(w, "\n%-28s %7s %9s %9s %9s %9s\n", "request", "count", "p50", "p90", "p99", "max")
+	for _, label := range labels {
+		samples := rec.samples[label]
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		fmt.Fprintf(w, "%-28s %7d %9s %9s %9s %9s\n", label, len(samples),
+			percentile(samples, 0.5).Round(time.Millisecond),
+			percentile(samples, 0.9).Round(time.Millisecond),
+			percentile(samples, 0.99).Round(time.Millisecond),
+			samples[len(samples)-1].Round(time.Millisecond))
+	}
+
+	if len(rec.errors) > 0 {
+		kinds := make([]string, 0, len(rec.errors))
+		for kind := range rec.errors {
+			kinds = append(kinds, kind)
+		}
+		sort.Slice(kinds, func(i, j int) bool { return rec.errors[kinds[i]] > rec.errors[kinds[j]] })
+
+		fmt.Fprintln(w, "\nerrors:")
+		for _, kind := range kinds {
+			fmt.Fprintf(w, "%7d  %s\n", rec.errors[kind], kind)
+		}
+	}
+}
+
+// benchState はシナリオ間で共有する検証用の状態
+type benchState struct {
+	mu     sync.Mutex
+	banned map[string]bool
+}
+
+func (st *benchState) ban(accountName string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.banned[accountName] = true
+}
+
+func (st *benchState) isBanned(accountName string) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.banned[accountName]
+}
+
+type benchError struct {
+	kind    string
+	timeout bool
+}
+
+func (e *benchError) Error() string {
+	return e.kind
+}
+
+// benchClient はひとりのユーザーとして振る舞う HTTP クライアント
+type benchClient struct {
+	cfg     *benchConfig
+	rec     *benchRecorder
+	http    *http.Client
+	account *benchAccount
+}
+
+func newBenchClient(cfg *benchConfig, rec *benchRecorder) *benchClient {
+	jar, _ := cookiejar.New(nil)
+	return &benchClient{
+		cfg: cfg,
+		rec: rec,
+		http: &http.Client{
+			Jar:     jar,
+			Timeout: cfg.timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type benchResponse struct {
+	status   int
+	location string
+	body     string
+}
+
+// do はリクエストを送り、期待したステータスなら記録して返す
+func (c *benchClient) do(req *http.Request, label string, point int, expected ...int) (*benchResponse, error) {
+	start := time.Now()
+	res, err := c.http.Do(req)
+	if err != nil {
+		if e, ok := err.(interface{ Timeout() bool }); ok && e.Timeout() {
+			c.rec.fail(label+": timeout", benchPenaltyTimeout)
+			return nil, &benchError{kind: label + ": timeout", timeout: true}
+		}
+		c.rec.fail(label+": request failed", benchPenaltyError)
+		return nil, &benchError{kind: label + ": " + err.Error()}
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	latency := time.Since(start)
+	if err != nil {
+		c.rec.fail(label+": failed to read body", benchPenaltyError)
+		return nil, err
+	}
+
+	for _, status := range expected {
+		if res.StatusCode == status {
+			c.rec.success(benchSample{label: label, latency: latency}, point)
+			return &benchResponse{status: res.StatusCode, location: res.Header.Get("Location"), body: string(body)}, nil
+		}
+	}
+
+	kind := fmt.Sprintf("%s: unexpected status %d", label, res.StatusCode)
+	c.rec.fail(kind, benchPenaltyError)
+	return nil, &benchError{kind: kind}
+}
+
+func (c *benchClient) get(path, label string, expected ...int) (*benchResponse, error) {
+	req, err := http.NewRequest(http.MethodGet, c.cfg.target.String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(expected) == 0 {
+		expected = []int{http.StatusOK}
+	}
+	return c.do(req, "GET "+label, benchScoreGet, expected...)
+}
+
+func (c *benchClient) postForm(path, label string, form url.Values, expected ...int) (*benchResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, c.cfg.target.String()+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return c.do(req, "POST "+label, benchScorePost, expected...)
+}
+
+// invalid は検証エラーを記録する
+func (c *benchClient) invalid(kind string) error {
+	c.rec.fail("validation: "+kind, benchPenaltyError)
+	return &benchError{kind: kind}
+}
+
+func (c *benchClient) csrfToken(page string) string {
+	m := benchCSRFRegexp.FindStringSubmatch(page)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+func (c *benchClient) login(account benchAccount) error {
+	if _, err := c.get("/login", "/login"); err != nil {
+		return err
+	}
+
+	res, err := c.postForm("/login", "/login", url.Values{
+		"account_name": {account.AccountName},
+		"password":     {account.Password},
+	}, http.StatusFound)
+	if err != nil {
+		return err
+	}
+	if res.location == "/login/2fa" && account.TOTP != nil {
+		res, err = c.postForm("/login/2fa", "/login/2fa", url.Values{"code": {account.TOTP.next()}}, http.StatusFound)
+		if err != nil {
+			return err
+		}
+	}
+	if res.location != "/" {
+		return c.invalid(fmt.Sprintf("failed to log in as %s", account.AccountName))
+	}
+
+	c.account = &account
+	return nil
+}
+
+func (c *benchClient) register() (benchAccount, error) {
+	account := benchAccount{
+		AccountName: "bench_" + secureRandomStr(6),
+		Password:    secureRandomStr(8),
+	}
+	res, err := c.postForm("/register", "/register", url.Values{
+		"account_name": {account.AccountName},
+		"password":     {account.Password},
+	}, http.StatusFound)
+	if err != nil {
+		return account, err
+	}
+	if res.location != "/" {
+		return account, c.invalid("failed to register " + account.AccountName)
+	}
+	c.account = &account
+	return account, nil
+}
+
+// ensureLogin はまだログインしていなければ初期データのユーザーでログインする
+func (c *benchClient) ensureLogin(rnd *rand.Rand) error {
+	if c.account != nil {
+		return nil
+	}
+	return c.login(c.cfg.accounts[rnd.Intn(len(c.cfg.accounts))])
+}
+
+type benchPost struct {
+	id        int
+	createdAt string
+	account   string
+}
+
+func parseBenchPosts(page string) []benchPost {
+	ids := benchPostIDRegexp.FindAllStringSubmatch(page, -1)
+	accounts := benchPostAccountRegexp.FindAllStringSubmatch(page, -1)
+	posts := make([]benchPost, len(ids))
+	for i, m := range ids {
+		id, _ := strconv.Atoi(m[1])
+		posts[i] = benchPost{id: id, createdAt: html.UnescapeString(m[2])}
+		// 投稿ヘッダーと本文の前に2回アカウント名がある
+		if 2*i < len(accounts) {
+			posts[i].account = accounts[2*i][1]
+		}
+	}
+	return posts
+}
+
+func (c *benchClient) checkBanned(st *benchState, posts []benchPost, label string) error {
+	for _, p := range posts {
+		if st.isBanned(p.account) {
+			return c.invalid(fmt.Sprintf("%s shows a post of banned user %s", label, p.account))
+		}
+	}
+	return nil
+}
+
+func (c *benchClient) fetchImages(page string, n int) {
+	for i, m := range benchImageRegexp.FindAllStringSubmatch(page, -1) {
+		if i >= n {
+			return
+		}
+		c.get(html.UnescapeString(m[1]), "/image/:id", http.StatusOK, http.StatusNotModified)
+	}
+}
+
+func (c *benchClient) scenarioBrowse(rnd *rand.Rand, st *benchState) error {
+	res, err := c.get("/", "/")
+	if err != nil {
+		return err
+	}
+	posts := parseBenchPosts(res.body)
+	if len(posts) == 0 {
+		return c.invalid("/ has no posts")
+	}
+	if len(posts) > postsPerPage {
+		return c.invalid(fmt.Sprintf("/ has %d posts", len(posts)))
+	}
+	if err := c.checkBanned(st, posts, "/"); err != nil {
+		return err
+	}
+	c.fetchImages(res.body, 3)
+	return nil
+}
+
+func (c *benchClient) scenarioScroll(rnd *rand.Rand, st *benchState) error {
+	res, err := c.get("/", "/")
+	if err != nil {
+		return err
+	}
+	posts := parseBenchPosts(res.body)
+	if len(posts) == 0 {
+		return c.invalid("/ has no posts")
+	}
+
+	// 何ページか遡る
+	maxCreatedAt := posts[len(posts)-1].createdAt
+	for page := 0; page < 1+rnd.Intn(3); page++ {
+		res, err := c.get("/posts?max_created_at="+url.QueryEscape(maxCreatedAt), "/posts")
+		if err != nil {
+			return err
+		}
+		posts := parseBenchPosts(res.body)
+		if len(posts) == 0 {
+			return nil
+		}
+
+		max, _ := time.Parse(ISO8601Format, maxCreatedAt)
+		for _, p := range posts {
+			t, err := time.Parse(ISO8601Format, p.createdAt)
+			if err != nil || t.After(max) {
+				return c.invalid("/posts returned a post newer than max_created_at")
+			}
+		}
+		if err := c.checkBanned(st, posts, "/posts"); err != nil {
+			return err
+		}
+		maxCreatedAt = posts[len(posts)-1].createdAt
+	}
+	return nil
+}
+
+func (c *benchClient) scenarioProfile(rnd *rand.Rand, st *benchState) error {
+	res, err := c.get("/", "/")
+	if err != nil {
+		return err
+	}
+	posts := parseBenchPosts(res.body)
+	if len(posts) == 0 {
+		return c.invalid("/ has no posts")
+	}
+
+	account := posts[rnd.Intn(len(posts))].account
+	res, err = c.get("/@"+account, "/@:account_name")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(res.body, `<span class="isu-user-account-name">`+account+`さん</span>`) {
+		return c.invalid("/@" + account + " shows another user")
+	}
+	for _, p := range parseBenchPosts(res.body) {
+		if p.account != account {
+			return c.invalid("/@" + account + " shows a post of " + p.account)
+		}
+	}
+	c.fetchImages(res.body, 3)
+	return nil
+}
+
+func (c *benchClient) scenarioLogin(rnd *rand.Rand, st *benchState) error {
+	// 毎回新しいクッキーでログインし直す
+	fresh := newBenchClient(c.cfg, c.rec)
+	if err := fresh.ensureLogin(rnd); err != nil {
+		return err
+	}
+	res, err := fresh.get("/", "/")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(res.body, `<span class="isu-account-name">`+fresh.account.AccountName+`</span>`) {
+		return fresh.invalid("/ does not show the logged in user")
+	}
+	return nil
+}
+
+func (c *benchClient) scenarioRegister(rnd *rand.Rand, st *benchState) error {
+	fresh := newBenchClient(c.cfg, c.rec)
+	account, err := fresh.register()
+	if err != nil {
+		return err
+	}
+	res, err := fresh.get("/", "/")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(res.body, `<span class="isu-account-name">`+account.AccountName+`</span>`) {
+		return fresh.invalid("/ does not show the registered user")
+	}
+	return nil
+}
+
+// scenarioRateLimit は ISUCONP_RATE_LIMIT=true で動かしているときに、制限がかかることを確かめる。
+// 他のシナリオに影響しないように、ログインではなくパスワード再設定の制限を使う
+func (c *benchClient) scenarioRateLimit(rnd *rand.Rand, st *benchState) error {
+	fresh := newBenchClient(c.cfg, c.rec)
+	form := url.Values{"account_name": {"benchlimit" + secureRandomStr(6)}}
+	for i := 0; i <= rateLimits["password_reset:acc"].Burst; i++ {
+		res, err := fresh.postForm("/password/reset", "/password/reset", form, http.StatusFound, http.StatusTooManyRequests)
+		if err != nil {
+			return err
+		}
+		if res.status == http.StatusTooManyRequests {
+			return nil
+		}
+	}
+	return fresh.invalid("POST /password/reset is not rate limited")
+}
+
+func benchImage(rnd *rand.Rand) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	base := color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{base.R + uint8(x), base.G + uint8(y), base.B, 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+func (c *benchClient) upload(rnd *rand.Rand, body string) (int, error) {
+	res, err := c.get("/", "/")
+	if err != nil {
+		return 0, err
+	}
+	token := c.csrfToken(res.body)
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="bench.png"`)
+	h.Set("Content-Type", "image/png")
+	fw, _ := mw.CreatePart(h)
+	fw.Write(benchImage(rnd))
+	mw.WriteField("body", body)
+	mw.WriteField("csrf_token", token)
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.cfg.target.String()+"/", &buf)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	res, err = c.do(req, "POST /", benchScoreUpload, http.StatusFound)
+	if err != nil {
+		return 0, err
+	}
+
+	m := benchPostLocRegexp.FindStringSubmatch(res.location)
+	if m == nil {
+		return 0, c.invalid("POST / did not redirect to the new post")
+	}
+	pid, _ := strconv.Atoi(m[1])
+	return pid, nil
+}
+
+func (c *benchClient) scenarioUpload(rnd *rand.Rand, st *benchState) error {
+	if err := c.ensureLogin(rnd); err != nil {
+		return err
+	}
+
+	body := "bench " + secureRandomStr(8)
+	pid, err := c.upload(rnd, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.get(fmt.Sprintf("/posts/%d", pid), "/posts/:id")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(res.body, body) {
+		return c.invalid("/posts/:id does not show the uploaded body")
+	}
+	c.fetchImages(res.body, 1)
+	return nil
+}
+
+func (c *benchClient) scenarioComment(rnd *rand.Rand, st *benchState) error {
+	if err := c.ensureLogin(rnd); err != nil {
+		return err
+	}
+
+	res, err := c.get("/", "/")
+	if err != nil {
+		return err
+	}
+	posts := parseBenchPosts(res.body)
+	if len(posts) == 0 {
+		return c.invalid("/ has no posts")
+	}
+	post := posts[rnd.Intn(len(posts))]
+	path := fmt.Sprintf("/posts/%d", post.id)
+
+	res, err = c.get(path, "/posts/:id")
+	if err != nil {
+		return err
+	}
+	m := benchCommentCntRegexp.FindStringSubmatch(res.body)
+	if m == nil {
+		return c.invalid("/posts/:id has no comment count")
+	}
+	before, _ := strconv.Atoi(m[1])
+
+	comment := "bench comment " + secureRandomStr(8)
+	res, err = c.postForm("/comment", "/comment", url.Values{
+		"post_id":    {strconv.Itoa(post.id)},
+		"comment":    {comment},
+		"csrf_token": {c.csrfToken(res.body)},
+	}, http.StatusFound)
+	if err != nil {
+		return err
+	}
+	if res.location != path {
+		return c.invalid("POST /comment did not redirect to the post")
+	}
+
+	res, err = c.get(path, "/posts/:id")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(res.body, comment) {
+		return c.invalid("/posts/:id does not show the new comment")
+	}
+	m = benchCommentCntRegexp.FindStringSubmatch(res.body)
+	if m == nil {
+		return c.invalid("/posts/:id has no comment count")
+	}
+	// 他のワーカーも同時にコメントするので増えていれば良しとする
+	if after, _ := strconv.Atoi(m[1]); after <= before {
+		return c.invalid(fmt.Sprintf("comment count did not increase (%d -> %d)", before, after))
+	}
+	return nil
+}
+
+func (c *benchClient) scenarioBan(rnd *rand.Rand, st *benchState) error {
+	if c.cfg.admin == nil {
+		return nil
+	}
+	if c.account == nil {
+		if err := c.login(*c.cfg.admin); err != nil {
+			return err
+		}
+	}
+
+	// 新しいユーザーに投稿させてから BAN する
+	victim := newBenchClient(c.cfg, c.rec)
+	account, err := victim.register()
+	if err != nil {
+		return err
+	}
+	if _, err := victim.upload(rnd, "to be banned"); err != nil {
+		return err
+	}
+
+	res, err := c.get("/admin/banned", "/admin/banned")
+	if err != nil {
+		return err
+	}
+	uid := ""
+	for _, m := range benchBannedUIDRegexp.FindAllStringSubmatch(res.body, -1) {
+		if m[2] == account.AccountName {
+			uid = m[1]
+		}
+	}
+	if uid == "" {
+		return c.invalid("/admin/banned does not list " + account.AccountName)
+	}
+
+	_, err = c.postForm("/admin/banned", "/admin/banned", url.Values{
+		"uid[]":      {uid},
+		"csrf_token": {c.csrfToken(res.body)},
+	}, http.StatusFound)
+	if err != nil {
+		return err
+	}
+	st.ban(account.AccountName)
+
+	res, err = newBenchClient(c.cfg, c.rec).get("/", "/")
+	if err != nil {
+		return err
+	}
+	return c.checkBanned(st, parseBenchPosts(res.body), "/")
+}
+
+type benchScenario func(c *benchClient, rnd *rand.Rand, st *benchState) error
+
+var benchScenarios = map[string]benchScenario{
+	"browse":    (*benchClient).scenarioBrowse,
+	"scroll":    (*benchClient).scenarioScroll,
+	"profile":   (*benchClient).scenarioProfile,
+	"login":     (*benchClient).scenarioLogin,
+	"ratelimit": (*benchClient).scenarioRateLimit,
+	"register":  (*benchClient).scenarioRegister,
+	"upload":    (*benchClient).scenarioUpload,
+	"comment":   (*benchClient).scenarioComment,
+	"ban":       (*benchClient).scenarioBan,
+}
+
+// ratelimit はアプリ側で制限を有効にしたときだけ -scenarios で指定する
+const defaultBenchScenarios = "browse=10,scroll=5,profile=5,login=2,register=1,upload=2,comment=3,ban=1"
+
+// parseBenchScenarios は "browse=10,comment=3" のような重み付きのシナリオ指定を読む
+func parseBenchScenarios(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, weight := item, 1
+		if i := strings.Index(item, "="); i >= 0 {
+			name = item[:i]
+			w, err := strconv.Atoi(item[i+1:])
+			if err != nil || w < 0 {
+				return nil, fmt.Errorf("invalid weight for scenario %s", name)
+			}
+			weight = w
+		}
+		if _, ok := benchScenarios[name]; !ok {
+			return nil, fmt.Errorf("unknown scenario %s", name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// loadBenchAccounts は "account_name password" が1行ずつ書かれたファイルを読む
+func loadBenchAccounts(path string) ([]benchAccount, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	accounts := []benchAccount{}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid account line: %q", sc.Text())
+		}
+		accounts = append(accounts, benchAccount{AccountName: fields[0], Password: fields[1]})
+	}
+	return accounts, sc.Err()
+}
+
+// loadSeededBenchAccounts は初期データのユーザーを DB から読む。パスワードは account_name を2回繰り返したもの
+func loadSeededBenchAccounts() ([]benchAccount, error) {
+	conn, _, err := openDB(primaryDSN())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	names := []string{}
+	err = conn.Select(&names, "SELECT `account_name` FROM `users` WHERE `id` <= ? AND `del_flg` = 0 ORDER BY `id`", seedMaxUserID)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no seeded users found")
+	}
+	accounts := make([]benchAccount, len(names))
+	for i, name := range names {
+		accounts[i] = benchAccount{AccountName: name, Password: name + name}
+	}
+	return accounts, nil
+}
+
+// prepareBenchAdmin は BAN のシナリオで使う管理者を二段階認証でログインできるようにする。
+// /initialize で初期データのユーザーの二段階認証は外れるので、secret がなければここで設定する
+func prepareBenchAdmin(cfg *benchConfig, secret string) error {
+	c := newBenchClient(cfg, newBenchRecorder())
+	if secret != "" {
+		totp, err := newBenchTOTP(secret)
+		if err != nil {
+			return err
+		}
+		cfg.admin.TOTP = totp
+		return c.login(*cfg.admin)
+	}
+
+	if err := c.login(*cfg.admin); err != nil {
+		return fmt.Errorf("%w (pass -admin-totp-secret if the admin already has 2FA)", err)
+	}
+	res, err := c.get("/2fa", "/2fa")
+	if err != nil {
+		return err
+	}
+	m := benchTOTPSecretRegexp.FindStringSubmatch(res.body)
+	if m == nil {
+		return fmt.Errorf("/2fa does not show a TOTP secret for %s", cfg.admin.AccountName)
+	}
+	totp, err := newBenchTOTP(m[1])
+	if err != nil {
+		return err
+	}
+	_, err = c.postForm("/2fa/enable", "/2fa/enable", url.Values{
+		"code":       {totp.next()},
+		"csrf_token": {c.csrfToken(res.body)},
+	}, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	cfg.admin.TOTP = totp
+	return nil
+}
+
+func benchInitialize(cfg *benchConfig) error {
+	req, err := http.NewRequest(http.MethodGet, cfg.target.String()+"/initialize", nil)
+	if err != nil {
+		return err
+	}
+	if cfg.initializeToken != "" {
+		req.Header.Set("X-Initialize-Token", cfg.initializeToken)
+	}
+
+	// 初期化は重いので長めに待つ
+	client := &http.Client{Timeout: 30 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /initialize returned %d", res.StatusCode)
+	}
+	return nil
+}
+
+func runBenchWorker(ctx context.Context, cfg *benchConfig, rec *benchRecorder, st *benchState, seed int64) {
+	rnd := rand.New(rand.NewSource(seed))
+
+	names := make([]string, 0, len(cfg.scenarios))
+	total := 0
+	for name, weight := range cfg.scenarios {
+		if weight > 0 {
+			names = append(names, name)
+			total += weight
+		}
+	}
+	sort.Strings(names)
+	if total == 0 {
+		return
+	}
+
+	clients := map[string]*benchClient{}
+	for ctx.Err() == nil {
+		n := rnd.Intn(total)
+		name := names[0]
+		for _, candidate := range names {
+			if n < cfg.scenarios[candidate] {
+				name = candidate
+				break
+			}
+			n -= cfg.scenarios[candidate]
+		}
+
+		// シナリオごとに別のユーザーとして振る舞う
+		c, ok := clients[name]
+		if !ok {
+			c = newBenchClient(cfg, rec)
+			clients[name] = c
+		}
+		benchScenarios[name](c, rnd, st)
+	}
+}
+
+// runBench は `app bench` を実行する
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("target", "http://localhost", "base URL of the application")
+	duration := fs.Duration("duration", 60*time.Second, "how long to run the load")
+	concurrency := fs.Int("concurrency", 4, "number of concurrent workers")
+	timeout := fs.Duration("timeout", 10*time.Second, "timeout for each request")
+	scenarios := fs.String("scenarios", defaultBenchScenarios, "weighted scenarios to run")
+	accountsFile := fs.String("accounts", "", `file of "account_name password" lines for seeded users (read from the DB if empty)`)
+	admin := fs.String("admin", "", "admin account as account_name:password (ban scenario is skipped if empty)")
+	adminTOTPSecret := fs.String("admin-totp-secret", "", "TOTP secret of the admin if 2FA is already enabled (enabled by the bench if empty)")
+	initializeToken := fs.String("initialize-token", os.Getenv("ISUCONP_INITIALIZE_TOKEN"), "token for /initialize")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "random seed")
+	fs.Parse(args)
+
+	u, err := url.Parse(*target)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	weights, err := parseBenchScenarios(*scenarios)
+	if err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	cfg := &benchConfig{
+		target:          u,
+		duration:        *duration,
+		concurrency:     *concurrency,
+		timeout:         *timeout,
+		initializeToken: *initializeToken,
+		scenarios:       weights,
+	}
+	if *accountsFile != "" {
+		cfg.accounts, err = loadBenchAccounts(*accountsFile)
+		if err != nil {
+			log.Print(err)
+			return 2
+		}
+	}
+	if *admin != "" {
+		i := strings.Index(*admin, ":")
+		if i < 0 {
+			log.Print("-admin must be account_name:password")
+			return 2
+		}
+		cfg.admin = &benchAccount{AccountName: (*admin)[:i], Password: (*admin)[i+1:]}
+	}
+
+	if err := benchInitialize(cfg); err != nil {
+		log.Printf("failed to initialize: %s", err)
+		return 1
+	}
+	// /initialize の後なら初期データのユーザーは元のパスワードに戻っている
+	if len(cfg.accounts) == 0 {
+		cfg.accounts, err = loadSeededBenchAccounts()
+		if err != nil {
+			log.Printf("failed to load seeded users (use -accounts): %s", err)
+			return 1
+		}
+	}
+	// 管理画面は二段階認証を有効にした管理者しか使えない
+	if cfg.admin != nil {
+		if err := prepareBenchAdmin(cfg, *adminTOTPSecret); err != nil {
+			log.Printf("failed to prepare the admin: %s", err)
+			return 1
+		}
+	}
+
+	rec := newBenchRecorder()
+	st := &benchState{banned: map[string]bool{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			runBenchWorker(ctx, cfg, rec, st, *seed+int64(i))
+		}(i)
+	}
+	wg.Wait()
+
+	rec.report(os.Stdout, time.Since(start))
+	return 0
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var templateBlocks = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("blocks.html"),
+))
+
+// loadRelations はブロック (どちら向きでも) とミュートの相手をまとめて引く。
+// 投稿やコメントごとに引かないよう、リクエストの中で一度だけ読む
+func (v *postViewer) loadRelations(q sqlx.Queryer) error {
+	if v.blocked != nil {
+		return nil
+	}
+	blocked := []int{}
+	muted := []int{}
+	if isLogin(v.User) {
+		err := sqlx.Select(q, &blocked, "SELECT `blocked_id` FROM `blocks` WHERE `blocker_id` = ? UNION SELECT `blocker_id` FROM `blocks` WHERE `blocked_id` = ?", v.User.ID, v.User.ID)
+		if err != nil {
+			return err
+		}
+		err = sqlx.Select(q, &muted, "SELECT `muted_id` FROM `mutes` WHERE `muter_id` = ?", v.User.ID)
+		if err != nil {
+			return err
+		}
+	}
+	v.blocked = make(map[int]bool, len(blocked))
+	for _, id := range blocked {
+		v.blocked[id] = true
+	}
+	v.muted = make(map[int]bool, len(muted))
+	for _, id := range muted {
+		v.muted[id] = true
+	}
+	return nil
+}
+
+// blocking は viewer と userID のどちらかがもう一方をブロックしているかを返す
+func (v *postViewer) blocking(q sqlx.Queryer, userID int) (bool, error) {
+	if err := v.loadRelations(q); err != nil {
+		return false, err
+	}
+	return v.blocked[userID], nil
+}
+
+// timelineHidden はタイムラインから外すユーザー。ブロックとミュートの相手を合わせて小さい順に返す
+func (v *postViewer) timelineHidden(q sqlx.Queryer) ([]int, error) {
+	if err := v.loadRelations(q); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(v.blocked)+len(v.muted))
+	for id := range v.blocked {
+		ids = append(ids, id)
+	}
+	for id := range v.muted {
+		if !v.blocked[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// blockedUsers はコメントを出さないユーザー。ブロックの相手を小さい順に返す
+func (v *postViewer) blockedUsers(q sqlx.Queryer) ([]int, error) {
+	if err := v.loadRelations(q); err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(v.blocked))
+	for id := range v.blocked {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// relationTarget はブロックやミュートの操作を受けたときに、ログインと CSRF を確かめて相手を引く
+func relationTarget(w http.ResponseWriter, r *http.Request) (User, User, bool) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return User{}, User{}, false
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return User{}, User{}, false
+	}
+
+	target := User{}
+	err := db.Get(&target, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.FormValue("account_name"))
+	if err != nil || target.ID == me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return User{}, User{}, false
+	}
+	return me, target, true
+}
+
+// postBlock は相手をブロックする。お互いのフォローも外す
+func postBlock(w http.ResponseWriter, r *http.Request) {
+	me, target, ok := relationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT IGNORE INTO `blocks` (`blocker_id`, `blocked_id`, `created_at`) VALUES (?,?,?)", me.ID, target.ID, time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = tx.Exec(
+		"DELETE FROM `follows` WHERE (`follower_id` = ? AND `followee_id` = ?) OR (`follower_id` = ? AND `followee_id` = ?)",
+		me.ID, target.ID, target.ID, me.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, "/@"+target.AccountName, http.StatusFound)
+}
+
+func postUnblock(w http.ResponseWriter, r *http.Request) {
+	me, target, ok := relationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM `blocks` WHERE `blocker_id` = ? AND `blocked_id` = ?", me.ID, target.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, redirectBack(r, "/@"+target.AccountName), http.StatusFound)
+}
+
+func postMute(w http.ResponseWriter, r *http.Request) {
+	me, target, ok := relationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("INSERT IGNORE INTO `mutes` (`muter_id`, `muted_id`, `created_at`) VALUES (?,?,?)", me.ID, target.ID, time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, "/@"+target.AccountName, http.StatusFound)
+}
+
+func postUnmute(w http.ResponseWriter, r *http.Request) {
+	me, target, ok := relationTarget(w, r)
+	if !ok {
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM `mutes` WHERE `muter_id` = ? AND `muted_id` = ?", me.ID, target.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, redirectBack(r, "/@"+target.AccountName), http.StatusFound)
+}
+
+// redirectBack は一覧の画面から解除したときに一覧へ戻す。それ以外は相手のページへ戻す
+func redirectBack(r *http.Request, fallback string) string {
+	if r.FormValue("return_to") == "/blocks" {
+		return "/blocks"
+	}
+	return fallback
+}
+
+// relationUsers は me がブロックかミュートしている相手を新しい順に返す
+func relationUsers(query string, userID int) ([]User, error) {
+	ids := []int{}
+	err := db.Select(&ids, query, userID)
+	if err != nil || len(ids) == 0 {
+		return []User{}, err
+	}
+	userMap, err := getUsers(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if u := userMap[id]; u != nil && u.DelFlg == 0 {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+
+func getBlocks(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	blocked, err := relationUsers("SELECT `blocked_id` FROM `blocks` WHERE `blocker_id` = ? ORDER BY `created_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	muted, err := relationUsers("SELECT `muted_id` FROM `mutes` WHERE `muter_id` = ? ORDER BY `created_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateBlocks.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Blocked   []User
+		Muted     []User
+	}{me, getCSRFToken(r), blocked, muted})
+}
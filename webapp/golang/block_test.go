@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestMute(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	carol := app.addUser("carol", 0, 0)
+	dave := app.addUser("dave", 0, 0)
+	app.addPost(dave, "dave post", []byte("png"))
+	// ミュートした相手の投稿でページが埋まっても、その先の投稿が出るか
+	var muted int
+	for i := 0; i < postsPerPage+1; i++ {
+		muted = app.addPost(carol, "carol post", []byte("png"))
+	}
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+	assertRedirect(t, c.postForm("/mute", url.Values{"account_name": {"carol"}, "csrf_token": {token}}), "/@carol")
+
+	res := c.get("/")
+	if strings.Contains(res.Body, "carol post") || !strings.Contains(res.Body, "dave post") {
+		t.Error("muted user's posts are shown on the timeline")
+	}
+	if !strings.Contains(app.newClient().get("/").Body, "carol post") {
+		t.Error("mute affects other users")
+	}
+	// タイムライン以外ではミュートしても見える
+	if !strings.Contains(c.get("/@carol").Body, "carol post") {
+		t.Error("muted user's page is hidden")
+	}
+	assertStatus(t, c.get(fmt.Sprintf("/posts/%d", muted)), http.StatusOK)
+
+	if !strings.Contains(c.get("/blocks").Body, `<div class="isu-muted-user" data-user-id="`+fmt.Sprint(carol)+`">`) {
+		t.Error("muted user is not listed")
+	}
+	assertRedirect(t, c.postForm("/unmute", url.Values{"account_name": {"carol"}, "return_to": {"/blocks"}, "csrf_token": {token}}), "/blocks")
+	if !strings.Contains(c.get("/").Body, "carol post") {
+		t.Error("unmuted user's posts are not shown")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	carol := app.addUser("carol", 0, 0)
+	maryPost := app.addPost(mary, "mary post", []byte("png"))
+	bobPost := app.addPost(bob, "bob post", []byte("png"))
+	carolPost := app.addPost(carol, "carol post", []byte("png"))
+	app.addComment(carolPost, bob, "bob comment")
+	app.addComment(carolPost, carol, "carol comment")
+
+	m := app.newClient()
+	m.login("mary")
+	b := app.newClient()
+	b.login("bob")
+	assertRedirect(t, b.postForm("/follow", url.Values{"account_name": {"mary"}, "csrf_token": {b.csrfToken()}}), "/@mary")
+
+	assertStatus(t, m.postForm("/block", url.Values{"account_name": {"bob"}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	assertStatus(t, m.postForm("/block", url.Values{"account_name": {"mary"}, "csrf_token": {m.csrfToken()}}), http.StatusNotFound)
+	assertRedirect(t, m.postForm("/block", url.Values{"account_name": {"bob"}, "csrf_token": {m.csrfToken()}}), "/@bob")
+	if n := app.count("follows"); n != 0 {
+		t.Errorf("follows = %d, want 0", n)
+	}
+
+	// ブロックはどちらから見ても効く
+	for name, c := range map[string]*testClient{"blocker": m, "blocked": b} {
+		other, otherPost := "bob post", bobPost
+		if name == "blocked" {
+			other, otherPost = "mary post", maryPost
+		}
+		for _, path := range []string{"/", "/posts?max_created_at=" + url.QueryEscape("2100-01-01T00:00:00+09:00")} {
+			if strings.Contains(c.get(path).Body, other) {
+				t.Errorf("%s: %s shows %q", name, path, other)
+			}
+		}
+		assertStatus(t, c.get(fmt.Sprintf("/posts/%d", otherPost)), http.StatusNotFound)
+		assertStatus(t, c.postForm("/comment", url.Values{"post_id": {fmt.Sprint(otherPost)}, "comment": {"hi"}, "csrf_token": {c.csrfToken()}}), http.StatusNotFound)
+	}
+
+	res := m.get("/@bob")
+	if strings.Contains(res.Body, "bob post") || !strings.Contains(res.Body, "このユーザーの投稿は表示できません") || !strings.Contains(res.Body, "ブロックを解除") {
+		t.Error("blocked user's page is not hidden")
+	}
+	res = b.get("/@mary")
+	if strings.Contains(res.Body, "mary post") || strings.Contains(res.Body, "ブロックを解除") {
+		t.Error("blocker's page is not hidden from the blocked user")
+	}
+	assertStatus(t, b.postForm("/follow", url.Values{"account_name": {"mary"}, "csrf_token": {b.csrfToken()}}), http.StatusNotFound)
+
+	// 第三者の投稿でも、ブロックの相手のコメントは出さない
+	res = m.get(fmt.Sprintf("/posts/%d", carolPost))
+	if strings.Contains(res.Body, "bob comment") || !strings.Contains(res.Body, "carol comment") {
+		t.Error("blocked user's comment is shown")
+	}
+	if !strings.Contains(app.newClient().get(fmt.Sprintf("/posts/%d", carolPost)).Body, "bob comment") {
+		t.Error("block affects other users")
+	}
+	// 新しい 3 件がブロックの相手のものでも、タイムラインのコメントは空にならない
+	for i := 0; i < 3; i++ {
+		app.addComment(carolPost, bob, "bob comment")
+	}
+	res = m.get("/")
+	if strings.Contains(res.Body, "bob comment") || !strings.Contains(res.Body, "carol comment") {
+		t.Error("blocked user's comments fill the timeline preview")
+	}
+
+	// ブロックされた側からは解除できない
+	assertRedirect(t, b.postForm("/unblock", url.Values{"account_name": {"mary"}, "csrf_token": {b.csrfToken()}}), "/@mary")
+	assertStatus(t, b.get(fmt.Sprintf("/posts/%d", maryPost)), http.StatusNotFound)
+
+	assertRedirect(t, m.postForm("/unblock", url.Values{"account_name": {"bob"}, "csrf_token": {m.csrfToken()}}), "/@bob")
+	assertStatus(t, b.get(fmt.Sprintf("/posts/%d", maryPost)), http.StatusOK)
+	if !strings.Contains(m.get(fmt.Sprintf("/posts/%d", carolPost)).Body, "bob comment") {
+		t.Error("comment is hidden after unblocking")
+	}
+}
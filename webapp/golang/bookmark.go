@@ -0,0 +1,456 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	bookmarkCollectionNameMaxLength = 64
+	maxBookmarkCollectionsPerUser   = 50
+)
+
+var (
+	templateBookmarks = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("bookmarks.html"),
+		getTemplPath("bookmark_posts.html"),
+		getTemplPath("post.html"),
+	))
+	templateBookmarkPosts = template.Must(template.New("bookmark_posts.html").Funcs(fmap).ParseFiles(
+		getTemplPath("bookmark_posts.html"),
+		getTemplPath("post.html"),
+	))
+)
+
+type BookmarkCollection struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// bookmarkRow はブックマークした投稿と、入っているコレクション。
+// コレクションはフォルダーのようなもので、ひとつのブックマークが入れるのはひとつのコレクションだけ
+type bookmarkRow struct {
+	Post
+	CollectionID int `db:"collection_id"`
+}
+
+// bookmarkedPosts はブックマークの一覧を描くのに使う。CollectionIDs は投稿ごとに入っているコレクション
+type bookmarkedPosts struct {
+	Posts         []Post
+	CollectionIDs map[int]int
+	Collections   []BookmarkCollection
+	ReturnTo      string
+	CSRFToken     string
+}
+
+// getBookmarkedIDs は postIDs のうち me がブックマークしている投稿
+func getBookmarkedIDs(q sqlx.Queryer, me User, postIDs []int) (map[int]bool, error) {
+	bookmarked := map[int]bool{}
+	if !isLogin(me) || len(postIDs) == 0 {
+		return bookmarked, nil
+	}
+	ids := []int{}
+	err := sqlx.Select(q, &ids, fmt.Sprintf("SELECT `post_id` FROM `bookmarks` WHERE `user_id` = ? AND `post_id` IN (%s)", joinIDs(postIDs)), me.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		bookmarked[id] = true
+	}
+	return bookmarked, nil
+}
+
+func getBookmarkCollections(q sqlx.Queryer, userID int) ([]BookmarkCollection, error) {
+	collections := []BookmarkCollection{}
+	err := sqlx.Select(q, &collections, "SELECT * FROM `bookmark_collections` WHERE `user_id` = ? ORDER BY `name`", userID)
+	return collections, err
+}
+
+// getBookmarkPosts は viewer がブックマークした投稿を getTimelinePosts と同じく投稿の新しい順に返す。
+// 投稿者が退会や BAN されたもの、ブロックの相手のもの、ブックマークしたあとに公開範囲が狭まって見えなくなったものは
+// ページが欠けないよう SQL の段階で外す
+func getBookmarkPosts(q sqlx.Queryer, viewer *postViewer, collectionID int, maxCreatedAt string) ([]bookmarkRow, error) {
+	if err := viewer.loadRelations(q); err != nil {
+		return nil, err
+	}
+	if err := viewer.loadFollowees(q); err != nil {
+		return nil, err
+	}
+	// canView と同じく、自分の投稿・公開アカウントの公開投稿・フォロー先の only_me 以外の投稿だけを見せる
+	visible := "p.`user_id` = ? OR (p.`visibility` = 'public' AND u.`is_private` = 0)"
+	if len(viewer.followees) > 0 {
+		followees := make([]int, 0, len(viewer.followees))
+		for id := range viewer.followees {
+			followees = append(followees, id)
+		}
+		sort.Ints(followees)
+		visible += fmt.Sprintf(" OR (p.`user_id` IN (%s) AND p.`visibility` <> 'only_me')", joinIDs(followees))
+	}
+	where := ""
+	args := []interface{}{viewer.User.ID, viewer.User.ID}
+	if len(viewer.blocked) > 0 {
+		blocked := make([]int, 0, len(viewer.blocked))
+		for id := range viewer.blocked {
+			blocked = append(blocked, id)
+		}
+		where += fmt.Sprintf(" AND p.`user_id` NOT IN (%s)", joinIDs(blocked))
+	}
+	if collectionID != 0 {
+		where += " AND b.`collection_id` = ?"
+		args = append(args, collectionID)
+	}
+	if maxCreatedAt != "" {
+		where += " AND p.`created_at` <= ?"
+		args = append(args, maxCreatedAt)
+	}
+
+	rows := []bookmarkRow{}
+	err := sqlx.Select(q, &rows, fmt.Sprintf(
+		"SELECT %s, b.`collection_id` FROM `bookmarks` AS b JOIN `posts` AS p ON p.`id` = b.`post_id` JOIN `users` AS u ON u.`id` = p.`user_id` AND u.`del_flg` = 0 WHERE b.`user_id` = ? AND p.`status` = 'published' AND (%s)%s ORDER BY p.`created_at` DESC LIMIT %d",
+		timelineColumns, visible, where, postsPerPage,
+	), args...)
+	return rows, err
+}
+
+// loadBookmarkedPosts は /bookmarks と /bookmarks/posts で見せる投稿を引く。
+// collection が他人のものや存在しないときは ok が false
+func loadBookmarkedPosts(r *http.Request, me User, maxCreatedAt string) (bookmarkedPosts, BookmarkCollection, bool, error) {
+	rdb := readDB(r)
+	bp := bookmarkedPosts{ReturnTo: "/bookmarks", CSRFToken: getCSRFToken(r)}
+	collections, err := getBookmarkCollections(rdb, me.ID)
+	if err != nil {
+		return bp, BookmarkCollection{}, false, err
+	}
+	bp.Collections = collections
+
+	current := BookmarkCollection{}
+	if v := r.URL.Query().Get("collection"); v != "" {
+		id, _ := strconv.Atoi(v)
+		for _, c := range collections {
+			if c.ID == id {
+				current = c
+			}
+		}
+		if current.ID == 0 {
+			return bp, current, false, nil
+		}
+		bp.ReturnTo = "/bookmarks?collection=" + strconv.Itoa(current.ID)
+	}
+
+	viewer := newPostViewer(me)
+	rows, err := getBookmarkPosts(rdb, viewer, current.ID, maxCreatedAt)
+	if err != nil {
+		return bp, current, false, err
+	}
+	results := make([]Post, len(rows))
+	bp.CollectionIDs = make(map[int]int, len(rows))
+	for i, row := range rows {
+		results[i] = row.Post
+		bp.CollectionIDs[row.ID] = row.CollectionID
+	}
+	bp.Posts, err = makePosts(rdb, results, viewer, bp.CSRFToken, false)
+	return bp, current, true, err
+}
+
+func getBookmarks(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	bp, current, ok, err := loadBookmarkedPosts(r, me, "")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// もっと見るで続きを引くパス
+	morePath := "/bookmarks/posts"
+	if current.ID != 0 {
+		morePath += "?collection=" + strconv.Itoa(current.ID)
+	}
+
+	templateBookmarks.Execute(w, struct {
+		Bookmarks  bookmarkedPosts
+		Collection BookmarkCollection
+		MorePath   string
+		Me         User
+		CSRFToken  string
+		Flash      string
+	}{bp, current, morePath, me, bp.CSRFToken, getFlash(w, r, "notice")})
+}
+
+// getBookmarkPostsPage は getPosts と同じく max_created_at より前のブックマークを返す
+func getBookmarkPostsPage(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	maxCreatedAt := r.URL.Query().Get("max_created_at")
+	if maxCreatedAt == "" {
+		return
+	}
+	t, err := time.Parse(ISO8601Format, maxCreatedAt)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	bp, _, ok, err := loadBookmarkedPosts(r, me, t.Format(ISO8601Format))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if !ok || len(bp.Posts) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	templateBookmarkPosts.Execute(w, bp)
+}
+
+// bookmarkReturnTo はブックマークの一覧から操作したときは一覧の同じコレクションへ戻す
+func bookmarkReturnTo(r *http.Request, fallback string) string {
+	if v := r.FormValue("return_to"); v == "/bookmarks" || strings.HasPrefix(v, "/bookmarks?collection=") {
+		return v
+	}
+	return fallback
+}
+
+// postBookmark は投稿のブックマークを付け外しする。付けられるのは見えている投稿だけ
+func postBookmark(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	back := bookmarkReturnTo(r, "/posts/"+strconv.Itoa(postID))
+
+	// 見えなくなった投稿のブックマークも外せるよう、先に外してみる
+	result, err := db.Exec("DELETE FROM `bookmarks` WHERE `user_id` = ? AND `post_id` = ?", me.ID, postID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		pinPrimary(w, r)
+		http.Redirect(w, r, back, http.StatusFound)
+		return
+	}
+
+	post := Post{}
+	err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", postID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+	visible := false
+	if err == nil {
+		owner, err := getUser(db, post.UserID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible, err = newPostViewer(me).canViewPost(db, owner, post.Visibility, post.Status)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible = visible && owner.DelFlg == 0
+	}
+	if !visible {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO `bookmarks` (`user_id`, `post_id`, `created_at`) VALUES (?,?,?)", me.ID, postID, time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, back, http.StatusFound)
+}
+
+// postBookmarkCollection はブックマークを入れるコレクションを変える。collection_id が 0 ならどこにも入れない
+func postBookmarkCollection(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	postID, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	collectionID, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if collectionID != 0 {
+		count := 0
+		err = db.Get(&count, "SELECT COUNT(*) FROM `bookmark_collections` WHERE `id` = ? AND `user_id` = ?", collectionID, me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if count == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+
+	// ブックマークがなければ何も変わらない
+	_, err = db.Exec("UPDATE `bookmarks` SET `collection_id` = ? WHERE `user_id` = ? AND `post_id` = ?", collectionID, me.ID, postID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, bookmarkReturnTo(r, "/bookmarks"), http.StatusFound)
+}
+
+func postBookmarkCollectionsCreate(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	fail := func(notice string) {
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/bookmarks", http.StatusFound)
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > bookmarkCollectionNameMaxLength {
+		fail("コレクションの名前は1文字以上64文字以下にしてください")
+		return
+	}
+
+	count := 0
+	err := db.Get(&count, "SELECT COUNT(*) FROM `bookmark_collections` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if count >= maxBookmarkCollectionsPerUser {
+		fail("これ以上コレクションを作れません")
+		return
+	}
+
+	result, err := db.Exec("INSERT IGNORE INTO `bookmark_collections` (`user_id`, `name`, `created_at`) VALUES (?,?,?)", me.ID, name, time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+	if n, _ := result.RowsAffected(); n == 0 {
+		fail("同じ名前のコレクションがあります")
+		return
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	http.Redirect(w, r, "/bookmarks?collection="+strconv.FormatInt(id, 10), http.StatusFound)
+}
+
+// postBookmarkCollectionsDelete はコレクションを消す。中のブックマークは消さずにどこにも入っていない状態に戻す
+func postBookmarkCollectionsDelete(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	collectionID, err := strconv.Atoi(r.FormValue("collection_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM `bookmark_collections` WHERE `id` = ? AND `user_id` = ?", collectionID, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, err = tx.Exec("UPDATE `bookmarks` SET `collection_id` = 0 WHERE `user_id` = ? AND `collection_id` = ?", me.ID, collectionID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, "/bookmarks", http.StatusFound)
+}
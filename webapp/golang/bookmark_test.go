@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (c *testClient) toggleBookmark(postID int) *testResponse {
+	c.t.Helper()
+	return c.postForm("/bookmark", url.Values{"post_id": {fmt.Sprint(postID)}, "csrf_token": {c.csrfToken()}})
+}
+
+func TestBookmark(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	first := app.addPost(mary, "first post", []byte("png"))
+	second := app.addPost(mary, "second post", []byte("png"))
+	app.fake.findOne("posts", "id", int64(second))["visibility"] = visibilityOnlyMe
+
+	c := app.newClient()
+	assertRedirect(t, c.get("/bookmarks"), "/login")
+	c.login("bob")
+
+	assertRedirect(t, c.toggleBookmark(first), fmt.Sprintf("/posts/%d", first))
+	// 見えない投稿はブックマークできない
+	assertStatus(t, c.toggleBookmark(second), http.StatusNotFound)
+	assertStatus(t, c.toggleBookmark(99), http.StatusNotFound)
+	assertStatus(t, c.postForm("/bookmark", url.Values{"post_id": {fmt.Sprint(first)}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	if n := app.count("bookmarks"); n != 1 {
+		t.Fatalf("bookmarks = %d, want 1", n)
+	}
+
+	if !strings.Contains(c.get("/").Body, `<button type="submit" class="isu-bookmarked">保存済み</button>`) {
+		t.Error("timeline does not show the bookmark")
+	}
+	body := c.get("/bookmarks").Body
+	if !strings.Contains(body, "first post") || !strings.Contains(body, fmt.Sprintf(`id="bookmark_%d"`, first)) {
+		t.Error("bookmark is not listed")
+	}
+	// ブックマークは本人にしか見えない
+	m := app.newClient()
+	m.login("mary")
+	if strings.Contains(m.get("/bookmarks").Body, "first post") {
+		t.Error("other user's bookmarks are listed")
+	}
+
+	// 投稿者が BAN されたら一覧から外す
+	app.fake.findOne("users", "id", int64(mary))["del_flg"] = int64(1)
+	if strings.Contains(c.get("/bookmarks").Body, "first post") {
+		t.Error("bookmark of a banned user's post is listed")
+	}
+	app.fake.findOne("users", "id", int64(mary))["del_flg"] = int64(0)
+
+	res := c.postForm("/bookmark", url.Values{"post_id": {fmt.Sprint(first)}, "return_to": {"/bookmarks"}, "csrf_token": {c.csrfToken()}})
+	assertRedirect(t, res, "/bookmarks")
+	if n := app.count("bookmarks"); n != 0 {
+		t.Errorf("bookmarks = %d, want 0", n)
+	}
+}
+
+func TestBookmarkCollections(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	app.addUser("carol", 0, 0)
+	first := app.addPost(mary, "first post", []byte("png"))
+	second := app.addPost(mary, "second post", []byte("png"))
+
+	c := app.newClient()
+	c.login("bob")
+	token := c.csrfToken()
+	assertRedirect(t, c.toggleBookmark(first), fmt.Sprintf("/posts/%d", first))
+	assertRedirect(t, c.toggleBookmark(second), fmt.Sprintf("/posts/%d", second))
+
+	create := func(name string) *testResponse {
+		return c.postForm("/bookmarks/collections", url.Values{"name": {name}, "csrf_token": {token}})
+	}
+	assertRedirect(t, create("旅行"), "/bookmarks?collection=1")
+	for name, notice := range map[string]string{
+		"旅行":                    "同じ名前のコレクションがあります",
+		" ":                     "コレクションの名前は1文字以上64文字以下にしてください",
+		strings.Repeat("a", 65): "コレクションの名前は1文字以上64文字以下にしてください",
+	} {
+		assertRedirect(t, create(name), "/bookmarks")
+		if !strings.Contains(c.get("/bookmarks").Body, notice) {
+			t.Errorf("flash %q not shown for %q", notice, name)
+		}
+	}
+
+	move := func(postID, collectionID int) *testResponse {
+		return c.postForm("/bookmarks/collection", url.Values{
+			"post_id":       {fmt.Sprint(postID)},
+			"collection_id": {fmt.Sprint(collectionID)},
+			"return_to":     {"/bookmarks?collection=1"},
+			"csrf_token":    {token},
+		})
+	}
+	assertRedirect(t, move(first, 1), "/bookmarks?collection=1")
+	assertStatus(t, move(first, 99), http.StatusNotFound)
+
+	body := c.get("/bookmarks?collection=1").Body
+	if !strings.Contains(body, "first post") || strings.Contains(body, "second post") {
+		t.Error("collection does not list only its bookmarks")
+	}
+	if !strings.Contains(body, `<option value="1" selected>旅行</option>`) {
+		t.Error("collection is not selected")
+	}
+
+	// コレクションは作った本人にしか見えない
+	o := app.newClient()
+	o.login("carol")
+	assertStatus(t, o.get("/bookmarks?collection=1"), http.StatusNotFound)
+	assertStatus(t, o.postForm("/bookmarks/collections/delete", url.Values{"collection_id": {"1"}, "csrf_token": {o.csrfToken()}}), http.StatusNotFound)
+
+	// 削除してもブックマークは残る
+	assertRedirect(t, c.postForm("/bookmarks/collections/delete", url.Values{"collection_id": {"1"}, "csrf_token": {token}}), "/bookmarks")
+	if n := app.count("bookmark_collections"); n != 0 {
+		t.Errorf("bookmark_collections = %d, want 0", n)
+	}
+	if row := app.fake.findOne("bookmarks", "post_id", int64(first)); row == nil || fakeInt(row["collection_id"]) != 0 {
+		t.Errorf("bookmark = %v", row)
+	}
+	assertStatus(t, c.get("/bookmarks?collection=1"), http.StatusNotFound)
+}
+
+func TestBookmarkPosts(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	ids := []int{}
+	for i := 0; i < postsPerPage+5; i++ {
+		ids = append(ids, app.addPost(mary, fmt.Sprintf("post%03d", i), nil))
+	}
+	c := app.newClient()
+	c.login("bob")
+	for _, id := range ids {
+		assertRedirect(t, c.toggleBookmark(id), fmt.Sprintf("/posts/%d", id))
+	}
+
+	body := c.get("/bookmarks").Body
+	if n := strings.Count(body, `class="isu-bookmark"`); n != postsPerPage {
+		t.Errorf("bookmarks = %d, want %d", n, postsPerPage)
+	}
+	if !strings.Contains(body, `<div id="isu-post-more" data-path="/bookmarks/posts">`) {
+		t.Error("more button does not point to /bookmarks/posts")
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		posts  int
+	}{
+		{"no max_created_at", "", http.StatusOK, 0},
+		{"invalid max_created_at", "?max_created_at=yesterday", http.StatusOK, 0},
+		{"future", "?max_created_at=" + url.QueryEscape(app.fake.now.Add(time.Hour).Format(ISO8601Format)), http.StatusOK, postsPerPage},
+		{"past", "?max_created_at=" + url.QueryEscape(app.fake.now.Add(-20*time.Second).Format(ISO8601Format)), http.StatusOK, 5},
+		{"before everything", "?max_created_at=" + url.QueryEscape("2000-01-01T00:00:00+09:00"), http.StatusNotFound, 0},
+		{"other collection", "?collection=1&max_created_at=" + url.QueryEscape(app.fake.now.Format(ISO8601Format)), http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := c.get("/bookmarks/posts" + tt.query)
+			assertStatus(t, res, tt.status)
+			if n := strings.Count(res.Body, `class="isu-bookmark"`); n != tt.posts {
+				t.Errorf("bookmarks = %d, want %d", n, tt.posts)
+			}
+		})
+	}
+	assertStatus(t, app.newClient().get("/bookmarks/posts"), http.StatusUnauthorized)
+}
+
+func TestBookmarkPostsHideInvisible(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	ids := []int{}
+	for i := 0; i < postsPerPage+15; i++ {
+		ids = append(ids, app.addPost(mary, fmt.Sprintf("post%03d", i), nil))
+	}
+	c := app.newClient()
+	c.login("bob")
+	for _, id := range ids {
+		assertRedirect(t, c.toggleBookmark(id), fmt.Sprintf("/posts/%d", id))
+	}
+
+	// ブックマークしたあとで新しい 10 件を自分だけに、その前の 1 件をフォロワー限定にする
+	newest := ids[len(ids)-10:]
+	for _, id := range newest {
+		app.fake.findOne("posts", "id", int64(id))["visibility"] = visibilityOnlyMe
+	}
+	followers := ids[len(ids)-11]
+	app.fake.findOne("posts", "id", int64(followers))["visibility"] = visibilityFollowers
+
+	// 見えない投稿を外してもページは埋まる
+	body := c.get("/bookmarks").Body
+	if n := strings.Count(body, `class="isu-bookmark"`); n != postsPerPage {
+		t.Errorf("bookmarks = %d, want %d", n, postsPerPage)
+	}
+	for _, id := range append(newest, followers) {
+		if strings.Contains(body, fmt.Sprintf(`id="bookmark_%d"`, id)) {
+			t.Errorf("invisible post %d is listed", id)
+		}
+	}
+
+	// フォローしていればフォロワー限定の投稿は見える
+	app.fake.insert("follows", fakeRow{"follower_id": int64(bob), "followee_id": int64(mary), "status": followStatusApproved})
+	body = c.get("/bookmarks").Body
+	if n := strings.Count(body, `class="isu-bookmark"`); n != postsPerPage {
+		t.Errorf("bookmarks = %d, want %d", n, postsPerPage)
+	}
+	if !strings.Contains(body, fmt.Sprintf(`id="bookmark_%d"`, followers)) {
+		t.Error("followers-only post of a followee is not listed")
+	}
+}
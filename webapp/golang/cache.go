@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultCacheSize = 10000
+
+	userCacheTTL     = 10 * time.Minute
+	commentsCacheTTL = 30 * time.Second
+	timelineCacheTTL = 30 * time.Second
+
+	timelineCacheKey = "timeline:first"
+)
+
+// Cache はホットな読み込みのためのキャッシュ。値はバイト列で持つ
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	GetMulti(keys []string) map[string][]byte
+	Set(key string, value []byte, ttl time.Duration)
+	Delete(keys ...string)
+	Flush()
+}
+
+var (
+	appCache     Cache
+	cacheFlights singleflight.Group
+
+	// cacheEpoch は無効化のたびに進める。読み込みの途中で無効化されたら、読んだ値は古いかもしれないので残さない
+	cacheEpoch uint64
+)
+
+func newCacheFromEnv() Cache {
+	switch backend := getEnv("ISUCONP_CACHE_BACKEND", "lru"); backend {
+	case "lru":
+		size := defaultCacheSize
+		if v := os.Getenv("ISUCONP_CACHE_SIZE"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				log.Fatalf("Failed to read cache size from an environment variable ISUCONP_CACHE_SIZE.\nError: %s", err.Error())
+			}
+			size = n
+		}
+		return newLRUCache(size)
+	case "memcached":
+		addr := getEnv("ISUCONP_CACHE_MEMCACHED_ADDRESS", getEnv("ISUCONP_MEMCACHED_ADDRESS", "localhost:11211"))
+		return newMemcachedCache(memcache.New(addr), "isucache_")
+	default:
+		log.Fatalf("Unknown cache backend %q in ISUCONP_CACHE_BACKEND.", backend)
+		return nil
+	}
+}
+
+type lruEntry struct {
+	key       string
+	value     []byte
+	expiresAt time.Time
+}
+
+// lruCache はプロセス内の LRU キャッシュ
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (c *lruCache) get(key string, now time.Time) ([]byte, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if now.After(e.expiresAt) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key, time.Now())
+}
+
+func (c *lruCache) GetMulti(keys []string) map[string][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	found := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if v, ok := c.get(key, now); ok {
+			found[key] = v
+		}
+	}
+	return found
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value = value
+		e.expiresAt = expiresAt
+		c.ll.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, value: value, expiresAt: expiresAt})
+	for c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.ll.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+func (c *lruCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element, c.capacity)
+}
+
+// memcachedCache は複数台のアプリで共有するキャッシュ。
+// セッションと同じ memcached を使うことがあるので FlushAll はせず、世代番号をキーに含めて無効化する
+// memcachedGenerationTTL はプロセス内に覚えておく世代の有効期間。
+// Get や Set のたびに世代を引きに行かないためのもので、他のプロセスの Flush はこの時間だけ遅れて効く
+const memcachedGenerationTTL = time.Second
+
+type memcachedCache struct {
+	client *memcache.Client
+	prefix string
+
+	mu        sync.Mutex
+	gen       string
+	genExpire time.Time
+}
+
+func newMemcachedCache(client *memcache.Client, prefix string) *memcachedCache {
+	return &memcachedCache{client: client, prefix: prefix}
+}
+
+func (c *memcachedCache) generation() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.gen != "" && now.Before(c.genExpire) {
+		return c.gen
+	}
+
+	gen := "1"
+	it, err := c.client.Get(c.prefix + "gen")
+	if err == memcache.ErrCacheMiss {
+		c.client.Add(&memcache.Item{Key: c.prefix + "gen", Value: []byte(gen)})
+	} else if err != nil {
+		// 読めなかった世代は覚えない
+		log.Print(err)
+		return "0"
+	} else {
+		gen = string(it.Value)
+	}
+	c.gen, c.genExpire = gen, now.Add(memcachedGenerationTTL)
+	return gen
+}
+
+func (c *memcachedCache) key(gen, key string) string {
+	return c.prefix + gen + ":" + key
+}
+
+func (c *memcachedCache) Get(key string) ([]byte, bool) {
+	it, err := c.client.Get(c.key(c.generation(), key))
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+		return nil, false
+	}
+	return it.Value, true
+}
+
+func (c *memcachedCache) GetMulti(keys []string) map[string][]byte {
+	gen := c.generation()
+	mkeys := make([]string, len(keys))
+	for i, key := range keys {
+		mkeys[i] = c.key(gen, key)
+	}
+
+	items, err := c.client.GetMulti(mkeys)
+	if err != nil {
+		log.Print(err)
+		return map[string][]byte{}
+	}
+
+	found := make(map[string][]byte, len(items))
+	for i, key := range keys {
+		if it, ok := items[mkeys[i]]; ok {
+			found[key] = it.Value
+		}
+	}
+	return found
+}
+
+func (c *memcachedCache) Set(key string, value []byte, ttl time.Duration) {
+	err := c.client.Set(&memcache.Item{Key: c.key(c.generation(), key), Value: value, Expiration: int32(ttl.Seconds())})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (c *memcachedCache) Delete(keys ...string) {
+	gen := c.generation()
+	for _, key := range keys {
+		err := c.client.Delete(c.key(gen, key))
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+	}
+}
+
+func (c *memcachedCache) Flush() {
+	gen, err := c.client.Increment(c.prefix+"gen", 1)
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+	// このプロセスでは覚えている世代を待たずにすぐ切り替える
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		c.gen, c.genExpire = strconv.FormatUint(gen, 10), time.Now().Add(memcachedGenerationTTL)
+	} else {
+		c.gen = ""
+	}
+}
+
+func encodeCacheValue(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCacheValue(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// cacheFillDB はキャッシュを埋めるときに読む接続。キャッシュはプライマリに固定したリクエストとも共有するので、
+// 遅れているレプリカの古い行を無効化したキーに入れ直さないよう、レプリカがあってもプライマリから読む
+func cacheFillDB(q sqlx.Queryer) sqlx.Queryer {
+	if cluster != nil {
+		return cluster.primary
+	}
+	return q
+}
+
+// cacheFlightKey は singleflight のキー。無効化より後のリクエストが、無効化の前から走っている読み込みの結果を使わないよう世代を含める
+func cacheFlightKey(key string, epoch uint64) string {
+	return fmt.Sprintf("%d:%s", epoch, key)
+}
+
+// cacheStore は epoch に読み込んだ値を保存する。保存の前後で無効化されていたら保存しない (した分は消す)
+func cacheStore(key string, value []byte, ttl time.Duration, epoch uint64) {
+	if atomic.LoadUint64(&cacheEpoch) != epoch {
+		return
+	}
+	appCache.Set(key, value, ttl)
+	if atomic.LoadUint64(&cacheEpoch) != epoch {
+		appCache.Delete(key)
+	}
+}
+
+// cacheFetch はキャッシュから dest に読み込む。なければ load の結果を保存する。
+// 同じキーの読み込みは singleflight で 1 回にまとめる。load は cacheFillDB から読むこと
+func cacheFetch(key string, ttl time.Duration, dest interface{}, load func() (interface{}, error)) error {
+	if b, ok := appCache.Get(key); ok {
+		if err := decodeCacheValue(b, dest); err == nil {
+			return nil
+		}
+	}
+
+	epoch := atomic.LoadUint64(&cacheEpoch)
+	v, err, _ := cacheFlights.Do(cacheFlightKey(key, epoch), func() (interface{}, error) {
+		v, err := load()
+		if err != nil {
+			return nil, err
+		}
+		b, err := encodeCacheValue(v)
+		if err != nil {
+			return nil, err
+		}
+		cacheStore(key, b, ttl, epoch)
+		return b, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return decodeCacheValue(v.([]byte), dest)
+}
+
+func userCacheKey(id int) string {
+	return fmt.Sprintf("user:%d", id)
+}
+
+func commentsCacheKey(postID int, allComments bool) string {
+	if allComments {
+		return fmt.Sprintf("comments:%d:all", postID)
+	}
+	return fmt.Sprintf("comments:%d:preview", postID)
+}
+
+// invalidateCache は書き込んだあとに呼ぶ。世代を進めてから消すので、読み込み中の古い値も残らない
+func invalidateCache(keys ...string) {
+	atomic.AddUint64(&cacheEpoch, 1)
+	appCache.Delete(keys...)
+}
+
+func invalidatePostComments(postID int) {
+	invalidateCache(commentsCacheKey(postID, false), commentsCacheKey(postID, true))
+}
+
+func invalidateUser(id int) {
+	invalidateCache(userCacheKey(id))
+}
+
+func invalidateTimeline() {
+	invalidateCache(timelineCacheKey)
+}
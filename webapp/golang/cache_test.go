@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestCacheFetchInvalidatedWhileLoading(t *testing.T) {
+	newTestApp(t)
+
+	// 読み込みの途中で書き込まれたら、読んだ値は保存しない
+	got := ""
+	err := cacheFetch("test:key", userCacheTTL, &got, func() (interface{}, error) {
+		invalidateCache("test:key")
+		return "old", nil
+	})
+	if err != nil || got != "old" {
+		t.Fatalf("cacheFetch = %q, %v", got, err)
+	}
+	if _, ok := appCache.Get("test:key"); ok {
+		t.Error("value loaded before the invalidation is cached")
+	}
+
+	err = cacheFetch("test:key", userCacheTTL, &got, func() (interface{}, error) {
+		return "new", nil
+	})
+	if err != nil || got != "new" {
+		t.Fatalf("cacheFetch = %q, %v", got, err)
+	}
+	if _, ok := appCache.Get("test:key"); !ok {
+		t.Error("value is not cached")
+	}
+}
+
+func TestUserCacheWithoutCredentials(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	row := app.fake.findOne("users", "id", int64(mary))
+	row["email"] = "mary@example.com"
+	row["totp_secret"] = "SECRET"
+
+	u, err := getUser(db, mary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.HasPassword || u.Passhash != "" || u.Email != "" || u.TOTPSecret != "" {
+		t.Errorf("getUser = %+v", u)
+	}
+	b, _ := appCache.Get(userCacheKey(mary))
+	cached := User{}
+	if err := decodeCacheValue(b, &cached); err != nil || cached.Passhash != "" || cached.Email != "" || cached.TOTPSecret != "" {
+		t.Errorf("cached user = %+v, %v", cached, err)
+	}
+
+	if err := loadUserCredentials(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Passhash == "" || u.Email != "mary@example.com" || u.TOTPSecret != "SECRET" {
+		t.Errorf("loadUserCredentials = %+v", u)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// defaultCommentMaxDepth はトップレベルを 1 とした入れ子の深さ。これより深い返信は同じ深さに並べる
+const defaultCommentMaxDepth = 3
+
+func commentMaxDepth() int {
+	if d := getEnvInt("ISUCONP_COMMENT_MAX_DEPTH", defaultCommentMaxDepth); d > 0 {
+		return d
+	}
+	return 1
+}
+
+type replyCount struct {
+	ParentID int `db:"parent_id"`
+	Count    int `db:"count"`
+}
+
+// getReplyCounts はコメントごとの直接の返信の数をまとめて引く
+func getReplyCounts(q sqlx.Queryer, commentIDs []int) (map[int]int, error) {
+	counts := map[int]int{}
+	if len(commentIDs) == 0 {
+		return counts, nil
+	}
+	rows := []replyCount{}
+	err := sqlx.Select(q, &rows, fmt.Sprintf("SELECT `parent_id`, COUNT(*) AS `count` FROM `comments` WHERE `parent_id` IN (%s) GROUP BY `parent_id`", joinIDs(commentIDs)))
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rows {
+		counts[r.ParentID] = r.Count
+	}
+	return counts, nil
+}
+
+// threadComments は古い順に並んだコメントを返信の木にする。
+// maxDepth より深い返信は maxDepth の深さに古い順で並べ、返信先を ReplyTo に入れる。
+// 返信先が見えない (ブロックや退会で消えた) 返信はトップレベルに出す
+func threadComments(comments []Comment, maxDepth int) []Comment {
+	index := make(map[int]int, len(comments))
+	for i, c := range comments {
+		index[c.ID] = i
+		comments[i].ReplyCount = 0
+	}
+	// 返信の数は見えている返信だけで数え直す
+	for _, c := range comments {
+		if p, ok := index[c.ParentID]; ok && c.ParentID != 0 {
+			comments[p].ReplyCount++
+		}
+	}
+	depths := make([]int, len(comments))
+	// parents は表示する親の添字。-1 はトップレベル
+	parents := make([]int, len(comments))
+
+	var resolve func(i int) int
+	resolve = func(i int) int {
+		if depths[i] > 0 {
+			return depths[i]
+		}
+		p, ok := index[comments[i].ParentID]
+		if comments[i].ParentID == 0 || !ok {
+			depths[i], parents[i] = 1, -1
+			return 1
+		}
+		d := resolve(p)
+		if d < maxDepth {
+			depths[i], parents[i] = d+1, p
+		} else {
+			depths[i], parents[i] = d, parents[p]
+			comments[i].ReplyTo = comments[p].User.AccountName
+		}
+		return depths[i]
+	}
+
+	roots := []int{}
+	children := make(map[int][]int, len(comments))
+	for i := range comments {
+		resolve(i)
+		if parents[i] < 0 {
+			roots = append(roots, i)
+		} else {
+			children[parents[i]] = append(children[parents[i]], i)
+		}
+	}
+
+	var build func(idx []int) []Comment
+	build = func(idx []int) []Comment {
+		thread := make([]Comment, len(idx))
+		for k, i := range idx {
+			thread[k] = comments[i]
+			thread[k].Depth = depths[i]
+			thread[k].Replies = build(children[i])
+		}
+		return thread
+	}
+	return build(roots)
+}
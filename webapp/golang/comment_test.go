@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestThreadComments(t *testing.T) {
+	c := func(id, parent int, name string) Comment {
+		return Comment{ID: id, ParentID: parent, User: User{AccountName: name}}
+	}
+	comments := []Comment{
+		c(1, 0, "a"),
+		c(2, 1, "b"),
+		c(3, 0, "c"),
+		c(4, 2, "d"),
+		c(5, 4, "e"),
+		c(6, 1, "f"),
+		// 返信先が見えないコメント
+		c(7, 99, "g"),
+	}
+
+	type node struct {
+		ID, Depth, ReplyCount int
+		ReplyTo               string
+		Replies               []node
+	}
+	var flatten func([]Comment) []node
+	flatten = func(cs []Comment) []node {
+		nodes := []node{}
+		for _, c := range cs {
+			nodes = append(nodes, node{c.ID, c.Depth, c.ReplyCount, c.ReplyTo, flatten(c.Replies)})
+		}
+		return nodes
+	}
+
+	got := flatten(threadComments(append([]Comment{}, comments...), 2))
+	want := []node{
+		{1, 1, 2, "", []node{
+			{2, 2, 1, "", []node{}},
+			{4, 2, 1, "b", []node{}},
+			{5, 2, 0, "d", []node{}},
+			{6, 2, 0, "", []node{}},
+		}},
+		{3, 1, 0, "", []node{}},
+		{7, 1, 0, "", []node{}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("threadComments(depth 2) = %+v, want %+v", got, want)
+	}
+
+	got = flatten(threadComments(append([]Comment{}, comments...), 1))
+	if len(got) != len(comments) {
+		t.Errorf("threadComments(depth 1) has %d roots, want %d", len(got), len(comments))
+	}
+}
+
+func TestCommentReplies(t *testing.T) {
+	t.Setenv("ISUCONP_COMMENT_MAX_DEPTH", "2")
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	pid := app.addPost(mary, "mary post", []byte("png"))
+	other := app.addPost(mary, "other post", []byte("png"))
+
+	c := app.newClient()
+	c.login("bob")
+	token := c.csrfToken()
+	comment := func(postID, parentID int, text string) *testResponse {
+		return c.postForm("/comment", url.Values{
+			"post_id":    {fmt.Sprint(postID)},
+			"parent_id":  {fmt.Sprint(parentID)},
+			"comment":    {text},
+			"csrf_token": {token},
+		})
+	}
+
+	assertRedirect(t, comment(pid, 0, "top comment"), fmt.Sprintf("/posts/%d", pid))
+	assertRedirect(t, comment(pid, 1, "first reply"), fmt.Sprintf("/posts/%d", pid))
+	assertRedirect(t, comment(pid, 2, "deep reply"), fmt.Sprintf("/posts/%d", pid))
+	// 返信先は同じ投稿のコメントだけ
+	assertStatus(t, comment(other, 1, "wrong post"), http.StatusNotFound)
+	assertStatus(t, comment(pid, 99, "no parent"), http.StatusNotFound)
+	if n := app.count("comments"); n != 3 {
+		t.Fatalf("comments = %d, want 3", n)
+	}
+
+	body := c.get(fmt.Sprintf("/posts/%d", pid)).Body
+	for _, want := range []string{
+		`<div class="isu-comment" id="comment_1" data-depth="1">`,
+		`<div class="isu-comment" id="comment_2" data-depth="2">`,
+		`<div class="isu-comment" id="comment_3" data-depth="2">`,
+		`<input type="hidden" name="parent_id" value="3">`,
+		`class="isu-comment-reply-to">@bob</a>`,
+		`comments: <b>3</b>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/posts/%d does not contain %s", pid, want)
+		}
+	}
+	if strings.Index(body, "deep reply") < strings.Index(body, "first reply") {
+		t.Error("replies are not in order")
+	}
+
+	// タイムラインにはトップレベルのコメントだけを出し、返信は数だけ出す
+	for i := 0; i < 3; i++ {
+		assertRedirect(t, comment(pid, 1, fmt.Sprintf("late reply %d", i)), fmt.Sprintf("/posts/%d", pid))
+	}
+	body = app.newClient().get("/").Body
+	if !strings.Contains(body, "top comment") || strings.Contains(body, "first reply") || strings.Contains(body, "late reply") {
+		t.Error("timeline preview shows replies")
+	}
+	if !strings.Contains(body, fmt.Sprintf(`<a href="/posts/%d#comment_1" class="isu-comment-reply-count">返信 4件</a>`, pid)) {
+		t.Error("timeline preview does not show the reply count")
+	}
+	if strings.Contains(body, `name="parent_id"`) {
+		t.Error("timeline preview has reply forms")
+	}
+}
+
+func TestCommentReplyBlocked(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.addUser("carol", 0, 0)
+	pid := app.addPost(mary, "mary post", []byte("png"))
+	app.addComment(pid, bob, "bob comment")
+
+	c := app.newClient()
+	c.login("carol")
+	assertRedirect(t, c.postForm("/block", url.Values{"account_name": {"bob"}, "csrf_token": {c.csrfToken()}}), "/@bob")
+	res := c.postForm("/comment", url.Values{"post_id": {fmt.Sprint(pid)}, "parent_id": {"1"}, "comment": {"hi"}, "csrf_token": {c.csrfToken()}})
+	assertStatus(t, res, http.StatusNotFound)
+}
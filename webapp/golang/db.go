@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultReplicaMaxLag        = 1 * time.Second
+	defaultPrimaryPinDuration   = 5 * time.Second
+	replicaHealthCheckInterval  = 1 * time.Second
+	replicaHealthCheckTimeout   = 500 * time.Millisecond
+	sessionKeyPrimaryPinnedTill = "primary_pinned_until"
+)
+
+// isDuplicateEntry は UNIQUE キーが重なって INSERT できなかったエラーか調べる
+func isDuplicateEntry(err error) bool {
+	var me *mysql.MySQLError
+	return errors.As(err, &me) && me.Number == 1062
+}
+
+// dbCluster は書き込み用のプライマリと読み込み用のレプリカをまとめて持つ
+type dbCluster struct {
+	primary  *sqlx.DB
+	replicas []*dbReplica
+	next     uint32
+
+	// レプリカの遅延がこれを超えたら読み込み先から外す
+	maxLag time.Duration
+	// 書き込み後にそのユーザーの読み込みをプライマリに固定する期間
+	pinDuration time.Duration
+}
+
+type dbReplica struct {
+	addr    string
+	db      *sqlx.DB
+	healthy int32
+}
+
+func getEnv(key, defaultValue string) string {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	return v
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Failed to parse %s as a duration.\nError: %s", key, err.Error())
+	}
+	return d
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Failed to parse %s as an integer.\nError: %s", key, err.Error())
+	}
+	return n
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Failed to parse %s as a boolean.\nError: %s", key, err.Error())
+	}
+	return b
+}
+
+func primaryDSN() string {
+	if dsn := os.Getenv("ISUCONP_DB_DSN"); dsn != "" {
+		return dsn
+	}
+
+	host := getEnv("ISUCONP_DB_HOST", "localhost")
+	port := getEnv("ISUCONP_DB_PORT", "3306")
+	_, err := strconv.Atoi(port)
+	if err != nil {
+		log.Fatalf("Failed to read DB port number from an environment variable ISUCONP_DB_PORT.\nError: %s", err.Error())
+	}
+	user := getEnv("ISUCONP_DB_USER", "root")
+	password := os.Getenv("ISUCONP_DB_PASSWORD")
+	dbname := getEnv("ISUCONP_DB_NAME", "isuconp")
+
+	return fmt.Sprintf(
+		"%s:%s@tcp(%s:%s)/%s?interpolateParams=true&charset=utf8mb4&parseTime=true&loc=Local",
+		user,
+		password,
+		host,
+		port,
+		dbname,
+	)
+}
+
+func replicaDSNs() []string {
+	dsns := []string{}
+	for _, dsn := range strings.Split(os.Getenv("ISUCONP_DB_REPLICA_DSNS"), ",") {
+		dsn = strings.TrimSpace(dsn)
+		if dsn != "" {
+			dsns = append(dsns, dsn)
+		}
+	}
+	return dsns
+}
+
+// normalizeDSN はアプリが前提にしている接続パラメータを DSN に補う
+func normalizeDSN(dsn string) (*mysql.Config, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ParseTime = true
+	cfg.InterpolateParams = true
+	cfg.Loc = time.Local
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	if _, ok := cfg.Params["charset"]; !ok {
+		cfg.Params["charset"] = "utf8mb4"
+	}
+	return cfg, nil
+}
+
+func openDB(dsn string) (*sqlx.DB, string, error) {
+	cfg, err := normalizeDSN(dsn)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := sqlx.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, "", err
+	}
+	return conn, cfg.Addr, nil
+}
+
+func newDBCluster(primaryDSN string, replicaDSNs []string) (*dbCluster, error) {
+	primary, _, err := openDB(primaryDSN)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dbCluster{
+		primary:     primary,
+		maxLag:      getEnvDuration("ISUCONP_DB_REPLICA_MAX_LAG", defaultReplicaMaxLag),
+		pinDuration: getEnvDuration("ISUCONP_DB_PRIMARY_PIN", defaultPrimaryPinDuration),
+	}
+
+	for _, dsn := range replicaDSNs {
+		conn, addr, err := openDB(dsn)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.replicas = append(c.replicas, &dbReplica{addr: addr, db: conn})
+	}
+
+	return c, nil
+}
+
+func (c *dbCluster) Close() error {
+	for _, rp := range c.replicas {
+		rp.db.Close()
+	}
+	return c.primary.Close()
+}
+
+// reader は健全なレプリカをラウンドロビンで返す。使えるレプリカがなければプライマリを返す
+func (c *dbCluster) reader() *sqlx.DB {
+	n := len(c.replicas)
+	if n == 0 {
+		return c.primary
+	}
+
+	start := int(atomic.AddUint32(&c.next, 1))
+	for i := 0; i < n; i++ {
+		rp := c.replicas[(start+i)%n]
+		if atomic.LoadInt32(&rp.healthy) == 1 {
+			return rp.db
+		}
+	}
+
+	return c.primary
+}
+
+// watchReplicas は定期的にレプリカの疎通と遅延を確認する
+func (c *dbCluster) watchReplicas(ctx context.Context) {
+	if len(c.replicas) == 0 {
+		return
+	}
+
+	c.checkReplicas(ctx)
+
+	ticker := time.NewTicker(replicaHealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.checkReplicas(ctx)
+		}
+	}
+}
+
+func (c *dbCluster) checkReplicas(ctx context.Context) {
+	for _, rp := range c.replicas {
+		lag, err := rp.lag(ctx)
+		healthy := err == nil && lag <= c.maxLag
+
+		var v int32
+		if healthy {
+			v = 1
+		}
+		if atomic.SwapInt32(&rp.healthy, v) != v {
+			if healthy {
+				log.Printf("replica %s is back (lag %s)", rp.addr, lag)
+			} else {
+				log.Printf("replica %s is out of rotation (lag %s, err %v)", rp.addr, lag, err)
+			}
+		}
+	}
+}
+
+// lag はレプリカの Seconds_Behind_Source を返す。レプリケーションが止まっていればエラー
+func (rp *dbReplica) lag(ctx context.Context) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, replicaHealthCheckTimeout)
+	defer cancel()
+
+	status, err := replicaStatus(ctx, rp.db, "SHOW REPLICA STATUS")
+	if err != nil {
+		// MySQL 8.0.22 より前は SHOW REPLICA STATUS がない
+		status, err = replicaStatus(ctx, rp.db, "SHOW SLAVE STATUS")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range []string{"Seconds_Behind_Source", "Seconds_Behind_Master"} {
+		v, ok := status[key]
+		if !ok {
+			continue
+		}
+		if v == nil {
+			return 0, fmt.Errorf("replication is not running")
+		}
+		sec, err := strconv.Atoi(fmt.Sprintf("%s", v))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(sec) * time.Second, nil
+	}
+
+	return 0, fmt.Errorf("replication status is unavailable")
+}
+
+func replicaStatus(ctx context.Context, conn *sqlx.DB, query string) (map[string]interface{}, error) {
+	rows, err := conn.QueryxContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("not configured as a replica")
+	}
+
+	status := map[string]interface{}{}
+	if err := rows.MapScan(status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// readDB はリクエストの読み込みに使う接続を返す。
+// 直前に書き込んだユーザーは自分の書き込みが見えるようにプライマリから読む
+func readDB(r *http.Request) *sqlx.DB {
+	if cluster == nil {
+		return db
+	}
+	if isPinnedToPrimary(r) {
+		return cluster.primary
+	}
+	return cluster.reader()
+}
+
+func isPinnedToPrimary(r *http.Request) bool {
+	session := getSession(r)
+	until, ok := session.Values[sessionKeyPrimaryPinnedTill].(int64)
+	if !ok {
+		return false
+	}
+	return time.Now().UnixNano() < until
+}
+
+// pinPrimary は書き込んだユーザーの読み込みをしばらくプライマリに固定する
+func pinPrimary(w http.ResponseWriter, r *http.Request) {
+	if cluster == nil || len(cluster.replicas) == 0 {
+		return
+	}
+	session := getSession(r)
+	session.Values[sessionKeyPrimaryPinnedTill] = time.Now().Add(cluster.pinDuration).UnixNano()
+	session.Save(r, w)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	postStatusPublished = "published"
+	postStatusDraft     = "draft"
+	postStatusScheduled = "scheduled"
+
+	// publishAtFormat は <input type="datetime-local"> の値
+	publishAtFormat = "2006-01-02T15:04"
+	// maxScheduleAhead より先には予約させない
+	maxScheduleAhead    = 365 * 24 * time.Hour
+	postPublishInterval = 10 * time.Second
+)
+
+var templateDrafts = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("drafts.html"),
+))
+
+// postPublication は投稿フォームの action と publish_at から公開の状態を決める。
+// action が空なら今までどおりすぐに公開する。受け付けられないときは notice に理由を返す
+func postPublication(r *http.Request, now time.Time) (string, sql.NullTime, string) {
+	switch r.FormValue("action") {
+	case "", "publish":
+		return postStatusPublished, sql.NullTime{}, ""
+	case "draft":
+		return postStatusDraft, sql.NullTime{}, ""
+	case "schedule":
+		t, err := time.ParseInLocation(publishAtFormat, r.FormValue("publish_at"), time.Local)
+		if err != nil {
+			return "", sql.NullTime{}, "公開する日時の形式が正しくありません"
+		}
+		if !t.After(now) {
+			return "", sql.NullTime{}, "公開する日時は今より後にしてください"
+		}
+		if t.After(now.Add(maxScheduleAhead)) {
+			return "", sql.NullTime{}, "予約できるのは1年先までです"
+		}
+		return postStatusScheduled, sql.NullTime{Time: t, Valid: true}, ""
+	}
+	return "", sql.NullTime{}, "公開の指定が正しくありません"
+}
+
+func publishAtValue(t sql.NullTime) string {
+	if !t.Valid {
+		return ""
+	}
+	return t.Time.In(time.Local).Format(publishAtFormat)
+}
+
+// getDrafts は自分の下書きと予約投稿を、公開の予定が近い順 (下書きは後ろに新しい順) に並べる
+func getDrafts(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	results := []Post{}
+	err := db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `image_hash`, `visibility`, `status`, `publish_at`, `created_at` FROM `posts` WHERE `user_id` = ? AND `status` <> 'published' ORDER BY `publish_at` IS NULL, `publish_at`, `created_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	posts, err := makePosts(db, results, newPostViewer(me), getCSRFToken(r), false)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateDrafts.Execute(w, struct {
+		Posts      []Post
+		Me         User
+		CSRFToken  string
+		Flash      string
+		Visibility []string
+	}{posts, me, getCSRFToken(r), getFlash(w, r, "notice"), postVisibilities})
+}
+
+// postDraft は下書きか予約投稿の本文・公開範囲・公開の予定を書き換える。公開済みの投稿は書き換えない
+func postDraft(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireAuthUser(w, r, scopePost)
+	if !ok {
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	pid, err := strconv.Atoi(r.FormValue("post_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	visibility := r.FormValue("visibility")
+	status, publishAt, notice := postPublication(r, now)
+	if !validVisibility(visibility) {
+		notice = "公開範囲の指定が正しくありません"
+	}
+	if notice != "" {
+		session := getSession(r)
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/drafts", http.StatusFound)
+		return
+	}
+
+	// 予約の時刻を過ぎてスケジューラが公開したあとなら、0 行になる
+	createdAt := sql.NullTime{}
+	if status == postStatusPublished {
+		createdAt = sql.NullTime{Time: now, Valid: true}
+	}
+	result, err := db.Exec(
+		"UPDATE `posts` SET `body` = ?, `visibility` = ?, `status` = ?, `publish_at` = ?, `created_at` = COALESCE(?, `created_at`) WHERE `id` = ? AND `user_id` = ? AND `status` <> 'published'",
+		r.FormValue("body"), visibility, status, publishAt, createdAt, pid, me.ID,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if status == postStatusPublished {
+		invalidateTimeline()
+		http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
+		return
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = publicationNotice(status, publishAt)
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/drafts", http.StatusFound)
+}
+
+func publicationNotice(status string, publishAt sql.NullTime) string {
+	if status == postStatusScheduled {
+		return publishAt.Time.In(time.Local).Format("2006-01-02 15:04") + " に公開します"
+	}
+	return "下書きを保存しました"
+}
+
+// runPostScheduler は予約の時刻を過ぎた投稿を公開する。
+// 予約は DB にだけ持つので、止まっていたあいだに時刻を過ぎた投稿も起動したときに公開する
+func runPostScheduler(ctx context.Context) {
+	ticker := time.NewTicker(postPublishInterval)
+	defer ticker.Stop()
+	for {
+		if err := publishDuePosts(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Print(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// publishDuePosts は 1 つの UPDATE で公開するので、複数のプロセスで動かしても二重に公開しない。
+// created_at は実際に公開した時刻にする。予約した時刻にすると、止まっていたあいだの分が
+// もう読み込まれたタイムラインのページの後ろに入り、max_created_at で先を読んでも出てこない
+func publishDuePosts(ctx context.Context, now time.Time) error {
+	result, err := db.ExecContext(ctx,
+		"UPDATE `posts` SET `status` = 'published', `created_at` = ? WHERE `status` = 'scheduled' AND `publish_at` <= ?",
+		now, now,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		invalidateTimeline()
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDraftPost(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+	b := app.newClient()
+	b.login("bob")
+
+	res := c.postImages(token, map[string]string{"body": "draft body", "action": "draft"}, testUpload{"image/png", []byte("png")})
+	assertRedirect(t, res, "/drafts")
+	if row := app.fake.findOne("posts", "id", int64(1)); fakeString(row["status"]) != postStatusDraft {
+		t.Fatalf("status = %v", row["status"])
+	}
+	if !strings.Contains(c.get("/drafts").Body, "下書きを保存しました") {
+		t.Error("notice is not shown")
+	}
+
+	// 公開するまでは本人にしか見えない
+	for _, path := range []string{"/", "/@mary"} {
+		if strings.Contains(b.get(path).Body, "draft body") || strings.Contains(c.get(path).Body, "draft body") {
+			t.Errorf("%s shows the draft", path)
+		}
+	}
+	assertStatus(t, b.get("/posts/1"), http.StatusNotFound)
+	assertStatus(t, b.get("/image/1.png"), http.StatusNotFound)
+	assertStatus(t, b.postForm("/comment", url.Values{"post_id": {"1"}, "comment": {"hi"}, "csrf_token": {b.csrfToken()}}), http.StatusNotFound)
+	if res := c.get("/posts/1"); res.StatusCode != http.StatusOK || !strings.Contains(res.Body, "下書き") {
+		t.Error("owner cannot preview the draft")
+	}
+	res = c.get("/image/1.png")
+	assertStatus(t, res, http.StatusOK)
+	if got := res.Header.Get("Cache-Control"); got != restrictedImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if !strings.Contains(c.get("/drafts").Body, `<div class="isu-draft" id="draft_1" data-status="draft">`) {
+		t.Error("draft is not listed")
+	}
+
+	// 他人の下書きは書き換えられない
+	assertStatus(t, b.postForm("/drafts", url.Values{"post_id": {"1"}, "body": {"x"}, "visibility": {"public"}, "action": {"draft"}, "csrf_token": {b.csrfToken()}}), http.StatusNotFound)
+	assertStatus(t, c.postForm("/drafts", url.Values{"post_id": {"1"}, "body": {"x"}, "visibility": {"public"}, "action": {"draft"}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+
+	assertRedirect(t, c.postForm("/drafts", url.Values{"post_id": {"1"}, "body": {"edited body"}, "visibility": {"public"}, "action": {"draft"}, "csrf_token": {token}}), "/drafts")
+	if !strings.Contains(c.get("/drafts").Body, "edited body") {
+		t.Error("draft is not edited")
+	}
+
+	assertRedirect(t, c.postForm("/drafts", url.Values{"post_id": {"1"}, "body": {"published body"}, "visibility": {"public"}, "action": {"publish"}, "csrf_token": {token}}), "/posts/1")
+	if !strings.Contains(b.get("/").Body, "published body") {
+		t.Error("published draft is not on the timeline")
+	}
+	assertStatus(t, b.get("/image/1.png"), http.StatusOK)
+	if strings.Contains(c.get("/drafts").Body, "isu-draft\"") {
+		t.Error("published post is still listed as a draft")
+	}
+	// 公開したあとは下書きとして書き換えられない
+	assertStatus(t, c.postForm("/drafts", url.Values{"post_id": {"1"}, "body": {"x"}, "visibility": {"public"}, "action": {"draft"}, "csrf_token": {token}}), http.StatusNotFound)
+}
+
+func TestScheduledPost(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		fields map[string]string
+		notice string
+	}{
+		{"past", map[string]string{"action": "schedule", "publish_at": now.Add(-time.Hour).Format(publishAtFormat)}, "公開する日時は今より後にしてください"},
+		{"too far", map[string]string{"action": "schedule", "publish_at": now.Add(maxScheduleAhead + 24*time.Hour).Format(publishAtFormat)}, "予約できるのは1年先までです"},
+		{"malformed", map[string]string{"action": "schedule", "publish_at": "tomorrow"}, "公開する日時の形式が正しくありません"},
+		{"unknown action", map[string]string{"action": "later"}, "公開の指定が正しくありません"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fields["body"] = "x"
+			assertRedirect(t, c.postImages(token, tt.fields, testUpload{"image/png", []byte("png")}), "/")
+			if res := c.get("/"); !strings.Contains(res.Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if n := app.count("posts"); n != 0 {
+		t.Fatalf("posts = %d, want 0", n)
+	}
+
+	publishAt := now.Add(time.Hour).Truncate(time.Minute)
+	res := c.postImages(token, map[string]string{"body": "scheduled body", "action": "schedule", "publish_at": publishAt.Format(publishAtFormat)}, testUpload{"image/png", []byte("png")})
+	assertRedirect(t, res, "/drafts")
+	body := c.get("/drafts").Body
+	if !strings.Contains(body, publishAt.Format("2006-01-02 15:04")+" に公開します") || !strings.Contains(body, `value="`+publishAt.Format(publishAtFormat)+`"`) {
+		t.Error("scheduled post is not listed with its time")
+	}
+
+	if err := publishDuePosts(context.Background(), publishAt.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(app.newClient().get("/").Body, "scheduled body") {
+		t.Fatal("scheduled post is published early")
+	}
+
+	// 止まっていたあいだに時刻を過ぎていても、次に動いたときにその時刻で公開する
+	if err := publishDuePosts(context.Background(), publishAt.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	row := app.fake.findOne("posts", "id", int64(1))
+	if fakeString(row["status"]) != postStatusPublished || !fakeTime(row["created_at"]).Equal(publishAt.Add(time.Hour)) {
+		t.Errorf("post = %v", row)
+	}
+	if !strings.Contains(app.newClient().get("/").Body, "scheduled body") {
+		t.Error("scheduled post is not on the timeline")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+const defaultEmailVerificationTTL = 24 * time.Hour
+
+var templateEmail = template.Must(template.ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("email.html")),
+)
+
+// EmailVerification はメールアドレス変更の確認トークン。トークンそのものは保存せずハッシュだけ持つ
+type EmailVerification struct {
+	ID        int          `db:"id"`
+	UserID    int          `db:"user_id"`
+	Email     string       `db:"email"`
+	TokenHash string       `db:"token_hash"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	UsedAt    sql.NullTime `db:"used_at"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+func getEmail(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if err := loadUserCredentials(&me); err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 確認待ちのアドレスがあれば知らせる
+	pending := ""
+	err := db.Get(&pending, "SELECT `email` FROM `email_verifications` WHERE `user_id` = ? AND `used_at` IS NULL AND `expires_at` > ? ORDER BY `id` DESC LIMIT 1", me.ID, time.Now())
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+
+	templateEmail.Execute(w, struct {
+		Me        User
+		Pending   string
+		CSRFToken string
+		Flash     string
+	}{me, pending, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+// postEmail は新しいアドレスに確認のリンクを送る。空にするときは確認なしで消す
+func postEmail(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+
+	// パスワード再設定のメールが届く先なので、パスワードがあれば確かめる
+	if me.HasPassword && tryLogin(me.AccountName, r.FormValue("password")) == nil {
+		session.Values["notice"] = "パスワードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/email", http.StatusFound)
+		return
+	}
+
+	email := strings.TrimSpace(r.FormValue("email"))
+	if !validateEmail(email) {
+		session.Values["notice"] = "メールアドレスの形式が正しくありません"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/email", http.StatusFound)
+		return
+	}
+
+	now := time.Now()
+	if email == "" {
+		_, err := db.Exec("UPDATE `users` SET `email` = ? WHERE `id` = ?", "", me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		_, err = db.Exec("UPDATE `email_verifications` SET `used_at` = ? WHERE `user_id` = ? AND `used_at` IS NULL", now, me.ID)
+		if err != nil {
+			log.Print(err)
+		}
+		invalidateUser(me.ID)
+		pinPrimary(w, r)
+
+		session.Values["notice"] = "メールアドレスを削除しました"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/email", http.StatusFound)
+		return
+	}
+
+	if !allowRequest(w, "email:user", strconv.Itoa(me.ID)) {
+		return
+	}
+
+	token := secureRandomStr(32)
+	_, err := db.Exec(
+		"INSERT INTO `email_verifications` (`user_id`, `email`, `token_hash`, `expires_at`, `created_at`) VALUES (?,?,?,?,?)",
+		me.ID, email, passwordResetTokenHash(token), now.Add(getEnvDuration("ISUCONP_EMAIL_VERIFICATION_TTL", defaultEmailVerificationTTL)), now,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	err = mailer.Send(r.Context(), Mail{
+		To:      email,
+		Subject: "Iscogram メールアドレスの確認",
+		Body: fmt.Sprintf(
+			"%sさん\n\n以下のリンクを開くと、このアドレスをアカウントのメールアドレスにします。\n%s/email/verify/%s\n\n心当たりがなければこのメールは無視してください。\n",
+			me.AccountName, baseURL(), token,
+		),
+	})
+	if err != nil {
+		log.Print(err)
+	}
+
+	session.Values["notice"] = "確認のメールを送りました。メールのリンクを開くと変更されます"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/email", http.StatusFound)
+}
+
+// getEmailVerify は確認のリンクが開かれたらアドレスを変える。
+// 前のアドレスに送ったパスワード再設定のリンクはもう使えないようにする
+func getEmailVerify(w http.ResponseWriter, r *http.Request) {
+	ev := EmailVerification{}
+	err := db.Get(&ev, "SELECT * FROM `email_verifications` WHERE `token_hash` = ?", passwordResetTokenHash(pat.Param(r, "token")))
+	if err == sql.ErrNoRows || (err == nil && (ev.UsedAt.Valid || !time.Now().Before(ev.ExpiresAt))) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	user, err := getUser(db, ev.UserID)
+	if err == sql.ErrNoRows || user.DelFlg != 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	now := time.Now()
+	// 同時に開かれても 1 回しか通らないように、未使用のときだけ使用済みにする
+	result, err := db.Exec("UPDATE `email_verifications` SET `used_at` = ? WHERE `id` = ? AND `used_at` IS NULL", now, ev.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec("UPDATE `users` SET `email` = ? WHERE `id` = ?", ev.Email, user.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, q := range []string{
+		"UPDATE `email_verifications` SET `used_at` = ? WHERE `user_id` = ? AND `used_at` IS NULL",
+		"UPDATE `password_resets` SET `used_at` = ? WHERE `user_id` = ? AND `used_at` IS NULL",
+	} {
+		if _, err := db.Exec(q, now, user.ID); err != nil {
+			log.Print(err)
+		}
+	}
+	invalidateUser(user.ID)
+	pinPrimary(w, r)
+
+	session := getSession(r)
+	session.Values["notice"] = "メールアドレスを変更しました"
+	session.Save(r, w)
+
+	if me := getSessionUser(r); me.ID == user.ID {
+		http.Redirect(w, r, "/email", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var emailVerifyLinkRegexp = regexp.MustCompile(`/email/verify/([0-9a-f]+)`)
+
+func TestChangeEmail(t *testing.T) {
+	app := newTestApp(t)
+	sent := useRecordingMailer(t)
+	mary := app.addUser("mary", 0, 0)
+	row := app.fake.findOne("users", "id", int64(mary))
+
+	assertRedirect(t, app.newClient().get("/email"), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	if !strings.Contains(c.get("/email").Body, "未設定") {
+		t.Error("missing email is not shown")
+	}
+	token := c.csrfToken()
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		notice string
+	}{
+		{"wrong password", url.Values{"email": {"mary@example.com"}, "password": {"wrongpass"}}, "パスワードが間違っています"},
+		{"invalid email", url.Values{"email": {"not an email"}, "password": {"marymary"}}, "メールアドレスの形式が正しくありません"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.form.Set("csrf_token", token)
+			assertRedirect(t, c.postForm("/email", tt.form), "/email")
+			if !strings.Contains(c.get("/email").Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if len(sent.mails) != 0 {
+		t.Fatalf("mails = %+v", sent.mails)
+	}
+
+	// 確認のリンクを開くまでは変わらない
+	assertRedirect(t, c.postForm("/email", url.Values{"email": {" mary@example.com "}, "password": {"marymary"}, "csrf_token": {token}}), "/email")
+	if len(sent.mails) != 1 || sent.mails[0].To != "mary@example.com" {
+		t.Fatalf("mails = %+v", sent.mails)
+	}
+	m := emailVerifyLinkRegexp.FindStringSubmatch(sent.mails[0].Body)
+	if m == nil || !strings.Contains(sent.mails[0].Body, appBaseURL+m[0]) {
+		t.Fatalf("verification link not found in %q", sent.mails[0].Body)
+	}
+	if fakeString(row["email"]) != "" {
+		t.Fatalf("email changed before verification: %v", row["email"])
+	}
+	if !strings.Contains(c.get("/email").Body, "mary@example.com の確認待ちです") {
+		t.Error("pending email is not shown")
+	}
+
+	// 前のアドレスに送ったパスワード再設定のリンクは使えなくなる
+	app.fake.insert("password_resets", fakeRow{"user_id": int64(mary), "token_hash": "old", "expires_at": time.Now().Add(time.Hour)})
+
+	assertStatus(t, c.get("/email/verify/0123abcd"), http.StatusNotFound)
+	assertRedirect(t, c.get("/email/verify/"+m[1]), "/email")
+	if fakeString(row["email"]) != "mary@example.com" {
+		t.Errorf("email = %v", row["email"])
+	}
+	if !strings.Contains(c.get("/email").Body, "現在のメールアドレス: mary@example.com") {
+		t.Error("new email is not shown")
+	}
+	if app.fake.findOne("password_resets", "token_hash", "old")["used_at"] == nil {
+		t.Error("old password reset link is still usable")
+	}
+	assertStatus(t, c.get("/email/verify/"+m[1]), http.StatusNotFound)
+
+	// 期限が切れたリンクでは変わらない
+	assertRedirect(t, c.postForm("/email", url.Values{"email": {"new@example.com"}, "password": {"marymary"}, "csrf_token": {token}}), "/email")
+	m = emailVerifyLinkRegexp.FindStringSubmatch(sent.mails[1].Body)
+	app.fake.findOne("email_verifications", "email", "new@example.com")["expires_at"] = time.Now().Add(-time.Minute)
+	assertStatus(t, app.newClient().get("/email/verify/"+m[1]), http.StatusNotFound)
+
+	assertRedirect(t, c.postForm("/email", url.Values{"email": {""}, "password": {"marymary"}, "csrf_token": {token}}), "/email")
+	if fakeString(row["email"]) != "" {
+		t.Errorf("email is not removed: %v", row["email"])
+	}
+}
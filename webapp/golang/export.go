@@ -0,0 +1,496 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"goji.io/pat"
+)
+
+const (
+	exportStatusPending = "pending"
+	exportStatusRunning = "running"
+	exportStatusDone    = "done"
+	exportStatusFailed  = "failed"
+
+	exportFormatVersion = 1
+	defaultExportTTL    = 7 * 24 * time.Hour
+	exportPollInterval  = 30 * time.Second
+	// 作成中のまま止まったエクスポートは、プロセスが落ちたものとみなしてやり直す
+	exportStaleAfter = 10 * time.Minute
+	exportBatchSize  = 10
+	exportErrorMax   = 255
+)
+
+var exportDir = getEnv("ISUCONP_EXPORT_DIR", "/tmp/isuconp-exports")
+
+// exportWakeup はエクスポートの依頼があったことをワーカーに知らせる
+var exportWakeup = make(chan struct{}, 1)
+
+// DataExport はユーザーのデータを ZIP にまとめる依頼
+type DataExport struct {
+	ID         int          `db:"id"`
+	UserID     int          `db:"user_id"`
+	Status     string       `db:"status"`
+	FileName   string       `db:"file_name"`
+	Size       int64        `db:"size"`
+	Error      string       `db:"error"`
+	CreatedAt  time.Time    `db:"created_at"`
+	StartedAt  sql.NullTime `db:"started_at"`
+	FinishedAt sql.NullTime `db:"finished_at"`
+	ExpiresAt  sql.NullTime `db:"expires_at"`
+}
+
+// Downloadable は ZIP ができていて期限が切れていないかを返す
+func (e DataExport) Downloadable(now time.Time) bool {
+	return e.Status == exportStatusDone && e.ExpiresAt.Valid && now.Before(e.ExpiresAt.Time)
+}
+
+func exportPath(fileName string) string {
+	return filepath.Join(exportDir, fileName+".zip")
+}
+
+type exportManifest struct {
+	FormatVersion int            `json:"format_version"`
+	GeneratedAt   time.Time      `json:"generated_at"`
+	UserID        int            `json:"user_id"`
+	AccountName   string         `json:"account_name"`
+	Counts        map[string]int `json:"counts"`
+	Files         []string       `json:"files"`
+}
+
+type exportProfile struct {
+	ID          int              `json:"id"`
+	AccountName string           `json:"account_name"`
+	DisplayName string           `json:"display_name"`
+	Bio         string           `json:"bio"`
+	Email       string           `json:"email"`
+	IsPrivate   bool             `json:"is_private"`
+	Avatar      string           `json:"avatar,omitempty"`
+	CreatedAt   time.Time        `json:"created_at"`
+	Identities  []exportIdentity `json:"identities"`
+}
+
+type exportIdentity struct {
+	Provider  string    `json:"provider"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type exportPost struct {
+	ID         int        `json:"id"`
+	Body       string     `json:"body"`
+	Mime       string     `json:"mime"`
+	Visibility string     `json:"visibility"`
+	Status     string     `json:"status"`
+	PublishAt  *time.Time `json:"publish_at,omitempty"`
+	Image      string     `json:"image"`
+	Images     []string   `json:"images,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type exportComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	ParentID  int       `json:"parent_id,omitempty"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// wakeExportWorker は待っているワーカーを起こす。起こせなくても次のポーリングで拾われる
+func wakeExportWorker() {
+	select {
+	case exportWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// runExportWorker は依頼されたエクスポートを作り、期限の切れた ZIP を消す
+func runExportWorker(ctx context.Context) {
+	ticker := time.NewTicker(exportPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := processDataExports(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Print(err)
+		}
+		if err := removeExpiredExports(ctx, time.Now()); err != nil && ctx.Err() == nil {
+			log.Print(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-exportWakeup:
+		}
+	}
+}
+
+// processDataExports は待っているエクスポートを取って作る。
+// 複数のプロセスで動かしても同じ依頼を二重に作らないよう、UPDATE で取れたものだけを作る
+func processDataExports(ctx context.Context, now time.Time) error {
+	stale := now.Add(-exportStaleAfter)
+	ids := []int{}
+	err := db.SelectContext(ctx, &ids,
+		fmt.Sprintf("SELECT `id` FROM `data_exports` WHERE `status` = ? OR (`status` = ? AND `started_at` < ?) ORDER BY `id` LIMIT %d", exportBatchSize),
+		exportStatusPending, exportStatusRunning, stale,
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		res, err := db.ExecContext(ctx,
+			"UPDATE `data_exports` SET `status` = ?, `started_at` = ? WHERE `id` = ? AND (`status` = ? OR (`status` = ? AND `started_at` < ?))",
+			exportStatusRunning, now, id, exportStatusPending, exportStatusRunning, stale,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		ex := DataExport{}
+		err = db.GetContext(ctx, &ex, "SELECT * FROM `data_exports` WHERE `id` = ?", id)
+		if err != nil {
+			return err
+		}
+		if err := finishDataExport(ctx, ex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func finishDataExport(ctx context.Context, ex DataExport) error {
+	u, err := getUser(db, ex.UserID)
+	if err != nil {
+		return err
+	}
+	// メールアドレスはキャッシュにないので読み直す
+	if err := loadUserCredentials(&u); err != nil {
+		return err
+	}
+
+	fileName := secureRandomStr(16)
+	size, buildErr := buildDataExport(ctx, u, exportPath(fileName))
+	now := time.Now()
+	if buildErr != nil {
+		log.Printf("data export %d: %s", ex.ID, buildErr)
+		msg := buildErr.Error()
+		if len(msg) > exportErrorMax {
+			msg = msg[:exportErrorMax]
+		}
+		_, err = db.ExecContext(ctx,
+			"UPDATE `data_exports` SET `status` = ?, `error` = ?, `finished_at` = ? WHERE `id` = ?",
+			exportStatusFailed, msg, now, ex.ID,
+		)
+		return err
+	}
+
+	_, err = db.ExecContext(ctx,
+		"UPDATE `data_exports` SET `status` = ?, `file_name` = ?, `size` = ?, `finished_at` = ?, `expires_at` = ? WHERE `id` = ?",
+		exportStatusDone, fileName, size, now, now.Add(getEnvDuration("ISUCONP_EXPORT_TTL", defaultExportTTL)), ex.ID,
+	)
+	if err != nil {
+		os.Remove(exportPath(fileName))
+		return err
+	}
+
+	if u.Email != "" {
+		err = mailer.Send(ctx, Mail{
+			To:      u.Email,
+			Subject: "Iscogram データのエクスポートができました",
+			Body:    fmt.Sprintf("%sさん\n\n依頼されたデータのエクスポートができました。アカウント設定の画面からダウンロードしてください。\n", u.AccountName),
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return nil
+}
+
+// buildDataExport はプロフィール・投稿と画像・コメントを ZIP にまとめて path に書く
+func buildDataExport(ctx context.Context, u User, path string) (int64, error) {
+	posts := []Post{}
+	err := db.SelectContext(ctx, &posts, "SELECT `id`, `user_id`, `body`, `mime`, `image_hash`, `visibility`, `status`, `publish_at`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at`, `id`", u.ID)
+	if err != nil {
+		return 0, err
+	}
+	comments := []Comment{}
+	err = db.SelectContext(ctx, &comments, "SELECT * FROM `comments` WHERE `user_id` = ? ORDER BY `created_at`, `id`", u.ID)
+	if err != nil {
+		return 0, err
+	}
+	identities := []UserIdentity{}
+	err = db.SelectContext(ctx, &identities, "SELECT * FROM `user_identities` WHERE `user_id` = ? ORDER BY `id`", u.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(exportDir, 0700); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(exportDir, ".export-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	zw := zip.NewWriter(tmp)
+	files := []string{}
+	writeFile := func(name string, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		files = append(files, name)
+		return err
+	}
+	writeJSON := func(name string, v interface{}) error {
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		return writeFile(name, data)
+	}
+
+	profile := exportProfile{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		DisplayName: u.DisplayName,
+		Bio:         u.Bio,
+		Email:       u.Email,
+		IsPrivate:   u.IsPrivate,
+		CreatedAt:   u.CreatedAt,
+		Identities:  []exportIdentity{},
+	}
+	for _, ident := range identities {
+		profile.Identities = append(profile.Identities, exportIdentity{Provider: ident.Provider, Email: ident.Email, CreatedAt: ident.CreatedAt})
+	}
+	if u.AvatarHash != "" {
+		data, err := os.ReadFile(avatarPath(u.ID, u.AvatarMime))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			profile.Avatar = "avatar." + getExt(u.AvatarMime)
+			if err := writeFile(profile.Avatar, data); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if err := writeJSON("profile.json", profile); err != nil {
+		return 0, err
+	}
+
+	postIDs := make([]int, len(posts))
+	for i, p := range posts {
+		postIDs[i] = p.ID
+	}
+	images, err := getPostImages(db, postIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	exported := make([]exportPost, 0, len(posts))
+	for _, p := range posts {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		ep := exportPost{ID: p.ID, Body: p.Body, Mime: p.Mime, Visibility: p.Visibility, Status: p.Status, CreatedAt: p.CreatedAt}
+		if p.PublishAt.Valid {
+			t := p.PublishAt.Time
+			ep.PublishAt = &t
+		}
+		data, err := loadImage(imageMeta{ID: p.ID, Mime: p.Mime})
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err == nil {
+			ep.Image = fmt.Sprintf("images/%d.%s", p.ID, getExt(p.Mime))
+			if err := writeFile(ep.Image, data); err != nil {
+				return 0, err
+			}
+		}
+		for _, img := range images[p.ID] {
+			if img.Position == 0 {
+				continue
+			}
+			data, err := os.ReadFile(postImagePath(p.ID, img.Position, img.Mime))
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			name := fmt.Sprintf("images/%d_%d.%s", p.ID, img.Position, getExt(img.Mime))
+			if err := writeFile(name, data); err != nil {
+				return 0, err
+			}
+			ep.Images = append(ep.Images, name)
+		}
+		exported = append(exported, ep)
+	}
+	if err := writeJSON("posts.json", exported); err != nil {
+		return 0, err
+	}
+
+	exportedComments := make([]exportComment, 0, len(comments))
+	for _, c := range comments {
+		exportedComments = append(exportedComments, exportComment{ID: c.ID, PostID: c.PostID, ParentID: c.ParentID, Comment: c.Comment, CreatedAt: c.CreatedAt})
+	}
+	if err := writeJSON("comments.json", exportedComments); err != nil {
+		return 0, err
+	}
+
+	// manifest.json は他のファイルの一覧なので最後に書く
+	manifest := exportManifest{
+		FormatVersion: exportFormatVersion,
+		GeneratedAt:   time.Now(),
+		UserID:        u.ID,
+		AccountName:   u.AccountName,
+		Counts:        map[string]int{"posts": len(exported), "comments": len(exportedComments)},
+		Files:         append([]string{}, files...),
+	}
+	if err := writeJSON("manifest.json", manifest); err != nil {
+		return 0, err
+	}
+	if err := zw.Close(); err != nil {
+		return 0, err
+	}
+
+	fi, err := tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// removeExpiredExports は期限の切れた ZIP と行を消す
+func removeExpiredExports(ctx context.Context, now time.Time) error {
+	expired := []DataExport{}
+	err := db.SelectContext(ctx, &expired, "SELECT * FROM `data_exports` WHERE `expires_at` <= ?", now)
+	if err != nil {
+		return err
+	}
+	for _, ex := range expired {
+		if err := removeDataExport(ctx, ex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeDataExport(ctx context.Context, ex DataExport) error {
+	if ex.FileName != "" {
+		if err := os.Remove(exportPath(ex.FileName)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	_, err := db.ExecContext(ctx, "DELETE FROM `data_exports` WHERE `id` = ?", ex.ID)
+	return err
+}
+
+func getUserDataExports(userID int) ([]DataExport, error) {
+	exports := []DataExport{}
+	err := db.Select(&exports, "SELECT * FROM `data_exports` WHERE `user_id` = ? ORDER BY `created_at` DESC, `id` DESC", userID)
+	return exports, err
+}
+
+func postAccountExport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !allowRequest(w, "export:user", strconv.Itoa(me.ID)) {
+		return
+	}
+
+	session := getSession(r)
+	exports, err := getUserDataExports(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, ex := range exports {
+		if ex.Status == exportStatusPending || ex.Status == exportStatusRunning {
+			session.Values["notice"] = "エクスポートを作成中です。できあがるまでお待ちください"
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/account", http.StatusFound)
+			return
+		}
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO `data_exports` (`user_id`, `status`, `created_at`) VALUES (?,?,?)",
+		me.ID, exportStatusPending, time.Now(),
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	wakeExportWorker()
+
+	session.Values["notice"] = "エクスポートを受け付けました。できあがるとここからダウンロードできます"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+func getAccountExport(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	ex := DataExport{}
+	err := db.Get(&ex, "SELECT * FROM `data_exports` WHERE `id` = ? AND `user_id` = ?", pat.Param(r, "id"), me.ID)
+	if err == sql.ErrNoRows || (err == nil && !ex.Downloadable(time.Now())) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	f, err := os.Open(exportPath(ex.FileName))
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="iscogram-%s-%s.zip"`, me.AccountName, ex.CreatedAt.Format("20060102")))
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeContent(w, r, "", ex.FinishedAt.Time, f)
+}
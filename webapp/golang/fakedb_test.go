@@ -0,0 +1,1895 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeDB はアプリが発行するクエリだけを解釈するメモリ上の DB。
+// テーブルの行は列名から値へのマップで持ち、クエリは正規表現で振り分ける
+type fakeDB struct {
+	mu      sync.Mutex
+	tables  map[string][]fakeRow
+	nextIDs map[string]int64
+	now     time.Time
+}
+
+type fakeRow map[string]driver.Value
+
+// fakeColumns は SELECT * で返す列の順番
+var fakeColumns = map[string][]string{
+	"users":                {"id", "account_name", "display_name", "bio", "avatar_mime", "avatar_hash", "is_private", "passhash", "email", "totp_secret", "totp_enabled", "totp_last_step", "authority", "del_flg", "deletion_scheduled_at", "deleted_at", "created_at"},
+	"posts":                {"id", "user_id", "mime", "imgdata", "image_hash", "body", "visibility", "status", "publish_at", "created_at"},
+	"comments":             {"id", "post_id", "user_id", "parent_id", "comment", "created_at"},
+	"comment_count":        {"post_id", "count"},
+	"post_images":          {"id", "post_id", "position", "mime", "image_hash", "created_at"},
+	"post_videos":          {"post_id", "duration_ms", "width", "height", "poster_mime", "poster_hash", "created_at"},
+	"user_sessions":        {"id", "user_id", "user_agent", "ip", "created_at", "last_active_at"},
+	"password_resets":      {"id", "user_id", "token_hash", "expires_at", "used_at", "created_at"},
+	"email_verifications":  {"id", "user_id", "email", "token_hash", "expires_at", "used_at", "created_at"},
+	"recovery_codes":       {"id", "user_id", "code_hash", "used_at", "created_at"},
+	"user_identities":      {"id", "user_id", "provider", "subject", "email", "created_at"},
+	"access_tokens":        {"id", "user_id", "name", "token_hash", "scopes", "last_used_at", "created_at"},
+	"data_exports":         {"id", "user_id", "status", "file_name", "size", "error", "created_at", "started_at", "finished_at", "expires_at"},
+	"follows":              {"follower_id", "followee_id", "status", "created_at"},
+	"blocks":               {"blocker_id", "blocked_id", "created_at"},
+	"mutes":                {"muter_id", "muted_id", "created_at"},
+	"comment_reactions":    {"comment_id", "user_id", "reaction", "created_at"},
+	"bookmarks":            {"user_id", "post_id", "collection_id", "created_at"},
+	"bookmark_collections": {"id", "user_id", "name", "created_at"},
+}
+
+// fakeDefaults は INSERT で省略された列の値
+var fakeDefaults = map[string]fakeRow{
+	"users":                {"display_name": "", "bio": "", "avatar_mime": "", "avatar_hash": "", "is_private": false, "email": "", "totp_secret": "", "totp_enabled": false, "totp_last_step": int64(0), "authority": int64(0), "del_flg": int64(0), "deletion_scheduled_at": nil, "deleted_at": nil},
+	"posts":                {"imgdata": nil, "image_hash": "", "visibility": "public", "status": "published", "publish_at": nil},
+	"comments":             {"parent_id": int64(0)},
+	"post_images":          {},
+	"post_videos":          {},
+	"password_resets":      {"used_at": nil},
+	"email_verifications":  {"used_at": nil},
+	"recovery_codes":       {"used_at": nil},
+	"user_identities":      {"email": ""},
+	"access_tokens":        {"last_used_at": nil},
+	"follows":              {},
+	"blocks":               {},
+	"mutes":                {},
+	"comment_reactions":    {},
+	"bookmarks":            {"collection_id": int64(0)},
+	"bookmark_collections": {},
+	"data_exports":         {"status": "pending", "file_name": "", "size": int64(0), "error": "", "started_at": nil, "finished_at": nil, "expires_at": nil},
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		tables:  map[string][]fakeRow{},
+		nextIDs: map[string]int64{},
+		now:     time.Date(2022, 6, 1, 12, 0, 0, 0, time.Local),
+	}
+}
+
+func (f *fakeDB) sqlx() *sqlx.DB {
+	return sqlx.NewDb(sql.OpenDB(fakeConnector{f}), "mysql")
+}
+
+// tick はデータを入れるたびに進む時刻を返す
+func (f *fakeDB) tick() time.Time {
+	f.now = f.now.Add(time.Second)
+	return f.now
+}
+
+func (f *fakeDB) insert(table string, row fakeRow) int64 {
+	for k, v := range fakeDefaults[table] {
+		if _, ok := row[k]; !ok {
+			row[k] = v
+		}
+	}
+	if _, ok := row["id"]; !ok && table != "comment_count" {
+		f.nextIDs[table]++
+		row["id"] = f.nextIDs[table]
+	} else if id, ok := row["id"].(int64); ok && id > f.nextIDs[table] {
+		f.nextIDs[table] = id
+	}
+	if _, ok := row["created_at"]; !ok && table != "comment_count" {
+		row["created_at"] = f.tick()
+	}
+	f.tables[table] = append(f.tables[table], row)
+	id, _ := row["id"].(int64)
+	return id
+}
+
+func (f *fakeDB) find(table string, match func(fakeRow) bool) []fakeRow {
+	rows := []fakeRow{}
+	for _, row := range f.tables[table] {
+		if match(row) {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+func (f *fakeDB) findOne(table, column string, value driver.Value) fakeRow {
+	for _, row := range f.tables[table] {
+		if fakeEqual(row[column], value) {
+			return row
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) remove(table string, match func(fakeRow) bool) int64 {
+	kept := []fakeRow{}
+	removed := int64(0)
+	for _, row := range f.tables[table] {
+		if match(row) {
+			removed++
+		} else {
+			kept = append(kept, row)
+		}
+	}
+	f.tables[table] = kept
+	return removed
+}
+
+func (f *fakeDB) snapshot() map[string][]fakeRow {
+	copied := make(map[string][]fakeRow, len(f.tables))
+	for table, rows := range f.tables {
+		copied[table] = make([]fakeRow, len(rows))
+		for i, row := range rows {
+			r := make(fakeRow, len(row))
+			for k, v := range row {
+				r[k] = v
+			}
+			copied[table][i] = r
+		}
+	}
+	return copied
+}
+
+// fakeEqual は driver.Value 同士を MySQL のように緩く比較する
+func fakeEqual(a, b driver.Value) bool {
+	return fakeString(a) == fakeString(b)
+}
+
+func fakeString(v driver.Value) string {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(ISO8601Format)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func fakeInt(v driver.Value) int64 {
+	n, _ := strconv.ParseInt(fakeString(v), 10, 64)
+	return n
+}
+
+func fakeTime(v driver.Value) time.Time {
+	switch v := v.(type) {
+	case time.Time:
+		return v
+	default:
+		s := fakeString(v)
+		for _, layout := range []string{ISO8601Format, seedDateFormat} {
+			if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+				return t
+			}
+		}
+		return time.Time{}
+	}
+}
+
+// fakeIDs は "1,2,3" のような IN 句の中身を読む
+func fakeIDs(s string) map[int64]bool {
+	ids := map[int64]bool{}
+	for _, v := range strings.Split(s, ",") {
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			ids[n] = true
+		}
+	}
+	return ids
+}
+
+// sortByCreatedAtDesc は created_at の新しい順、同じなら id の大きい順に並べる
+func sortByCreatedAtDesc(rows []fakeRow) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		ti, tj := fakeTime(rows[i]["created_at"]), fakeTime(rows[j]["created_at"])
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return fakeInt(rows[i]["id"]) > fakeInt(rows[j]["id"])
+	})
+}
+
+func reverseFakeRows(rows []fakeRow) {
+	for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+		rows[i], rows[j] = rows[j], rows[i]
+	}
+}
+
+// fakeExportClaimable は status = ? OR (status = ? AND started_at < ?) を評価する
+func fakeExportClaimable(r fakeRow, args []driver.Value) bool {
+	if fakeEqual(r["status"], args[0]) {
+		return true
+	}
+	return fakeEqual(r["status"], args[1]) && r["started_at"] != nil && fakeTime(r["started_at"]).Before(fakeTime(args[2]))
+}
+
+type fakeResultSet struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+// project は "p.id, p.user_id" や "*" のような列指定で行を取り出す
+func project(table, columnList string, rows []fakeRow) *fakeResultSet {
+	var columns []string
+	if strings.TrimSpace(columnList) == "*" {
+		columns = fakeColumns[table]
+	} else {
+		for _, c := range strings.Split(columnList, ",") {
+			c = strings.TrimSpace(c)
+			if i := strings.Index(c, "."); i >= 0 {
+				c = c[i+1:]
+			}
+			columns = append(columns, c)
+		}
+	}
+
+	rs := &fakeResultSet{columns: columns}
+	for _, row := range rows {
+		values := make([]driver.Value, len(columns))
+		for i, c := range columns {
+			values[i] = row[c]
+		}
+		rs.rows = append(rs.rows, values)
+	}
+	return rs
+}
+
+func scalar(column string, v driver.Value) *fakeResultSet {
+	return &fakeResultSet{columns: []string{column}, rows: [][]driver.Value{{v}}}
+}
+
+type fakeQuery struct {
+	re    *regexp.Regexp
+	query func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error)
+	exec  func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error)
+}
+
+// fakeQueries はバッククォートを除き空白をまとめたクエリに対して照合する
+var fakeQueries = []fakeQuery{
+	// users
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM users WHERE account_name = \? AND del_flg = 0$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("users", m[1], f.find("users", func(r fakeRow) bool {
+				return fakeEqual(r["account_name"], args[0]) && fakeInt(r["del_flg"]) == 0
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*|[\w, ]+) FROM users WHERE id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("users", m[1], f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM users WHERE id IN \(([\d, ]+)\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[2])
+			return project("users", m[1], f.find("users", func(r fakeRow) bool { return ids[fakeInt(r["id"])] })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT 1 FROM users WHERE account_name = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rs := &fakeResultSet{columns: []string{"1"}}
+			if f.findOne("users", "account_name", args[0]) != nil {
+				rs.rows = append(rs.rows, []driver.Value{int64(1)})
+			}
+			return rs, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO users \(account_name, passhash, email\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if f.findOne("users", "account_name", args[0]) != nil {
+				return 0, 0, &mysql.MySQLError{Number: 1062, Message: fmt.Sprintf("Duplicate entry '%s' for key 'account_name'", args[0])}
+			}
+			return f.insert("users", fakeRow{"account_name": fakeString(args[0]), "passhash": fakeString(args[1]), "email": fakeString(args[2])}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM users WHERE authority = 0 AND del_flg = 0 ORDER BY created_at DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("users", func(r fakeRow) bool { return fakeInt(r["authority"]) == 0 && fakeInt(r["del_flg"]) == 0 })
+			sortByCreatedAtDesc(rows)
+			return project("users", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET (del_flg|passhash|email) = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[1]) }) {
+				if m[1] == "del_flg" {
+					r[m[1]] = fakeInt(args[0])
+				} else {
+					r[m[1]] = fakeString(args[0])
+				}
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+
+	{
+		re: regexp.MustCompile(`^UPDATE users SET totp_secret = \?, totp_enabled = \?, totp_last_step = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[3]) }) {
+				r["totp_secret"] = fakeString(args[0])
+				r["totp_enabled"] = fakeInt(args[1]) != 0
+				r["totp_last_step"] = fakeInt(args[2])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET display_name = \?, bio = \?, is_private = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[3]) }) {
+				r["display_name"] = fakeString(args[0])
+				r["bio"] = fakeString(args[1])
+				r["is_private"] = fakeInt(args[2]) != 0
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET avatar_mime = \?, avatar_hash = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[2]) }) {
+				r["avatar_mime"] = fakeString(args[0])
+				r["avatar_hash"] = fakeString(args[1])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET totp_last_step = \? WHERE id = \? AND totp_last_step < \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[1]) && fakeInt(r["totp_last_step"]) < fakeInt(args[2])
+			}) {
+				r["totp_last_step"] = fakeInt(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+
+	// recovery_codes
+	{
+		re: regexp.MustCompile(`^DELETE FROM recovery_codes WHERE user_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("recovery_codes", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO recovery_codes \(user_id, code_hash, created_at\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("recovery_codes", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"code_hash":  fakeString(args[1]),
+				"created_at": fakeTime(args[2]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE recovery_codes SET used_at = \? WHERE user_id = \? AND code_hash = \? AND used_at IS NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("recovery_codes", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[1]) && fakeEqual(r["code_hash"], args[2]) && r["used_at"] == nil
+			}) {
+				r["used_at"] = fakeTime(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) FROM recovery_codes WHERE user_id = \? AND used_at IS NULL$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("recovery_codes", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) && r["used_at"] == nil })
+			return scalar("COUNT(*)", int64(len(rows))), nil
+		},
+	},
+
+	// user_identities
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM user_identities WHERE provider = \? AND subject = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("user_identities", func(r fakeRow) bool {
+				return fakeEqual(r["provider"], args[0]) && fakeEqual(r["subject"], args[1])
+			})
+			return project("user_identities", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM user_identities WHERE user_id = \? ORDER BY id$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("user_identities", m[1], f.find("user_identities", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO user_identities \(user_id, provider, subject, email, created_at\) VALUES \(\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find("user_identities", func(r fakeRow) bool {
+				return fakeEqual(r["provider"], args[1]) && fakeEqual(r["subject"], args[2])
+			})) > 0 {
+				return 0, 0, fmt.Errorf("fakedb: duplicate entry for key provider_subject")
+			}
+			return f.insert("user_identities", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"provider":   fakeString(args[1]),
+				"subject":    fakeString(args[2]),
+				"email":      fakeString(args[3]),
+				"created_at": fakeTime(args[4]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM user_identities WHERE user_id = \? AND provider = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("user_identities", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeEqual(r["provider"], args[1])
+			}), nil
+		},
+	},
+
+	// access_tokens
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM access_tokens WHERE token_hash = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("access_tokens", m[1], f.find("access_tokens", func(r fakeRow) bool { return fakeEqual(r["token_hash"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM access_tokens WHERE user_id = \? ORDER BY created_at DESC, id DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("access_tokens", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })
+			sortByCreatedAtDesc(rows)
+			return project("access_tokens", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) FROM access_tokens WHERE user_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("access_tokens", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })
+			return scalar("COUNT(*)", int64(len(rows))), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO access_tokens \(user_id, name, token_hash, scopes, created_at\) VALUES \(\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("access_tokens", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"name":       fakeString(args[1]),
+				"token_hash": fakeString(args[2]),
+				"scopes":     fakeString(args[3]),
+				"created_at": fakeTime(args[4]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE access_tokens SET last_used_at = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("access_tokens", func(r fakeRow) bool { return fakeEqual(r["id"], args[1]) }) {
+				r["last_used_at"] = fakeTime(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM access_tokens WHERE id = \? AND user_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("access_tokens", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[0]) && fakeEqual(r["user_id"], args[1])
+			}), nil
+		},
+	},
+
+	// posts
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM posts AS p JOIN users AS u ON u.id = p.user_id AND u.del_flg = 0 AND u.is_private = 0 WHERE p.visibility = 'public' AND p.status = 'published'(?: AND p.user_id NOT IN \(([\d,]+)\))?( AND p.created_at <= \?)? ORDER BY p.created_at DESC LIMIT (\d+)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			hidden := fakeIDs(m[2])
+			var max time.Time
+			if m[3] != "" {
+				max = fakeTime(args[0])
+			}
+			rows := f.find("posts", func(r fakeRow) bool {
+				u := f.findOne("users", "id", r["user_id"])
+				if u == nil || fakeInt(u["del_flg"]) != 0 || fakeInt(u["is_private"]) != 0 || fakeString(r["visibility"]) != "public" || fakeString(r["status"]) != "published" || hidden[fakeInt(r["user_id"])] {
+					return false
+				}
+				return max.IsZero() || !fakeTime(r["created_at"]).After(max)
+			})
+			sortByCreatedAtDesc(rows)
+			if limit, _ := strconv.Atoi(m[4]); len(rows) > limit {
+				rows = rows[:limit]
+			}
+			return project("posts", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM posts AS p JOIN users AS u ON u.id = p.user_id AND u.del_flg = 0 WHERE p.user_id IN \(([\d,]+)\) AND \(p.visibility <> 'public' OR u.is_private = 1\) AND \(p.visibility <> 'only_me' OR p.user_id = \?\) AND p.status = 'published'(?: AND p.user_id NOT IN \([\d,]+\))?( AND p.created_at <= \?)? ORDER BY p.created_at DESC LIMIT (\d+)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			// NOT IN に入るユーザーは authors から外してあるので見なくてよい
+			authors := fakeIDs(m[2])
+			var max time.Time
+			if m[3] != "" {
+				max = fakeTime(args[1])
+			}
+			rows := f.find("posts", func(r fakeRow) bool {
+				u := f.findOne("users", "id", r["user_id"])
+				if u == nil || fakeInt(u["del_flg"]) != 0 || !authors[fakeInt(r["user_id"])] || fakeString(r["status"]) != "published" {
+					return false
+				}
+				v := fakeString(r["visibility"])
+				if v == "public" && fakeInt(u["is_private"]) == 0 {
+					return false
+				}
+				if v == "only_me" && !fakeEqual(r["user_id"], args[0]) {
+					return false
+				}
+				return max.IsZero() || !fakeTime(r["created_at"]).After(max)
+			})
+			sortByCreatedAtDesc(rows)
+			if limit, _ := strconv.Atoi(m[4]); len(rows) > limit {
+				rows = rows[:limit]
+			}
+			return project("posts", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM posts WHERE user_id = \? AND status = 'published'(?: AND visibility (<>|=) '(\w+)')? ORDER BY created_at DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("posts", func(r fakeRow) bool {
+				if !fakeEqual(r["user_id"], args[0]) || fakeString(r["status"]) != "published" {
+					return false
+				}
+				switch m[2] {
+				case "=":
+					return fakeString(r["visibility"]) == m[3]
+				case "<>":
+					return fakeString(r["visibility"]) != m[3]
+				}
+				return true
+			})
+			sortByCreatedAtDesc(rows)
+			return project("posts", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+|\*) FROM posts WHERE (id|user_id) = \?( AND status = 'published')?(?: AND visibility (<>|=) '(\w+)')?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("posts", m[1], f.find("posts", func(r fakeRow) bool {
+				if !fakeEqual(r[m[2]], args[0]) || (m[3] != "" && fakeString(r["status"]) != "published") {
+					return false
+				}
+				switch m[4] {
+				case "=":
+					return fakeString(r["visibility"]) == m[5]
+				case "<>":
+					return fakeString(r["visibility"]) != m[5]
+				}
+				return true
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM posts WHERE user_id = \? AND status <> 'published' ORDER BY publish_at IS NULL, publish_at, created_at DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("posts", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeString(r["status"]) != "published"
+			})
+			sortByCreatedAtDesc(rows)
+			sort.SliceStable(rows, func(i, j int) bool {
+				a, b := rows[i]["publish_at"], rows[j]["publish_at"]
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				return a != nil && fakeTime(a).Before(fakeTime(b))
+			})
+			return project("posts", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE posts SET body = \?, visibility = \?, status = \?, publish_at = \?, created_at = COALESCE\(\?, created_at\) WHERE id = \? AND user_id = \? AND status <> 'published'$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("posts", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[5]) && fakeEqual(r["user_id"], args[6]) && fakeString(r["status"]) != "published"
+			}) {
+				r["body"], r["visibility"], r["status"], r["publish_at"] = fakeString(args[0]), fakeString(args[1]), fakeString(args[2]), args[3]
+				if args[4] != nil {
+					r["created_at"] = fakeTime(args[4])
+				}
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE posts SET status = 'published', created_at = \? WHERE status = 'scheduled' AND publish_at <= \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("posts", func(r fakeRow) bool {
+				return fakeString(r["status"]) == "scheduled" && r["publish_at"] != nil && !fakeTime(r["publish_at"]).After(fakeTime(args[1]))
+			}) {
+				r["status"], r["created_at"] = "published", fakeTime(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE posts SET image_hash = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("posts", func(r fakeRow) bool { return fakeEqual(r["id"], args[1]) }) {
+				r["image_hash"] = fakeString(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO posts \(user_id, mime, body, image_hash, visibility, status, publish_at\) VALUES \(\?,\?,\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("posts", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"mime":       fakeString(args[1]),
+				"body":       fakeString(args[2]),
+				"image_hash": fakeString(args[3]),
+				"visibility": fakeString(args[4]),
+				"status":     fakeString(args[5]),
+				"publish_at": args[6],
+			}), 1, nil
+		},
+	},
+
+	// post_images
+	{
+		re: regexp.MustCompile(`^INSERT INTO post_images \(post_id, position, mime, image_hash\) VALUES (\(\?,\?,\?,\?\)(?:,\(\?,\?,\?,\?\))*)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for i := 0; i+3 < len(args); i += 4 {
+				f.insert("post_images", fakeRow{
+					"post_id":    fakeInt(args[i]),
+					"position":   fakeInt(args[i+1]),
+					"mime":       fakeString(args[i+2]),
+					"image_hash": fakeString(args[i+3]),
+				})
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT post_id, position, mime, image_hash FROM post_images WHERE post_id IN \(([\d,]+)\) ORDER BY post_id, position$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[1])
+			rows := f.find("post_images", func(r fakeRow) bool { return ids[fakeInt(r["post_id"])] })
+			sort.SliceStable(rows, func(i, j int) bool {
+				if fakeInt(rows[i]["post_id"]) != fakeInt(rows[j]["post_id"]) {
+					return fakeInt(rows[i]["post_id"]) < fakeInt(rows[j]["post_id"])
+				}
+				return fakeInt(rows[i]["position"]) < fakeInt(rows[j]["position"])
+			})
+			return project("post_images", "post_id, position, mime, image_hash", rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT post_id, position, mime, image_hash FROM post_images WHERE post_id = \? AND position = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("post_images", "post_id, position, mime, image_hash", f.find("post_images", func(r fakeRow) bool {
+				return fakeEqual(r["post_id"], args[0]) && fakeEqual(r["position"], args[1])
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM post_images WHERE post_id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			max, _ := strconv.ParseInt(m[1], 10, 64)
+			return 0, f.remove("post_images", func(r fakeRow) bool { return fakeInt(r["post_id"]) > max }), nil
+		},
+	},
+
+	// post_videos
+	{
+		re: regexp.MustCompile(`^INSERT INTO post_videos \(post_id, duration_ms, width, height, poster_mime, poster_hash\) VALUES \(\?,\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			f.insert("post_videos", fakeRow{
+				"post_id":     fakeInt(args[0]),
+				"duration_ms": fakeInt(args[1]),
+				"width":       fakeInt(args[2]),
+				"height":      fakeInt(args[3]),
+				"poster_mime": fakeString(args[4]),
+				"poster_hash": fakeString(args[5]),
+			})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT post_id, duration_ms, width, height, poster_mime, poster_hash FROM post_videos WHERE post_id IN \(([\d,]+)\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[1])
+			return project("post_videos", "post_id, duration_ms, width, height, poster_mime, poster_hash", f.find("post_videos", func(r fakeRow) bool {
+				return ids[fakeInt(r["post_id"])]
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT post_id, duration_ms, width, height, poster_mime, poster_hash FROM post_videos WHERE post_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("post_videos", "post_id, duration_ms, width, height, poster_mime, poster_hash", f.find("post_videos", func(r fakeRow) bool {
+				return fakeEqual(r["post_id"], args[0])
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM post_videos WHERE post_id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			max, _ := strconv.ParseInt(m[1], 10, 64)
+			return 0, f.remove("post_videos", func(r fakeRow) bool { return fakeInt(r["post_id"]) > max }), nil
+		},
+	},
+
+	// follows
+	{
+		re: regexp.MustCompile(`^INSERT IGNORE INTO follows \(follower_id, followee_id, status, created_at\) VALUES \(\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["follower_id"], args[0]) && fakeEqual(r["followee_id"], args[1])
+			})) > 0 {
+				return 0, 0, nil
+			}
+			f.insert("follows", fakeRow{
+				"follower_id": fakeInt(args[0]),
+				"followee_id": fakeInt(args[1]),
+				"status":      fakeString(args[2]),
+				"created_at":  args[3],
+			})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT followee_id FROM follows WHERE follower_id = \? AND status = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("follows", "followee_id", f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["follower_id"], args[0]) && fakeEqual(r["status"], args[1])
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT follower_id FROM follows WHERE followee_id = \? AND status = \? ORDER BY created_at DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["followee_id"], args[0]) && fakeEqual(r["status"], args[1])
+			})
+			sortByCreatedAtDesc(rows)
+			return project("follows", "follower_id", rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT status FROM follows WHERE follower_id = \? AND followee_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("follows", "status", f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["follower_id"], args[0]) && fakeEqual(r["followee_id"], args[1])
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE follows SET status = \? WHERE follower_id = \? AND followee_id = \? AND status = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["follower_id"], args[1]) && fakeEqual(r["followee_id"], args[2]) && fakeEqual(r["status"], args[3])
+			}) {
+				r["status"] = fakeString(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE follows SET status = \? WHERE followee_id = \? AND status = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("follows", func(r fakeRow) bool {
+				return fakeEqual(r["followee_id"], args[1]) && fakeEqual(r["status"], args[2])
+			}) {
+				r["status"] = fakeString(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM follows WHERE follower_id = \? AND followee_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("follows", func(r fakeRow) bool {
+				return fakeEqual(r["follower_id"], args[0]) && fakeEqual(r["followee_id"], args[1])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (follows|blocks|mutes) WHERE (follower_id|blocker_id|muter_id) = (\d+) OR (followee_id|blocked_id|muted_id) = (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove(m[1], func(r fakeRow) bool {
+				return fakeEqual(r[m[2]], m[3]) || fakeEqual(r[m[4]], m[5])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM follows WHERE \(follower_id = \? AND followee_id = \?\) OR \(follower_id = \? AND followee_id = \?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("follows", func(r fakeRow) bool {
+				return (fakeEqual(r["follower_id"], args[0]) && fakeEqual(r["followee_id"], args[1])) ||
+					(fakeEqual(r["follower_id"], args[2]) && fakeEqual(r["followee_id"], args[3]))
+			}), nil
+		},
+	},
+
+	// blocks, mutes
+	{
+		re: regexp.MustCompile(`^INSERT IGNORE INTO (blocks|mutes) \((blocker_id|muter_id), (blocked_id|muted_id), created_at\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find(m[1], func(r fakeRow) bool {
+				return fakeEqual(r[m[2]], args[0]) && fakeEqual(r[m[3]], args[1])
+			})) > 0 {
+				return 0, 0, nil
+			}
+			f.insert(m[1], fakeRow{m[2]: fakeInt(args[0]), m[3]: fakeInt(args[1]), "created_at": args[2]})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (blocks|mutes) WHERE (blocker_id|muter_id) = \? AND (blocked_id|muted_id) = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove(m[1], func(r fakeRow) bool {
+				return fakeEqual(r[m[2]], args[0]) && fakeEqual(r[m[3]], args[1])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT blocked_id FROM blocks WHERE blocker_id = \? UNION SELECT blocker_id FROM blocks WHERE blocked_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rs := &fakeResultSet{columns: []string{"blocked_id"}}
+			seen := map[int64]bool{}
+			for _, r := range f.tables["blocks"] {
+				id := int64(0)
+				if fakeEqual(r["blocker_id"], args[0]) {
+					id = fakeInt(r["blocked_id"])
+				} else if fakeEqual(r["blocked_id"], args[1]) {
+					id = fakeInt(r["blocker_id"])
+				}
+				if id != 0 && !seen[id] {
+					seen[id] = true
+					rs.rows = append(rs.rows, []driver.Value{id})
+				}
+			}
+			return rs, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (blocked_id|muted_id) FROM (blocks|mutes) WHERE (blocker_id|muter_id) = \?( ORDER BY created_at DESC)?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find(m[2], func(r fakeRow) bool { return fakeEqual(r[m[3]], args[0]) })
+			if m[4] != "" {
+				sortByCreatedAtDesc(rows)
+			}
+			return project(m[2], m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) FROM blocks WHERE blocker_id = \? AND blocked_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return scalar("COUNT(*)", int64(len(f.find("blocks", func(r fakeRow) bool {
+				return fakeEqual(r["blocker_id"], args[0]) && fakeEqual(r["blocked_id"], args[1])
+			})))), nil
+		},
+	},
+
+	// comments
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) AS count FROM comments WHERE user_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return scalar("count", int64(len(f.find("comments", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })))), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) AS count FROM comments WHERE post_id IN \([?, ]+\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := map[int64]bool{}
+			for _, a := range args {
+				ids[fakeInt(a)] = true
+			}
+			return scalar("count", int64(len(f.find("comments", func(r fakeRow) bool { return ids[fakeInt(r["post_id"])] })))), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (.+) FROM (?:\(SELECT \*, ROW_NUMBER\(\) OVER \(PARTITION BY post_id ORDER BY created_at DESC\) AS rn FROM comments WHERE post_id IN \(([\d,]+)\) AND parent_id = 0(?: AND user_id NOT IN \(([\d,]+)\))?\) AS c JOIN users AS u ON c.user_id = u.id WHERE c.rn <= (\d+)|comments AS c JOIN users AS u ON c.user_id = u.id WHERE c.post_id IN \(([\d,]+)\)(?: AND c.user_id NOT IN \(([\d,]+)\))?) ORDER BY c.created_at DESC$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[2] + m[5])
+			hidden := fakeIDs(m[3] + m[6])
+			limit := 0
+			if m[4] != "" {
+				limit, _ = strconv.Atoi(m[4])
+			}
+
+			comments := f.find("comments", func(r fakeRow) bool {
+				return ids[fakeInt(r["post_id"])] && !hidden[fakeInt(r["user_id"])] && (limit == 0 || fakeInt(r["parent_id"]) == 0)
+			})
+			sortByCreatedAtDesc(comments)
+			perPost := map[int64]int{}
+			rows := []fakeRow{}
+			for _, c := range comments {
+				pid := fakeInt(c["post_id"])
+				if limit > 0 && perPost[pid] >= limit {
+					continue
+				}
+				u := f.findOne("users", "id", c["user_id"])
+				if u == nil {
+					continue
+				}
+				perPost[pid]++
+				row := fakeRow{"post_id": c["post_id"]}
+				for k, v := range c {
+					row["comment."+k] = v
+				}
+				for k, v := range u {
+					row["user."+k] = v
+				}
+				rows = append(rows, row)
+			}
+
+			// "c.id AS comment.id" のような列を別名で取り出す
+			rs := &fakeResultSet{}
+			for _, col := range strings.Split(m[1], ", ") {
+				parts := strings.Split(col, " AS ")
+				rs.columns = append(rs.columns, parts[len(parts)-1])
+			}
+			for _, row := range rows {
+				values := make([]driver.Value, len(rs.columns))
+				for i, c := range rs.columns {
+					values[i] = row[c]
+				}
+				rs.rows = append(rs.rows, values)
+			}
+			return rs, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO comments \(post_id, user_id, parent_id, comment\) VALUES \(\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("comments", fakeRow{
+				"post_id":   fakeInt(args[0]),
+				"user_id":   fakeInt(args[1]),
+				"parent_id": fakeInt(args[2]),
+				"comment":   fakeString(args[3]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (id, post_id, user_id) FROM comments WHERE id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("comments", m[1], f.find("comments", func(r fakeRow) bool { return fakeEqual(r["id"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT parent_id, COUNT\(\*\) AS count FROM comments WHERE parent_id IN \(([\d,]+)\) GROUP BY parent_id$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[1])
+			counts := map[int64]int64{}
+			order := []int64{}
+			for _, r := range f.find("comments", func(r fakeRow) bool { return ids[fakeInt(r["parent_id"])] }) {
+				pid := fakeInt(r["parent_id"])
+				if counts[pid] == 0 {
+					order = append(order, pid)
+				}
+				counts[pid]++
+			}
+			rs := &fakeResultSet{columns: []string{"parent_id", "count"}}
+			for _, pid := range order {
+				rs.rows = append(rs.rows, []driver.Value{pid, counts[pid]})
+			}
+			return rs, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE comments AS r JOIN comments AS p ON p.id = r.parent_id SET r.parent_id = 0 WHERE p.user_id = (\d+) AND p.id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			min, _ := strconv.ParseInt(m[2], 10, 64)
+			n := int64(0)
+			for _, r := range f.tables["comments"] {
+				if p := f.findOne("comments", "id", r["parent_id"]); p != nil && fakeEqual(p["user_id"], m[1]) && fakeInt(p["id"]) > min {
+					r["parent_id"] = int64(0)
+					n++
+				}
+			}
+			return 0, n, nil
+		},
+	},
+
+	// comment_reactions
+	{
+		re: regexp.MustCompile(`^SELECT comment_id, reaction, COUNT\(\*\) AS count FROM comment_reactions WHERE comment_id IN \(([\d,]+)\) GROUP BY comment_id, reaction$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[1])
+			type key struct {
+				commentID int64
+				reaction  string
+			}
+			counts := map[key]int64{}
+			order := []key{}
+			for _, r := range f.find("comment_reactions", func(r fakeRow) bool { return ids[fakeInt(r["comment_id"])] }) {
+				k := key{fakeInt(r["comment_id"]), fakeString(r["reaction"])}
+				if counts[k] == 0 {
+					order = append(order, k)
+				}
+				counts[k]++
+			}
+			rs := &fakeResultSet{columns: []string{"comment_id", "reaction", "count"}}
+			for _, k := range order {
+				rs.rows = append(rs.rows, []driver.Value{k.commentID, k.reaction, counts[k]})
+			}
+			return rs, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (comment_id, reaction) FROM comment_reactions WHERE user_id = \? AND comment_id IN \(([\d,]+)\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[2])
+			return project("comment_reactions", m[1], f.find("comment_reactions", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && ids[fakeInt(r["comment_id"])]
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT IGNORE INTO comment_reactions \(comment_id, user_id, reaction, created_at\) VALUES \(\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find("comment_reactions", func(r fakeRow) bool {
+				return fakeEqual(r["comment_id"], args[0]) && fakeEqual(r["user_id"], args[1]) && fakeEqual(r["reaction"], args[2])
+			})) > 0 {
+				return 0, 0, nil
+			}
+			f.insert("comment_reactions", fakeRow{"comment_id": fakeInt(args[0]), "user_id": fakeInt(args[1]), "reaction": fakeString(args[2]), "created_at": args[3]})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM comment_reactions WHERE comment_id = \? AND user_id = \? AND reaction = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("comment_reactions", func(r fakeRow) bool {
+				return fakeEqual(r["comment_id"], args[0]) && fakeEqual(r["user_id"], args[1]) && fakeEqual(r["reaction"], args[2])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM comment_reactions WHERE (?:user_id = (\d+) OR )?comment_id IN \(SELECT id FROM comments WHERE (post_id IN \(([\d,]+)\)|user_id = (\d+) AND id > (\d+))\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			min, _ := strconv.ParseInt(m[5], 10, 64)
+			comments := map[int64]bool{}
+			for _, c := range f.tables["comments"] {
+				if (m[3] != "" && fakeIDs(m[3])[fakeInt(c["post_id"])]) || (m[4] != "" && fakeEqual(c["user_id"], m[4]) && fakeInt(c["id"]) > min) {
+					comments[fakeInt(c["id"])] = true
+				}
+			}
+			return 0, f.remove("comment_reactions", func(r fakeRow) bool {
+				return (m[1] != "" && fakeEqual(r["user_id"], m[1])) || comments[fakeInt(r["comment_id"])]
+			}), nil
+		},
+	},
+
+	// bookmarks, bookmark_collections
+	{
+		re: regexp.MustCompile(`^SELECT (post_id) FROM bookmarks WHERE user_id = \? AND post_id IN \(([\d,]+)\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[2])
+			return project("bookmarks", m[1], f.find("bookmarks", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && ids[fakeInt(r["post_id"])]
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM bookmarks AS b JOIN posts AS p ON p.id = b.post_id JOIN users AS u ON u.id = p.user_id AND u.del_flg = 0 WHERE b.user_id = \? AND p.status = 'published' AND \(p.user_id = \? OR \(p.visibility = 'public' AND u.is_private = 0\)(?: OR \(p.user_id IN \(([\d,]+)\) AND p.visibility <> 'only_me'\))?\)(?: AND p.user_id NOT IN \(([\d,]+)\))?( AND b.collection_id = \?)?( AND p.created_at <= \?)? ORDER BY p.created_at DESC LIMIT (\d+)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			followees, hidden := fakeIDs(m[2]), fakeIDs(m[3])
+			userID, args := args[0], args[2:]
+			var collectionID driver.Value
+			if m[4] != "" {
+				collectionID, args = args[0], args[1:]
+			}
+			var max time.Time
+			if m[5] != "" {
+				max = fakeTime(args[0])
+			}
+			rows := []fakeRow{}
+			for _, b := range f.find("bookmarks", func(r fakeRow) bool { return fakeEqual(r["user_id"], userID) }) {
+				if collectionID != nil && !fakeEqual(b["collection_id"], collectionID) {
+					continue
+				}
+				p := f.findOne("posts", "id", b["post_id"])
+				if p == nil || fakeString(p["status"]) != "published" || hidden[fakeInt(p["user_id"])] {
+					continue
+				}
+				u := f.findOne("users", "id", p["user_id"])
+				if u == nil || fakeInt(u["del_flg"]) != 0 {
+					continue
+				}
+				own := fakeEqual(p["user_id"], userID)
+				public := fakeString(p["visibility"]) == "public" && fakeInt(u["is_private"]) == 0
+				followed := followees[fakeInt(p["user_id"])] && fakeString(p["visibility"]) != "only_me"
+				if !own && !public && !followed {
+					continue
+				}
+				if !max.IsZero() && fakeTime(p["created_at"]).After(max) {
+					continue
+				}
+				// b.collection_id は posts にない列なので、投稿の行に足して取り出す
+				row := fakeRow{"collection_id": b["collection_id"]}
+				for k, v := range p {
+					row[k] = v
+				}
+				rows = append(rows, row)
+			}
+			sortByCreatedAtDesc(rows)
+			if limit, _ := strconv.Atoi(m[6]); len(rows) > limit {
+				rows = rows[:limit]
+			}
+			return project("posts", m[1], rows), nil
+		},
+	},
+
+	{
+		re: regexp.MustCompile(`^DELETE FROM bookmarks WHERE user_id = \? AND post_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("bookmarks", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeEqual(r["post_id"], args[1])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT IGNORE INTO bookmarks \(user_id, post_id, created_at\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find("bookmarks", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeEqual(r["post_id"], args[1])
+			})) > 0 {
+				return 0, 0, nil
+			}
+			f.insert("bookmarks", fakeRow{"user_id": fakeInt(args[0]), "post_id": fakeInt(args[1]), "created_at": args[2]})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE bookmarks SET collection_id = (\?|0) WHERE user_id = \? AND (post_id|collection_id) = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			var collectionID driver.Value = int64(0)
+			if m[1] == "?" {
+				collectionID, args = fakeInt(args[0]), args[1:]
+			}
+			n := int64(0)
+			for _, r := range f.find("bookmarks", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeEqual(r[m[2]], args[1])
+			}) {
+				if !fakeEqual(r["collection_id"], collectionID) {
+					r["collection_id"] = collectionID
+					n++
+				}
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM bookmark_collections WHERE user_id = \? ORDER BY name$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("bookmark_collections", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })
+			sort.SliceStable(rows, func(i, j int) bool { return fakeString(rows[i]["name"]) < fakeString(rows[j]["name"]) })
+			return project("bookmark_collections", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT COUNT\(\*\) FROM bookmark_collections WHERE (id = \? AND )?user_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return scalar("COUNT(*)", int64(len(f.find("bookmark_collections", func(r fakeRow) bool {
+				if m[1] != "" {
+					return fakeEqual(r["id"], args[0]) && fakeEqual(r["user_id"], args[1])
+				}
+				return fakeEqual(r["user_id"], args[0])
+			})))), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT IGNORE INTO bookmark_collections \(user_id, name, created_at\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			if len(f.find("bookmark_collections", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeEqual(r["name"], args[1])
+			})) > 0 {
+				return 0, 0, nil
+			}
+			id := f.insert("bookmark_collections", fakeRow{"user_id": fakeInt(args[0]), "name": fakeString(args[1]), "created_at": args[2]})
+			return id, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM bookmark_collections WHERE id = \? AND user_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("bookmark_collections", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[0]) && fakeEqual(r["user_id"], args[1])
+			}), nil
+		},
+	},
+
+	// comment_count
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM comment_count WHERE post_id IN \(([\d,]+)\)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			ids := fakeIDs(m[2])
+			return project("comment_count", m[1], f.find("comment_count", func(r fakeRow) bool { return ids[fakeInt(r["post_id"])] })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO comment_count \(post_id, count\) VALUES \(\?, 0\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			f.insert("comment_count", fakeRow{"post_id": fakeInt(args[0]), "count": int64(0)})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE comment_count SET count = count\+1 WHERE post_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("comment_count", func(r fakeRow) bool { return fakeEqual(r["post_id"], args[0]) }) {
+				r["count"] = fakeInt(r["count"]) + 1
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+
+	// user_sessions
+	{
+		re: regexp.MustCompile(`^INSERT INTO user_sessions \(id, user_id, user_agent, ip, created_at, last_active_at\) VALUES \(\?,\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			f.insert("user_sessions", fakeRow{
+				"id":             fakeString(args[0]),
+				"user_id":        fakeInt(args[1]),
+				"user_agent":     fakeString(args[2]),
+				"ip":             fakeString(args[3]),
+				"created_at":     fakeTime(args[4]),
+				"last_active_at": fakeTime(args[5]),
+			})
+			return 0, 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*|id) FROM user_sessions WHERE (id|user_id) = \?( ORDER BY last_active_at DESC)?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("user_sessions", func(r fakeRow) bool { return fakeEqual(r[m[2]], args[0]) })
+			sort.SliceStable(rows, func(i, j int) bool {
+				return fakeTime(rows[i]["last_active_at"]).After(fakeTime(rows[j]["last_active_at"]))
+			})
+			return project("user_sessions", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE user_sessions SET last_active_at = \?, ip = \? WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("user_sessions", func(r fakeRow) bool { return fakeEqual(r["id"], args[2]) }) {
+				r["last_active_at"] = fakeTime(args[0])
+				r["ip"] = fakeString(args[1])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM user_sessions WHERE id = \? AND user_id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("user_sessions", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[0]) && fakeEqual(r["user_id"], args[1])
+			}), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM user_sessions WHERE user_id = \? AND id <> \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("user_sessions", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && !fakeEqual(r["id"], args[1])
+			}), nil
+		},
+	},
+
+	// password_resets
+	{
+		re: regexp.MustCompile(`^INSERT INTO password_resets \(user_id, token_hash, expires_at, created_at\) VALUES \(\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("password_resets", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"token_hash": fakeString(args[1]),
+				"expires_at": fakeTime(args[2]),
+				"created_at": fakeTime(args[3]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM password_resets WHERE token_hash = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("password_resets", m[1], f.find("password_resets", func(r fakeRow) bool { return fakeEqual(r["token_hash"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE (password_resets|email_verifications) SET used_at = \? WHERE (id|user_id) = \? AND used_at IS NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find(m[1], func(r fakeRow) bool { return fakeEqual(r[m[2]], args[1]) && r["used_at"] == nil }) {
+				r["used_at"] = fakeTime(args[0])
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+
+	// email_verifications
+	{
+		re: regexp.MustCompile(`^INSERT INTO email_verifications \(user_id, email, token_hash, expires_at, created_at\) VALUES \(\?,\?,\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("email_verifications", fakeRow{
+				"user_id":    fakeInt(args[0]),
+				"email":      fakeString(args[1]),
+				"token_hash": fakeString(args[2]),
+				"expires_at": fakeTime(args[3]),
+				"created_at": fakeTime(args[4]),
+			}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM email_verifications WHERE token_hash = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("email_verifications", m[1], f.find("email_verifications", func(r fakeRow) bool { return fakeEqual(r["token_hash"], args[0]) })), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (email) FROM email_verifications WHERE user_id = \? AND used_at IS NULL AND expires_at > \? ORDER BY id DESC LIMIT 1$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("email_verifications", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && r["used_at"] == nil && fakeTime(r["expires_at"]).After(fakeTime(args[1]))
+			})
+			if len(rows) > 1 {
+				rows = rows[len(rows)-1:]
+			}
+			return project("email_verifications", m[1], rows), nil
+		},
+	},
+
+	// 退会とエクスポート
+	{
+		re: regexp.MustCompile(`^UPDATE users SET deletion_scheduled_at = (\?|NULL) WHERE id = \? AND deleted_at IS NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			var at driver.Value
+			if m[1] == "?" {
+				at, args = args[0], args[1:]
+			}
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeEqual(r["id"], args[0]) && r["deleted_at"] == nil }) {
+				r["deletion_scheduled_at"] = at
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT id FROM users WHERE deletion_scheduled_at <= \? AND deleted_at IS NULL$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("users", "id", f.find("users", func(r fakeRow) bool {
+				return r["deletion_scheduled_at"] != nil && !fakeTime(r["deletion_scheduled_at"]).After(fakeTime(args[0])) && r["deleted_at"] == nil
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET account_name = \?, display_name = '', bio = '', avatar_mime = '', avatar_hash = '', is_private = 0, passhash = '', email = '', totp_secret = '', totp_enabled = 0, totp_last_step = 0, del_flg = 1, deletion_scheduled_at = NULL, deleted_at = \? WHERE id = \? AND deletion_scheduled_at <= \? AND deleted_at IS NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool {
+				return fakeEqual(r["id"], args[2]) && r["deletion_scheduled_at"] != nil && !fakeTime(r["deletion_scheduled_at"]).After(fakeTime(args[3])) && r["deleted_at"] == nil
+			}) {
+				for _, c := range []string{"display_name", "bio", "avatar_mime", "avatar_hash", "passhash", "email", "totp_secret"} {
+					r[c] = ""
+				}
+				r["account_name"] = fakeString(args[0])
+				r["is_private"] = false
+				r["totp_enabled"] = false
+				r["totp_last_step"] = int64(0)
+				r["del_flg"] = int64(1)
+				r["deletion_scheduled_at"] = nil
+				r["deleted_at"] = args[1]
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT id, mime FROM posts WHERE user_id = \? AND id > \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("posts", "id, mime", f.find("posts", func(r fakeRow) bool {
+				return fakeEqual(r["user_id"], args[0]) && fakeInt(r["id"]) > fakeInt(args[1])
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM comments WHERE user_id = (\d+) AND id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			min, _ := strconv.ParseInt(m[2], 10, 64)
+			return 0, f.remove("comments", func(r fakeRow) bool { return fakeEqual(r["user_id"], m[1]) && fakeInt(r["id"]) > min }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT DISTINCT post_id FROM comments WHERE user_id = \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			seen := map[int64]bool{}
+			rows := []fakeRow{}
+			for _, r := range f.find("comments", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) }) {
+				if !seen[fakeInt(r["post_id"])] {
+					seen[fakeInt(r["post_id"])] = true
+					rows = append(rows, r)
+				}
+			}
+			return project("comments", "post_id", rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (comments|comment_count|post_images|post_videos|bookmarks|posts) WHERE (post_id|id) IN \(([\d,]+)\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			ids := fakeIDs(m[3])
+			return 0, f.remove(m[1], func(r fakeRow) bool { return ids[fakeInt(r[m[2]])] }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (user_identities|access_tokens|recovery_codes|password_resets|email_verifications|data_exports|bookmarks|bookmark_collections) WHERE user_id = (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove(m[1], func(r fakeRow) bool { return fakeEqual(r["user_id"], m[2]) }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE comment_count AS cc SET cc.count = \(SELECT COUNT\(\*\) FROM comments AS c WHERE c.post_id = cc.post_id\) WHERE cc.post_id IN \(([\d,]+)\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			ids := fakeIDs(m[1])
+			n := int64(0)
+			for _, r := range f.find("comment_count", func(r fakeRow) bool { return ids[fakeInt(r["post_id"])] }) {
+				r["count"] = int64(len(f.find("comments", func(c fakeRow) bool { return fakeEqual(c["post_id"], r["post_id"]) })))
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT ([\w., ]+) FROM posts WHERE user_id = \? ORDER BY created_at, id$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("posts", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })
+			sortByCreatedAtDesc(rows)
+			reverseFakeRows(rows)
+			return project("posts", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM comments WHERE user_id = \? ORDER BY created_at, id$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("comments", func(r fakeRow) bool { return fakeEqual(r["user_id"], args[0]) })
+			sortByCreatedAtDesc(rows)
+			reverseFakeRows(rows)
+			return project("comments", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO data_exports \(user_id, status, created_at\) VALUES \(\?,\?,\?\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return f.insert("data_exports", fakeRow{"user_id": fakeInt(args[0]), "status": fakeString(args[1]), "created_at": args[2]}), 1, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM data_exports WHERE (id|user_id) = \?( AND user_id = \?)?( ORDER BY created_at DESC, id DESC)?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			rows := f.find("data_exports", func(r fakeRow) bool {
+				return fakeEqual(r[m[2]], args[0]) && (m[3] == "" || fakeEqual(r["user_id"], args[1]))
+			})
+			sortByCreatedAtDesc(rows)
+			return project("data_exports", m[1], rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT (\*) FROM data_exports WHERE expires_at <= \?$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			return project("data_exports", m[1], f.find("data_exports", func(r fakeRow) bool {
+				return r["expires_at"] != nil && !fakeTime(r["expires_at"]).After(fakeTime(args[0]))
+			})), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^SELECT id FROM data_exports WHERE status = \? OR \(status = \? AND started_at < \?\) ORDER BY id LIMIT (\d+)$`),
+		query: func(f *fakeDB, m []string, args []driver.Value) (*fakeResultSet, error) {
+			limit, _ := strconv.Atoi(m[1])
+			rows := f.find("data_exports", func(r fakeRow) bool { return fakeExportClaimable(r, args) })
+			if len(rows) > limit {
+				rows = rows[:limit]
+			}
+			return project("data_exports", "id", rows), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE data_exports SET status = \?, started_at = \? WHERE id = \? AND \(status = \? OR \(status = \? AND started_at < \?\)\)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("data_exports", func(r fakeRow) bool { return fakeEqual(r["id"], args[2]) && fakeExportClaimable(r, args[3:]) }) {
+				r["status"] = fakeString(args[0])
+				r["started_at"] = args[1]
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE data_exports SET status = \?, ((?:\w+ = \?, )*finished_at = \?(?:, expires_at = \?)?) WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			columns := []string{"status"}
+			for _, c := range strings.Split(m[1], ", ") {
+				columns = append(columns, strings.TrimSuffix(c, " = ?"))
+			}
+			n := int64(0)
+			for _, r := range f.find("data_exports", func(r fakeRow) bool { return fakeEqual(r["id"], args[len(args)-1]) }) {
+				for i, c := range columns {
+					r[c] = args[i]
+				}
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM data_exports WHERE id = \?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("data_exports", func(r fakeRow) bool { return fakeEqual(r["id"], args[0]) }), nil
+		},
+	},
+
+	// /initialize
+	{
+		re: regexp.MustCompile(`^DELETE FROM (users|posts|comments) WHERE id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			max, _ := strconv.ParseInt(m[2], 10, 64)
+			return 0, f.remove(m[1], func(r fakeRow) bool { return fakeInt(r["id"]) > max }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (user_sessions|user_identities|access_tokens) WHERE user_id > (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			max, _ := strconv.ParseInt(m[2], 10, 64)
+			return 0, f.remove(m[1], func(r fakeRow) bool { return fakeInt(r["user_id"]) > max }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET display_name = '', bio = '', avatar_mime = '', avatar_hash = '' WHERE display_name <> '' OR bio <> '' OR avatar_hash <> ''$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.tables["users"] {
+				if r["display_name"] != "" || r["bio"] != "" || r["avatar_hash"] != "" {
+					r["display_name"], r["bio"], r["avatar_mime"], r["avatar_hash"] = "", "", "", ""
+					n++
+				}
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET del_flg = (\d)(?: WHERE id % (\d+) = 0)?$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			mod, _ := strconv.ParseInt(m[2], 10, 64)
+			for _, r := range f.tables["users"] {
+				if mod == 0 || fakeInt(r["id"])%mod == 0 {
+					r["del_flg"] = fakeInt(m[1])
+					n++
+				}
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM (follows|blocks|mutes|comment_reactions|bookmarks|bookmark_collections|password_resets|email_verifications|recovery_codes)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove(m[1], func(fakeRow) bool { return true }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET passhash = SHA2\(CONCAT\(account_name, account_name, ':', SHA2\(account_name, 512\)\), 512\), email = '', totp_secret = '', totp_enabled = 0, totp_last_step = 0 WHERE id <= (\d+)$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			max, _ := strconv.ParseInt(m[1], 10, 64)
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeInt(r["id"]) <= max }) {
+				name := fakeString(r["account_name"])
+				r["passhash"], r["email"], r["totp_secret"], r["totp_enabled"], r["totp_last_step"] = seedPasshash(name, name+name), "", "", false, int64(0)
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET is_private = 0 WHERE is_private = 1$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return fakeInt(r["is_private"]) == 1 }) {
+				r["is_private"] = false
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM data_exports$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("data_exports", func(fakeRow) bool { return true }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET deleted_at = NULL WHERE deleted_at IS NOT NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return r["deleted_at"] != nil }) {
+				r["deleted_at"] = nil
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^UPDATE users SET deletion_scheduled_at = NULL WHERE deletion_scheduled_at IS NOT NULL$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			n := int64(0)
+			for _, r := range f.find("users", func(r fakeRow) bool { return r["deletion_scheduled_at"] != nil }) {
+				r["deletion_scheduled_at"] = nil
+				n++
+			}
+			return 0, n, nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^DELETE FROM comment_count$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			return 0, f.remove("comment_count", func(fakeRow) bool { return true }), nil
+		},
+	},
+	{
+		re: regexp.MustCompile(`^INSERT INTO comment_count \(post_id, count\) SELECT p.id, COUNT\(c.id\) FROM posts AS p LEFT JOIN comments AS c ON c.post_id = p.id GROUP BY p.id$`),
+		exec: func(f *fakeDB, m []string, args []driver.Value) (int64, int64, error) {
+			for _, p := range f.tables["posts"] {
+				n := len(f.find("comments", func(r fakeRow) bool { return fakeEqual(r["post_id"], p["id"]) }))
+				f.insert("comment_count", fakeRow{"post_id": p["id"], "count": int64(n)})
+			}
+			return 0, int64(len(f.tables["posts"])), nil
+		},
+	},
+}
+
+var fakeSpaceRegexp = regexp.MustCompile(`\s+`)
+
+func normalizeFakeQuery(query string) string {
+	return strings.TrimSpace(fakeSpaceRegexp.ReplaceAllString(strings.ReplaceAll(query, "`", ""), " "))
+}
+
+func (f *fakeDB) lookup(query string) (fakeQuery, []string, error) {
+	q := normalizeFakeQuery(query)
+	for _, fq := range fakeQueries {
+		if m := fq.re.FindStringSubmatch(q); m != nil {
+			return fq, m, nil
+		}
+	}
+	return fakeQuery{}, nil, fmt.Errorf("fakedb: unsupported query: %s", q)
+}
+
+func namedToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+	}
+	return values
+}
+
+type fakeConnector struct {
+	f *fakeDB
+}
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{f: c.f}, nil
+}
+
+func (c fakeConnector) Driver() driver.Driver {
+	return fakeDriver{}
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, fmt.Errorf("fakedb: use fakeConnector")
+}
+
+type fakeConn struct {
+	f      *fakeDB
+	backup map[string][]fakeRow
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	c.backup = c.f.snapshot()
+	return &fakeTx{c: c}, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+
+	fq, m, err := c.f.lookup(query)
+	if err != nil {
+		return nil, err
+	}
+	if fq.query == nil {
+		return nil, fmt.Errorf("fakedb: not a query: %s", query)
+	}
+	rs, err := fq.query(c.f, m, namedToValues(args))
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{rs: rs}, nil
+}
+
+func (c *fakeConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+
+	fq, m, err := c.f.lookup(query)
+	if err != nil {
+		return nil, err
+	}
+	if fq.exec == nil {
+		return nil, fmt.Errorf("fakedb: not a statement: %s", query)
+	}
+	id, n, err := fq.exec(c.f, m, namedToValues(args))
+	if err != nil {
+		return nil, err
+	}
+	return fakeResult{id: id, n: n}, nil
+}
+
+type fakeTx struct {
+	c *fakeConn
+}
+
+func (tx *fakeTx) Commit() error {
+	tx.c.backup = nil
+	return nil
+}
+
+func (tx *fakeTx) Rollback() error {
+	tx.c.f.mu.Lock()
+	defer tx.c.f.mu.Unlock()
+	if tx.c.backup != nil {
+		tx.c.f.tables = tx.c.backup
+		tx.c.backup = nil
+	}
+	return nil
+}
+
+type fakeStmt struct {
+	c     *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func toNamed(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, a := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: a}
+	}
+	return named
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.c.ExecContext(context.Background(), s.query, toNamed(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.c.QueryContext(context.Background(), s.query, toNamed(args))
+}
+
+type fakeResult struct {
+	id int64
+	n  int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) {
+	return r.id, nil
+}
+
+func (r fakeResult) RowsAffected() (int64, error) {
+	return r.n, nil
+}
+
+type fakeRows struct {
+	rs *fakeResultSet
+	i  int
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.rs.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rs.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rs.rows[r.i])
+	r.i++
+	return nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	visibilityPublic    = "public"
+	visibilityFollowers = "followers"
+	visibilityOnlyMe    = "only_me"
+
+	followStatusPending  = "pending"
+	followStatusApproved = "approved"
+)
+
+var postVisibilities = []string{visibilityPublic, visibilityFollowers, visibilityOnlyMe}
+
+var templateFollowers = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("followers.html"),
+))
+
+// timelineColumns はタイムラインの一覧で引く posts の列。imgdata は重いので含めない
+const timelineColumns = "p.`id`, p.`user_id`, p.`body`, p.`mime`, p.`image_hash`, p.`visibility`, p.`status`, p.`created_at`"
+
+func validVisibility(v string) bool {
+	for _, s := range postVisibilities {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// postViewer は投稿を見ているユーザー。承認済みのフォロー先やブロックの相手は必要になったときに一度だけ引く
+type postViewer struct {
+	User      User
+	followees map[int]bool
+	blocked   map[int]bool
+	muted     map[int]bool
+}
+
+func newPostViewer(u User) *postViewer {
+	return &postViewer{User: u}
+}
+
+func (v *postViewer) loadFollowees(q sqlx.Queryer) error {
+	if v.followees != nil {
+		return nil
+	}
+	ids := []int{}
+	if isLogin(v.User) {
+		err := sqlx.Select(q, &ids, "SELECT `followee_id` FROM `follows` WHERE `follower_id` = ? AND `status` = ?", v.User.ID, followStatusApproved)
+		if err != nil {
+			return err
+		}
+	}
+	v.followees = make(map[int]bool, len(ids))
+	for _, id := range ids {
+		v.followees[id] = true
+	}
+	return nil
+}
+
+func (v *postViewer) following(q sqlx.Queryer, userID int) (bool, error) {
+	if err := v.loadFollowees(q); err != nil {
+		return false, err
+	}
+	return v.followees[userID], nil
+}
+
+// canView は owner の visibility の投稿を見られるかを返す。
+// 鍵アカウントの投稿は公開範囲にかかわらずフォロワー限定として扱う
+func (v *postViewer) canView(q sqlx.Queryer, owner User, visibility string) (bool, error) {
+	if isLogin(v.User) && v.User.ID == owner.ID {
+		return true, nil
+	}
+	if visibility == visibilityOnlyMe {
+		return false, nil
+	}
+	blocking, err := v.blocking(q, owner.ID)
+	if err != nil || blocking {
+		return false, err
+	}
+	if visibility == visibilityPublic && !owner.IsPrivate {
+		return true, nil
+	}
+	return v.following(q, owner.ID)
+}
+
+// canViewPost は canView に加えて、下書きと予約投稿は公開されるまで本人にだけ見せる
+func (v *postViewer) canViewPost(q sqlx.Queryer, owner User, visibility, status string) (bool, error) {
+	if status != postStatusPublished && !(isLogin(v.User) && v.User.ID == owner.ID) {
+		return false, nil
+	}
+	return v.canView(q, owner, visibility)
+}
+
+// getTimelinePosts は viewer に見える新しい投稿を返す。
+// 誰にでも見える投稿はキャッシュを共有し、自分とフォロー先の限定公開の投稿だけを別に引いて混ぜる。
+// ブロックやミュートの相手がいるときは、ページが欠けないよう SQL の段階で外す
+func getTimelinePosts(q sqlx.Queryer, viewer *postViewer, maxCreatedAt string) ([]Post, error) {
+	results := []Post{}
+	hidden := []int{}
+	if isLogin(viewer.User) {
+		var err error
+		hidden, err = viewer.timelineHidden(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+	where := ""
+	args := []interface{}{}
+	if len(hidden) > 0 {
+		where += fmt.Sprintf(" AND p.`user_id` NOT IN (%s)", joinIDs(hidden))
+	}
+	if maxCreatedAt != "" {
+		where += " AND p.`created_at` <= ?"
+		args = append(args, maxCreatedAt)
+	}
+	publicQuery := fmt.Sprintf("SELECT %s FROM `posts` AS p JOIN `users` AS u ON u.`id` = p.`user_id` AND u.`del_flg` = 0 AND u.`is_private` = 0 WHERE p.`visibility` = 'public' AND p.`status` = 'published'%s ORDER BY p.`created_at` DESC LIMIT %d", timelineColumns, where, postsPerPage)
+	var err error
+	if where == "" {
+		err = cacheFetch(timelineCacheKey, timelineCacheTTL, &results, func() (interface{}, error) {
+			results := []Post{}
+			err := sqlx.Select(cacheFillDB(q), &results, publicQuery)
+			return results, err
+		})
+	} else {
+		err = sqlx.Select(q, &results, publicQuery, args...)
+	}
+	if err != nil || !isLogin(viewer.User) {
+		return results, err
+	}
+
+	if err := viewer.loadFollowees(q); err != nil {
+		return nil, err
+	}
+	authors := []int{viewer.User.ID}
+	for id := range viewer.followees {
+		if !viewer.blocked[id] && !viewer.muted[id] {
+			authors = append(authors, id)
+		}
+	}
+	sort.Ints(authors)
+
+	restricted := []Post{}
+	err = sqlx.Select(q, &restricted, fmt.Sprintf(
+		"SELECT %s FROM `posts` AS p JOIN `users` AS u ON u.`id` = p.`user_id` AND u.`del_flg` = 0 WHERE p.`user_id` IN (%s) AND (p.`visibility` <> 'public' OR u.`is_private` = 1) AND (p.`visibility` <> 'only_me' OR p.`user_id` = ?) AND p.`status` = 'published'%s ORDER BY p.`created_at` DESC LIMIT %d",
+		timelineColumns, joinIDs(authors), where, postsPerPage,
+	), append([]interface{}{viewer.User.ID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	if len(restricted) == 0 {
+		return results, nil
+	}
+
+	// どちらも新しい順に postsPerPage 件ずつなので、混ぜて先頭を取れば全体の先頭になる
+	merged := make([]Post, 0, len(results)+len(restricted))
+	merged = append(merged, results...)
+	merged = append(merged, restricted...)
+	sort.SliceStable(merged, func(i, j int) bool {
+		if !merged[i].CreatedAt.Equal(merged[j].CreatedAt) {
+			return merged[i].CreatedAt.After(merged[j].CreatedAt)
+		}
+		return merged[i].ID > merged[j].ID
+	})
+	if len(merged) > postsPerPage {
+		merged = merged[:postsPerPage]
+	}
+	return merged, nil
+}
+
+// userPostsVisibilityCondition は /@account で viewer に見せる投稿の条件を返す。何も見せないときは ok が false
+func userPostsVisibilityCondition(q sqlx.Queryer, viewer *postViewer, owner User) (string, bool, error) {
+	if isLogin(viewer.User) && viewer.User.ID == owner.ID {
+		return "", true, nil
+	}
+	blocking, err := viewer.blocking(q, owner.ID)
+	if err != nil || blocking {
+		return "", false, err
+	}
+	following, err := viewer.following(q, owner.ID)
+	if err != nil {
+		return "", false, err
+	}
+	if following {
+		return " AND `visibility` <> 'only_me'", true, nil
+	}
+	if owner.IsPrivate {
+		return "", false, nil
+	}
+	return " AND `visibility` = 'public'", true, nil
+}
+
+// followStatus は follower から followee へのフォローの状態を返す。フォローしていなければ空文字
+func followStatus(q sqlx.Queryer, followerID, followeeID int) (string, error) {
+	status := ""
+	err := sqlx.Get(q, &status, "SELECT `status` FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", followerID, followeeID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+func postFollow(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	target := User{}
+	err := db.Get(&target, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.FormValue("account_name"))
+	if err != nil || target.ID == me.ID {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// ブロックしている相手、されている相手はフォローできない
+	blocking, err := newPostViewer(me).blocking(db, target.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if blocking {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 鍵アカウントは承認を待つ
+	status := followStatusApproved
+	if target.IsPrivate {
+		status = followStatusPending
+	}
+	_, err = db.Exec(
+		"INSERT IGNORE INTO `follows` (`follower_id`, `followee_id`, `status`, `created_at`) VALUES (?,?,?,?)",
+		me.ID, target.ID, status, time.Now(),
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, "/@"+target.AccountName, http.StatusFound)
+}
+
+// postUnfollow はフォローをやめる。承認待ちのリクエストの取り下げにも使う
+func postUnfollow(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	target := User{}
+	err := db.Get(&target, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", r.FormValue("account_name"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", me.ID, target.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, "/@"+target.AccountName, http.StatusFound)
+}
+
+func getFollowerUsers(userID int, status string) ([]User, error) {
+	ids := []int{}
+	err := db.Select(&ids, "SELECT `follower_id` FROM `follows` WHERE `followee_id` = ? AND `status` = ? ORDER BY `created_at` DESC", userID, status)
+	if err != nil || len(ids) == 0 {
+		return []User{}, err
+	}
+	userMap, err := getUsers(db, ids)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]User, 0, len(ids))
+	for _, id := range ids {
+		if u := userMap[id]; u != nil && u.DelFlg == 0 {
+			users = append(users, *u)
+		}
+	}
+	return users, nil
+}
+
+func getFollowers(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	requests, err := getFollowerUsers(me.ID, followStatusPending)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	followers, err := getFollowerUsers(me.ID, followStatusApproved)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateFollowers.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+		Requests  []User
+		Followers []User
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), requests, followers})
+}
+
+func postFollowersApprove(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err := db.Exec(
+		"UPDATE `follows` SET `status` = ? WHERE `follower_id` = ? AND `followee_id` = ? AND `status` = ?",
+		followStatusApproved, r.FormValue("follower_id"), me.ID, followStatusPending,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	session := getSession(r)
+	session.Values["notice"] = "フォローリクエストを承認しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/followers", http.StatusFound)
+}
+
+// postFollowersRemove はフォローリクエストを断るか、承認済みのフォロワーを外す
+func postFollowersRemove(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err := db.Exec("DELETE FROM `follows` WHERE `follower_id` = ? AND `followee_id` = ?", r.FormValue("follower_id"), me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	pinPrimary(w, r)
+
+	session := getSession(r)
+	session.Values["notice"] = "フォロワーから外しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/followers", http.StatusFound)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func (a *testApp) setVisibility(postID int, visibility string) {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	a.fake.findOne("posts", "id", int64(postID))["visibility"] = visibility
+}
+
+func TestPostVisibility(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	app.addUser("carol", 0, 0)
+	public := app.addPost(mary, "public post", []byte("png"))
+	followers := app.addPost(mary, "followers post", []byte("png"))
+	app.setVisibility(followers, visibilityFollowers)
+	onlyMe := app.addPost(mary, "only me post", []byte("png"))
+	app.setVisibility(onlyMe, visibilityOnlyMe)
+	for _, pid := range []int{public, followers, onlyMe} {
+		app.addComment(pid, mary, "note")
+	}
+
+	owner := app.newClient()
+	owner.login("mary")
+	bob := app.newClient()
+	bob.login("bob")
+	assertRedirect(t, bob.postForm("/follow", url.Values{"account_name": {"mary"}, "csrf_token": {bob.csrfToken()}}), "/@mary")
+	carol := app.newClient()
+	carol.login("carol")
+	guest := app.newClient()
+
+	tests := []struct {
+		name  string
+		c     *testClient
+		want  map[string]bool
+		count int
+	}{
+		{"owner", owner, map[string]bool{"public post": true, "followers post": true, "only me post": true}, 3},
+		{"follower", bob, map[string]bool{"public post": true, "followers post": true, "only me post": false}, 2},
+		{"other", carol, map[string]bool{"public post": true, "followers post": false, "only me post": false}, 1},
+		{"guest", guest, map[string]bool{"public post": true, "followers post": false, "only me post": false}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{"/", "/@mary", "/posts?max_created_at=" + url.QueryEscape("2100-01-01T00:00:00+09:00")} {
+				body := tt.c.get(path).Body
+				for text, want := range tt.want {
+					if got := strings.Contains(body, text); got != want {
+						t.Errorf("%s: %q shown = %v, want %v", path, text, got, want)
+					}
+				}
+			}
+			// 投稿数と被コメント数も見える投稿だけで数える
+			body := tt.c.get("/@mary").Body
+			for _, class := range []string{"isu-post-count", "isu-commented-count"} {
+				if want := fmt.Sprintf(`<span class="%s">%d</span>`, class, tt.count); !strings.Contains(body, want) {
+					t.Errorf("%s not shown", want)
+				}
+			}
+			for pid, want := range map[int]bool{public: true, followers: tt.want["followers post"], onlyMe: tt.want["only me post"]} {
+				status := http.StatusNotFound
+				if want {
+					status = http.StatusOK
+				}
+				assertStatus(t, tt.c.get(fmt.Sprintf("/posts/%d", pid)), status)
+				assertStatus(t, tt.c.get(fmt.Sprintf("/image/%d.png", pid)), status)
+			}
+		})
+	}
+
+	res := bob.get(fmt.Sprintf("/image/%d.png", followers))
+	if got := res.Header.Get("Cache-Control"); got != restrictedImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+
+	// 見られない投稿にはコメントできない
+	assertStatus(t, carol.postForm("/comment", url.Values{"post_id": {fmt.Sprint(followers)}, "comment": {"hi"}, "csrf_token": {carol.csrfToken()}}), http.StatusNotFound)
+	assertRedirect(t, bob.postForm("/comment", url.Values{"post_id": {fmt.Sprint(followers)}, "comment": {"hi"}, "csrf_token": {bob.csrfToken()}}), fmt.Sprintf("/posts/%d", followers))
+}
+
+// postImageAs は公開範囲を指定して画像を投稿する
+func (c *testClient) postImageAs(csrfToken, visibility string, data []byte) *testResponse {
+	c.t.Helper()
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("body", "body")
+	mw.WriteField("visibility", visibility)
+	mw.WriteField("csrf_token", csrfToken)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+	h.Set("Content-Type", "image/png")
+	part, err := mw.CreatePart(h)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	part.Write(data)
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+"/", buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func TestPostIndexVisibility(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	assertRedirect(t, c.postImageAs(token, "everyone", []byte("png")), "/")
+	if !strings.Contains(c.get("/").Body, "公開範囲の指定が正しくありません") {
+		t.Error("invalid visibility is not rejected")
+	}
+	if n := app.count("posts"); n != 0 {
+		t.Fatalf("posts = %d, want 0", n)
+	}
+
+	assertStatus(t, c.postImageAs(token, visibilityOnlyMe, []byte("png")), http.StatusFound)
+	assertStatus(t, c.postImage(token, "default", "image/png", []byte("png")), http.StatusFound)
+	rows := app.fake.tables["posts"]
+	if len(rows) != 2 || fakeString(rows[0]["visibility"]) != visibilityOnlyMe || fakeString(rows[1]["visibility"]) != visibilityPublic {
+		t.Errorf("posts = %v", rows)
+	}
+	if !strings.Contains(c.get("/").Body, "自分のみ") {
+		t.Error("visibility label is not shown")
+	}
+}
+
+func TestPrivateAccount(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.addPost(mary, "mary post", []byte("png"))
+
+	owner := app.newClient()
+	owner.login("mary")
+	assertRedirect(t, owner.postProfile(map[string]string{"is_private": "1", "csrf_token": owner.csrfToken()}, "", nil), "/profile")
+	if row := app.fake.findOne("users", "id", int64(mary)); fakeInt(row["is_private"]) != 1 {
+		t.Fatalf("is_private = %v", row["is_private"])
+	}
+
+	c := app.newClient()
+	c.login("bob")
+	token := c.csrfToken()
+	if res := c.get("/@mary"); strings.Contains(res.Body, "mary post") || !strings.Contains(res.Body, "非公開アカウントです") {
+		t.Error("private account's posts are shown to a non-follower")
+	}
+	if strings.Contains(c.get("/").Body, "mary post") {
+		t.Error("private account's posts are shown on the timeline")
+	}
+
+	assertRedirect(t, c.postForm("/follow", url.Values{"account_name": {"mary"}, "csrf_token": {token}}), "/@mary")
+	if status := app.fake.findOne("follows", "follower_id", int64(bob))["status"]; fakeString(status) != followStatusPending {
+		t.Fatalf("status = %v, want pending", status)
+	}
+	if res := c.get("/@mary"); strings.Contains(res.Body, "mary post") || !strings.Contains(res.Body, "フォローリクエストを取り消す") {
+		t.Error("pending request is not shown")
+	}
+
+	res := owner.get("/followers")
+	if !strings.Contains(res.Body, `<div class="isu-follow-request" data-user-id="`+fmt.Sprint(bob)+`">`) {
+		t.Error("request is not listed")
+	}
+	assertStatus(t, owner.postForm("/followers/approve", url.Values{"follower_id": {fmt.Sprint(bob)}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	assertRedirect(t, owner.postForm("/followers/approve", url.Values{"follower_id": {fmt.Sprint(bob)}, "csrf_token": {owner.csrfToken()}}), "/followers")
+
+	if !strings.Contains(c.get("/@mary").Body, "mary post") || !strings.Contains(c.get("/").Body, "mary post") {
+		t.Error("approved follower cannot see the posts")
+	}
+	if strings.Contains(app.newClient().get("/").Body, "mary post") {
+		t.Error("private account's posts are shown to a guest")
+	}
+
+	assertRedirect(t, owner.postForm("/followers/remove", url.Values{"follower_id": {fmt.Sprint(bob)}, "csrf_token": {owner.csrfToken()}}), "/followers")
+	if strings.Contains(c.get("/@mary").Body, "mary post") {
+		t.Error("removed follower can still see the posts")
+	}
+
+	// 鍵を外すと待たせていたリクエストは承認される
+	assertRedirect(t, c.postForm("/follow", url.Values{"account_name": {"mary"}, "csrf_token": {token}}), "/@mary")
+	assertRedirect(t, owner.postProfile(map[string]string{"csrf_token": owner.csrfToken()}, "", nil), "/profile")
+	if status := app.fake.findOne("follows", "follower_id", int64(bob))["status"]; fakeString(status) != followStatusApproved {
+		t.Errorf("status = %v, want approved", status)
+	}
+	if !strings.Contains(app.newClient().get("/").Body, "mary post") {
+		t.Error("public account's posts are not shown on the timeline")
+	}
+
+	assertRedirect(t, c.postForm("/unfollow", url.Values{"account_name": {"mary"}, "csrf_token": {token}}), "/@mary")
+	if n := app.count("follows"); n != 0 {
+		t.Errorf("follows = %d, want 0", n)
+	}
+}
+
+func TestStaticFilesHidesImages(t *testing.T) {
+	h := staticFiles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/img/ajax-loader.gif", http.StatusOK},
+		{"/css/style.css", http.StatusOK},
+		{"/img/1.png", http.StatusNotFound},
+		{"/img/../img/12.jpg", http.StatusNotFound},
+		{"/img/avatars/1.png", http.StatusNotFound},
+		{"/img/avatars/", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s: status = %d, want %d", tt.path, w.Code, tt.status)
+		}
+	}
+}
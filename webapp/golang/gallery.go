@@ -0,0 +1,175 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+// MaxPostImages は 1 つの投稿に付けられる画像の枚数。合計のサイズは UploadLimit まで
+const MaxPostImages = 10
+
+// PostImage は投稿の position 番目の画像。0 枚目は posts の mime と image_hash と同じで、
+// post_images の行がない以前の投稿は posts の画像 1 枚だけとして扱う
+type PostImage struct {
+	PostID    int    `db:"post_id"`
+	Position  int    `db:"position"`
+	Mime      string `db:"mime"`
+	ImageHash string `db:"image_hash"`
+}
+
+type uploadedImage struct {
+	Data []byte
+	Mime string
+}
+
+// postImagePath は 0 枚目を今までどおり <id>.<ext> に、2 枚目からは <id>_<position>.<ext> に置く
+func postImagePath(postID, position int, mime string) string {
+	if position == 0 {
+		return imagePath(postID, mime)
+	}
+	return fmt.Sprintf("%s/%d_%d.%s", imageDir, postID, position, getExt(mime))
+}
+
+func postImageURL(img PostImage) string {
+	u := "/image/" + strconv.Itoa(img.PostID)
+	if img.Position > 0 {
+		u += "/" + strconv.Itoa(img.Position)
+	}
+	u += "." + getExt(img.Mime)
+	if img.ImageHash != "" {
+		u += "?v=" + imageVersion(img.ImageHash)
+	}
+	return u
+}
+
+// getPostImages は投稿の画像を position 順にまとめて引く。post_images の行がない投稿は含まない
+func getPostImages(q sqlx.Queryer, postIDs []int) (map[int][]PostImage, error) {
+	images := map[int][]PostImage{}
+	if len(postIDs) == 0 {
+		return images, nil
+	}
+	rows := []PostImage{}
+	err := sqlx.Select(q, &rows, fmt.Sprintf("SELECT `post_id`, `position`, `mime`, `image_hash` FROM `post_images` WHERE `post_id` IN (%s) ORDER BY `post_id`, `position`", joinIDs(postIDs)))
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range rows {
+		images[img.PostID] = append(images[img.PostID], img)
+	}
+	return images, nil
+}
+
+// readUploadedMedia は投稿とアイコンで共通のアップロードの読み込み。
+// field に付いた画像をすべて読み、1 枚ずつ形式を確かめ、合計が limit を超えたら断る。
+// video なら動画も 1 本だけ、VideoUploadLimit まで受け付ける。
+// ファイルがなければ (multipart でないときも) http.ErrMissingFile を返す
+func readUploadedMedia(r *http.Request, field string, max, limit int, video bool) ([]uploadedImage, error) {
+	// FormValue と同じ 32MB までをメモリに置く。もう読んであれば何もしない
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		return nil, http.ErrMissingFile
+	}
+	headers := r.MultipartForm.File[field]
+	if len(headers) == 0 {
+		return nil, http.ErrMissingFile
+	}
+	for _, header := range headers {
+		if !video || videoMimeType(header.Header.Get("Content-Type")) == "" {
+			continue
+		}
+		if len(headers) > 1 {
+			return nil, uploadError("動画は1本だけで投稿してください")
+		}
+		limit = VideoUploadLimit
+	}
+	if len(headers) > max {
+		return nil, uploadError(fmt.Sprintf("画像は%d枚までです", max))
+	}
+
+	images := make([]uploadedImage, 0, len(headers))
+	total := 0
+	for i, header := range headers {
+		// 1 枚のときは今までと同じ文言にする
+		prefix := ""
+		if len(headers) > 1 {
+			prefix = fmt.Sprintf("%d枚目: ", i+1)
+		}
+		contentType := header.Header.Get("Content-Type")
+		mime := imageMimeType(contentType)
+		if mime == "" && video {
+			mime = videoMimeType(contentType)
+		}
+		if mime == "" && video {
+			return nil, uploadError(prefix + "投稿できる形式はjpgとpngとgifとmp4とwebmだけです")
+		}
+		if mime == "" {
+			return nil, uploadError(prefix + "投稿できる画像形式はjpgとpngとgifだけです")
+		}
+
+		file, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(file, int64(limit-total)+1))
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		total += len(data)
+		if total > limit {
+			if len(headers) > 1 {
+				return nil, uploadError("画像の合計サイズが大きすぎます")
+			}
+			return nil, uploadError("ファイルサイズが大きすぎます")
+		}
+		images = append(images, uploadedImage{Data: data, Mime: mime})
+	}
+	return images, nil
+}
+
+// getPostImage は 2 枚目からの画像を返す。0 枚目は今までどおり getImage が返す
+func getPostImage(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(pat.Param(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	position, err := strconv.Atoi(pat.Param(r, "position"))
+	if err != nil || position <= 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rdb := readDB(r)
+	meta, restricted, ok := authorizeImage(w, r, rdb, pid)
+	if !ok {
+		return
+	}
+
+	img := PostImage{}
+	err = rdb.Get(&img, "SELECT `post_id`, `position`, `mime`, `image_hash` FROM `post_images` WHERE `post_id` = ? AND `position` = ?", pid, position)
+	if err == sql.ErrNoRows || (err == nil && pat.Param(r, "ext") != getExt(img.Mime)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	path := postImagePath(pid, position, img.Mime)
+	serveImage(w, r, img.ImageHash, img.Mime, meta.CreatedAt, restricted, path, func() (io.ReadSeeker, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
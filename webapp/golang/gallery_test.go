@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+type testUpload struct {
+	contentType string
+	data        []byte
+}
+
+// postImages は画像を何枚か付けて投稿する
+func (c *testClient) postImages(csrfToken string, fields map[string]string, files ...testUpload) *testResponse {
+	c.t.Helper()
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("csrf_token", csrfToken)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	for _, f := range files {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+		h.Set("Content-Type", f.contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write(f.data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+"/", buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func TestMultiImagePost(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	tooMany := make([]testUpload, MaxPostImages+1)
+	for i := range tooMany {
+		tooMany[i] = testUpload{"image/png", []byte("png")}
+	}
+	half := UploadLimit/2 + 1
+	tests := []struct {
+		name   string
+		files  []testUpload
+		notice string
+	}{
+		{"too many", tooMany, fmt.Sprintf("画像は%d枚までです", MaxPostImages)},
+		{"unsupported type", []testUpload{{"image/png", []byte("png")}, {"image/bmp", []byte("bmp")}}, "2枚目: 投稿できる形式はjpgとpngとgifとmp4とwebmだけです"},
+		{"total too large", []testUpload{{"image/png", make([]byte, half)}, {"image/png", make([]byte, half)}}, "画像の合計サイズが大きすぎます"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertRedirect(t, c.postImages(token, map[string]string{"body": "x"}, tt.files...), "/")
+			if res := c.get("/"); !strings.Contains(res.Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if n := app.count("posts"); n != 0 {
+		t.Fatalf("posts = %d, want 0", n)
+	}
+
+	res := c.postImages(token, map[string]string{"body": "gallery post"},
+		testUpload{"image/png", []byte("first")},
+		testUpload{"image/jpeg", []byte("second")},
+		testUpload{"image/gif", []byte("third")},
+	)
+	assertRedirect(t, res, "/posts/1")
+	if n := app.count("post_images"); n != 3 {
+		t.Fatalf("post_images = %d, want 3", n)
+	}
+	if row := app.fake.findOne("posts", "id", int64(1)); fakeString(row["mime"]) != "image/png" || fakeString(row["image_hash"]) != imageHash([]byte("first")) {
+		t.Errorf("cover = %v", row)
+	}
+	for _, f := range []struct {
+		path, data string
+	}{
+		{imagePath(1, "image/png"), "first"},
+		{postImagePath(1, 1, "image/jpeg"), "second"},
+		{postImagePath(1, 2, "image/gif"), "third"},
+	} {
+		if data, err := os.ReadFile(f.path); err != nil || string(data) != f.data {
+			t.Errorf("%s = %q, %v", f.path, data, err)
+		}
+	}
+
+	second := "/image/1/1.jpg?v=" + imageVersion(imageHash([]byte("second")))
+	for _, path := range []string{"/posts/1", "/"} {
+		body := c.get(path).Body
+		if !strings.Contains(body, `data-image-count="3"`) || !strings.Contains(body, second) || !strings.Contains(body, "/image/1/2.gif") {
+			t.Errorf("%s does not render the gallery", path)
+		}
+	}
+
+	res = c.get(second)
+	assertStatus(t, res, http.StatusOK)
+	if res.Body != "second" || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("image = %q, %q", res.Body, res.Header.Get("Content-Type"))
+	}
+	if got := res.Header.Get("Cache-Control"); got != immutableImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	assertStatus(t, c.get(second, "If-None-Match", res.Header.Get("ETag")), http.StatusNotModified)
+	assertStatus(t, c.get("/image/1/1.png"), http.StatusNotFound)
+	assertStatus(t, c.get("/image/1/0.png"), http.StatusNotFound)
+	assertStatus(t, c.get("/image/1/3.png"), http.StatusNotFound)
+
+	// 1 枚だけの投稿は今までどおり
+	assertRedirect(t, c.postImages(token, map[string]string{"body": "single"}, testUpload{"image/png", []byte("single")}), "/posts/2")
+	if strings.Contains(c.get("/posts/2").Body, "data-image-count") {
+		t.Error("single image post is rendered as a gallery")
+	}
+}
+
+func TestMultiImagePostVisibility(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+
+	res := c.postImages(c.csrfToken(), map[string]string{"body": "secret", "visibility": visibilityOnlyMe},
+		testUpload{"image/png", []byte("first")},
+		testUpload{"image/png", []byte("second")},
+	)
+	assertRedirect(t, res, "/posts/1")
+
+	res = c.get("/image/1/1.png")
+	assertStatus(t, res, http.StatusOK)
+	if got := res.Header.Get("Cache-Control"); got != restrictedImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	assertStatus(t, app.newClient().get("/image/1/1.png"), http.StatusNotFound)
+}
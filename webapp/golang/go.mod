@@ -6,12 +6,11 @@ require (
 	github.com/bradfitz/gomemcache v0.0.0-20220106215444-fb4bf637b56d
 	github.com/bradleypeabody/gorilla-sessions-memcache v0.0.0-20181103040241-659414f458e1
 	github.com/go-sql-driver/mysql v1.6.0
+	github.com/gorilla/securecookie v1.1.1
 	github.com/gorilla/sessions v1.2.1
 	github.com/jmoiron/sqlx v1.3.5
 	goji.io v2.0.2+incompatible
+	golang.org/x/sync v0.9.0
 )
 
-require (
-	github.com/gorilla/securecookie v1.1.1 // indirect
-	github.com/memcachier/mc v2.0.1+incompatible // indirect
-)
+require github.com/memcachier/mc v2.0.1+incompatible // indirect
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const (
+	imageCacheControl          = "public, max-age=3600"
+	immutableImageCacheControl = "public, max-age=31536000, immutable"
+	// 公開範囲を絞った投稿と公開前の投稿の画像は共有キャッシュに置かせず、毎回見られるか確かめる
+	restrictedImageCacheControl = "private, no-cache"
+	// imageURL に付けるハッシュの長さ
+	imageVersionLength = 16
+)
+
+type imageMeta struct {
+	ID         int       `db:"id"`
+	UserID     int       `db:"user_id"`
+	Mime       string    `db:"mime"`
+	Visibility string    `db:"visibility"`
+	Status     string    `db:"status"`
+	ImageHash  string    `db:"image_hash"`
+	CreatedAt  time.Time `db:"created_at"`
+}
+
+func imageHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func imageVersion(hash string) string {
+	if len(hash) < imageVersionLength {
+		return hash
+	}
+	return hash[:imageVersionLength]
+}
+
+func imagePath(id int, mime string) string {
+	return fmt.Sprintf("%s/%d.%s", imageDir, id, getExt(mime))
+}
+
+// loadImage は DB の imgdata を返す。新しい投稿は DB ではなくファイルに置いている
+func loadImage(meta imageMeta) ([]byte, error) {
+	var data []byte
+	err := db.Get(&data, "SELECT `imgdata` FROM `posts` WHERE `id` = ?", meta.ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		return data, nil
+	}
+	return os.ReadFile(imagePath(meta.ID, meta.Mime))
+}
+
+// etagMatches は If-None-Match に etag が含まれるかを弱い比較で調べる
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified は画像本体を読み込む前に 304 を返せるか判定する
+func notModified(r *http.Request, etag string, modtime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		if err != nil {
+			return false
+		}
+		return !modtime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// authorizeImage は画像の投稿を引き、リクエストしたユーザーが見られるかを確かめる。
+// 見られないときは 404 を書いて ok に false を返す。restricted なら共有キャッシュに置かせない
+func authorizeImage(w http.ResponseWriter, r *http.Request, rdb *sqlx.DB, pid int) (imageMeta, bool, bool) {
+	meta := imageMeta{}
+	err := rdb.Get(&meta, "SELECT `id`, `user_id`, `mime`, `image_hash`, `visibility`, `status`, `created_at` FROM `posts` WHERE `id` = ?", pid)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		return meta, false, false
+	}
+	if err != nil {
+		log.Print(err)
+		return meta, false, false
+	}
+
+	owner, err := getUser(rdb, meta.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return meta, false, false
+	}
+	// BAN されたユーザーや退会したユーザーの画像は誰にも見せない
+	if err == sql.ErrNoRows || owner.DelFlg != 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return meta, false, false
+	}
+	restricted := meta.Visibility != visibilityPublic || owner.IsPrivate || meta.Status != postStatusPublished
+	if restricted {
+		visible, err := newPostViewer(getAuthUser(r, scopeRead)).canViewPost(rdb, owner, meta.Visibility, meta.Status)
+		if err != nil {
+			log.Print(err)
+			return meta, false, false
+		}
+		if !visible {
+			w.WriteHeader(http.StatusNotFound)
+			return meta, false, false
+		}
+	}
+	return meta, restricted, true
+}
+
+// serveImage は ETag と Cache-Control を付けて画像を返す。
+// ファイルがあって ISUCONP_IMAGE_ACCEL_REDIRECT が設定されていれば nginx に返してもらい、なければ open で開く。
+// nginx には imageDir からの相対パスを渡す。ETag と Last-Modified はここで付けたものを nginx の設定で引き継がせる。
+// Range リクエストは http.ServeContent が扱うので、動画は途中から再生できる
+func serveImage(w http.ResponseWriter, r *http.Request, hash, mime string, modtime time.Time, restricted bool, file string, open func() (io.ReadSeeker, error)) {
+	etag := `"` + hash + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	if restricted {
+		w.Header().Set("Cache-Control", restrictedImageCacheControl)
+	} else if v := r.URL.Query().Get("v"); v != "" && v == imageVersion(hash) {
+		w.Header().Set("Cache-Control", immutableImageCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", imageCacheControl)
+	}
+
+	if notModified(r, etag, modtime) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", mime)
+
+	if prefix := os.Getenv("ISUCONP_IMAGE_ACCEL_REDIRECT"); prefix != "" {
+		if rel, err := filepath.Rel(imageDir, file); err == nil {
+			if _, err := os.Stat(file); err == nil {
+				w.Header().Set("X-Accel-Redirect", prefix+filepath.ToSlash(rel))
+				return
+			}
+		}
+	}
+
+	content, err := open()
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if c, ok := content.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	http.ServeContent(w, r, "", modtime, content)
+}
+
+func getImage(w http.ResponseWriter, r *http.Request) {
+	pidStr := pat.Param(r, "id")
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	meta, restricted, ok := authorizeImage(w, r, readDB(r), pid)
+	if !ok {
+		return
+	}
+
+	ext := pat.Param(r, "ext")
+	if ext == "" || ext != getExt(meta.Mime) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	var data []byte
+	if meta.ImageHash == "" {
+		// ハッシュを持っていない初期データはここで計算して保存しておく
+		data, err = loadImage(meta)
+		if err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		meta.ImageHash = imageHash(data)
+		_, err = db.Exec("UPDATE `posts` SET `image_hash` = ? WHERE `id` = ?", meta.ImageHash, meta.ID)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	serveImage(w, r, meta.ImageHash, meta.Mime, meta.CreatedAt, restricted, imagePath(meta.ID, meta.Mime), func() (io.ReadSeeker, error) {
+		if data == nil && isVideo(meta.Mime) {
+			// 動画は大きいので読み込まずにファイルから返す
+			f, err := os.Open(imagePath(meta.ID, meta.Mime))
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
+		}
+		if data == nil {
+			data, err = loadImage(meta)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return bytes.NewReader(data), nil
+	})
+}
+
+// staticFiles は ../public を配信する。投稿の画像とアイコンは公開範囲や BAN を確かめる /image と /avatar からだけ返す
+func staticFiles(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean(r.URL.Path)
+		dir, file := path.Split(p)
+		if (dir == "/img/" && imageFileRegexp.MatchString(file)) || p == "/img/avatars" || strings.HasPrefix(p, "/img/avatars/") {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
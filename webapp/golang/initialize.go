@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 初期データの範囲。これより大きい ID はベンチマーク中に作られたもの
+const (
+	seedMaxUserID    = 1000
+	seedMaxPostID    = 10000
+	seedMaxCommentID = 100000
+)
+
+var imageDir = "../public/img"
+
+// imageFileRegexp は投稿の画像ファイルの名前。2 枚目からは <id>_<position>.<ext>、動画のポスターは <id>_poster.<ext>
+var imageFileRegexp = regexp.MustCompile(`\A(\d+)(?:_\d+|_poster)?\.(jpg|png|gif|mp4|webm)\z`)
+
+var (
+	cacheFlushersMu sync.Mutex
+	cacheFlushers   []func()
+)
+
+// registerCacheFlusher は /initialize で捨てるプロセス内キャッシュを登録する
+func registerCacheFlusher(f func()) {
+	cacheFlushersMu.Lock()
+	defer cacheFlushersMu.Unlock()
+	cacheFlushers = append(cacheFlushers, f)
+}
+
+func flushCaches() {
+	cacheFlushersMu.Lock()
+	defer cacheFlushersMu.Unlock()
+	for _, f := range cacheFlushers {
+		f()
+	}
+}
+
+type initializeStep struct {
+	Name      string  `json:"name"`
+	Rows      int64   `json:"rows"`
+	ElapsedMs float64 `json:"elapsed_ms"`
+}
+
+type initializeResult struct {
+	Steps         []initializeStep `json:"steps"`
+	RemovedImages int              `json:"removed_images"`
+	ElapsedMs     float64          `json:"elapsed_ms"`
+}
+
+func elapsedMs(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+func dbInitialize(ctx context.Context) (*initializeResult, error) {
+	start := time.Now()
+	result := &initializeResult{}
+
+	steps := []struct {
+		name  string
+		query string
+	}{
+		{"delete_users", fmt.Sprintf("DELETE FROM `users` WHERE `id` > %d", seedMaxUserID)},
+		{"delete_posts", fmt.Sprintf("DELETE FROM `posts` WHERE `id` > %d", seedMaxPostID)},
+		{"delete_post_images", fmt.Sprintf("DELETE FROM `post_images` WHERE `post_id` > %d", seedMaxPostID)},
+		{"delete_post_videos", fmt.Sprintf("DELETE FROM `post_videos` WHERE `post_id` > %d", seedMaxPostID)},
+		{"delete_comments", fmt.Sprintf("DELETE FROM `comments` WHERE `id` > %d", seedMaxCommentID)},
+		{"delete_comment_reactions", "DELETE FROM `comment_reactions`"},
+		{"delete_bookmarks", "DELETE FROM `bookmarks`"},
+		{"delete_bookmark_collections", "DELETE FROM `bookmark_collections`"},
+		{"delete_user_sessions", fmt.Sprintf("DELETE FROM `user_sessions` WHERE `user_id` > %d", seedMaxUserID)},
+		{"delete_user_identities", fmt.Sprintf("DELETE FROM `user_identities` WHERE `user_id` > %d", seedMaxUserID)},
+		{"delete_access_tokens", fmt.Sprintf("DELETE FROM `access_tokens` WHERE `user_id` > %d", seedMaxUserID)},
+		{"delete_data_exports", "DELETE FROM `data_exports`"},
+		{"delete_password_resets", "DELETE FROM `password_resets`"},
+		{"delete_email_verifications", "DELETE FROM `email_verifications`"},
+		{"delete_recovery_codes", "DELETE FROM `recovery_codes`"},
+		{"delete_follows", "DELETE FROM `follows`"},
+		{"delete_blocks", "DELETE FROM `blocks`"},
+		{"delete_mutes", "DELETE FROM `mutes`"},
+		// 退会した初期データのユーザーは行を残してあるので戻す
+		{"restore_deleted_users", "UPDATE `users` SET `deleted_at` = NULL WHERE `deleted_at` IS NOT NULL"},
+		{"cancel_account_deletions", "UPDATE `users` SET `deletion_scheduled_at` = NULL WHERE `deletion_scheduled_at` IS NOT NULL"},
+		{"reset_profiles", "UPDATE `users` SET `display_name` = '', `bio` = '', `avatar_mime` = '', `avatar_hash` = '' WHERE `display_name` <> '' OR `bio` <> '' OR `avatar_hash` <> ''"},
+		{"reset_is_private", "UPDATE `users` SET `is_private` = 0 WHERE `is_private` = 1"},
+		// 初期データのパスワードは account_name を2回繰り返したもの。calculatePasshash と同じ計算を SQL でする
+		{"reset_credentials", fmt.Sprintf("UPDATE `users` SET `passhash` = SHA2(CONCAT(`account_name`, `account_name`, ':', SHA2(`account_name`, 512)), 512), `email` = '', `totp_secret` = '', `totp_enabled` = 0, `totp_last_step` = 0 WHERE `id` <= %d", seedMaxUserID)},
+		{"reset_del_flg", "UPDATE `users` SET `del_flg` = 0"},
+		{"ban_users", "UPDATE `users` SET `del_flg` = 1 WHERE `id` % 50 = 0"},
+		{"clear_comment_count", "DELETE FROM `comment_count`"},
+		{"rebuild_comment_count", "INSERT INTO `comment_count` (`post_id`, `count`) SELECT p.`id`, COUNT(c.`id`) FROM `posts` AS p LEFT JOIN `comments` AS c ON c.`post_id` = p.`id` GROUP BY p.`id`"},
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, step := range steps {
+		stepStart := time.Now()
+		res, err := tx.ExecContext(ctx, step.query)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.name, err)
+		}
+		rows, _ := res.RowsAffected()
+		result.Steps = append(result.Steps, initializeStep{Name: step.name, Rows: rows, ElapsedMs: elapsedMs(stepStart)})
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	removed, err := removeUploadedImages()
+	if err != nil {
+		return nil, err
+	}
+	result.RemovedImages = removed
+
+	if err := removeExportFiles(); err != nil {
+		return nil, err
+	}
+
+	flushCaches()
+
+	result.ElapsedMs = elapsedMs(start)
+	return result, nil
+}
+
+// removeUploadedImages は初期データより後に投稿された画像ファイルを消す
+func removeUploadedImages() (int, error) {
+	entries, err := os.ReadDir(imageDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, e := range entries {
+		m := imageFileRegexp.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		id, err := strconv.Atoi(m[1])
+		if err != nil || id <= seedMaxPostID {
+			continue
+		}
+		if err := os.Remove(filepath.Join(imageDir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+
+	// アイコンは初期データにないのですべて消す
+	avatars, err := os.ReadDir(filepath.Join(imageDir, "avatars"))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, err
+	}
+	for _, e := range avatars {
+		if err := os.Remove(filepath.Join(imageDir, "avatars", e.Name())); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed++
+	}
+
+	return removed, nil
+}
+
+// removeExportFiles はエクスポートの ZIP をすべて消す。行は data_exports ごと消している
+func removeExportFiles() error {
+	entries, err := os.ReadDir(exportDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		if err := os.Remove(filepath.Join(exportDir, e.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// validInitializeToken は ISUCONP_INITIALIZE_TOKEN が設定されていればそれと一致するか確認する
+func validInitializeToken(r *http.Request) bool {
+	expected := os.Getenv("ISUCONP_INITIALIZE_TOKEN")
+	if expected == "" {
+		return true
+	}
+
+	token := r.Header.Get("X-Initialize-Token")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1
+}
+
+func getInitialize(w http.ResponseWriter, r *http.Request) {
+	if !validInitializeToken(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	result, err := dbInitialize(r.Context())
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	log.Printf("initialized in %.1fms", result.ElapsedMs)
+	json.NewEncoder(w).Encode(result)
+}
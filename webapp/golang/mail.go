@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Mail は送信するプレーンテキストのメール
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MailSender はメールの送り先。本番は SMTP、手元ではファイルかログに書く
+type MailSender interface {
+	Send(ctx context.Context, m Mail) error
+}
+
+var mailer MailSender
+
+func newMailSenderFromEnv() MailSender {
+	from := getEnv("ISUCONP_MAIL_FROM", "noreply@iscogram.example")
+	switch sender := getEnv("ISUCONP_MAIL_SENDER", "log"); sender {
+	case "log":
+		return logMailSender{}
+	case "file":
+		return &fileMailSender{dir: getEnv("ISUCONP_MAIL_DIR", "/tmp/isuconp-mail"), from: from}
+	case "smtp":
+		return &smtpMailSender{
+			addr:     getEnv("ISUCONP_SMTP_ADDRESS", "localhost:25"),
+			username: os.Getenv("ISUCONP_SMTP_USER"),
+			password: os.Getenv("ISUCONP_SMTP_PASSWORD"),
+			from:     from,
+		}
+	default:
+		log.Fatalf("Unknown mail sender %q in ISUCONP_MAIL_SENDER.", sender)
+		return nil
+	}
+}
+
+// formatMail は RFC 5322 形式のメッセージを組み立てる
+func formatMail(from string, m Mail, now time.Time) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "From: %s\r\n", from)
+	fmt.Fprintf(buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
+
+// validMailHeader はヘッダーインジェクションになる改行を含んでいないか確かめる
+func validMailHeader(s string) bool {
+	return !strings.ContainsAny(s, "\r\n")
+}
+
+// logMailSender はメールをログに出すだけ
+type logMailSender struct{}
+
+func (logMailSender) Send(ctx context.Context, m Mail) error {
+	log.Printf("mail to=%s subject=%q\n%s", m.To, m.Subject, m.Body)
+	return nil
+}
+
+// fileMailSender は 1 通ずつ .eml ファイルとして書き出す
+type fileMailSender struct {
+	dir  string
+	from string
+	seq  uint64
+}
+
+func (s *fileMailSender) Send(ctx context.Context, m Mail) error {
+	if !validMailHeader(m.To) || !validMailHeader(m.Subject) {
+		return fmt.Errorf("mail: invalid header")
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s-%d.eml", now.Format("20060102T150405.000000000"), atomic.AddUint64(&s.seq, 1))
+	return os.WriteFile(filepath.Join(s.dir, name), formatMail(s.from, m, now), 0644)
+}
+
+// smtpMailSender は SMTP サーバーに渡す。ユーザーが設定されていれば PLAIN 認証する
+type smtpMailSender struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (s *smtpMailSender) Send(ctx context.Context, m Mail) error {
+	if !validMailHeader(m.To) || !validMailHeader(m.Subject) {
+		return fmt.Errorf("mail: invalid header")
+	}
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	return smtp.SendMail(s.addr, auth, s.from, []string{m.To}, formatMail(s.from, m, time.Now()))
+}
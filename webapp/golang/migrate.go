@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFS embed.FS
+
+const migrationLockTimeout = 10 // seconds
+
+var migrationFileRegexp = regexp.MustCompile(`\A(\d+)_(\w+)\.(up|down)\.sql\z`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type appliedMigration struct {
+	Version   int       `db:"version"`
+	Name      string    `db:"name"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+// loadMigrations は埋め込んだ migrations/NNNN_name.(up|down).sql をバージョン順に返す
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFS.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		m := migrationFileRegexp.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file name: %s", e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+
+		body, err := migrationFS.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		mg, ok := byVersion[version]
+		if !ok {
+			mg = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mg
+		} else if mg.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names: %s, %s", version, mg.Name, m[2])
+		}
+		if m[3] == "up" {
+			mg.Up = string(body)
+		} else {
+			mg.Down = string(body)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mg := range byVersion {
+		if mg.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up script", mg.Version, mg.Name)
+		}
+		migrations = append(migrations, *mg)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// splitStatements は ; で終わる行を区切りとして SQL を文ごとに分ける
+func splitStatements(script string) []string {
+	stmts := []string{}
+	var b strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		b.WriteString(line)
+		b.WriteString("\n")
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSpace(b.String()))
+			b.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(b.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+type migrator struct {
+	conn       *sqlx.Conn
+	migrations []migration
+}
+
+// newMigrator は他のプロセスと同時にマイグレーションしないようにロックを取る
+func newMigrator(ctx context.Context, conn *sqlx.DB) (*migrator, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := conn.Connx(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	locked := 0
+	err = c.GetContext(ctx, &locked, "SELECT GET_LOCK('schema_migrations', ?)", migrationLockTimeout)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if locked != 1 {
+		c.Close()
+		return nil, fmt.Errorf("another migration is running")
+	}
+
+	_, err = c.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `schema_migrations` ("+
+		"`version` int NOT NULL, "+
+		"`name` varchar(255) NOT NULL, "+
+		"`applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP, "+
+		"PRIMARY KEY (`version`)"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &migrator{conn: c, migrations: migrations}, nil
+}
+
+func (m *migrator) Close() error {
+	m.conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK('schema_migrations')")
+	return m.conn.Close()
+}
+
+func (m *migrator) applied(ctx context.Context) (map[int]appliedMigration, error) {
+	rows := []appliedMigration{}
+	err := m.conn.SelectContext(ctx, &rows, "SELECT `version`, `name`, `applied_at` FROM `schema_migrations` ORDER BY `version`")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]appliedMigration, len(rows))
+	for _, a := range rows {
+		applied[a.Version] = a
+	}
+	return applied, nil
+}
+
+// Up は未適用のマイグレーションを古い順に最大 steps 件適用する。steps が 0 以下なら全部
+func (m *migrator) Up(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []migration{}
+	for _, mg := range m.migrations {
+		if _, ok := applied[mg.Version]; ok {
+			continue
+		}
+		if steps > 0 && len(done) >= steps {
+			break
+		}
+
+		// MySQL の DDL は暗黙にコミットされるのでトランザクションにはできない
+		for _, stmt := range splitStatements(mg.Up) {
+			if _, err := m.conn.ExecContext(ctx, stmt); err != nil {
+				return done, fmt.Errorf("%04d_%s: %w", mg.Version, mg.Name, err)
+			}
+		}
+		_, err = m.conn.ExecContext(ctx, "INSERT INTO `schema_migrations` (`version`, `name`) VALUES (?, ?)", mg.Version, mg.Name)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, mg)
+	}
+
+	return done, nil
+}
+
+// Down は適用済みのマイグレーションを新しい順に steps 件戻す。
+// down のないマイグレーション (既存のテーブルを採用する 0001 など) は戻せず、そこで止まる
+func (m *migrator) Down(ctx context.Context, steps int) ([]migration, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	done := []migration{}
+	for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		mg := m.migrations[i]
+		if _, ok := applied[mg.Version]; !ok {
+			continue
+		}
+		if mg.Down == "" {
+			return done, fmt.Errorf("%04d_%s: irreversible (no down script)", mg.Version, mg.Name)
+		}
+
+		for _, stmt := range splitStatements(mg.Down) {
+			if _, err := m.conn.ExecContext(ctx, stmt); err != nil {
+				return done, fmt.Errorf("%04d_%s: %w", mg.Version, mg.Name, err)
+			}
+		}
+		_, err = m.conn.ExecContext(ctx, "DELETE FROM `schema_migrations` WHERE `version` = ?", mg.Version)
+		if err != nil {
+			return done, err
+		}
+		done = append(done, mg)
+	}
+
+	return done, nil
+}
+
+func (m *migrator) Status(ctx context.Context, w io.Writer) error {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return err
+	}
+
+	known := map[int]bool{}
+	for _, mg := range m.migrations {
+		known[mg.Version] = true
+		if a, ok := applied[mg.Version]; ok {
+			fmt.Fprintf(w, "%04d_%s\tapplied at %s\n", mg.Version, mg.Name, a.AppliedAt.Format(ISO8601Format))
+		} else {
+			fmt.Fprintf(w, "%04d_%s\tpending\n", mg.Version, mg.Name)
+		}
+	}
+	for _, a := range applied {
+		if !known[a.Version] {
+			fmt.Fprintf(w, "%04d_%s\tapplied at %s (missing in this binary)\n", a.Version, a.Name, a.AppliedAt.Format(ISO8601Format))
+		}
+	}
+
+	return nil
+}
+
+// runMigrate は `app migrate up|down|status` を実行する
+func runMigrate(args []string) int {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := fs.Int("steps", 0, "number of migrations to apply (up: 0 means all, down: 0 means 1)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: app migrate [-steps N] up|down|status")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	conn, _, err := openDB(primaryDSN())
+	if err != nil {
+		log.Printf("Failed to connect to DB: %s.", err.Error())
+		return 1
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	m, err := newMigrator(ctx, conn)
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+	defer m.Close()
+
+	var done []migration
+	switch fs.Arg(0) {
+	case "up":
+		done, err = m.Up(ctx, *steps)
+		for _, mg := range done {
+			fmt.Printf("applied %04d_%s\n", mg.Version, mg.Name)
+		}
+	case "down":
+		if *steps <= 0 {
+			*steps = 1
+		}
+		done, err = m.Down(ctx, *steps)
+		for _, mg := range done {
+			fmt.Printf("reverted %04d_%s\n", mg.Version, mg.Name)
+		}
+	case "status":
+		err = m.Status(ctx, os.Stdout)
+	default:
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	return 0
+}
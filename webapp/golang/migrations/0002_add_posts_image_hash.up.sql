@@ -0,0 +1,2 @@
+-- 画像の ETag とキャッシュ用 URL に使う内容の SHA-256
+ALTER TABLE `posts` ADD COLUMN `image_hash` varchar(64) NOT NULL DEFAULT '' AFTER `imgdata`;
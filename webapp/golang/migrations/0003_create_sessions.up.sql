@@ -0,0 +1,8 @@
+-- ISUCONP_SESSION_BACKEND=mysql のときのセッション置き場
+CREATE TABLE IF NOT EXISTS `sessions` (
+  `id` varchar(64) NOT NULL,
+  `data` blob NOT NULL,
+  `expires_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_expires_at` (`expires_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
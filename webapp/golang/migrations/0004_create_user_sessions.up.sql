@@ -0,0 +1,11 @@
+-- ログインごとの端末の一覧。行を消すとそのセッションはログアウト扱いになる
+CREATE TABLE IF NOT EXISTS `user_sessions` (
+  `id` varchar(64) NOT NULL,
+  `user_id` int NOT NULL,
+  `user_agent` varchar(255) NOT NULL DEFAULT '',
+  `ip` varchar(64) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  `last_active_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_user_id_last_active_at` (`user_id`, `last_active_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `password_resets`;
+ALTER TABLE `users` DROP COLUMN `email`;
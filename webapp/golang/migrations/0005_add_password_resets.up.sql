@@ -0,0 +1,15 @@
+-- パスワード再設定のメール送信先。登録時に任意で入れてもらう
+ALTER TABLE `users` ADD COLUMN `email` varchar(254) NOT NULL DEFAULT '' AFTER `passhash`;
+
+-- 再設定用のトークン。トークンそのものではなく SHA-256 を保存する
+CREATE TABLE IF NOT EXISTS `password_resets` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime NULL DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `idx_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,16 @@
+-- TOTP による二段階認証。totp_last_step は最後に使ったコードのステップで、同じコードの使い回しを防ぐ
+ALTER TABLE `users`
+  ADD COLUMN `totp_secret` varchar(64) NOT NULL DEFAULT '' AFTER `email`,
+  ADD COLUMN `totp_enabled` tinyint(1) NOT NULL DEFAULT 0 AFTER `totp_secret`,
+  ADD COLUMN `totp_last_step` bigint NOT NULL DEFAULT 0 AFTER `totp_enabled`;
+
+-- 回復コードは SHA-256 だけを保存する
+CREATE TABLE IF NOT EXISTS `recovery_codes` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used_at` datetime NULL DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
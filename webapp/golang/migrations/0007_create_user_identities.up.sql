@@ -0,0 +1,12 @@
+-- OpenID Connect で連携した外部アカウント。外部 ID だけで登録したユーザーは passhash が空になる
+CREATE TABLE IF NOT EXISTS `user_identities` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `provider` varchar(32) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `email` varchar(254) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `provider_subject` (`provider`, `subject`),
+  KEY `idx_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
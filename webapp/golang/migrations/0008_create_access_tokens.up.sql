@@ -0,0 +1,13 @@
+-- API クライアント用の個人アクセストークン。トークンそのものではなく SHA-256 を保存する
+CREATE TABLE IF NOT EXISTS `access_tokens` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `scopes` varchar(64) NOT NULL,
+  `last_used_at` datetime NULL DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
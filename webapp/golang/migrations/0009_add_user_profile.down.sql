@@ -0,0 +1,5 @@
+ALTER TABLE `users`
+  DROP COLUMN `avatar_hash`,
+  DROP COLUMN `avatar_mime`,
+  DROP COLUMN `bio`,
+  DROP COLUMN `display_name`;
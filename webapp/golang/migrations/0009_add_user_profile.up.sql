@@ -0,0 +1,6 @@
+-- プロフィール。アイコンの画像は投稿と同じく DB ではなくファイルに置き、avatar_hash で版を管理する
+ALTER TABLE `users`
+  ADD COLUMN `display_name` varchar(32) NOT NULL DEFAULT '' AFTER `account_name`,
+  ADD COLUMN `bio` varchar(300) NOT NULL DEFAULT '' AFTER `display_name`,
+  ADD COLUMN `avatar_mime` varchar(64) NOT NULL DEFAULT '' AFTER `bio`,
+  ADD COLUMN `avatar_hash` char(64) NOT NULL DEFAULT '' AFTER `avatar_mime`;
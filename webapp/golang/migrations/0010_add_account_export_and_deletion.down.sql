@@ -0,0 +1,5 @@
+ALTER TABLE `users`
+  DROP KEY `idx_deletion_scheduled_at`,
+  DROP COLUMN `deleted_at`,
+  DROP COLUMN `deletion_scheduled_at`;
+DROP TABLE IF EXISTS `data_exports`;
@@ -0,0 +1,22 @@
+-- データのエクスポート。ZIP はファイルに書き、file_name にはダウンロード用の推測できない名前を入れる
+CREATE TABLE IF NOT EXISTS `data_exports` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `status` varchar(16) NOT NULL DEFAULT 'pending',
+  `file_name` varchar(64) NOT NULL DEFAULT '',
+  `size` bigint NOT NULL DEFAULT 0,
+  `error` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  `started_at` datetime NULL DEFAULT NULL,
+  `finished_at` datetime NULL DEFAULT NULL,
+  `expires_at` datetime NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_user_id_created_at` (`user_id`, `created_at`),
+  KEY `idx_status` (`status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- 退会は deletion_scheduled_at を過ぎてから実行し、ユーザーの行は匿名化して deleted_at を入れる
+ALTER TABLE `users`
+  ADD COLUMN `deletion_scheduled_at` datetime NULL DEFAULT NULL AFTER `del_flg`,
+  ADD COLUMN `deleted_at` datetime NULL DEFAULT NULL AFTER `deletion_scheduled_at`,
+  ADD KEY `idx_deletion_scheduled_at` (`deletion_scheduled_at`);
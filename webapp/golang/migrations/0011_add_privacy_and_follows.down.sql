@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS `follows`;
+ALTER TABLE `posts` DROP COLUMN `visibility`;
+ALTER TABLE `users` DROP COLUMN `is_private`;
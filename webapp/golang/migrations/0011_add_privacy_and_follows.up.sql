@@ -0,0 +1,16 @@
+-- 鍵アカウントの投稿と、公開範囲を絞った投稿は承認済みのフォロワーにだけ見せる
+ALTER TABLE `users`
+  ADD COLUMN `is_private` tinyint(1) NOT NULL DEFAULT 0 AFTER `avatar_hash`;
+
+ALTER TABLE `posts`
+  ADD COLUMN `visibility` varchar(16) NOT NULL DEFAULT 'public' AFTER `body`;
+
+-- 鍵アカウントへのフォローは status = 'pending' で作り、相手が承認すると 'approved' になる
+CREATE TABLE IF NOT EXISTS `follows` (
+  `follower_id` int NOT NULL,
+  `followee_id` int NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`follower_id`, `followee_id`),
+  KEY `idx_followee_id_status` (`followee_id`, `status`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,16 @@
+-- ブロックはお互いの投稿とコメントを見えなくし、コメントもできなくする
+CREATE TABLE IF NOT EXISTS `blocks` (
+  `blocker_id` int NOT NULL,
+  `blocked_id` int NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`blocker_id`, `blocked_id`),
+  KEY `idx_blocked_id` (`blocked_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- ミュートは自分のタイムラインから相手の投稿を外すだけで、相手には何も変わらない
+CREATE TABLE IF NOT EXISTS `mutes` (
+  `muter_id` int NOT NULL,
+  `muted_id` int NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`muter_id`, `muted_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,11 @@
+-- 投稿の画像を順番付きで持つ。0 枚目は posts の mime と image_hash と同じものを入れる。
+-- 行のない以前の投稿は posts の画像 1 枚だけの投稿として扱う
+CREATE TABLE IF NOT EXISTS `post_images` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `post_id` int NOT NULL,
+  `position` int NOT NULL,
+  `mime` varchar(64) NOT NULL,
+  `image_hash` varchar(64) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY `idx_post_id_position` (`post_id`, `position`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
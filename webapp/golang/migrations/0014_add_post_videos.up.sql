@@ -0,0 +1,10 @@
+-- 動画の投稿の長さと大きさ、ポスター。動画そのものは posts の mime と image_hash で持つ
+CREATE TABLE IF NOT EXISTS `post_videos` (
+  `post_id` int NOT NULL PRIMARY KEY,
+  `duration_ms` int NOT NULL,
+  `width` int NOT NULL,
+  `height` int NOT NULL,
+  `poster_mime` varchar(64) NOT NULL,
+  `poster_hash` varchar(64) NOT NULL,
+  `created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
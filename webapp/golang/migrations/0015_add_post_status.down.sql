@@ -0,0 +1,5 @@
+ALTER TABLE `posts`
+  DROP KEY `idx_user_id_status`,
+  DROP KEY `idx_status_publish_at`,
+  DROP COLUMN `publish_at`,
+  DROP COLUMN `status`;
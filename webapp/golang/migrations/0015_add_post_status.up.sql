@@ -0,0 +1,6 @@
+-- 下書きと予約投稿。公開するときに created_at を公開した時刻にして、タイムラインの並びとページングはそのまま使う
+ALTER TABLE `posts`
+  ADD COLUMN `status` varchar(16) NOT NULL DEFAULT 'published' AFTER `visibility`,
+  ADD COLUMN `publish_at` datetime NULL DEFAULT NULL AFTER `status`,
+  ADD KEY `idx_status_publish_at` (`status`, `publish_at`),
+  ADD KEY `idx_user_id_status` (`user_id`, `status`);
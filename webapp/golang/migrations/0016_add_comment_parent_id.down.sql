@@ -0,0 +1,4 @@
+ALTER TABLE `comments`
+  DROP KEY `idx_parent_id`,
+  DROP KEY `idx_post_id_parent_id_created_at`,
+  DROP COLUMN `parent_id`;
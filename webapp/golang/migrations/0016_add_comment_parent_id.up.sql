@@ -0,0 +1,5 @@
+-- コメントへの返信。parent_id が 0 のコメントはトップレベルで、タイムラインにはトップレベルのコメントだけを出す
+ALTER TABLE `comments`
+  ADD COLUMN `parent_id` int NOT NULL DEFAULT 0 AFTER `user_id`,
+  ADD KEY `idx_post_id_parent_id_created_at` (`post_id`, `parent_id`, `created_at`),
+  ADD KEY `idx_parent_id` (`parent_id`);
@@ -0,0 +1,9 @@
+-- コメントへのリアクション。reaction には決まった種類の名前 (like など) を入れる
+CREATE TABLE IF NOT EXISTS `comment_reactions` (
+  `comment_id` int NOT NULL,
+  `user_id` int NOT NULL,
+  `reaction` varchar(16) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`comment_id`, `user_id`, `reaction`),
+  KEY `idx_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
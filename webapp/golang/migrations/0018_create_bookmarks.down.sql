@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS `bookmarks`;
+DROP TABLE IF EXISTS `bookmark_collections`;
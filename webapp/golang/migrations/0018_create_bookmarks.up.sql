@@ -0,0 +1,19 @@
+-- 投稿のブックマークと、自分だけに見えるコレクション。collection_id が 0 のブックマークはどのコレクションにも入っていない。
+-- コレクションはフォルダーとして扱い、ひとつのブックマークはひとつのコレクションにだけ入る
+CREATE TABLE IF NOT EXISTS `bookmark_collections` (
+  `id` int NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` int NOT NULL,
+  `name` varchar(64) NOT NULL,
+  `created_at` datetime NOT NULL,
+  UNIQUE KEY `idx_user_id_name` (`user_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `bookmarks` (
+  `user_id` int NOT NULL,
+  `post_id` int NOT NULL,
+  `collection_id` int NOT NULL DEFAULT 0,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`user_id`, `post_id`),
+  KEY `idx_user_id_collection_id` (`user_id`, `collection_id`),
+  KEY `idx_post_id` (`post_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
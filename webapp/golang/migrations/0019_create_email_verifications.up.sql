@@ -0,0 +1,14 @@
+-- メールアドレス変更の確認。新しいアドレスに送ったリンクが開かれるまで users.email は変えない。
+-- トークンそのものではなく SHA-256 を保存する
+CREATE TABLE IF NOT EXISTS `email_verifications` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `user_id` int NOT NULL,
+  `email` varchar(254) NOT NULL,
+  `token_hash` char(64) NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime NULL DEFAULT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  KEY `idx_user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
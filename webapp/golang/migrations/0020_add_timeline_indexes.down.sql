@@ -0,0 +1,9 @@
+ALTER TABLE `posts` MODIFY `imgdata` mediumblob NOT NULL;
+
+ALTER TABLE `comments`
+  DROP INDEX `idx_user_id`,
+  DROP INDEX `idx_post_id_created_at`;
+
+ALTER TABLE `posts`
+  DROP INDEX `idx_user_id_created_at`,
+  DROP INDEX `idx_created_at`;
@@ -0,0 +1,11 @@
+-- タイムライン、ユーザーページ、コメント一覧で使うインデックス
+ALTER TABLE `posts`
+  ADD INDEX `idx_created_at` (`created_at`),
+  ADD INDEX `idx_user_id_created_at` (`user_id`, `created_at`);
+
+ALTER TABLE `comments`
+  ADD INDEX `idx_post_id_created_at` (`post_id`, `created_at`),
+  ADD INDEX `idx_user_id` (`user_id`);
+
+-- 新しい投稿の画像はファイルに書き出すので imgdata は NULL を許す
+ALTER TABLE `posts` MODIFY `imgdata` mediumblob;
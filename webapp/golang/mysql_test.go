@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// newMySQLTestDB は ISUCONP_TEST_DSN の MySQL にマイグレーションを当て、テーブルを空にしてから db に差し替える。
+// fakeDB では確かめられない SQL (ウィンドウ関数や複数テーブルの UPDATE) を本物で動かすためのもので、
+// 中身を消すので捨ててよいデータベースを指定する (例: root@tcp(127.0.0.1:3306)/isuconp_test?parseTime=true&loc=Local)。
+// 未設定ならスキップする
+func newMySQLTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	dsn := os.Getenv("ISUCONP_TEST_DSN")
+	if dsn == "" {
+		t.Skip("ISUCONP_TEST_DSN is not set")
+	}
+	conn, err := sqlx.Open("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	ctx := context.Background()
+	m, err := newMigrator(ctx, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Up(ctx, 0)
+	m.Close()
+	if err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+
+	tables := []string{}
+	err = conn.Select(&tables, "SELECT `table_name` FROM `information_schema`.`tables` WHERE `table_schema` = DATABASE() AND `table_name` <> 'schema_migrations'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		mustExec(t, conn, fmt.Sprintf("TRUNCATE TABLE `%s`", table))
+	}
+
+	oldDB, oldCluster, oldCache, oldImageDir, oldExportDir := db, cluster, appCache, imageDir, exportDir
+	db = conn
+	cluster = nil
+	appCache = newLRUCache(1000)
+	imageDir = t.TempDir()
+	exportDir = t.TempDir()
+	t.Cleanup(func() {
+		db, cluster, appCache, imageDir, exportDir = oldDB, oldCluster, oldCache, oldImageDir, oldExportDir
+	})
+
+	return conn
+}
+
+func mustExec(t *testing.T, conn *sqlx.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := conn.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func TestMySQLCommentPreview(t *testing.T) {
+	conn := newMySQLTestDB(t)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	mustExec(t, conn, "INSERT INTO `users` (`id`, `account_name`, `passhash`) VALUES (1, 'mary', ''), (2, 'bob', '')")
+	mustExec(t, conn, "INSERT INTO `posts` (`id`, `user_id`, `mime`, `imgdata`, `body`) VALUES (1, 1, 'image/png', '', ''), (2, 2, 'image/png', '', '')")
+	for i, c := range []struct {
+		postID, userID, parentID int
+		comment                  string
+	}{
+		{1, 1, 0, "mary 1"},
+		{1, 1, 0, "mary 2"},
+		{1, 2, 0, "bob 3"},
+		{1, 2, 0, "bob 4"},
+		{1, 2, 0, "bob 5"},
+		{1, 2, 1, "reply to mary 1"},
+		{2, 1, 0, "mary on bob"},
+	} {
+		mustExec(t, conn, "INSERT INTO `comments` (`post_id`, `user_id`, `parent_id`, `comment`, `created_at`) VALUES (?,?,?,?,?)",
+			c.postID, c.userID, c.parentID, c.comment, base.Add(time.Duration(i)*time.Minute))
+	}
+
+	tests := []struct {
+		name   string
+		hidden []int
+		want   []string
+	}{
+		// 返信は数えず、トップレベルの新しい 3 件を古い順に
+		{"all", nil, []string{"bob 3", "bob 4", "bob 5"}},
+		// ブロックの相手を外してから 3 件を選ぶ
+		{"hidden", []int{2}, []string{"mary 1", "mary 2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			comments, err := queryPostComments(conn, []string{"1", "2"}, false, tt.hidden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, c := range comments[1].Comments {
+				got = append(got, c.Comment)
+				if c.Comment == "mary 1" && c.ReplyCount != 1 {
+					t.Errorf("reply count = %d, want 1", c.ReplyCount)
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("comments = %v, want %v", got, tt.want)
+			}
+			if n := len(comments[2].Comments); n != 1 {
+				t.Errorf("comments on post 2 = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestMySQLAccountDeletion(t *testing.T) {
+	conn := newMySQLTestDB(t)
+	now := time.Now().Truncate(time.Second)
+	mary, bob := seedMaxUserID+1, seedMaxUserID+2
+	post := seedMaxPostID + 1
+	comment := seedMaxCommentID + 1
+
+	mustExec(t, conn, "INSERT INTO `users` (`id`, `account_name`, `passhash`, `deletion_scheduled_at`) VALUES (?, 'mary', '', ?), (?, 'bob', '', NULL)", mary, now.Add(-time.Hour), bob)
+	mustExec(t, conn, "INSERT INTO `posts` (`id`, `user_id`, `mime`, `imgdata`, `body`) VALUES (?, ?, 'image/png', '', '')", post, bob)
+	mustExec(t, conn, "INSERT INTO `comments` (`id`, `post_id`, `user_id`, `parent_id`, `comment`) VALUES (?, ?, ?, 0, 'mary'), (?, ?, ?, ?, 'reply')",
+		comment, post, mary, comment+1, post, bob, comment)
+	mustExec(t, conn, "INSERT INTO `comment_count` (`post_id`, `count`) VALUES (?, 2)", post)
+
+	if err := deleteAccount(context.Background(), mary, now); err != nil {
+		t.Fatal(err)
+	}
+
+	u := User{}
+	if err := conn.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", mary); err != nil {
+		t.Fatal(err)
+	}
+	if u.AccountName != fmt.Sprintf(deletedAccountNameFormat, mary) || u.DelFlg != 1 || !u.DeletedAt.Valid {
+		t.Errorf("user = %+v", u)
+	}
+	// 返信は残してトップレベルに上げ、件数は数え直す
+	parentIDs := []int{}
+	if err := conn.Select(&parentIDs, "SELECT `parent_id` FROM `comments` WHERE `post_id` = ?", post); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(parentIDs) != "[0]" {
+		t.Errorf("remaining comments' parent_id = %v, want [0]", parentIDs)
+	}
+	count := 0
+	if err := conn.Get(&count, "SELECT `count` FROM `comment_count` WHERE `post_id` = ?", post); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("comment count = %d, want 1", count)
+	}
+}
+
+func TestMySQLBookmarkVisibility(t *testing.T) {
+	conn := newMySQLTestDB(t)
+	base := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	mustExec(t, conn, "INSERT INTO `users` (`id`, `account_name`, `passhash`, `is_private`, `del_flg`) VALUES (1, 'mary', '', 0, 0), (2, 'bob', '', 0, 0), (3, 'carol', '', 1, 0), (4, 'dave', '', 0, 0), (5, 'eve', '', 0, 1), (6, 'frank', '', 0, 0)")
+	mustExec(t, conn, "INSERT INTO `follows` (`follower_id`, `followee_id`, `status`, `created_at`) VALUES (1, 4, ?, ?), (1, 3, ?, ?)", followStatusApproved, base, followStatusPending, base)
+	mustExec(t, conn, "INSERT INTO `blocks` (`blocker_id`, `blocked_id`, `created_at`) VALUES (6, 1, ?)", base)
+	posts := []struct {
+		userID     int
+		visibility string
+		status     string
+		visible    bool
+	}{
+		{1, visibilityOnlyMe, postStatusPublished, true},
+		{2, visibilityPublic, postStatusPublished, true},
+		{3, visibilityPublic, postStatusPublished, false}, // 承認待ちの鍵アカウント
+		{4, visibilityFollowers, postStatusPublished, true},
+		{4, visibilityOnlyMe, postStatusPublished, false},
+		{5, visibilityPublic, postStatusPublished, false}, // BAN された
+		{2, visibilityPublic, postStatusDraft, false},
+		{6, visibilityPublic, postStatusPublished, false}, // ブロックされた
+	}
+	want := []int{}
+	for i, p := range posts {
+		id := i + 1
+		mustExec(t, conn, "INSERT INTO `posts` (`id`, `user_id`, `mime`, `imgdata`, `body`, `visibility`, `status`, `created_at`) VALUES (?, ?, 'image/png', '', '', ?, ?, ?)",
+			id, p.userID, p.visibility, p.status, base.Add(time.Duration(i)*time.Minute))
+		mustExec(t, conn, "INSERT INTO `bookmarks` (`user_id`, `post_id`, `created_at`) VALUES (1, ?, ?)", id, base)
+		if p.visible {
+			want = append([]int{id}, want...)
+		}
+	}
+
+	rows, err := getBookmarkPosts(conn, newPostViewer(User{ID: 1, AccountName: "mary"}), 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []int{}
+	for _, r := range rows {
+		got = append(got, r.ID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("bookmarked posts = %v, want %v", got, want)
+	}
+}
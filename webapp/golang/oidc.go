@@ -0,0 +1,710 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"goji.io/pat"
+)
+
+const (
+	oidcFlowTTL      = 10 * time.Minute
+	oidcClockSkew    = time.Minute
+	oidcJWKSMinFetch = time.Minute
+
+	sessionKeyOIDCProvider = "oidc_provider"
+	sessionKeyOIDCState    = "oidc_state"
+	sessionKeyOIDCNonce    = "oidc_nonce"
+	sessionKeyOIDCVerifier = "oidc_verifier"
+	sessionKeyOIDCUntil    = "oidc_until"
+	sessionKeyOIDCLinkUser = "oidc_link_user_id"
+)
+
+var oidcProviderNameRegexp = regexp.MustCompile(`\A[a-z0-9_]+\z`)
+
+var templateIdentities = template.Must(template.ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("identities.html")),
+)
+
+// oidcProviders は「〜でログイン」に出す OpenID Connect のプロバイダー
+var (
+	oidcProviders  []*oidcProvider
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// UserIdentity は外部の ID とユーザーの対応。provider と subject の組で一意になる
+type UserIdentity struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Provider  string    `db:"provider"`
+	Subject   string    `db:"subject"`
+	Email     string    `db:"email"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider はディスカバリーと公開鍵を初めて使うときに取りに行き、覚えておく
+type oidcProvider struct {
+	Name         string
+	Label        string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	mu            sync.Mutex
+	discovery     *oidcDiscovery
+	keys          map[string]*rsa.PublicKey
+	keysFetchedAt time.Time
+}
+
+// loadOIDCProvidersFromEnv は ISUCONP_OIDC_PROVIDERS に並べた名前ごとに
+// ISUCONP_OIDC_<NAME>_ISSUER などを読む
+func loadOIDCProvidersFromEnv() []*oidcProvider {
+	var providers []*oidcProvider
+	for _, name := range strings.Split(os.Getenv("ISUCONP_OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !oidcProviderNameRegexp.MatchString(name) {
+			log.Fatalf("Invalid OIDC provider name %q in ISUCONP_OIDC_PROVIDERS.", name)
+		}
+		prefix := "ISUCONP_OIDC_" + strings.ToUpper(name) + "_"
+		p := &oidcProvider{
+			Name:         name,
+			Label:        getEnv(prefix+"LABEL", name),
+			Issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+		if p.Issuer == "" || p.ClientID == "" {
+			log.Fatalf("%sISSUER and %sCLIENT_ID are required.", prefix, prefix)
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+func findOIDCProvider(name string) *oidcProvider {
+	for _, p := range oidcProviders {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func oidcGetJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: status %d", u, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := &oidcDiscovery{}
+	err := oidcGetJSON(ctx, p.Issuer+"/.well-known/openid-configuration", d)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("oidc: issuer mismatch: %q", d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete discovery document for %s", p.Issuer)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+type oidcJWK struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func parseRSAJWK(k oidcJWK) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if len(n) < 256 || !exp.IsInt64() || exp.Int64() < 3 || exp.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("oidc: unsupported RSA key %q", k.Kid)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+// publicKey は kid の鍵を返す。知らない kid ならローテーションされたとみて取り直す
+func (p *oidcProvider) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetchedAt) < oidcJWKSMinFetch {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+
+	var jwks struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	err = oidcGetJSON(ctx, d.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := parseRSAJWK(k)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	p.keys, p.keysFetchedAt = keys, time.Now()
+
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("oidc: unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+func (p *oidcProvider) redirectURI() string {
+	return baseURL() + "/auth/" + p.Name + "/callback"
+}
+
+// oidcAudience は文字列と配列のどちらで来ても受け取れるようにする
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+func (a oidcAudience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type idTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expiry            int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     bool         `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// verifyIDToken は RS256 の署名と iss・aud・exp・nonce を確かめる
+func (p *oidcProvider) verifyIDToken(ctx context.Context, raw, nonce string, now time.Time) (idTokenClaims, error) {
+	claims := idTokenClaims{}
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return claims, fmt.Errorf("oidc: malformed id_token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(b, &header); err != nil {
+		return claims, err
+	}
+	if header.Alg != "RS256" {
+		return claims, fmt.Errorf("oidc: unsupported alg %q", header.Alg)
+	}
+
+	key, err := p.publicKey(ctx, header.Kid)
+	if err != nil {
+		return claims, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return claims, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return claims, fmt.Errorf("oidc: invalid signature: %w", err)
+	}
+
+	b, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return claims, err
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != p.Issuer:
+		return claims, fmt.Errorf("oidc: issuer mismatch: %q", claims.Issuer)
+	case !claims.Audience.contains(p.ClientID):
+		return claims, fmt.Errorf("oidc: audience mismatch: %v", claims.Audience)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return claims, fmt.Errorf("oidc: azp mismatch: %q", claims.AuthorizedParty)
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)):
+		return claims, fmt.Errorf("oidc: id_token expired")
+	case claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return claims, fmt.Errorf("oidc: id_token issued in the future")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return claims, fmt.Errorf("oidc: nonce mismatch")
+	case claims.Subject == "":
+		return claims, fmt.Errorf("oidc: sub is empty")
+	}
+	return claims, nil
+}
+
+// exchangeCode は認可コードをトークンに交換し、検証した ID トークンを返す
+func (p *oidcProvider) exchangeCode(ctx context.Context, r *http.Request, code, verifier, nonce string) (idTokenClaims, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.redirectURI()},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	defer res.Body.Close()
+
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&token)
+	if err != nil {
+		return idTokenClaims{}, err
+	}
+	if res.StatusCode != http.StatusOK || token.IDToken == "" {
+		return idTokenClaims{}, fmt.Errorf("oidc: token endpoint: status %d error %q", res.StatusCode, token.Error)
+	}
+
+	return p.verifyIDToken(ctx, token.IDToken, nonce, time.Now())
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func clearOIDCFlow(values map[interface{}]interface{}) {
+	for _, k := range []string{sessionKeyOIDCProvider, sessionKeyOIDCState, sessionKeyOIDCNonce, sessionKeyOIDCVerifier, sessionKeyOIDCUntil, sessionKeyOIDCLinkUser} {
+		delete(values, k)
+	}
+}
+
+// startOIDCFlow は state・nonce・PKCE をセッションに置いてプロバイダーに送り出す
+func startOIDCFlow(w http.ResponseWriter, r *http.Request, p *oidcProvider, linkUserID int) {
+	d, err := p.getDiscovery(r.Context())
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	state, nonce, verifier := secureRandomStr(16), secureRandomStr(16), secureRandomStr(32)
+	session := getSession(r)
+	clearOIDCFlow(session.Values)
+	session.Values[sessionKeyOIDCProvider] = p.Name
+	session.Values[sessionKeyOIDCState] = state
+	session.Values[sessionKeyOIDCNonce] = nonce
+	session.Values[sessionKeyOIDCVerifier] = verifier
+	session.Values[sessionKeyOIDCUntil] = time.Now().Add(oidcFlowTTL).UnixNano()
+	if linkUserID != 0 {
+		session.Values[sessionKeyOIDCLinkUser] = linkUserID
+	}
+	session.Save(r, w)
+
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.ClientID},
+		"redirect_uri":          {p.redirectURI()},
+		"scope":                 {"openid profile email"},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {pkceChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, d.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+func getOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(pat.Param(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	startOIDCFlow(w, r, p, 0)
+}
+
+func postOIDCLink(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(pat.Param(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+	startOIDCFlow(w, r, p, me.ID)
+}
+
+// oidcAccountNameRegexp は /@accountName のルーティングに合わない文字。外部 ID から作る名前は英字だけにする
+var oidcAccountNameRegexp = regexp.MustCompile(`[^a-zA-Z]`)
+
+// oidcAccountNameAttempts は名前が重なったときに付け直す回数
+const oidcAccountNameAttempts = 10
+
+// oidcAccountNameCandidate は preferred_username かメールアドレスのローカル部からアカウント名の元を作る
+func oidcAccountNameCandidate(claims idTokenClaims) string {
+	for _, s := range []string{claims.PreferredUsername, strings.SplitN(claims.Email, "@", 2)[0], claims.Name} {
+		name := oidcAccountNameRegexp.ReplaceAllString(s, "")
+		if len(name) > 20 {
+			name = name[:20]
+		}
+		if validateAccountName(name) {
+			return name
+		}
+	}
+	return "user"
+}
+
+// registerOIDCUser は外部 ID から新しくユーザーを作る。パスワードは空にしておき、パスワードではログインできない
+func registerOIDCUser(p *oidcProvider, claims idTokenClaims) (User, error) {
+	base := oidcAccountNameCandidate(claims)
+	email := ""
+	if claims.EmailVerified && validateEmail(claims.Email) {
+		email = claims.Email
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	// 先に空きを確かめても同時に登録されると重なるので、INSERT して重なったら名前を変えてやり直す
+	var result sql.Result
+	for i := 0; ; i++ {
+		accountName := base
+		if i > 0 {
+			accountName = base + secureRandomLetters(4)
+		}
+		result, err = tx.Exec("INSERT INTO `users` (`account_name`, `passhash`, `email`) VALUES (?,?,?)", accountName, "", email)
+		if err == nil {
+			break
+		}
+		if !isDuplicateEntry(err) || i+1 >= oidcAccountNameAttempts {
+			return User{}, err
+		}
+	}
+	uid, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO `user_identities` (`user_id`, `provider`, `subject`, `email`, `created_at`) VALUES (?,?,?,?,?)",
+		uid, p.Name, claims.Subject, claims.Email, time.Now(),
+	)
+	if err != nil {
+		return User{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return getUser(db, int(uid))
+}
+
+func getOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := findOIDCProvider(pat.Param(r, "provider"))
+	if p == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	session := getSession(r)
+	name, _ := session.Values[sessionKeyOIDCProvider].(string)
+	state, _ := session.Values[sessionKeyOIDCState].(string)
+	nonce, _ := session.Values[sessionKeyOIDCNonce].(string)
+	verifier, _ := session.Values[sessionKeyOIDCVerifier].(string)
+	until, _ := session.Values[sessionKeyOIDCUntil].(int64)
+	linkUserID, _ := session.Values[sessionKeyOIDCLinkUser].(int)
+
+	// state は一度しか使えないように、結果にかかわらず消す
+	clearOIDCFlow(session.Values)
+
+	failTo := "/login"
+	if linkUserID != 0 {
+		failTo = "/identities"
+	}
+	fail := func(notice string) {
+		session.Values["notice"] = notice
+		session.Save(r, w)
+		http.Redirect(w, r, failTo, http.StatusFound)
+	}
+
+	q := r.URL.Query()
+	if name != p.Name || state == "" || time.Now().UnixNano() > until ||
+		subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		fail("ログインの有効期限が切れました。もう一度お試しください")
+		return
+	}
+	if q.Get("error") != "" || q.Get("code") == "" {
+		fail(p.Label + " での認証が完了しませんでした")
+		return
+	}
+
+	claims, err := p.exchangeCode(r.Context(), r, q.Get("code"), verifier, nonce)
+	if err != nil {
+		log.Print(err)
+		fail(p.Label + " での認証に失敗しました")
+		return
+	}
+
+	identity := UserIdentity{}
+	err = db.Get(&identity, "SELECT * FROM `user_identities` WHERE `provider` = ? AND `subject` = ?", p.Name, claims.Subject)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+	found := err == nil
+
+	if linkUserID != 0 {
+		me := getSessionUser(r)
+		if me.ID != linkUserID {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		if found && identity.UserID != me.ID {
+			fail("この " + p.Label + " のアカウントは別のユーザーに連携されています")
+			return
+		}
+		if !found {
+			_, err = db.Exec(
+				"INSERT INTO `user_identities` (`user_id`, `provider`, `subject`, `email`, `created_at`) VALUES (?,?,?,?,?)",
+				me.ID, p.Name, claims.Subject, claims.Email, time.Now(),
+			)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+		}
+		session.Values["notice"] = p.Label + " と連携しました"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/identities", http.StatusFound)
+		return
+	}
+
+	var u User
+	if found {
+		u, err = getUser(db, identity.UserID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Print(err)
+			return
+		}
+		if err == sql.ErrNoRows || u.DelFlg != 0 {
+			fail("このアカウントは利用できません")
+			return
+		}
+	} else {
+		// 同じメールアドレスの既存ユーザーがいても勝手には連携しない。連携はログインしてから行う
+		u, err = registerOIDCUser(p, claims)
+		if err != nil {
+			log.Print(err)
+			fail(p.Label + " のアカウントでユーザーを登録できませんでした。もう一度お試しください")
+			return
+		}
+		pinPrimary(w, r)
+	}
+
+	beginLogin(w, r, session, u)
+}
+
+type identityRow struct {
+	Provider *oidcProvider
+	Identity *UserIdentity
+}
+
+func getUserIdentities(userID int) ([]UserIdentity, error) {
+	identities := []UserIdentity{}
+	err := db.Select(&identities, "SELECT * FROM `user_identities` WHERE `user_id` = ? ORDER BY `id`", userID)
+	return identities, err
+}
+
+func getIdentities(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	identities, err := getUserIdentities(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	rows := make([]identityRow, 0, len(oidcProviders))
+	for _, p := range oidcProviders {
+		row := identityRow{Provider: p}
+		for i := range identities {
+			if identities[i].Provider == p.Name {
+				row.Identity = &identities[i]
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	templateIdentities.Execute(w, struct {
+		Me         User
+		CSRFToken  string
+		Flash      string
+		Identities []identityRow
+	}{me, getCSRFToken(r), getFlash(w, r, "notice"), rows})
+}
+
+func postIdentitiesUnlink(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	identities, err := getUserIdentities(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	// パスワードがないユーザーは最後の連携を外すとログインできなくなる
+	if !me.HasPassword && len(identities) <= 1 {
+		session.Values["notice"] = "パスワードを設定するまで最後の連携は解除できません"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/identities", http.StatusFound)
+		return
+	}
+
+	_, err = db.Exec("DELETE FROM `user_identities` WHERE `user_id` = ? AND `provider` = ?", me.ID, r.FormValue("provider"))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	session.Values["notice"] = "連携を解除しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/identities", http.StatusFound)
+}
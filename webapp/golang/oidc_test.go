@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockOIDC は discovery・JWKS・トークンエンドポイントだけを持つ OpenID Connect のプロバイダー
+type mockOIDC struct {
+	t      *testing.T
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+type mockOIDCCode struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]interface{}
+}
+
+var (
+	mockOIDCKeyOnce sync.Once
+	mockOIDCKey     *rsa.PrivateKey
+)
+
+func mockOIDCSigningKey(t *testing.T) *rsa.PrivateKey {
+	mockOIDCKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mockOIDCKey = key
+	})
+	return mockOIDCKey
+}
+
+// useMockOIDC はモックを立ち上げ、"mock" という名前のプロバイダーとして登録する
+func useMockOIDC(t *testing.T) *mockOIDC {
+	m := &mockOIDC{t: t, key: mockOIDCSigningKey(t), codes: map[string]mockOIDCCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"kid": "key1",
+				"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "client" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		m.mu.Lock()
+		code, ok := m.codes[r.FormValue("code")]
+		delete(m.codes, r.FormValue("code"))
+		m.mu.Unlock()
+		if !ok || r.FormValue("grant_type") != "authorization_code" || r.FormValue("redirect_uri") != code.redirectURI ||
+			pkceChallenge(r.FormValue("code_verifier")) != code.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     m.sign(m.key, "key1", code.claims),
+		})
+	})
+	m.server = httptest.NewServer(mux)
+
+	old := oidcProviders
+	oidcProviders = []*oidcProvider{{Name: "mock", Label: "Mock", Issuer: m.server.URL, ClientID: "client", ClientSecret: "secret"}}
+	t.Cleanup(func() {
+		m.server.Close()
+		oidcProviders = old
+	})
+	return m
+}
+
+func (m *mockOIDC) claims(sub string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss": m.server.URL,
+		"sub": sub,
+		"aud": "client",
+		"exp": now.Add(time.Minute).Unix(),
+		"iat": now.Unix(),
+	}
+}
+
+func (m *mockOIDC) sign(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// authorize はプロバイダーの画面でユーザーが同意したことにして、コールバックを呼ぶ
+func (m *mockOIDC) authorize(c *testClient, res *testResponse, claims map[string]interface{}) *testResponse {
+	m.t.Helper()
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || res.StatusCode != http.StatusFound || !strings.HasPrefix(loc.String(), m.server.URL+"/authorize?") {
+		m.t.Fatalf("not redirected to authorization endpoint: %d %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	q := loc.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != "client" || q.Get("code_challenge_method") != "S256" ||
+		q.Get("state") == "" || q.Get("nonce") == "" || !strings.Contains(q.Get("scope"), "openid") {
+		m.t.Fatalf("authorization request = %v", q)
+	}
+
+	claims["nonce"] = q.Get("nonce")
+	code := secureRandomStr(8)
+	m.mu.Lock()
+	m.codes[code] = mockOIDCCode{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: claims}
+	m.mu.Unlock()
+
+	redirect, _ := url.Parse(q.Get("redirect_uri"))
+	return c.get(redirect.Path + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode())
+}
+
+func TestOIDCSignInRegisters(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+	app.addUser("alice", 0, 0)
+
+	c := app.newClient()
+	if !strings.Contains(c.get("/login").Body, `href="/auth/mock"`) {
+		t.Error("provider link not shown")
+	}
+	assertStatus(t, c.get("/auth/unknown"), http.StatusNotFound)
+
+	claims := m.claims("sub-1")
+	claims["preferred_username"] = "alice"
+	claims["email"] = "alice@example.com"
+	claims["email_verified"] = true
+	assertRedirect(t, m.authorize(c, c.get("/auth/mock"), claims), "/")
+	if !c.loggedIn() {
+		t.Fatal("not logged in")
+	}
+
+	// 既存の alice とは別のユーザーとして、/@accountName で開ける名前で登録される
+	if n := app.count("users"); n != 2 {
+		t.Fatalf("users = %d", n)
+	}
+	row := app.fake.tables["users"][1]
+	name := fakeString(row["account_name"])
+	if !regexp.MustCompile(`\Aalice[a-z]{4}\z`).MatchString(name) {
+		t.Errorf("account_name = %q", name)
+	}
+	assertStatus(t, c.get("/@"+name), http.StatusOK)
+	if fakeString(row["passhash"]) != "" || fakeString(row["email"]) != "alice@example.com" {
+		t.Errorf("user = %v", row)
+	}
+	if n := app.count("user_identities"); n != 1 {
+		t.Errorf("user_identities = %d", n)
+	}
+
+	// 同じ sub なら同じユーザーでログインする
+	again := app.newClient()
+	claims = m.claims("sub-1")
+	claims["preferred_username"] = "alice"
+	assertRedirect(t, m.authorize(again, again.get("/auth/mock"), claims), "/")
+	if n := app.count("users"); n != 2 {
+		t.Errorf("users = %d", n)
+	}
+	if !strings.Contains(again.get("/").Body, `<span class="isu-account-name">`+name+`</span>`) {
+		t.Error("logged in as another user")
+	}
+
+	// パスワードのないユーザーはパスワードではログインできない
+	assertRedirect(t, app.newClient().postForm("/login", url.Values{"account_name": {name}, "password": {""}}), "/login")
+}
+
+func TestOIDCAccountNameCandidate(t *testing.T) {
+	tests := []struct {
+		claims idTokenClaims
+		want   string
+	}{
+		{idTokenClaims{PreferredUsername: "bob.smith"}, "bobsmith"},
+		{idTokenClaims{PreferredUsername: "b", Email: "bob_s2@example.com"}, "bobs"},
+		{idTokenClaims{Email: "日本@example.com", Name: "Taro Yamada"}, "TaroYamada"},
+		{idTokenClaims{PreferredUsername: "abcdefghijklmnopqrstuvwxyz"}, "abcdefghijklmnopqrst"},
+		{idTokenClaims{Name: "太郎"}, "user"},
+	}
+	for _, tt := range tests {
+		if got := oidcAccountNameCandidate(tt.claims); got != tt.want {
+			t.Errorf("oidcAccountNameCandidate(%+v) = %q, want %q", tt.claims, got, tt.want)
+		}
+	}
+}
+
+func TestOIDCCallbackRejectsBadState(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+
+	c := app.newClient()
+	assertRedirect(t, c.get("/auth/mock/callback?code=x&state=y"), "/login")
+
+	res := c.get("/auth/mock")
+	loc, _ := url.Parse(res.Header.Get("Location"))
+	assertRedirect(t, c.get("/auth/mock/callback?code=x&state=wrong"), "/login")
+	if !strings.Contains(c.get("/login").Body, "有効期限が切れました") {
+		t.Error("flash not shown")
+	}
+
+	// 一度失敗した state はもう使えない
+	assertRedirect(t, c.get("/auth/mock/callback?code=x&state="+loc.Query().Get("state")), "/login")
+
+	// プロバイダーで拒否された
+	res = c.get("/auth/mock")
+	loc, _ = url.Parse(res.Header.Get("Location"))
+	assertRedirect(t, c.get("/auth/mock/callback?error=access_denied&state="+loc.Query().Get("state")), "/login")
+	if c.loggedIn() || app.count("users") != 0 {
+		t.Error("signed in without authorization")
+	}
+
+	// 別のブラウザで始めたフローは使えない
+	other := app.newClient()
+	res = c.get("/auth/mock")
+	m.authorize(other, res, m.claims("sub-1"))
+	if other.loggedIn() {
+		t.Error("callback accepted in another session")
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	m := useMockOIDC(t)
+	p := oidcProviders[0]
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(map[string]interface{})
+		key    *rsa.PrivateKey
+		kid    string
+		ok     bool
+	}{
+		{"valid", func(c map[string]interface{}) {}, m.key, "key1", true},
+		{"audience array", func(c map[string]interface{}) { c["aud"] = []string{"client", "other"}; c["azp"] = "client" }, m.key, "key1", true},
+		{"audience array without azp", func(c map[string]interface{}) { c["aud"] = []string{"client", "other"} }, m.key, "key1", false},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "other" }, m.key, "key1", false},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, m.key, "key1", false},
+		{"expired", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }, m.key, "key1", false},
+		{"wrong nonce", func(c map[string]interface{}) { c["nonce"] = "other" }, m.key, "key1", false},
+		{"empty sub", func(c map[string]interface{}) { c["sub"] = "" }, m.key, "key1", false},
+		{"wrong key", func(c map[string]interface{}) {}, other, "key1", false},
+		{"unknown kid", func(c map[string]interface{}) {}, m.key, "key2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := m.claims("sub-1")
+			claims["nonce"] = "nonce"
+			tt.modify(claims)
+			_, err := p.verifyIDToken(context.Background(), m.sign(tt.key, tt.kid, claims), "nonce", time.Now())
+			if (err == nil) != tt.ok {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{}`))
+	if _, err := p.verifyIDToken(context.Background(), header+"."+payload+".", "nonce", time.Now()); err == nil {
+		t.Error("alg none accepted")
+	}
+}
+
+func TestOIDCLink(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+	assertStatus(t, c.get("/identities"), http.StatusOK)
+	assertStatus(t, c.postForm("/auth/mock/link", url.Values{}), http.StatusUnprocessableEntity)
+
+	assertRedirect(t, m.authorize(c, c.postForm("/auth/mock/link", url.Values{"csrf_token": {token}}), m.claims("sub-mary")), "/identities")
+	if row := app.fake.findOne("user_identities", "subject", "sub-mary"); row == nil || fakeInt(row["user_id"]) != int64(mary) {
+		t.Fatalf("identity = %v", row)
+	}
+	if !strings.Contains(c.get("/identities").Body, "連携済み") {
+		t.Error("linked identity not shown")
+	}
+
+	// 連携した ID でログインすると mary になる
+	fresh := app.newClient()
+	assertRedirect(t, m.authorize(fresh, fresh.get("/auth/mock"), m.claims("sub-mary")), "/")
+	if !strings.Contains(fresh.get("/").Body, `<span class="isu-account-name">mary</span>`) {
+		t.Error("not logged in as mary")
+	}
+
+	// 他のユーザーに連携済みの ID は使えない
+	bob := app.newClient()
+	bob.login("bob")
+	assertRedirect(t, m.authorize(bob, bob.postForm("/auth/mock/link", url.Values{"csrf_token": {bob.csrfToken()}}), m.claims("sub-mary")), "/identities")
+	if !strings.Contains(bob.get("/identities").Body, "別のユーザーに連携されています") {
+		t.Error("flash not shown")
+	}
+
+	assertRedirect(t, c.postForm("/identities/unlink", url.Values{"provider": {"mock"}, "csrf_token": {token}}), "/identities")
+	if n := app.count("user_identities"); n != 0 {
+		t.Errorf("user_identities = %d", n)
+	}
+}
+
+func TestOIDCUnlinkLastIdentityWithoutPassword(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+
+	c := app.newClient()
+	m.authorize(c, c.get("/auth/mock"), m.claims("sub-1"))
+	assertRedirect(t, c.postForm("/identities/unlink", url.Values{"provider": {"mock"}, "csrf_token": {c.csrfToken()}}), "/identities")
+	if n := app.count("user_identities"); n != 1 {
+		t.Errorf("user_identities = %d", n)
+	}
+}
+
+func TestOIDCSignInRespects2FAAndBan(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.enableTOTP(mary)
+	app.fake.mu.Lock()
+	for uid, sub := range map[int]string{mary: "sub-mary", bob: "sub-bob"} {
+		app.fake.insert("user_identities", fakeRow{"user_id": int64(uid), "provider": "mock", "subject": sub})
+	}
+	app.fake.mu.Unlock()
+
+	c := app.newClient()
+	assertRedirect(t, m.authorize(c, c.get("/auth/mock"), m.claims("sub-mary")), "/login/2fa")
+	if c.loggedIn() {
+		t.Error("logged in without 2FA")
+	}
+
+	app.fake.findOne("users", "id", int64(bob))["del_flg"] = int64(1)
+	c = app.newClient()
+	assertRedirect(t, m.authorize(c, c.get("/auth/mock"), m.claims("sub-bob")), "/login")
+	if c.loggedIn() {
+		t.Error("banned user logged in")
+	}
+}
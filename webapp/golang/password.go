@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"goji.io/pat"
+)
+
+const (
+	defaultPasswordResetTTL = 30 * time.Minute
+	emailMaxLength          = 254
+	passwordResetNotice     = "登録されているメールアドレスにパスワード再設定用のリンクを送りました"
+)
+
+var emailRegexp = regexp.MustCompile(`\A[^@\s]+@[^@\s]+\.[^@\s]+\z`)
+
+var (
+	templatePassword = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password.html")),
+	)
+
+	templatePasswordReset = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password_reset.html")),
+	)
+
+	templatePasswordResetConfirm = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("password_reset_confirm.html")),
+	)
+)
+
+// PasswordReset はパスワード再設定のトークン。トークンそのものは保存せずハッシュだけ持つ
+type PasswordReset struct {
+	ID        int          `db:"id"`
+	UserID    int          `db:"user_id"`
+	TokenHash string       `db:"token_hash"`
+	ExpiresAt time.Time    `db:"expires_at"`
+	UsedAt    sql.NullTime `db:"used_at"`
+	CreatedAt time.Time    `db:"created_at"`
+}
+
+// validateEmail は空ならメールアドレスなしとして通す
+func validateEmail(email string) bool {
+	return email == "" || (len(email) <= emailMaxLength && emailRegexp.MatchString(email))
+}
+
+func validatePassword(password string) bool {
+	return regexp.MustCompile(`\A[0-9a-zA-Z_]{6,}\z`).MatchString(password)
+}
+
+func passwordResetTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// appBaseURL はメールや OIDC のコールバックに書くリンクの先頭。
+// Host ヘッダーは書き換えられるので使わず、起動時に ISUCONP_BASE_URL から読む
+var appBaseURL string
+
+func loadBaseURL() (string, error) {
+	v := os.Getenv("ISUCONP_BASE_URL")
+	if v == "" {
+		return "", fmt.Errorf("ISUCONP_BASE_URL is not set")
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("ISUCONP_BASE_URL must be an absolute http(s) URL: %s", v)
+	}
+	return strings.TrimSuffix(v, "/"), nil
+}
+
+func baseURL() string {
+	return appBaseURL
+}
+
+// updatePassword はパスワードを変え、今あるセッションをすべて取り消す
+func updatePassword(user User, password string) error {
+	passhash, err := calculatePasshash(user.AccountName, password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE `users` SET `passhash` = ? WHERE `id` = ?", passhash, user.ID)
+	if err != nil {
+		return err
+	}
+	invalidateUser(user.ID)
+	return revokeUserSessions(user.ID, "")
+}
+
+func getPassword(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	templatePassword.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postPassword(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+
+	// OIDC で登録したユーザーはパスワードがないので、最初の 1 回は現在のパスワードなしで設定できる
+	if me.HasPassword && tryLogin(me.AccountName, r.FormValue("current_password")) == nil {
+		session.Values["notice"] = "現在のパスワードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password", http.StatusFound)
+		return
+	}
+
+	password := r.FormValue("new_password")
+	if !validatePassword(password) {
+		session.Values["notice"] = "パスワードは6文字以上である必要があります"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password", http.StatusFound)
+		return
+	}
+
+	err := updatePassword(me, password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// この端末だけは新しいセッションでログインし直す
+	sid, err := startUserSession(r, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	session.Values[sessionKeyUserSessionID] = sid
+	session.Values["csrf_token"] = secureRandomStr(16)
+	if me.HasPassword {
+		session.Values["notice"] = "パスワードを変更しました"
+	} else {
+		session.Values["notice"] = "パスワードを設定しました"
+	}
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/password", http.StatusFound)
+}
+
+func getPasswordReset(w http.ResponseWriter, r *http.Request) {
+	templatePasswordReset.Execute(w, struct {
+		Me    User
+		Flash string
+	}{getSessionUser(r), getFlash(w, r, "notice")})
+}
+
+func postPasswordReset(w http.ResponseWriter, r *http.Request) {
+	accountName := r.FormValue("account_name")
+	if !allowRequest(w, "password_reset:ip", clientIP(r)) || !allowRequest(w, "password_reset:acc", accountName) {
+		return
+	}
+
+	// アカウントの有無がわからないように、見つからなくても同じ画面を返す
+	user := User{}
+	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+
+	if user.ID != 0 && user.Email != "" {
+		token := secureRandomStr(32)
+		now := time.Now()
+		_, err = db.Exec(
+			"INSERT INTO `password_resets` (`user_id`, `token_hash`, `expires_at`, `created_at`) VALUES (?,?,?,?)",
+			user.ID, passwordResetTokenHash(token), now.Add(getEnvDuration("ISUCONP_PASSWORD_RESET_TTL", defaultPasswordResetTTL)), now,
+		)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+
+		err = mailer.Send(r.Context(), Mail{
+			To:      user.Email,
+			Subject: "Iscogram パスワードの再設定",
+			Body: fmt.Sprintf(
+				"%sさん\n\n以下のリンクから新しいパスワードを設定してください。\n%s/password/reset/%s\n\nこのリンクは一度だけ使えます。心当たりがなければこのメールは無視してください。\n",
+				user.AccountName, baseURL(), token,
+			),
+		})
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = passwordResetNotice
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/password/reset", http.StatusFound)
+}
+
+// findPasswordReset は未使用で期限内のトークンを探す
+func findPasswordReset(token string) (PasswordReset, bool) {
+	pr := PasswordReset{}
+	err := db.Get(&pr, "SELECT * FROM `password_resets` WHERE `token_hash` = ?", passwordResetTokenHash(token))
+	if err == sql.ErrNoRows {
+		return pr, false
+	}
+	if err != nil {
+		log.Print(err)
+		return pr, false
+	}
+	return pr, !pr.UsedAt.Valid && time.Now().Before(pr.ExpiresAt)
+}
+
+func getPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	token := pat.Param(r, "token")
+	if _, ok := findPasswordReset(token); !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	templatePasswordResetConfirm.Execute(w, struct {
+		Me    User
+		Token string
+		Flash string
+	}{getSessionUser(r), token, getFlash(w, r, "notice")})
+}
+
+func postPasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	token := pat.Param(r, "token")
+	pr, ok := findPasswordReset(token)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	session := getSession(r)
+
+	password := r.FormValue("password")
+	if !validatePassword(password) {
+		session.Values["notice"] = "パスワードは6文字以上である必要があります"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/password/reset/"+token, http.StatusFound)
+		return
+	}
+
+	user, err := getUser(db, pr.UserID)
+	if err == sql.ErrNoRows || user.DelFlg != 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 同時に使われても 1 回しか通らないように、未使用のときだけ使用済みにする
+	result, err := db.Exec("UPDATE `password_resets` SET `used_at` = ? WHERE `id` = ? AND `used_at` IS NULL", time.Now(), pr.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n != 1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	err = updatePassword(user, password)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	// 他に発行済みのトークンも使えなくする
+	_, err = db.Exec("UPDATE `password_resets` SET `used_at` = ? WHERE `user_id` = ? AND `used_at` IS NULL", time.Now(), user.ID)
+	if err != nil {
+		log.Print(err)
+	}
+
+	session.Values["notice"] = "パスワードを再設定しました。新しいパスワードでログインしてください"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
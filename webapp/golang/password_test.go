@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingMailSender struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func (s *recordingMailSender) Send(ctx context.Context, m Mail) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mails = append(s.mails, m)
+	return nil
+}
+
+// useRecordingMailer は送ったメールを覚えておく MailSender に差し替える
+func useRecordingMailer(t *testing.T) *recordingMailSender {
+	s := &recordingMailSender{}
+	old := mailer
+	mailer = s
+	t.Cleanup(func() { mailer = old })
+	return s
+}
+
+var resetLinkRegexp = regexp.MustCompile(`/password/reset/([0-9a-f]+)`)
+
+func TestChangePassword(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	assertRedirect(t, app.newClient().get("/password"), "/login")
+
+	other := app.newClient()
+	other.login("mary")
+	c := app.newClient()
+	c.login("mary")
+	assertStatus(t, c.get("/password"), http.StatusOK)
+	token := c.csrfToken()
+
+	tests := []struct {
+		name    string
+		current string
+		new     string
+		notice  string
+	}{
+		{"wrong current password", "wrongpass", "newpassword", "現在のパスワードが間違っています"},
+		{"short new password", "marymary", "short", "パスワードは6文字以上である必要があります"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := c.postForm("/password", url.Values{"current_password": {tt.current}, "new_password": {tt.new}, "csrf_token": {token}})
+			assertRedirect(t, res, "/password")
+			if !strings.Contains(c.get("/password").Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+
+	assertStatus(t, c.postForm("/password", url.Values{"current_password": {"marymary"}, "new_password": {"newpassword"}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+
+	res := c.postForm("/password", url.Values{"current_password": {"marymary"}, "new_password": {"newpassword"}, "csrf_token": {token}})
+	assertRedirect(t, res, "/password")
+	if !strings.Contains(c.get("/password").Body, "パスワードを変更しました") {
+		t.Error("success flash not shown")
+	}
+
+	if !c.loggedIn() {
+		t.Error("current session is logged out")
+	}
+	if other.loggedIn() {
+		t.Error("other session is still logged in")
+	}
+
+	fresh := app.newClient()
+	assertRedirect(t, fresh.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}}), "/login")
+	assertRedirect(t, fresh.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"newpassword"}}), "/")
+}
+
+func TestSetInitialPassword(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+
+	c := app.newClient()
+	claims := m.claims("sub-1")
+	claims["preferred_username"] = "carol"
+	assertRedirect(t, m.authorize(c, c.get("/auth/mock"), claims), "/")
+
+	// パスワードのないユーザーには現在のパスワードを聞かない
+	if strings.Contains(c.get("/password").Body, `name="current_password"`) {
+		t.Error("current password is asked")
+	}
+	token := c.csrfToken()
+	assertRedirect(t, c.postForm("/password", url.Values{"new_password": {"carolpass"}, "csrf_token": {token}}), "/password")
+	if !strings.Contains(c.get("/password").Body, "パスワードを設定しました") {
+		t.Error("success flash not shown")
+	}
+	assertRedirect(t, app.newClient().postForm("/login", url.Values{"account_name": {"carol"}, "password": {"carolpass"}}), "/")
+
+	// 設定したあとは現在のパスワードが要る
+	if !strings.Contains(c.get("/password").Body, `name="current_password"`) {
+		t.Error("current password is not asked")
+	}
+	assertRedirect(t, c.postForm("/password", url.Values{"new_password": {"otherpass"}, "csrf_token": {c.csrfToken()}}), "/password")
+	if !strings.Contains(c.get("/password").Body, "現在のパスワードが間違っています") {
+		t.Error("password changed without the current password")
+	}
+}
+
+func TestPasswordReset(t *testing.T) {
+	app := newTestApp(t)
+	sent := useRecordingMailer(t)
+	mary := app.addUser("mary", 0, 0)
+	app.fake.findOne("users", "id", int64(mary))["email"] = "mary@example.com"
+	app.addUser("noemail", 0, 0)
+
+	loggedIn := app.newClient()
+	loggedIn.login("mary")
+
+	c := app.newClient()
+	assertStatus(t, c.get("/password/reset"), http.StatusOK)
+
+	// アカウントがなくてもメールアドレスがなくても同じ表示にする
+	for _, name := range []string{"nobody", "noemail", "mary"} {
+		assertRedirect(t, c.postForm("/password/reset", url.Values{"account_name": {name}}), "/password/reset")
+		if !strings.Contains(c.get("/password/reset").Body, passwordResetNotice) {
+			t.Errorf("%s: notice not shown", name)
+		}
+	}
+	if len(sent.mails) != 1 || sent.mails[0].To != "mary@example.com" {
+		t.Fatalf("mails = %+v", sent.mails)
+	}
+	m := resetLinkRegexp.FindStringSubmatch(sent.mails[0].Body)
+	if m == nil {
+		t.Fatalf("reset link not found in %q", sent.mails[0].Body)
+	}
+	path := "/password/reset/" + m[1]
+	if row := app.fake.tables["password_resets"][0]; fakeString(row["token_hash"]) == m[1] {
+		t.Error("token is stored in plain text")
+	}
+
+	assertStatus(t, c.get("/password/reset/0123abcd"), http.StatusNotFound)
+	assertStatus(t, c.get(path), http.StatusOK)
+
+	assertRedirect(t, c.postForm(path, url.Values{"password": {"short"}}), path)
+	assertRedirect(t, c.postForm(path, url.Values{"password": {"resetpassword"}}), "/login")
+	if !strings.Contains(c.get("/login").Body, "パスワードを再設定しました") {
+		t.Error("success flash not shown")
+	}
+
+	// 一度使ったトークンはもう使えない
+	assertStatus(t, c.get(path), http.StatusNotFound)
+	assertStatus(t, c.postForm(path, url.Values{"password": {"anotherpassword"}}), http.StatusNotFound)
+
+	if loggedIn.loggedIn() {
+		t.Error("existing session survived password reset")
+	}
+	assertRedirect(t, c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"resetpassword"}}), "/")
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	app := newTestApp(t)
+	sent := useRecordingMailer(t)
+	mary := app.addUser("mary", 0, 0)
+	app.fake.findOne("users", "id", int64(mary))["email"] = "mary@example.com"
+
+	c := app.newClient()
+	c.postForm("/password/reset", url.Values{"account_name": {"mary"}})
+	m := resetLinkRegexp.FindStringSubmatch(sent.mails[0].Body)
+
+	app.fake.tables["password_resets"][0]["expires_at"] = time.Now().Add(-time.Minute)
+	assertStatus(t, c.get("/password/reset/"+m[1]), http.StatusNotFound)
+}
+
+func TestRegisterEmail(t *testing.T) {
+	app := newTestApp(t)
+
+	c := app.newClient()
+	assertRedirect(t, c.postForm("/register", url.Values{"account_name": {"mary"}, "password": {"marymary"}, "email": {"not-an-email"}}), "/register")
+	if !strings.Contains(c.get("/register").Body, "メールアドレスの形式が正しくありません") {
+		t.Error("flash not shown")
+	}
+
+	assertRedirect(t, c.postForm("/register", url.Values{"account_name": {"mary"}, "password": {"marymary"}, "email": {"mary@example.com"}}), "/")
+	if row := app.fake.findOne("users", "account_name", "mary"); fakeString(row["email"]) != "mary@example.com" {
+		t.Errorf("email = %v", row["email"])
+	}
+}
+
+func TestFileMailSender(t *testing.T) {
+	dir := t.TempDir()
+	s := &fileMailSender{dir: dir, from: "noreply@example.com"}
+
+	err := s.Send(context.Background(), Mail{To: "mary@example.com", Subject: "パスワード", Body: "line1\nline2\n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("files = %v", files)
+	}
+	b, _ := os.ReadFile(files[0])
+	for _, want := range []string{"To: mary@example.com\r\n", "Subject: =?UTF-8?b?", "\r\n\r\nline1\r\nline2\r\n"} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("%q not found in %q", want, b)
+		}
+	}
+
+	if err := s.Send(context.Background(), Mail{To: "a@example.com\r\nBcc: b@example.com"}); err == nil {
+		t.Error("header injection accepted")
+	}
+}
+
+func TestPasswordResetLinkIgnoresHost(t *testing.T) {
+	app := newTestApp(t)
+	sent := useRecordingMailer(t)
+	mary := app.addUser("mary", 0, 0)
+	app.fake.findOne("users", "id", int64(mary))["email"] = "mary@example.com"
+
+	req, err := http.NewRequest(http.MethodPost, app.server.URL+"/password/reset", strings.NewReader(url.Values{"account_name": {"mary"}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "evil.example.com"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if len(sent.mails) != 1 {
+		t.Fatalf("mails = %+v", sent.mails)
+	}
+	if body := sent.mails[0].Body; !strings.Contains(body, app.server.URL+"/password/reset/") || strings.Contains(body, "evil.example.com") {
+		t.Errorf("reset link does not use the base URL: %q", body)
+	}
+}
+
+func TestLoadBaseURL(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+		ok   bool
+	}{
+		{"", "", false},
+		{"localhost", "", false},
+		{"ftp://example.com", "", false},
+		{"https://example.com/", "https://example.com", true},
+		{"http://localhost:8080", "http://localhost:8080", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("ISUCONP_BASE_URL", tt.env)
+		got, err := loadBaseURL()
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("%q: got %q, %v", tt.env, got, err)
+		}
+	}
+}
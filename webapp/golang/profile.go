@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"goji.io/pat"
+)
+
+const (
+	displayNameMaxLength = 32
+	bioMaxLength         = 300
+	AvatarUploadLimit    = 1 * 1024 * 1024 // 1mb
+)
+
+var templateProfile = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("profile.html"),
+))
+
+// uploadError は利用者にそのまま見せるアップロードのエラー
+type uploadError string
+
+func (e uploadError) Error() string {
+	return string(e)
+}
+
+// imageMimeType は投稿の Content-Type から画像のタイプを決める
+func imageMimeType(contentType string) string {
+	if strings.Contains(contentType, "jpeg") {
+		return "image/jpeg"
+	} else if strings.Contains(contentType, "png") {
+		return "image/png"
+	} else if strings.Contains(contentType, "gif") {
+		return "image/gif"
+	}
+	return ""
+}
+
+// readUploadedImage は 1 枚だけの画像 (アイコンや動画のポスター) を readUploadedMedia で読む
+func readUploadedImage(r *http.Request, field string, limit int) ([]byte, string, error) {
+	images, err := readUploadedMedia(r, field, 1, limit, false)
+	if err != nil {
+		return nil, "", err
+	}
+	return images[0].Data, images[0].Mime, nil
+}
+
+// writeImageFile は書きかけのファイルを配信しないように、一時ファイルに書いてから置き換える
+func writeImageFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func avatarPath(userID int, mime string) string {
+	return fmt.Sprintf("%s/avatars/%d.%s", imageDir, userID, getExt(mime))
+}
+
+// avatarURL はアイコンがなければ空文字を返す
+func avatarURL(u User) string {
+	if u.AvatarHash == "" {
+		return ""
+	}
+	return fmt.Sprintf("/avatar/%d.%s?v=%s", u.ID, getExt(u.AvatarMime), imageVersion(u.AvatarHash))
+}
+
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	templateProfile.Execute(w, struct {
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postProfile(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	fail := func(notice string) {
+		session.Values["notice"] = notice
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/profile", http.StatusFound)
+	}
+
+	displayName := strings.TrimSpace(r.FormValue("display_name"))
+	bio := strings.TrimSpace(strings.ReplaceAll(r.FormValue("bio"), "\r\n", "\n"))
+	if utf8.RuneCountInString(displayName) > displayNameMaxLength {
+		fail(fmt.Sprintf("表示名は%d文字以下にしてください", displayNameMaxLength))
+		return
+	}
+	if utf8.RuneCountInString(bio) > bioMaxLength {
+		fail(fmt.Sprintf("自己紹介は%d文字以下にしてください", bioMaxLength))
+		return
+	}
+
+	data, mime, err := readUploadedImage(r, "avatar", AvatarUploadLimit)
+	if ue, ok := err.(uploadError); ok {
+		fail(string(ue))
+		return
+	}
+	if err != nil && err != http.ErrMissingFile {
+		log.Print(err)
+		return
+	}
+
+	isPrivate := r.FormValue("is_private") != ""
+	_, err = db.Exec("UPDATE `users` SET `display_name` = ?, `bio` = ?, `is_private` = ? WHERE `id` = ?", displayName, bio, isPrivate, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	// 鍵を外したら待たせていたリクエストはまとめて承認する
+	if me.IsPrivate && !isPrivate {
+		_, err = db.Exec("UPDATE `follows` SET `status` = ? WHERE `followee_id` = ? AND `status` = ?", followStatusApproved, me.ID, followStatusPending)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	if me.IsPrivate != isPrivate {
+		invalidateTimeline()
+	}
+
+	if data != nil || r.FormValue("remove_avatar") != "" {
+		newMime, newHash := "", ""
+		if data != nil {
+			newMime, newHash = mime, imageHash(data)
+			err = writeImageFile(avatarPath(me.ID, mime), data)
+			if err != nil {
+				log.Print(err)
+				return
+			}
+		}
+		_, err = db.Exec("UPDATE `users` SET `avatar_mime` = ?, `avatar_hash` = ? WHERE `id` = ?", newMime, newHash, me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		// 形式が変わったか消したときは前のファイルを残さない
+		if me.AvatarMime != "" && me.AvatarMime != newMime {
+			if err := os.Remove(avatarPath(me.ID, me.AvatarMime)); err != nil && !os.IsNotExist(err) {
+				log.Print(err)
+			}
+		}
+	}
+	invalidateUser(me.ID)
+	pinPrimary(w, r)
+
+	session.Values["notice"] = "プロフィールを更新しました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/profile", http.StatusFound)
+}
+
+func getAvatar(w http.ResponseWriter, r *http.Request) {
+	uid, err := strconv.Atoi(pat.Param(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	u, err := getUser(readDB(r), uid)
+	if err != nil || u.DelFlg != 0 || u.AvatarHash == "" || pat.Param(r, "ext") != getExt(u.AvatarMime) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	path := avatarPath(u.ID, u.AvatarMime)
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	serveImage(w, r, u.AvatarHash, u.AvatarMime, fi.ModTime(), false, path, func() (io.ReadSeeker, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+)
+
+// postProfile はプロフィール編集フォームを送る。contentType が空ならアイコンを付けない
+func (c *testClient) postProfile(fields map[string]string, contentType string, data []byte) *testResponse {
+	c.t.Helper()
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	if contentType != "" {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="avatar"; filename="avatar"`)
+		h.Set("Content-Type", contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+"/profile", buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func TestProfile(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	pid := app.addPost(mary, "body", []byte("png"))
+	app.addComment(pid, mary, "first")
+
+	assertRedirect(t, app.newClient().get("/profile"), "/login")
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	// コメントのキャッシュを作っておき、プロフィールの変更が反映されるか確かめる
+	c.get(fmt.Sprintf("/posts/%d", pid))
+
+	assertStatus(t, c.postProfile(map[string]string{"display_name": "Mary", "csrf_token": "wrong"}, "", nil), http.StatusUnprocessableEntity)
+
+	tests := []struct {
+		name        string
+		fields      map[string]string
+		contentType string
+		notice      string
+	}{
+		{"long display name", map[string]string{"display_name": strings.Repeat("あ", displayNameMaxLength+1)}, "", "表示名は32文字以下にしてください"},
+		{"long bio", map[string]string{"bio": strings.Repeat("a", bioMaxLength+1)}, "", "自己紹介は300文字以下にしてください"},
+		{"unsupported type", map[string]string{}, "image/bmp", "投稿できる画像形式はjpgとpngとgifだけです"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fields["csrf_token"] = token
+			assertRedirect(t, c.postProfile(tt.fields, tt.contentType, []byte("data")), "/profile")
+			if res := c.get("/profile"); !strings.Contains(res.Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if row := app.fake.findOne("users", "id", int64(mary)); fakeString(row["display_name"]) != "" || fakeString(row["bio"]) != "" {
+		t.Fatalf("profile is updated: %v", row)
+	}
+
+	res := c.postProfile(map[string]string{"display_name": " Mary ", "bio": "hello <b>", "csrf_token": token}, "image/png", []byte("avatar png"))
+	assertRedirect(t, res, "/profile")
+	data, err := os.ReadFile(avatarPath(mary, "image/png"))
+	if err != nil || string(data) != "avatar png" {
+		t.Errorf("avatar file = %q, %v", data, err)
+	}
+	avatar := fmt.Sprintf("/avatar/%d.png?v=%s", mary, imageVersion(imageHash([]byte("avatar png"))))
+
+	res = c.get("/@mary")
+	for _, want := range []string{`<div class="isu-user-display-name">Mary</div>`, "hello &lt;b&gt;", avatar} {
+		if !strings.Contains(res.Body, want) {
+			t.Errorf("user page does not contain %q", want)
+		}
+	}
+	res = c.get(fmt.Sprintf("/posts/%d", pid))
+	if !strings.Contains(res.Body, `<span class="isu-post-display-name">Mary</span>`) || !strings.Contains(res.Body, `<span class="isu-comment-display-name">Mary</span>`) {
+		t.Error("display name is not shown next to the post and comment")
+	}
+
+	res = c.get(avatar)
+	assertStatus(t, res, http.StatusOK)
+	if res.Body != "avatar png" || res.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("avatar = %q, %q", res.Body, res.Header.Get("Content-Type"))
+	}
+	if got := res.Header.Get("Cache-Control"); got != immutableImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	assertStatus(t, c.get(avatar, "If-None-Match", res.Header.Get("ETag")), http.StatusNotModified)
+	assertStatus(t, c.get(avatar, "If-Modified-Since", res.Header.Get("Last-Modified")), http.StatusNotModified)
+	// nginx に返してもらうときも imageDir からのパスとアプリの ETag を付ける
+	t.Setenv("ISUCONP_IMAGE_ACCEL_REDIRECT", "/internal/image/")
+	accel := c.get(avatar)
+	if got := accel.Header.Get("X-Accel-Redirect"); got != fmt.Sprintf("/internal/image/avatars/%d.png", mary) {
+		t.Errorf("X-Accel-Redirect = %q", got)
+	}
+	if accel.Header.Get("ETag") != res.Header.Get("ETag") || accel.Header.Get("Cache-Control") != immutableImageCacheControl {
+		t.Errorf("accel headers = %v", accel.Header)
+	}
+	t.Setenv("ISUCONP_IMAGE_ACCEL_REDIRECT", "")
+	assertStatus(t, c.get(fmt.Sprintf("/avatar/%d.jpg", mary)), http.StatusNotFound)
+
+	// 画像を変えずに送っても表示名だけ変わり、アイコンは残る
+	assertRedirect(t, c.postProfile(map[string]string{"display_name": "", "bio": "", "csrf_token": token}, "", nil), "/profile")
+	if row := app.fake.findOne("users", "id", int64(mary)); fakeString(row["display_name"]) != "" || fakeString(row["avatar_hash"]) == "" {
+		t.Errorf("profile = %v", row)
+	}
+
+	assertRedirect(t, c.postProfile(map[string]string{"remove_avatar": "1", "csrf_token": token}, "", nil), "/profile")
+	if _, err := os.Stat(avatarPath(mary, "image/png")); !os.IsNotExist(err) {
+		t.Errorf("avatar file remains: %v", err)
+	}
+	assertStatus(t, c.get(fmt.Sprintf("/avatar/%d.png", mary)), http.StatusNotFound)
+	if strings.Contains(c.get("/@mary").Body, "/avatar/") {
+		t.Error("removed avatar is still shown")
+	}
+}
+
+func TestAvatarOfBannedUser(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	assertRedirect(t, c.postProfile(map[string]string{"csrf_token": c.csrfToken()}, "image/gif", []byte("gif")), "/profile")
+	path := fmt.Sprintf("/avatar/%d.gif", mary)
+	assertStatus(t, c.get(path), http.StatusOK)
+
+	app.fake.findOne("users", "id", int64(mary))["del_flg"] = int64(1)
+	invalidateUser(mary)
+	assertStatus(t, app.newClient().get(path), http.StatusNotFound)
+}
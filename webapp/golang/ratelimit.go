@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// rateLimit はトークンバケットの設定。Burst 個まで溜まり、Interval ごとに 1 つ回復する
+type rateLimit struct {
+	Burst    int
+	Interval time.Duration
+}
+
+var rateLimits = map[string]rateLimit{
+	"login:ip":           {Burst: 20, Interval: 3 * time.Second},
+	"login_2fa:ip":       {Burst: 20, Interval: 3 * time.Second},
+	"login_2fa:user":     {Burst: 10, Interval: 30 * time.Second},
+	"register:ip":        {Burst: 10, Interval: time.Minute},
+	"post:user":          {Burst: 10, Interval: 30 * time.Second},
+	"comment:user":       {Burst: 20, Interval: 5 * time.Second},
+	"password_reset:ip":  {Burst: 5, Interval: time.Minute},
+	"password_reset:acc": {Burst: 3, Interval: 10 * time.Minute},
+	"export:user":        {Burst: 3, Interval: 20 * time.Minute},
+	"email:user":         {Burst: 3, Interval: 10 * time.Minute},
+}
+
+// ログインの失敗が続いたアカウントと IP は、失敗するたびに倍の時間ロックする
+const (
+	loginFailureWindow      = 15 * time.Minute
+	loginLockoutThreshold   = 5
+	loginIPLockoutThreshold = 20
+	loginLockoutBase        = 30 * time.Second
+	loginLockoutMax         = time.Hour
+)
+
+// RateLimitStore はバケットと失敗回数の置き場所。複数台で動かすときは memcached を使う
+type RateLimitStore interface {
+	// Take はバケットから 1 つ取り出す。空なら次に取り出せるまでの時間を返す
+	Take(key string, limit rateLimit, now time.Time) (bool, time.Duration)
+	// Increment はカウンターを 1 増やす。ttl はカウンターを作ったときにだけ使う
+	Increment(key string, ttl time.Duration) int64
+	Get(key string) (int64, bool)
+	Set(key string, value int64, ttl time.Duration)
+	Delete(key string)
+	Flush()
+}
+
+// rateLimitStore はトークンバケットの置き場所。nil ならバケットでは制限しない
+var rateLimitStore RateLimitStore
+
+// loginLockoutStore はログイン失敗の回数とロックの置き場所。総当たりを防ぐので ISUCONP_RATE_LIMIT にかかわらず常に使う
+var loginLockoutStore RateLimitStore
+
+// ベンチマーカーはひとつの IP からアクセスするので、バケットは既定では使わない
+func newRateLimitStoreFromEnv() RateLimitStore {
+	if !getEnvBool("ISUCONP_RATE_LIMIT", false) {
+		return nil
+	}
+	return newRateLimitBackendFromEnv("isurate_")
+}
+
+func newLoginLockoutStoreFromEnv() RateLimitStore {
+	return newRateLimitBackendFromEnv("isulock_")
+}
+
+// newRateLimitBackendFromEnv は ISUCONP_RATE_LIMIT_BACKEND の置き場所を作る。prefix は memcached のキーの先頭
+func newRateLimitBackendFromEnv(prefix string) RateLimitStore {
+	switch backend := getEnv("ISUCONP_RATE_LIMIT_BACKEND", "memory"); backend {
+	case "memory":
+		return newMemoryRateLimitStore()
+	case "memcached":
+		addr := getEnv("ISUCONP_RATE_LIMIT_MEMCACHED_ADDRESS", getEnv("ISUCONP_MEMCACHED_ADDRESS", "localhost:11211"))
+		return newMemcachedRateLimitStore(memcache.New(addr), prefix)
+	default:
+		log.Fatalf("Unknown rate limit backend %q in ISUCONP_RATE_LIMIT_BACKEND.", backend)
+		return nil
+	}
+}
+
+// rateLimitKey はアカウント名のような任意の文字列もキーに使えるようにする
+func rateLimitKey(parts ...string) string {
+	key := ""
+	for i, p := range parts {
+		if i > 0 {
+			key += ":"
+		}
+		key += url.QueryEscape(p)
+	}
+	if len(key) > 128 {
+		sum := sha256.Sum256([]byte(key))
+		return hex.EncodeToString(sum[:])
+	}
+	return key
+}
+
+// refillBucket は経過時間ぶんトークンを足してから 1 つ取り出す
+func refillBucket(tokens float64, last time.Time, limit rateLimit, now time.Time) (float64, bool, time.Duration) {
+	if elapsed := now.Sub(last); elapsed > 0 {
+		tokens += float64(elapsed) / float64(limit.Interval)
+	}
+	if tokens > float64(limit.Burst) {
+		tokens = float64(limit.Burst)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true, 0
+	}
+	return tokens, false, time.Duration((1 - tokens) * float64(limit.Interval))
+}
+
+func bucketTTL(limit rateLimit) time.Duration {
+	return time.Duration(limit.Burst) * limit.Interval
+}
+
+// allowRequest は name のバケットから 1 つ取り出す。空なら 429 を返して false を返す
+func allowRequest(w http.ResponseWriter, name string, key string) bool {
+	if rateLimitStore == nil {
+		return true
+	}
+	limit, ok := rateLimits[name]
+	if !ok {
+		panic("unknown rate limit " + name)
+	}
+	allowed, retryAfter := rateLimitStore.Take(rateLimitKey("bucket", name, key), limit, time.Now())
+	if !allowed {
+		tooManyRequests(w, retryAfter)
+	}
+	return allowed
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "リクエストが多すぎます。しばらくしてからやり直してください", http.StatusTooManyRequests)
+}
+
+func loginLockoutDuration(fails, threshold int64) time.Duration {
+	if fails < threshold {
+		return 0
+	}
+	d := loginLockoutBase
+	for i := threshold; i < fails && d < loginLockoutMax; i++ {
+		d *= 2
+	}
+	if d > loginLockoutMax {
+		d = loginLockoutMax
+	}
+	return d
+}
+
+func loginLockoutKeys(accountName, ip string) map[string]int64 {
+	return map[string]int64{
+		rateLimitKey("account", accountName): loginLockoutThreshold,
+		rateLimitKey("ip", ip):               loginIPLockoutThreshold,
+	}
+}
+
+// loginLockedFor はアカウントか IP がロック中なら残り時間を返す
+func loginLockedFor(accountName, ip string, now time.Time) time.Duration {
+	var locked time.Duration
+	for key := range loginLockoutKeys(accountName, ip) {
+		until, ok := loginLockoutStore.Get("loginlock:" + key)
+		if !ok {
+			continue
+		}
+		if d := time.Unix(0, until).Sub(now); d > locked {
+			locked = d
+		}
+	}
+	return locked
+}
+
+func recordLoginFailure(accountName, ip string, now time.Time) {
+	for key, threshold := range loginLockoutKeys(accountName, ip) {
+		fails := loginLockoutStore.Increment("loginfail:"+key, loginFailureWindow)
+		if d := loginLockoutDuration(fails, threshold); d > 0 {
+			loginLockoutStore.Set("loginlock:"+key, now.Add(d).UnixNano(), d)
+		}
+	}
+}
+
+// clearLoginFailures はログインできたアカウントの失敗回数を消す。IP のほうは他のアカウントへの試行もあるので残す
+func clearLoginFailures(accountName string) {
+	key := rateLimitKey("account", accountName)
+	loginLockoutStore.Delete("loginfail:" + key)
+	loginLockoutStore.Delete("loginlock:" + key)
+}
+
+type rateLimitEntry struct {
+	tokens    float64
+	last      time.Time
+	value     int64
+	expiresAt time.Time
+}
+
+// memoryRateLimitStore はプロセス内に持つ。期限切れのエントリーはときどきまとめて消す
+type memoryRateLimitStore struct {
+	mu        sync.Mutex
+	entries   map[string]*rateLimitEntry
+	lastSweep time.Time
+}
+
+func newMemoryRateLimitStore() *memoryRateLimitStore {
+	return &memoryRateLimitStore{entries: map[string]*rateLimitEntry{}, lastSweep: time.Now()}
+}
+
+func (s *memoryRateLimitStore) get(key string, now time.Time) (*rateLimitEntry, bool) {
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if now.After(e.expiresAt) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	e, ok := s.entries[key]
+	if !ok || now.After(e.expiresAt) {
+		return nil, false
+	}
+	return e, true
+}
+
+func (s *memoryRateLimitStore) Take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key, now)
+	if !ok {
+		e = &rateLimitEntry{tokens: float64(limit.Burst), last: now}
+		s.entries[key] = e
+	}
+	tokens, allowed, retryAfter := refillBucket(e.tokens, e.last, limit, now)
+	e.tokens, e.last, e.expiresAt = tokens, now, now.Add(bucketTTL(limit))
+	return allowed, retryAfter
+}
+
+func (s *memoryRateLimitStore) Increment(key string, ttl time.Duration) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.get(key, now)
+	if !ok {
+		e = &rateLimitEntry{expiresAt: now.Add(ttl)}
+		s.entries[key] = e
+	}
+	e.value++
+	return e.value
+}
+
+func (s *memoryRateLimitStore) Get(key string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.get(key, time.Now())
+	if !ok {
+		return 0, false
+	}
+	return e.value, true
+}
+
+func (s *memoryRateLimitStore) Set(key string, value int64, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = &rateLimitEntry{value: value, expiresAt: time.Now().Add(ttl)}
+}
+
+func (s *memoryRateLimitStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+}
+
+func (s *memoryRateLimitStore) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = map[string]*rateLimitEntry{}
+}
+
+// memcachedRateLimitStore は複数台で制限を共有する。バケットは CAS で更新し、
+// 競合が続いたり memcached に届かなかったりしたときは通す
+type memcachedRateLimitStore struct {
+	client *memcache.Client
+	prefix string
+}
+
+func newMemcachedRateLimitStore(client *memcache.Client, prefix string) *memcachedRateLimitStore {
+	return &memcachedRateLimitStore{client: client, prefix: prefix}
+}
+
+func (s *memcachedRateLimitStore) key(key string) string {
+	gen := "0"
+	it, err := s.client.Get(s.prefix + "gen")
+	if err == nil {
+		gen = string(it.Value)
+	} else if err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+	return s.prefix + gen + ":" + key
+}
+
+// memcachedMaxRelativeExpiration を超える有効期限は、memcached が秒数ではなく Unix 時刻として扱う
+const memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+// memcachedExpiration は ttl を memcached の有効期限にする。30 日を超えるときは Unix 時刻で渡す
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl > memcachedMaxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	sec := int32(math.Ceil(ttl.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	return sec
+}
+
+func (s *memcachedRateLimitStore) Take(key string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	mkey := s.key(key)
+	for i := 0; i < 3; i++ {
+		it, err := s.client.Get(mkey)
+		if err != nil && err != memcache.ErrCacheMiss {
+			log.Print(err)
+			return true, 0
+		}
+
+		tokens, last := float64(limit.Burst), now
+		if err == nil {
+			var nsec int64
+			if _, err := fmt.Sscanf(string(it.Value), "%g %d", &tokens, &nsec); err == nil {
+				last = time.Unix(0, nsec)
+			}
+		}
+		tokens, allowed, retryAfter := refillBucket(tokens, last, limit, now)
+
+		item := &memcache.Item{
+			Key:        mkey,
+			Value:      []byte(fmt.Sprintf("%g %d", tokens, now.UnixNano())),
+			Expiration: memcachedExpiration(bucketTTL(limit)),
+		}
+		if it == nil {
+			err = s.client.Add(item)
+		} else {
+			it.Value, it.Expiration = item.Value, item.Expiration
+			err = s.client.CompareAndSwap(it)
+		}
+		if err == memcache.ErrNotStored || err == memcache.ErrCASConflict {
+			continue
+		}
+		if err != nil {
+			log.Print(err)
+			return true, 0
+		}
+		return allowed, retryAfter
+	}
+	return true, 0
+}
+
+func (s *memcachedRateLimitStore) Increment(key string, ttl time.Duration) int64 {
+	mkey := s.key(key)
+	for i := 0; i < 3; i++ {
+		n, err := s.client.Increment(mkey, 1)
+		if err == nil {
+			return int64(n)
+		}
+		if err != memcache.ErrCacheMiss {
+			log.Print(err)
+			return 0
+		}
+		err = s.client.Add(&memcache.Item{Key: mkey, Value: []byte("1"), Expiration: memcachedExpiration(ttl)})
+		if err == nil {
+			return 1
+		}
+		if err != memcache.ErrNotStored {
+			log.Print(err)
+			return 0
+		}
+	}
+	return 0
+}
+
+func (s *memcachedRateLimitStore) Get(key string) (int64, bool) {
+	it, err := s.client.Get(s.key(key))
+	if err != nil {
+		if err != memcache.ErrCacheMiss {
+			log.Print(err)
+		}
+		return 0, false
+	}
+	n, err := strconv.ParseInt(string(it.Value), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+func (s *memcachedRateLimitStore) Set(key string, value int64, ttl time.Duration) {
+	err := s.client.Set(&memcache.Item{Key: s.key(key), Value: []byte(strconv.FormatInt(value, 10)), Expiration: memcachedExpiration(ttl)})
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func (s *memcachedRateLimitStore) Delete(key string) {
+	err := s.client.Delete(s.key(key))
+	if err != nil && err != memcache.ErrCacheMiss {
+		log.Print(err)
+	}
+}
+
+func (s *memcachedRateLimitStore) Flush() {
+	_, err := s.client.Increment(s.prefix+"gen", 1)
+	if err == memcache.ErrCacheMiss {
+		err = s.client.Set(&memcache.Item{Key: s.prefix + "gen", Value: []byte("1")})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
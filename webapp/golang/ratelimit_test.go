@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useRateLimit はテストの間だけプロセス内のレート制限を有効にする
+func useRateLimit(t *testing.T) *memoryRateLimitStore {
+	s := newMemoryRateLimitStore()
+	old := rateLimitStore
+	rateLimitStore = s
+	t.Cleanup(func() { rateLimitStore = old })
+	return s
+}
+
+func TestMemoryRateLimitStoreTake(t *testing.T) {
+	s := newMemoryRateLimitStore()
+	limit := rateLimit{Burst: 3, Interval: 10 * time.Second}
+	now := time.Now()
+
+	for i := 0; i < limit.Burst; i++ {
+		if ok, _ := s.Take("k", limit, now); !ok {
+			t.Fatalf("request %d rejected", i)
+		}
+	}
+	ok, retryAfter := s.Take("k", limit, now)
+	if ok || retryAfter != 10*time.Second {
+		t.Errorf("empty bucket: ok %v retryAfter %s", ok, retryAfter)
+	}
+	if ok, _ := s.Take("other", limit, now); !ok {
+		t.Error("buckets are shared between keys")
+	}
+
+	ok, retryAfter = s.Take("k", limit, now.Add(4*time.Second))
+	if ok || retryAfter != 6*time.Second {
+		t.Errorf("partly refilled: ok %v retryAfter %s", ok, retryAfter)
+	}
+	if ok, _ := s.Take("k", limit, now.Add(10*time.Second)); !ok {
+		t.Error("refilled token rejected")
+	}
+
+	// 長く空いても Burst 個までしか溜まらない
+	later := now.Add(time.Hour)
+	for i := 0; i < limit.Burst; i++ {
+		s.Take("k", limit, later)
+	}
+	if ok, _ := s.Take("k", limit, later); ok {
+		t.Error("bucket exceeded burst")
+	}
+}
+
+func TestLoginLockoutDuration(t *testing.T) {
+	tests := []struct {
+		fails int64
+		want  time.Duration
+	}{
+		{4, 0},
+		{5, 30 * time.Second},
+		{6, time.Minute},
+		{8, 4 * time.Minute},
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := loginLockoutDuration(tt.fails, loginLockoutThreshold); got != tt.want {
+			t.Errorf("loginLockoutDuration(%d) = %s, want %s", tt.fails, got, tt.want)
+		}
+	}
+}
+
+func TestNewRateLimitStoreFromEnv(t *testing.T) {
+	t.Setenv("ISUCONP_RATE_LIMIT", "")
+	if s := newRateLimitStoreFromEnv(); s != nil {
+		t.Errorf("rate limit is enabled by default: %T", s)
+	}
+	t.Setenv("ISUCONP_RATE_LIMIT", "true")
+	if _, ok := newRateLimitStoreFromEnv().(*memoryRateLimitStore); !ok {
+		t.Error("ISUCONP_RATE_LIMIT=true does not enable the memory store")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	if got := rateLimitKey("account", "mary bob\r\n"); got != "account:mary+bob%0D%0A" {
+		t.Errorf("rateLimitKey = %q", got)
+	}
+	long := rateLimitKey("account", string(make([]byte, 300)))
+	if len(long) != 64 {
+		t.Errorf("long key = %q", long)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	// バケットを使わない既定の設定でもロックする
+	app := newTestApp(t)
+	s := loginLockoutStore
+	app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+
+	c := app.newClient()
+	for i := 0; i < loginLockoutThreshold; i++ {
+		assertRedirect(t, c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"wrongpass"}}), "/login")
+	}
+
+	// ロック中は正しいパスワードでも 429
+	res := c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}})
+	assertStatus(t, res, http.StatusTooManyRequests)
+	if n, _ := strconv.Atoi(res.Header.Get("Retry-After")); n < 1 || n > 30 {
+		t.Errorf("Retry-After = %q", res.Header.Get("Retry-After"))
+	}
+
+	// 別のアカウントには影響しない
+	app.newClient().login("bob")
+
+	// ロックが解けたあとにまた間違えると、ロックが倍になる
+	s.Delete("loginlock:" + rateLimitKey("account", "mary"))
+	assertRedirect(t, c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"wrongpass"}}), "/login")
+	res = c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}})
+	assertStatus(t, res, http.StatusTooManyRequests)
+	if n, _ := strconv.Atoi(res.Header.Get("Retry-After")); n <= 30 || n > 60 {
+		t.Errorf("Retry-After = %q", res.Header.Get("Retry-After"))
+	}
+
+	// ログインできたら失敗回数は消える
+	s.Delete("loginlock:" + rateLimitKey("account", "mary"))
+	c.login("mary")
+	if _, ok := s.Get("loginfail:" + rateLimitKey("account", "mary")); ok {
+		t.Error("failures are not cleared after login")
+	}
+}
+
+func TestLoginIPLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	// アカウント名を変えながら試しても IP でロックされる
+	c := app.newClient()
+	for i := 0; i < loginIPLockoutThreshold; i++ {
+		c.postForm("/login", url.Values{"account_name": {fmt.Sprintf("user%d", i)}, "password": {"wrongpass"}})
+	}
+	assertStatus(t, c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}}), http.StatusTooManyRequests)
+}
+
+func TestCommentRateLimit(t *testing.T) {
+	app := newTestApp(t)
+	useRateLimit(t)
+	mary := app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+	pid := app.addPost(mary, "post by mary", nil)
+
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+	form := url.Values{"post_id": {fmt.Sprint(pid)}, "comment": {"hello"}, "csrf_token": {token}}
+	for i := 0; i < rateLimits["comment:user"].Burst; i++ {
+		assertStatus(t, c.postForm("/comment", form), http.StatusFound)
+	}
+	res := c.postForm("/comment", form)
+	assertStatus(t, res, http.StatusTooManyRequests)
+	if res.Header.Get("Retry-After") == "" {
+		t.Error("Retry-After is not set")
+	}
+
+	bob := app.newClient()
+	bob.login("bob")
+	form.Set("csrf_token", bob.csrfToken())
+	assertStatus(t, bob.postForm("/comment", form), http.StatusFound)
+}
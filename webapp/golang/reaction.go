@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type reactionKind struct {
+	Name  string
+	Emoji string
+}
+
+// commentReactionKinds はコメントに付けられるリアクション。この順に表示する
+var commentReactionKinds = []reactionKind{
+	{"like", "👍"},
+	{"love", "❤️"},
+	{"laugh", "😂"},
+	{"wow", "😮"},
+	{"sad", "😢"},
+}
+
+// Reaction はコメントに付いたリアクションの数。Reacted は見ているユーザーが付けているか
+type Reaction struct {
+	Name    string
+	Emoji   string
+	Count   int
+	Reacted bool
+}
+
+func validReaction(name string) bool {
+	for _, k := range commentReactionKinds {
+		if k.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+type reactionRow struct {
+	CommentID int    `db:"comment_id"`
+	Reaction  string `db:"reaction"`
+	Count     int    `db:"count"`
+}
+
+// getCommentReactions はコメントごとのリアクションの数と、me が付けたリアクションをまとめて引く。
+// 数はリアクションが変わるたびに変わるので、コメントのキャッシュには入れない
+func getCommentReactions(q sqlx.Queryer, commentIDs []int, me User) (map[int][]Reaction, error) {
+	reactions := map[int][]Reaction{}
+	if len(commentIDs) == 0 {
+		return reactions, nil
+	}
+	in := joinIDs(commentIDs)
+	rows := []reactionRow{}
+	err := sqlx.Select(q, &rows, fmt.Sprintf("SELECT `comment_id`, `reaction`, COUNT(*) AS `count` FROM `comment_reactions` WHERE `comment_id` IN (%s) GROUP BY `comment_id`, `reaction`", in))
+	if err != nil {
+		return nil, err
+	}
+	mine := []reactionRow{}
+	if isLogin(me) {
+		err = sqlx.Select(q, &mine, fmt.Sprintf("SELECT `comment_id`, `reaction` FROM `comment_reactions` WHERE `user_id` = ? AND `comment_id` IN (%s)", in), me.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counts := make(map[int]map[string]int, len(rows))
+	for _, r := range rows {
+		if counts[r.CommentID] == nil {
+			counts[r.CommentID] = map[string]int{}
+		}
+		counts[r.CommentID][r.Reaction] = r.Count
+	}
+	reacted := make(map[int]map[string]bool, len(mine))
+	for _, r := range mine {
+		if reacted[r.CommentID] == nil {
+			reacted[r.CommentID] = map[string]bool{}
+		}
+		reacted[r.CommentID][r.Reaction] = true
+	}
+	for _, id := range commentIDs {
+		list := make([]Reaction, len(commentReactionKinds))
+		for i, k := range commentReactionKinds {
+			list[i] = Reaction{Name: k.Name, Emoji: k.Emoji, Count: counts[id][k.Name], Reacted: reacted[id][k.Name]}
+		}
+		reactions[id] = list
+	}
+	return reactions, nil
+}
+
+// postCommentReaction はコメントのリアクションを付け外しする。付いていれば外し、なければ付ける
+func postCommentReaction(w http.ResponseWriter, r *http.Request) {
+	me, ok := requireAuthUser(w, r, scopeComment)
+	if !ok {
+		return
+	}
+
+	if !validCSRF(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	reaction := r.FormValue("reaction")
+	commentID, err := strconv.Atoi(r.FormValue("comment_id"))
+	if err != nil || !validReaction(reaction) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// 見えない投稿のコメントと、ブロックの相手のコメントには付けさせない
+	comment := Comment{}
+	err = db.Get(&comment, "SELECT `id`, `post_id`, `user_id` FROM `comments` WHERE `id` = ?", commentID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Print(err)
+		return
+	}
+	post := Post{}
+	if err == nil {
+		err = db.Get(&post, "SELECT `id`, `user_id`, `visibility`, `status` FROM `posts` WHERE `id` = ?", comment.PostID)
+		if err != nil && err != sql.ErrNoRows {
+			log.Print(err)
+			return
+		}
+	}
+	visible := false
+	if post.ID != 0 {
+		viewer := newPostViewer(me)
+		owner, err := getUser(db, post.UserID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible, err = viewer.canViewPost(db, owner, post.Visibility, post.Status)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		blocking, err := viewer.blocking(db, comment.UserID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		visible = visible && !blocking && owner.DelFlg == 0
+	}
+	if !visible {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	result, err := db.Exec("INSERT IGNORE INTO `comment_reactions` (`comment_id`, `user_id`, `reaction`, `created_at`) VALUES (?,?,?,?)", commentID, me.ID, reaction, time.Now())
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		_, err = db.Exec("DELETE FROM `comment_reactions` WHERE `comment_id` = ? AND `user_id` = ? AND `reaction` = ?", commentID, me.ID, reaction)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+	pinPrimary(w, r)
+
+	http.Redirect(w, r, fmt.Sprintf("/posts/%d#comment_%d", post.ID, commentID), http.StatusFound)
+}
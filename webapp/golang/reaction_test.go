@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCommentReaction(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.addUser("carol", 0, 0)
+	pid := app.addPost(mary, "mary post", []byte("png"))
+	app.addComment(pid, bob, "bob comment")
+
+	b := app.newClient()
+	b.login("bob")
+	c := app.newClient()
+	c.login("carol")
+	react := func(client *testClient, commentID int, reaction string) *testResponse {
+		return client.postForm("/comment/reaction", url.Values{
+			"comment_id": {fmt.Sprint(commentID)},
+			"reaction":   {reaction},
+			"csrf_token": {client.csrfToken()},
+		})
+	}
+	back := fmt.Sprintf("/posts/%d#comment_1", pid)
+
+	assertRedirect(t, react(b, 1, "like"), back)
+	assertRedirect(t, react(c, 1, "like"), back)
+	assertRedirect(t, react(c, 1, "laugh"), back)
+	assertStatus(t, react(c, 1, "angry"), http.StatusNotFound)
+	assertStatus(t, react(c, 99, "like"), http.StatusNotFound)
+	assertStatus(t, c.postForm("/comment/reaction", url.Values{"comment_id": {"1"}, "reaction": {"like"}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+	if n := app.count("comment_reactions"); n != 3 {
+		t.Fatalf("comment_reactions = %d, want 3", n)
+	}
+
+	body := c.get(fmt.Sprintf("/posts/%d", pid)).Body
+	for _, want := range []string{
+		`<button type="submit" name="reaction" value="like" class="isu-reaction isu-reaction-reacted">👍 2</button>`,
+		`<button type="submit" name="reaction" value="laugh" class="isu-reaction isu-reaction-reacted">😂 1</button>`,
+		`<button type="submit" name="reaction" value="love" class="isu-reaction">❤️</button>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/posts/%d does not contain %s", pid, want)
+		}
+	}
+	// タイムラインでは付いている数だけを出す
+	body = app.newClient().get("/").Body
+	if !strings.Contains(body, `<span class="isu-reaction">👍 2</span>`) || strings.Contains(body, "❤️") || strings.Contains(body, `name="reaction"`) {
+		t.Error("timeline does not show the reaction counts")
+	}
+
+	// もう一度押すと外れる
+	assertRedirect(t, react(c, 1, "like"), back)
+	body = c.get(fmt.Sprintf("/posts/%d", pid)).Body
+	if !strings.Contains(body, `<button type="submit" name="reaction" value="like" class="isu-reaction">👍 1</button>`) {
+		t.Error("reaction is not removed")
+	}
+}
+
+func TestCommentReactionHidden(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	bob := app.addUser("bob", 0, 0)
+	app.addUser("carol", 0, 0)
+	pid := app.addPost(mary, "mary post", []byte("png"))
+	app.addComment(pid, bob, "bob comment")
+
+	m := app.newClient()
+	m.login("mary")
+	assertRedirect(t, m.postImages(m.csrfToken(), map[string]string{"body": "secret", "visibility": visibilityOnlyMe}, testUpload{"image/png", []byte("png")}), fmt.Sprintf("/posts/%d", pid+1))
+	app.addComment(pid+1, mary, "secret comment")
+
+	c := app.newClient()
+	c.login("carol")
+	assertRedirect(t, c.postForm("/block", url.Values{"account_name": {"bob"}, "csrf_token": {c.csrfToken()}}), "/@bob")
+	// ブロックの相手のコメントにも、見えない投稿のコメントにも付けられない
+	for _, id := range []int{1, 2} {
+		res := c.postForm("/comment/reaction", url.Values{"comment_id": {fmt.Sprint(id)}, "reaction": {"like"}, "csrf_token": {c.csrfToken()}})
+		assertStatus(t, res, http.StatusNotFound)
+	}
+	if n := app.count("comment_reactions"); n != 0 {
+		t.Errorf("comment_reactions = %d, want 0", n)
+	}
+}
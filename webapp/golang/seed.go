@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha512"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	seedDateFormat = "2006-01-02 15:04:05"
+	seedBatchSize  = 100
+)
+
+var (
+	// seedBaseTime 以降に投稿が作られたことにする。同じシードなら同じ結果になるよう固定
+	seedBaseTime = time.Date(2016, 1, 1, 0, 0, 0, 0, time.Local)
+
+	seedSyllables = []string{"ka", "ki", "ku", "ke", "ko", "sa", "shi", "su", "se", "so", "ta", "chi", "tsu", "te", "to", "na", "ni", "nu", "ne", "no", "ma", "mi", "mu", "me", "mo", "ra", "ri", "ru", "re", "ro"}
+	seedWords     = []string{"今日", "ランチ", "カフェ", "散歩", "空", "海", "猫", "犬", "旅行", "夕焼け", "コーヒー", "ケーキ", "花", "桜", "雨", "公園", "駅", "電車", "本", "映画"}
+	seedMimes     = []string{"image/jpeg", "image/png", "image/gif"}
+)
+
+type seedUser struct {
+	ID          int
+	AccountName string
+	Password    string
+	Passhash    string
+	Authority   int
+	DelFlg      int
+	CreatedAt   time.Time
+}
+
+type seedPost struct {
+	ID        int
+	UserID    int
+	Mime      string
+	Imgdata   []byte
+	Body      string
+	CreatedAt time.Time
+}
+
+type seedComment struct {
+	ID        int
+	PostID    int
+	UserID    int
+	Comment   string
+	CreatedAt time.Time
+}
+
+// seedWriter は生成したデータの書き出し先
+type seedWriter interface {
+	Truncate() error
+	Users(users []seedUser) error
+	Posts(posts []seedPost) error
+	Comments(comments []seedComment) error
+	CommentCounts(counts map[int]int) error
+	Close() error
+}
+
+func sha512Hex(s string) string {
+	sum := sha512.Sum512([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// seedPasshash は calculatePasshash と同じ値を openssl を起動せずに計算する
+func seedPasshash(accountName, password string) string {
+	return sha512Hex(password + ":" + sha512Hex(accountName))
+}
+
+// seedAccountName は /@accountName のルーティングに合わせて英字だけのユニークな名前を作る
+func seedAccountName(rnd *rand.Rand, i int) string {
+	var b strings.Builder
+	for j := 0; j < 2+rnd.Intn(2); j++ {
+		b.WriteString(seedSyllables[rnd.Intn(len(seedSyllables))])
+	}
+	// 重複しないように番号を英字にして付ける
+	for n := i + 1; n > 0; n /= 26 {
+		b.WriteByte(byte('a' + n%26))
+	}
+	return b.String()
+}
+
+func seedBody(rnd *rand.Rand, min, max int) string {
+	n := min + rnd.Intn(max-min+1)
+	words := make([]string, n)
+	for i := range words {
+		words[i] = seedWords[rnd.Intn(len(seedWords))]
+	}
+	return strings.Join(words, " ")
+}
+
+func seedImage(rnd *rand.Rand, mime string, size int) ([]byte, error) {
+	img := image.NewPaletted(image.Rect(0, 0, size, size), nil)
+	palette := make(color.Palette, 16)
+	for i := range palette {
+		palette[i] = color.RGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), 255}
+	}
+	img.Palette = palette
+	block := size / 8
+	if block == 0 {
+		block = 1
+	}
+	for y := 0; y < size; y += block {
+		for x := 0; x < size; x += block {
+			c := uint8(rnd.Intn(len(palette)))
+			for dy := 0; dy < block && y+dy < size; dy++ {
+				for dx := 0; dx < block && x+dx < size; dx++ {
+					img.SetColorIndex(x+dx, y+dy, c)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80})
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		err = fmt.Errorf("unsupported mime %s", mime)
+	}
+	return buf.Bytes(), err
+}
+
+type seedConfig struct {
+	users       int
+	posts       int
+	comments    int
+	admins      int
+	bannedRatio float64
+	imageSize   int
+	seed        int64
+}
+
+// generateSeed は設定に従ってデータを作り w に書き出す。アカウントとパスワードの一覧を返す
+func generateSeed(cfg seedConfig, w seedWriter) ([]seedUser, error) {
+	rnd := rand.New(rand.NewSource(cfg.seed))
+
+	users := make([]seedUser, cfg.users)
+	for i := range users {
+		name := seedAccountName(rnd, i)
+		users[i] = seedUser{
+			ID:          i + 1,
+			AccountName: name,
+			Password:    name + name,
+			CreatedAt:   seedBaseTime.Add(time.Duration(i) * time.Minute),
+		}
+		users[i].Passhash = seedPasshash(users[i].AccountName, users[i].Password)
+		if i < cfg.admins {
+			users[i].Authority = 1
+		} else if rnd.Float64() < cfg.bannedRatio {
+			users[i].DelFlg = 1
+		}
+	}
+	for i := 0; i < len(users); i += seedBatchSize {
+		if err := w.Users(users[i:minInt(i+seedBatchSize, len(users))]); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.users == 0 {
+		return users, nil
+	}
+
+	// 投稿もコメントも一部のユーザーに偏らせる
+	userZipf := rand.NewZipf(rnd, 1.2, 8, uint64(cfg.users-1))
+	postTimes := make([]time.Time, cfg.posts)
+	postStart := seedBaseTime.Add(time.Duration(cfg.users) * time.Minute)
+
+	batch := make([]seedPost, 0, seedBatchSize)
+	for i := 0; i < cfg.posts; i++ {
+		mime := seedMimes[rnd.Intn(len(seedMimes))]
+		img, err := seedImage(rnd, mime, cfg.imageSize)
+		if err != nil {
+			return nil, err
+		}
+		postTimes[i] = postStart.Add(time.Duration(i)*time.Minute + time.Duration(rnd.Intn(60))*time.Second)
+		batch = append(batch, seedPost{
+			ID:        i + 1,
+			UserID:    int(userZipf.Uint64()) + 1,
+			Mime:      mime,
+			Imgdata:   img,
+			Body:      seedBody(rnd, 1, 12),
+			CreatedAt: postTimes[i],
+		})
+		if len(batch) == seedBatchSize || i == cfg.posts-1 {
+			if err := w.Posts(batch); err != nil {
+				return nil, err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	counts := make(map[int]int, cfg.posts)
+	for i := 1; i <= cfg.posts; i++ {
+		counts[i] = 0
+	}
+	if cfg.posts > 0 {
+		postZipf := rand.NewZipf(rnd, 1.1, 16, uint64(cfg.posts-1))
+		comments := make([]seedComment, 0, seedBatchSize)
+		for i := 0; i < cfg.comments; i++ {
+			// 新しい投稿ほどコメントが付きやすい
+			postIdx := cfg.posts - 1 - int(postZipf.Uint64())
+			counts[postIdx+1]++
+			comments = append(comments, seedComment{
+				ID:        i + 1,
+				PostID:    postIdx + 1,
+				UserID:    int(userZipf.Uint64()) + 1,
+				Comment:   seedBody(rnd, 1, 8),
+				CreatedAt: postTimes[postIdx].Add(time.Duration(1+rnd.Intn(72*60)) * time.Minute),
+			})
+			if len(comments) == seedBatchSize || i == cfg.comments-1 {
+				if err := w.Comments(comments); err != nil {
+					return nil, err
+				}
+				comments = comments[:0]
+			}
+		}
+	}
+
+	if err := w.CommentCounts(counts); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// seedDBWriter は MySQL に直接書き込む
+type seedDBWriter struct {
+	db *sqlx.DB
+}
+
+func (w *seedDBWriter) insert(table string, columns []string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	placeholder := "(" + strings.TrimSuffix(strings.Repeat("?,", len(columns)), ",") + ")"
+	values := make([]string, len(rows))
+	args := make([]interface{}, 0, len(rows)*len(columns))
+	for i, row := range rows {
+		values[i] = placeholder
+		args = append(args, row...)
+	}
+	query := fmt.Sprintf("INSERT INTO `%s` (`%s`) VALUES %s", table, strings.Join(columns, "`, `"), strings.Join(values, ","))
+	_, err := w.db.Exec(query, args...)
+	return err
+}
+
+func (w *seedDBWriter) Truncate() error {
+	for _, table := range []string{"comment_count", "comments", "posts", "users"} {
+		if _, err := w.db.Exec("TRUNCATE TABLE `" + table + "`"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *seedDBWriter) Users(users []seedUser) error {
+	rows := make([][]interface{}, len(users))
+	for i, u := range users {
+		rows[i] = []interface{}{u.ID, u.AccountName, u.Passhash, u.Authority, u.DelFlg, u.CreatedAt}
+	}
+	return w.insert("users", []string{"id", "account_name", "passhash", "authority", "del_flg", "created_at"}, rows)
+}
+
+func (w *seedDBWriter) Posts(posts []seedPost) error {
+	rows := make([][]interface{}, len(posts))
+	for i, p := range posts {
+		rows[i] = []interface{}{p.ID, p.UserID, p.Mime, p.Imgdata, imageHash(p.Imgdata), p.Body, p.CreatedAt}
+	}
+	return w.insert("posts", []string{"id", "user_id", "mime", "imgdata", "image_hash", "body", "created_at"}, rows)
+}
+
+func (w *seedDBWriter) Comments(comments []seedComment) error {
+	rows := make([][]interface{}, len(comments))
+	for i, c := range comments {
+		rows[i] = []interface{}{c.ID, c.PostID, c.UserID, c.Comment, c.CreatedAt}
+	}
+	return w.insert("comments", []string{"id", "post_id", "user_id", "comment", "created_at"}, rows)
+}
+
+func (w *seedDBWriter) CommentCounts(counts map[int]int) error {
+	rows := make([][]interface{}, 0, seedBatchSize)
+	for id := 1; id <= len(counts); id++ {
+		rows = append(rows, []interface{}{id, counts[id]})
+		if len(rows) == seedBatchSize || id == len(counts) {
+			if err := w.insert("comment_count", []string{"post_id", "count"}, rows); err != nil {
+				return err
+			}
+			rows = rows[:0]
+		}
+	}
+	return nil
+}
+
+func (w *seedDBWriter) Close() error {
+	return w.db.Close()
+}
+
+var sqlStringReplacer = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\x00", `\0`, "\x1a", `\Z`)
+
+func sqlString(s string) string {
+	return "'" + sqlStringReplacer.Replace(s) + "'"
+}
+
+// seedSQLWriter は mysql コマンドで流し込める SQL を書き出す
+type seedSQLWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newSeedSQLWriter(path string) (*seedSQLWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "SET NAMES utf8mb4;")
+	fmt.Fprintln(w, "SET FOREIGN_KEY_CHECKS=0, UNIQUE_CHECKS=0;")
+	return &seedSQLWriter{f: f, w: w}, nil
+}
+
+func (w *seedSQLWriter) insert(table, columns string, values []string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	_, err := fmt.Fprintf(w.w, "INSERT INTO `%s` (%s) VALUES %s;\n", table, columns, strings.Join(values, ","))
+	return err
+}
+
+func (w *seedSQLWriter) Truncate() error {
+	for _, table := range []string{"comment_count", "comments", "posts", "users"} {
+		if _, err := fmt.Fprintf(w.w, "TRUNCATE TABLE `%s`;\n", table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *seedSQLWriter) Users(users []seedUser) error {
+	values := make([]string, len(users))
+	for i, u := range users {
+		values[i] = fmt.Sprintf("(%d,%s,%s,%d,%d,%s)", u.ID, sqlString(u.AccountName), sqlString(u.Passhash), u.Authority, u.DelFlg, sqlString(u.CreatedAt.Format(seedDateFormat)))
+	}
+	return w.insert("users", "`id`,`account_name`,`passhash`,`authority`,`del_flg`,`created_at`", values)
+}
+
+func (w *seedSQLWriter) Posts(posts []seedPost) error {
+	values := make([]string, len(posts))
+	for i, p := range posts {
+		values[i] = fmt.Sprintf("(%d,%d,%s,X'%s',%s,%s,%s)", p.ID, p.UserID, sqlString(p.Mime), hex.EncodeToString(p.Imgdata), sqlString(imageHash(p.Imgdata)), sqlString(p.Body), sqlString(p.CreatedAt.Format(seedDateFormat)))
+	}
+	return w.insert("posts", "`id`,`user_id`,`mime`,`imgdata`,`image_hash`,`body`,`created_at`", values)
+}
+
+func (w *seedSQLWriter) Comments(comments []seedComment) error {
+	values := make([]string, len(comments))
+	for i, c := range comments {
+		values[i] = fmt.Sprintf("(%d,%d,%d,%s,%s)", c.ID, c.PostID, c.UserID, sqlString(c.Comment), sqlString(c.CreatedAt.Format(seedDateFormat)))
+	}
+	return w.insert("comments", "`id`,`post_id`,`user_id`,`comment`,`created_at`", values)
+}
+
+func (w *seedSQLWriter) CommentCounts(counts map[int]int) error {
+	values := make([]string, 0, seedBatchSize)
+	for id := 1; id <= len(counts); id++ {
+		values = append(values, fmt.Sprintf("(%d,%d)", id, counts[id]))
+		if len(values) == seedBatchSize || id == len(counts) {
+			if err := w.insert("comment_count", "`post_id`,`count`", values); err != nil {
+				return err
+			}
+			values = values[:0]
+		}
+	}
+	return nil
+}
+
+func (w *seedSQLWriter) Close() error {
+	fmt.Fprintln(w.w, "SET FOREIGN_KEY_CHECKS=1, UNIQUE_CHECKS=1;")
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// seedCSVWriter はテーブルごとの CSV と LOAD DATA 用の load.sql を書き出す
+type seedCSVWriter struct {
+	dir      string
+	files    map[string]*os.File
+	writers  map[string]*csv.Writer
+	truncate bool
+}
+
+func newSeedCSVWriter(dir string) (*seedCSVWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w := &seedCSVWriter{dir: dir, files: map[string]*os.File{}, writers: map[string]*csv.Writer{}}
+	for _, table := range []string{"users", "posts", "comments", "comment_count"} {
+		f, err := os.Create(filepath.Join(dir, table+".csv"))
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		w.files[table] = f
+		w.writers[table] = csv.NewWriter(f)
+	}
+	return w, nil
+}
+
+func (w *seedCSVWriter) Truncate() error {
+	w.truncate = true
+	return nil
+}
+
+func (w *seedCSVWriter) Users(users []seedUser) error {
+	cw := w.writers["users"]
+	for _, u := range users {
+		cw.Write([]string{strconv.Itoa(u.ID), u.AccountName, u.Passhash, strconv.Itoa(u.Authority), strconv.Itoa(u.DelFlg), u.CreatedAt.Format(seedDateFormat)})
+	}
+	return cw.Error()
+}
+
+func (w *seedCSVWriter) Posts(posts []seedPost) error {
+	cw := w.writers["posts"]
+	for _, p := range posts {
+		cw.Write([]string{strconv.Itoa(p.ID), strconv.Itoa(p.UserID), p.Mime, hex.EncodeToString(p.Imgdata), imageHash(p.Imgdata), p.Body, p.CreatedAt.Format(seedDateFormat)})
+	}
+	return cw.Error()
+}
+
+func (w *seedCSVWriter) Comments(comments []seedComment) error {
+	cw := w.writers["comments"]
+	for _, c := range comments {
+		cw.Write([]string{strconv.Itoa(c.ID), strconv.Itoa(c.PostID), strconv.Itoa(c.UserID), c.Comment, c.CreatedAt.Format(seedDateFormat)})
+	}
+	return cw.Error()
+}
+
+func (w *seedCSVWriter) CommentCounts(counts map[int]int) error {
+	cw := w.writers["comment_count"]
+	for id := 1; id <= len(counts); id++ {
+		cw.Write([]string{strconv.Itoa(id), strconv.Itoa(counts[id])})
+	}
+	return cw.Error()
+}
+
+func (w *seedCSVWriter) Close() error {
+	var firstErr error
+	for table, f := range w.files {
+		w.writers[table].Flush()
+		if err := w.writers[table].Error(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	var b strings.Builder
+	b.WriteString("SET NAMES utf8mb4;\n")
+	if w.truncate {
+		for _, table := range []string{"comment_count", "comments", "posts", "users"} {
+			fmt.Fprintf(&b, "TRUNCATE TABLE `%s`;\n", table)
+		}
+	}
+	load := func(table, columns, set string) {
+		fmt.Fprintf(&b, "LOAD DATA LOCAL INFILE '%s.csv' INTO TABLE `%s` CHARACTER SET utf8mb4 FIELDS TERMINATED BY ',' OPTIONALLY ENCLOSED BY '\"' (%s)%s;\n", table, table, columns, set)
+	}
+	load("users", "`id`,`account_name`,`passhash`,`authority`,`del_flg`,`created_at`", "")
+	load("posts", "`id`,`user_id`,`mime`,@imgdata,`image_hash`,`body`,`created_at`", " SET `imgdata` = UNHEX(@imgdata)")
+	load("comments", "`id`,`post_id`,`user_id`,`comment`,`created_at`", "")
+	load("comment_count", "`post_id`,`count`", "")
+
+	return os.WriteFile(filepath.Join(w.dir, "load.sql"), []byte(b.String()), 0644)
+}
+
+func writeSeedAccounts(path string, users []seedUser) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, "# account_name password")
+	for _, u := range users {
+		// BAN されたユーザーはログインできないので含めない
+		if u.DelFlg == 1 {
+			continue
+		}
+		fmt.Fprintf(w, "%s %s\n", u.AccountName, u.Password)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runSeed は `app seed` を実行する
+func runSeed(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ExitOnError)
+	cfg := seedConfig{}
+	fs.IntVar(&cfg.users, "users", seedMaxUserID, "number of users")
+	fs.IntVar(&cfg.posts, "posts", seedMaxPostID, "number of posts")
+	fs.IntVar(&cfg.comments, "comments", seedMaxCommentID, "number of comments")
+	fs.IntVar(&cfg.admins, "admins", 1, "number of admin users (the first users)")
+	fs.Float64Var(&cfg.bannedRatio, "banned-ratio", 0.02, "ratio of banned users")
+	fs.IntVar(&cfg.imageSize, "image-size", 64, "width and height of generated images")
+	fs.Int64Var(&cfg.seed, "seed", 1, "random seed")
+	format := fs.String("format", "mysql", "output format: mysql, sql or csv")
+	out := fs.String("out", "", "output file (sql) or directory (csv)")
+	truncate := fs.Bool("truncate", false, "truncate tables before loading")
+	accountsOut := fs.String("accounts-out", "", "write account names and passwords for `app bench -accounts`")
+	fs.Parse(args)
+
+	var w seedWriter
+	var err error
+	switch *format {
+	case "mysql":
+		var conn *sqlx.DB
+		conn, _, err = openDB(primaryDSN())
+		w = &seedDBWriter{db: conn}
+	case "sql":
+		if *out == "" {
+			log.Print("-out is required for the sql format")
+			return 2
+		}
+		w, err = newSeedSQLWriter(*out)
+	case "csv":
+		if *out == "" {
+			log.Print("-out is required for the csv format")
+			return 2
+		}
+		w, err = newSeedCSVWriter(*out)
+	default:
+		log.Printf("unknown format %s", *format)
+		return 2
+	}
+	if err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if *truncate {
+		if err := w.Truncate(); err != nil {
+			log.Print(err)
+			w.Close()
+			return 1
+		}
+	}
+
+	start := time.Now()
+	users, err := generateSeed(cfg, w)
+	if err != nil {
+		log.Print(err)
+		w.Close()
+		return 1
+	}
+	if err := w.Close(); err != nil {
+		log.Print(err)
+		return 1
+	}
+
+	if *accountsOut != "" {
+		if err := writeSeedAccounts(*accountsOut, users); err != nil {
+			log.Print(err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "generated %d users, %d posts, %d comments in %s\n", cfg.users, cfg.posts, cfg.comments, time.Since(start).Round(time.Millisecond))
+	return 0
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sessionName      = "isuconp-go.session"
+	sessionKeyPrefix = "iscogram_"
+	// 以前から使っている署名用の鍵
+	defaultSessionSecret = "sendagaya"
+	defaultSessionMaxAge = 30 * 24 * time.Hour
+	sessionSweepInterval = 10 * time.Minute
+)
+
+// sessionBackend はセッションの値をサーバー側に置く先
+type sessionBackend interface {
+	// load は見つからなければ nil を返す
+	load(ctx context.Context, id string) ([]byte, error)
+	save(ctx context.Context, id string, data []byte, ttl time.Duration) error
+	delete(ctx context.Context, id string) error
+}
+
+// newSessionStore は ISUCONP_SESSION_BACKEND に従ってセッションストアを作る
+func newSessionStore(db *sqlx.DB) (sessions.Store, error) {
+	secrets := sessionSecrets()
+	options := sessionOptionsFromEnv()
+
+	switch backend := getEnv("ISUCONP_SESSION_BACKEND", "memcached"); backend {
+	case "memcached":
+		addr := getEnv("ISUCONP_MEMCACHED_ADDRESS", "localhost:11211")
+		s := gsm.NewMemcacherStore(gsmMemcacher{client: memcache.New(addr)}, sessionKeyPrefix, sessionKeyPairs(secrets, false)...)
+		s.Options = options
+		return s, nil
+	case "mysql":
+		return newServerSessionStore(&mysqlSessionBackend{db: db}, secrets, options), nil
+	case "redis":
+		client, err := newRedisClient(getEnv("ISUCONP_REDIS_URL", "redis://localhost:6379/0"))
+		if err != nil {
+			return nil, err
+		}
+		return newServerSessionStore(&redisSessionBackend{client: client, prefix: sessionKeyPrefix}, secrets, options), nil
+	case "cookie":
+		s := sessions.NewCookieStore(sessionKeyPairs(secrets, true)...)
+		s.Options = options
+		s.MaxAge(options.MaxAge)
+		return s, nil
+	default:
+		return nil, errors.New("unknown session backend in ISUCONP_SESSION_BACKEND: " + backend)
+	}
+}
+
+// memcacheClient は gsmMemcacher が使う *memcache.Client のメソッド
+type memcacheClient interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Delete(key string) error
+}
+
+// gsmMemcacher は gsm が MaxAge をそのまま memcached の有効期限に渡すのを直す。
+// 30 日を超える MaxAge は Unix 時刻に直し、負の MaxAge (ログアウト) は値を消す。
+// 0 (ブラウザを閉じるまで) はサーバー側では defaultSessionMaxAge で消す
+type gsmMemcacher struct {
+	client memcacheClient
+}
+
+func (m gsmMemcacher) Get(key string) (string, uint32, uint64, error) {
+	it, err := m.client.Get(key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return string(it.Value), it.Flags, 0, nil
+}
+
+func (m gsmMemcacher) Set(key, val string, flags, exp uint32, ocas uint64) (uint64, error) {
+	// gsm は int の MaxAge を uint32 にしてくるので符号を戻す
+	maxAge := int32(exp)
+	if maxAge < 0 {
+		err := m.client.Delete(key)
+		if err == memcache.ErrCacheMiss {
+			err = nil
+		}
+		return ocas, err
+	}
+	ttl := time.Duration(maxAge) * time.Second
+	if ttl == 0 {
+		ttl = defaultSessionMaxAge
+	}
+	return ocas, m.client.Set(&memcache.Item{Key: key, Value: []byte(val), Flags: flags, Expiration: memcachedExpiration(ttl)})
+}
+
+// sessionSecrets は ISUCONP_SESSION_SECRETS をカンマで区切って返す。
+// 先頭の鍵で署名し、残りは検証だけに使うのでローテーション中は古い鍵を後ろに残しておく
+func sessionSecrets() []string {
+	secrets := []string{}
+	for _, s := range strings.Split(os.Getenv("ISUCONP_SESSION_SECRETS"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			secrets = append(secrets, s)
+		}
+	}
+	if len(secrets) == 0 {
+		secrets = append(secrets, defaultSessionSecret)
+	}
+	return secrets
+}
+
+// sessionKeyPairs は securecookie に渡す署名鍵と暗号鍵の組を作る。
+// 署名鍵は今までのクッキーを読めるように秘密鍵をそのまま使い、暗号鍵は AES-256 用に導出する
+func sessionKeyPairs(secrets []string, encrypt bool) [][]byte {
+	pairs := make([][]byte, 0, len(secrets)*2)
+	for _, s := range secrets {
+		var blockKey []byte
+		if encrypt {
+			sum := sha256.Sum256([]byte("isuconp-session-block:" + s))
+			blockKey = sum[:]
+		}
+		pairs = append(pairs, []byte(s), blockKey)
+	}
+	return pairs
+}
+
+func sessionOptionsFromEnv() *sessions.Options {
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   int(getEnvDuration("ISUCONP_SESSION_MAX_AGE", defaultSessionMaxAge).Seconds()),
+		Secure:   getEnvBool("ISUCONP_SESSION_SECURE", false),
+		HttpOnly: getEnvBool("ISUCONP_SESSION_HTTP_ONLY", true),
+	}
+
+	switch v := strings.ToLower(getEnv("ISUCONP_SESSION_SAMESITE", "lax")); v {
+	case "lax":
+		options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		// SameSite=None は Secure がないとブラウザに捨てられる
+		options.SameSite = http.SameSiteNoneMode
+		options.Secure = true
+	case "default":
+		options.SameSite = http.SameSiteDefaultMode
+	default:
+		log.Fatalf("Unknown SameSite mode %q in ISUCONP_SESSION_SAMESITE.", v)
+	}
+
+	return options
+}
+
+// serverSessionStore はクッキーには署名したセッション ID だけを置き、値は sessionBackend に置く
+type serverSessionStore struct {
+	backend    sessionBackend
+	codecs     []securecookie.Codec
+	serializer securecookie.GobEncoder
+	Options    *sessions.Options
+}
+
+func newServerSessionStore(backend sessionBackend, secrets []string, options *sessions.Options) *serverSessionStore {
+	return &serverSessionStore{
+		backend: backend,
+		codecs:  securecookie.CodecsFromPairs(sessionKeyPairs(secrets, false)...),
+		Options: options,
+	}
+}
+
+func (s *serverSessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *serverSessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	id := ""
+	err = securecookie.DecodeMulti(name, c.Value, &id, s.codecs...)
+	if err != nil {
+		return session, err
+	}
+
+	data, err := s.backend.load(r.Context(), id)
+	if err != nil {
+		return session, err
+	}
+	if data == nil {
+		// 期限切れや削除済みなら新しいセッションとして扱う
+		return session, nil
+	}
+	err = s.serializer.Deserialize(data, &session.Values)
+	if err != nil {
+		return session, err
+	}
+	session.ID = id
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *serverSessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.backend.delete(r.Context(), session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	data, err := s.serializer.Serialize(session.Values)
+	if err != nil {
+		return err
+	}
+	ttl := time.Duration(session.Options.MaxAge) * time.Second
+	if ttl == 0 {
+		// ブラウザを閉じるまでのセッションもサーバー側ではいつか消す
+		ttl = defaultSessionMaxAge
+	}
+	err = s.backend.save(r.Context(), session.ID, data, ttl)
+	if err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+// mysqlSessionBackend は sessions テーブルにセッションを置く
+type mysqlSessionBackend struct {
+	db *sqlx.DB
+}
+
+func (b *mysqlSessionBackend) load(ctx context.Context, id string) ([]byte, error) {
+	var data []byte
+	err := b.db.GetContext(ctx, &data, "SELECT `data` FROM `sessions` WHERE `id` = ? AND `expires_at` > NOW()", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (b *mysqlSessionBackend) save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	_, err := b.db.ExecContext(ctx,
+		"INSERT INTO `sessions` (`id`, `data`, `expires_at`) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE `data` = VALUES(`data`), `expires_at` = VALUES(`expires_at`)",
+		id, data, time.Now().Add(ttl))
+	return err
+}
+
+func (b *mysqlSessionBackend) delete(ctx context.Context, id string) error {
+	_, err := b.db.ExecContext(ctx, "DELETE FROM `sessions` WHERE `id` = ?", id)
+	return err
+}
+
+// sweepSessions は期限切れのセッションを定期的に消す
+func (b *mysqlSessionBackend) sweepSessions(ctx context.Context) {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_, err := b.db.ExecContext(ctx, "DELETE FROM `sessions` WHERE `expires_at` <= NOW()")
+			if err != nil && ctx.Err() == nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// redisSessionBackend は Redis 互換のサーバーに期限つきでセッションを置く
+type redisSessionBackend struct {
+	client *redisClient
+	prefix string
+}
+
+func (b *redisSessionBackend) load(ctx context.Context, id string) ([]byte, error) {
+	data, err := b.client.Get(ctx, b.prefix+id)
+	if err == errRedisNil {
+		return nil, nil
+	}
+	return data, err
+}
+
+func (b *redisSessionBackend) save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	return b.client.Set(ctx, b.prefix+id, data, ttl)
+}
+
+func (b *redisSessionBackend) delete(ctx context.Context, id string) error {
+	return b.client.Del(ctx, b.prefix+id)
+}
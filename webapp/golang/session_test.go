@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/gorilla/sessions"
+)
+
+type memorySessionBackend struct {
+	mu   sync.Mutex
+	data map[string][]byte
+	ttls map[string]time.Duration
+}
+
+func newMemorySessionBackend() *memorySessionBackend {
+	return &memorySessionBackend{data: map[string][]byte{}, ttls: map[string]time.Duration{}}
+}
+
+func (b *memorySessionBackend) load(ctx context.Context, id string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.data[id], nil
+}
+
+func (b *memorySessionBackend) save(ctx context.Context, id string, data []byte, ttl time.Duration) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.data[id] = data
+	b.ttls[id] = ttl
+	return nil
+}
+
+func (b *memorySessionBackend) delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.data, id)
+	return nil
+}
+
+// saveSession は値を入れて保存し、返ってきたクッキーを返す
+func saveSession(t *testing.T, s sessions.Store, values map[interface{}]interface{}) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, _ := s.Get(r, sessionName)
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	return cookies[0]
+}
+
+func loadSession(t *testing.T, s sessions.Store, c *http.Cookie) *sessions.Session {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	session, _ := s.Get(r, sessionName)
+	return session
+}
+
+func TestServerSessionStore(t *testing.T) {
+	backend := newMemorySessionBackend()
+	options := &sessions.Options{Path: "/", MaxAge: 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode}
+	s := newServerSessionStore(backend, []string{"secret"}, options)
+
+	c := saveSession(t, s, map[interface{}]interface{}{"user_id": 10, "csrf_token": "token"})
+	if !c.HttpOnly || c.MaxAge != 3600 || c.SameSite != http.SameSiteLaxMode {
+		t.Errorf("cookie attributes = %+v", c)
+	}
+	if strings.Contains(c.Value, "token") {
+		t.Error("session values leaked into cookie")
+	}
+
+	session := loadSession(t, s, c)
+	if session.IsNew || session.Values["user_id"] != 10 || session.Values["csrf_token"] != "token" {
+		t.Fatalf("session = %+v", session)
+	}
+	if backend.ttls[session.ID] != time.Hour {
+		t.Errorf("ttl = %v", backend.ttls[session.ID])
+	}
+
+	// 改ざんされたクッキーは読まない
+	forged := *c
+	forged.Value = c.Value[:len(c.Value)-2] + "xx"
+	if session := loadSession(t, s, &forged); !session.IsNew {
+		t.Error("forged cookie accepted")
+	}
+
+	// MaxAge < 0 で保存するとサーバー側からも消える
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(c)
+	w := httptest.NewRecorder()
+	session, _ = s.Get(r, sessionName)
+	session.Options.MaxAge = -1
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if len(backend.data) != 0 {
+		t.Error("session is not deleted")
+	}
+	if session := loadSession(t, s, c); !session.IsNew {
+		t.Error("deleted session loaded")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	options := &sessions.Options{Path: "/", MaxAge: 3600}
+	backend := newMemorySessionBackend()
+
+	tests := []struct {
+		name string
+		new  func(secrets []string) sessions.Store
+	}{
+		{"server", func(secrets []string) sessions.Store {
+			return newServerSessionStore(backend, secrets, options)
+		}},
+		{"cookie", func(secrets []string) sessions.Store {
+			s := sessions.NewCookieStore(sessionKeyPairs(secrets, true)...)
+			s.Options = options
+			return s
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := saveSession(t, tt.new([]string{"old"}), map[interface{}]interface{}{"user_id": 1})
+
+			// 古い鍵を後ろに残していれば読める
+			session := loadSession(t, tt.new([]string{"new", "old"}), c)
+			if session.Values["user_id"] != 1 {
+				t.Errorf("rotated store cannot read old cookie: %+v", session.Values)
+			}
+
+			// 古い鍵を外すと読めない
+			session = loadSession(t, tt.new([]string{"new"}), c)
+			if !session.IsNew {
+				t.Error("cookie signed by removed key accepted")
+			}
+		})
+	}
+}
+
+func TestCookieSessionStoreEncrypts(t *testing.T) {
+	s := sessions.NewCookieStore(sessionKeyPairs([]string{"secret"}, true)...)
+	c := saveSession(t, s, map[interface{}]interface{}{"csrf_token": "plaintexttoken"})
+
+	// 署名だけのクッキーなら gob の中身がそのまま見える
+	plain := sessions.NewCookieStore(sessionKeyPairs([]string{"secret"}, false)...)
+	pc := saveSession(t, plain, map[interface{}]interface{}{"csrf_token": "plaintexttoken"})
+	if c.Value == pc.Value {
+		t.Error("cookie is not encrypted")
+	}
+	if session := loadSession(t, plain, c); !session.IsNew {
+		t.Error("encrypted cookie decoded without block key")
+	}
+}
+
+func TestSessionOptionsFromEnv(t *testing.T) {
+	t.Setenv("ISUCONP_SESSION_MAX_AGE", "2h")
+	t.Setenv("ISUCONP_SESSION_SECURE", "false")
+	t.Setenv("ISUCONP_SESSION_HTTP_ONLY", "false")
+	t.Setenv("ISUCONP_SESSION_SAMESITE", "none")
+
+	o := sessionOptionsFromEnv()
+	if o.MaxAge != 7200 || o.HttpOnly || o.SameSite != http.SameSiteNoneMode {
+		t.Errorf("options = %+v", o)
+	}
+	if !o.Secure {
+		t.Error("SameSite=None requires Secure")
+	}
+}
+
+// recordingMemcache は gsmMemcacher が渡した値をそのまま覚えておく
+type recordingMemcache struct {
+	items map[string]*memcache.Item
+}
+
+func (m *recordingMemcache) Get(key string) (*memcache.Item, error) {
+	if it, ok := m.items[key]; ok {
+		return it, nil
+	}
+	return nil, memcache.ErrCacheMiss
+}
+
+func (m *recordingMemcache) Set(item *memcache.Item) error {
+	m.items[item.Key] = item
+	return nil
+}
+
+func (m *recordingMemcache) Delete(key string) error {
+	if _, ok := m.items[key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(m.items, key)
+	return nil
+}
+
+func TestGsmMemcacherExpiration(t *testing.T) {
+	mc := &recordingMemcache{items: map[string]*memcache.Item{}}
+	m := gsmMemcacher{client: mc}
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		maxAge   int
+		min, max int64
+	}{
+		{"relative", 7200, 7200, 7200},
+		{"30 days", int(memcachedMaxRelativeExpiration.Seconds()), int64(memcachedMaxRelativeExpiration.Seconds()), int64(memcachedMaxRelativeExpiration.Seconds())},
+		// 30 日を超えると Unix 時刻で渡さないと 1970 年扱いですぐに消える
+		{"90 days", 90 * 24 * 3600, now.Add(90 * 24 * time.Hour).Unix(), now.Add(90*24*time.Hour + time.Minute).Unix()},
+		{"browser session", 0, int64(defaultSessionMaxAge.Seconds()), int64(defaultSessionMaxAge.Seconds())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := m.Set("key", "value", 0, uint32(tt.maxAge), 0); err != nil {
+				t.Fatal(err)
+			}
+			if got := int64(mc.items["key"].Expiration); got < tt.min || got > tt.max {
+				t.Errorf("expiration = %d, want %d..%d", got, tt.min, tt.max)
+			}
+		})
+	}
+
+	// gsm は MaxAge = -1 を uint32 にして渡してくる
+	maxAge := -1
+	if _, err := m.Set("key", "value", 0, uint32(maxAge), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := m.Get("key"); err != memcache.ErrCacheMiss {
+		t.Errorf("session is not deleted: %v", err)
+	}
+	if _, err := m.Set("key", "value", 0, uint32(maxAge), 0); err != nil {
+		t.Errorf("deleting a missing session: %v", err)
+	}
+}
+
+// fakeRedisServer は GET/SET/DEL だけを解釈する Redis もどき
+func fakeRedisServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	data := map[string]string{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					reply, err := readRedisReply(r)
+					if err != nil {
+						return
+					}
+					args := []string{}
+					for _, v := range reply.([]interface{}) {
+						args = append(args, string(v.([]byte)))
+					}
+					mu.Lock()
+					switch strings.ToUpper(args[0]) {
+					case "GET":
+						if v, ok := data[args[1]]; ok {
+							conn.Write([]byte("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"))
+						} else {
+							conn.Write([]byte("$-1\r\n"))
+						}
+					case "SET":
+						data[args[1]] = args[2]
+						conn.Write([]byte("+OK\r\n"))
+					case "DEL":
+						n := 0
+						for _, k := range args[1:] {
+							if _, ok := data[k]; ok {
+								delete(data, k)
+								n++
+							}
+						}
+						conn.Write([]byte(":" + strconv.Itoa(n) + "\r\n"))
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestRedisSessionBackend(t *testing.T) {
+	client, err := newRedisClient("redis://" + fakeRedisServer(t) + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	b := &redisSessionBackend{client: client, prefix: sessionKeyPrefix}
+	ctx := context.Background()
+
+	data, err := b.load(ctx, "missing")
+	if err != nil || data != nil {
+		t.Fatalf("load missing = %q, %v", data, err)
+	}
+	if err := b.save(ctx, "id", []byte("value\r\nwith newline"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	data, err = b.load(ctx, "id")
+	if err != nil || string(data) != "value\r\nwith newline" {
+		t.Fatalf("load = %q, %v", data, err)
+	}
+	if err := b.delete(ctx, "id"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := b.load(ctx, "id"); data != nil {
+		t.Errorf("deleted value = %q", data)
+	}
+
+	if _, err := client.do(ctx, "PING"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("error reply = %v", err)
+	}
+}
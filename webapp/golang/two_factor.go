@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	recoveryCodeCount = 10
+
+	// パスワードは通ったが 2 段階目がまだのセッションに入れる値
+	sessionKeyPending2FAUserID = "pending_2fa_user_id"
+	sessionKeyPending2FAUntil  = "pending_2fa_until"
+	sessionKeyPending2FAFails  = "pending_2fa_fails"
+	sessionKeyTOTPSecret       = "totp_pending_secret"
+
+	pending2FATTL       = 5 * time.Minute
+	pending2FAMaxFails  = 5
+	admin2FARequiredMsg = "管理者ページを使うには二段階認証の設定が必要です"
+)
+
+var (
+	templateLogin2FA = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("login_2fa.html")),
+	)
+
+	templateTwoFactor = template.Must(template.ParseFiles(
+		getTemplPath("layout.html"),
+		getTemplPath("two_factor.html")),
+	)
+)
+
+type twoFactorPage struct {
+	Me                  User
+	CSRFToken           string
+	Flash               string
+	Secret              string
+	ProvisioningURI     template.URL
+	RecoveryCodes       []string
+	UnusedRecoveryCodes int
+}
+
+// normalizeRecoveryCode は区切りや大文字小文字の違いを吸収する
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+func recoveryCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes は xxxxx-xxxxx 形式のコードを作り、ハッシュだけを保存する。平文はこの場で一度だけ見せる
+func newRecoveryCodes(userID int) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	now := time.Now()
+	for i := range codes {
+		s := secureRandomStr(5)
+		codes[i] = s[:5] + "-" + s[5:]
+		_, err = tx.Exec("INSERT INTO `recovery_codes` (`user_id`, `code_hash`, `created_at`) VALUES (?,?,?)", userID, recoveryCodeHash(codes[i]), now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return codes, tx.Commit()
+}
+
+// useRecoveryCode は未使用のコードなら使用済みにして true を返す
+func useRecoveryCode(userID int, code string) bool {
+	result, err := db.Exec(
+		"UPDATE `recovery_codes` SET `used_at` = ? WHERE `user_id` = ? AND `code_hash` = ? AND `used_at` IS NULL",
+		time.Now(), userID, recoveryCodeHash(code),
+	)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+// useTOTPCode はコードを確かめ、使ったステップを記録する。
+// 同時に同じコードが送られても片方しか通らないように条件つきで更新する
+func useTOTPCode(u User, code string) bool {
+	// 秘密鍵はキャッシュにないのでプライマリから読む
+	if err := loadUserCredentials(&u); err != nil {
+		log.Print(err)
+		return false
+	}
+	step, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastStep)
+	if !ok {
+		return false
+	}
+	result, err := db.Exec("UPDATE `users` SET `totp_last_step` = ? WHERE `id` = ? AND `totp_last_step` < ?", step, u.ID, step)
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	invalidateUser(u.ID)
+	n, _ := result.RowsAffected()
+	return n == 1
+}
+
+func clearPending2FA(session *sessions.Session) {
+	delete(session.Values, sessionKeyPending2FAUserID)
+	delete(session.Values, sessionKeyPending2FAUntil)
+	delete(session.Values, sessionKeyPending2FAFails)
+}
+
+// pending2FAUser はパスワード認証だけ済んだユーザーを返す
+func pending2FAUser(r *http.Request) (User, bool) {
+	session := getSession(r)
+	uid, ok := session.Values[sessionKeyPending2FAUserID].(int)
+	if !ok {
+		return User{}, false
+	}
+	until, _ := session.Values[sessionKeyPending2FAUntil].(int64)
+	if time.Now().UnixNano() > until {
+		return User{}, false
+	}
+	u, err := getUser(db, uid)
+	if err != nil || u.DelFlg != 0 || !u.TOTPEnabled {
+		return User{}, false
+	}
+	return u, true
+}
+
+// beginLogin はパスワードや外部 ID で本人確認できたユーザーをログインさせる。
+// 二段階認証が有効なら確認コードの入力に進める
+func beginLogin(w http.ResponseWriter, r *http.Request, session *sessions.Session, u User) {
+	if u.TOTPEnabled {
+		session.Values[sessionKeyPending2FAUserID] = u.ID
+		session.Values[sessionKeyPending2FAUntil] = time.Now().Add(pending2FATTL).UnixNano()
+		delete(session.Values, sessionKeyPending2FAFails)
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	err := loginUser(r, session, u.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func getLogin2FA(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	if _, ok := pending2FAUser(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	templateLogin2FA.Execute(w, struct {
+		Me    User
+		Flash string
+	}{User{}, getFlash(w, r, "notice")})
+}
+
+func postLogin2FA(w http.ResponseWriter, r *http.Request) {
+	if isLogin(getSessionUser(r)) {
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	u, ok := pending2FAUser(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	// セッションを作り直して失敗回数を消されても、IP とユーザーごとの上限で止める
+	if !allowRequest(w, "login_2fa:ip", clientIP(r)) || !allowRequest(w, "login_2fa:user", strconv.Itoa(u.ID)) {
+		return
+	}
+
+	session := getSession(r)
+
+	code := r.FormValue("code")
+	if !useTOTPCode(u, code) && !useRecoveryCode(u.ID, code) {
+		fails, _ := session.Values[sessionKeyPending2FAFails].(int)
+		fails++
+		if fails >= pending2FAMaxFails {
+			// 何度も間違えたらパスワードからやり直してもらう
+			clearPending2FA(session)
+			session.Values["notice"] = "確認コードを続けて間違えたため、もう一度ログインしてください"
+			session.Save(r, w)
+
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		session.Values[sessionKeyPending2FAFails] = fails
+		session.Values["notice"] = "確認コードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/login/2fa", http.StatusFound)
+		return
+	}
+
+	clearPending2FA(session)
+	err := loginUser(r, session, u.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func getTwoFactor(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	secret, uri := "", ""
+	if !me.TOTPEnabled {
+		// 有効にするまでは秘密鍵をセッションにだけ置いておく
+		session := getSession(r)
+		secret, _ = session.Values[sessionKeyTOTPSecret].(string)
+		if secret == "" {
+			secret = newTOTPSecret()
+			session.Values[sessionKeyTOTPSecret] = secret
+			session.Save(r, w)
+		}
+		uri = totpProvisioningURI(me.AccountName, secret)
+	}
+
+	unused := 0
+	if me.TOTPEnabled {
+		err := db.Get(&unused, "SELECT COUNT(*) FROM `recovery_codes` WHERE `user_id` = ? AND `used_at` IS NULL", me.ID)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	templateTwoFactor.Execute(w, twoFactorPage{me, getCSRFToken(r), getFlash(w, r, "notice"), secret, template.URL(uri), nil, unused})
+}
+
+// renderRecoveryCodes は作り直した回復コードをその場で表示する
+func renderRecoveryCodes(w http.ResponseWriter, r *http.Request, me User, codes []string, notice string) {
+	templateTwoFactor.Execute(w, twoFactorPage{me, getCSRFToken(r), notice, "", "", codes, len(codes)})
+}
+
+func postTwoFactorEnable(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	secret, _ := session.Values[sessionKeyTOTPSecret].(string)
+	if me.TOTPEnabled || secret == "" {
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
+
+	step, ok := verifyTOTP(secret, r.FormValue("code"), time.Now(), 0)
+	if !ok {
+		session.Values["notice"] = "確認コードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `totp_secret` = ?, `totp_enabled` = ?, `totp_last_step` = ? WHERE `id` = ?", secret, 1, step, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUser(me.ID)
+
+	// 二段階認証を通っていない他のセッションは残さない
+	err = revokeUserSessions(me.ID, currentUserSessionID(r))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	codes, err := newRecoveryCodes(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	delete(session.Values, sessionKeyTOTPSecret)
+	session.Save(r, w)
+
+	me.TOTPEnabled = true
+	renderRecoveryCodes(w, r, me, codes, "二段階認証を有効にしました。回復コードを安全な場所に控えてください")
+}
+
+func postTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	session := getSession(r)
+	if !me.TOTPEnabled {
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
+
+	// パスワードのないユーザーは確認コードだけで確かめる
+	if (me.HasPassword && tryLogin(me.AccountName, r.FormValue("password")) == nil) || !useTOTPCode(me, r.FormValue("code")) {
+		session.Values["notice"] = "パスワードか確認コードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
+
+	_, err := db.Exec("UPDATE `users` SET `totp_secret` = ?, `totp_enabled` = ?, `totp_last_step` = ? WHERE `id` = ?", "", 0, 0, me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	_, err = db.Exec("DELETE FROM `recovery_codes` WHERE `user_id` = ?", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	invalidateUser(me.ID)
+
+	session.Values["notice"] = "二段階認証を無効にしました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/2fa", http.StatusFound)
+}
+
+func postTwoFactorRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !me.TOTPEnabled || !useTOTPCode(me, r.FormValue("code")) {
+		session := getSession(r)
+		session.Values["notice"] = "確認コードが間違っています"
+		session.Save(r, w)
+
+		http.Redirect(w, r, "/2fa", http.StatusFound)
+		return
+	}
+
+	codes, err := newRecoveryCodes(me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	renderRecoveryCodes(w, r, me, codes, "回復コードを作り直しました。以前のコードは使えません")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+var recoveryCodeRegexp = regexp.MustCompile(`class="isu-recovery-code">([0-9a-f]{5}-[0-9a-f]{5})<`)
+
+// enableTOTP は二段階認証を有効にした状態にする
+func (a *testApp) enableTOTP(userID int) string {
+	a.fake.mu.Lock()
+	defer a.fake.mu.Unlock()
+	row := a.fake.findOne("users", "id", int64(userID))
+	row["totp_secret"] = testTOTPSecret
+	row["totp_enabled"] = true
+	row["totp_last_step"] = int64(0)
+	return testTOTPSecret
+}
+
+// nextTOTPCode はまだ使っていないステップのうち受け付けられるコードを返す
+func (a *testApp) nextTOTPCode(userID int, secret string) string {
+	a.fake.mu.Lock()
+	last := fakeInt(a.fake.findOne("users", "id", int64(userID))["totp_last_step"])
+	a.fake.mu.Unlock()
+
+	step := totpStep(time.Now()) - totpSkew
+	if step <= last {
+		step = last + 1
+	}
+	key, _ := decodeTOTPSecret(secret)
+	return totpCode(key, step)
+}
+
+func (c *testClient) loginWith2FA(accountName, code string) {
+	c.t.Helper()
+	res := c.postForm("/login", url.Values{"account_name": {accountName}, "password": {accountName + accountName}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/login/2fa" {
+		c.t.Fatalf("login %s: status %d location %q", accountName, res.StatusCode, res.Header.Get("Location"))
+	}
+	res = c.postForm("/login/2fa", url.Values{"code": {code}})
+	if res.StatusCode != http.StatusFound || res.Header.Get("Location") != "/" {
+		c.t.Fatalf("2fa %s: status %d location %q", accountName, res.StatusCode, res.Header.Get("Location"))
+	}
+}
+
+// loginAdmin は二段階認証を有効にした管理者でログインする
+func (c *testClient) loginAdmin(app *testApp, uid int, accountName string) {
+	c.t.Helper()
+	secret := app.enableTOTP(uid)
+	c.loginWith2FA(accountName, app.nextTOTPCode(uid, secret))
+}
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B の SHA-1 のテストベクターの下 6 桁
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(key, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+	current := totpStep(now)
+
+	if step, ok := verifyTOTP(secret, "081804", now, 0); !ok || step != current {
+		t.Errorf("current code: step %d ok %v", step, ok)
+	}
+	if _, ok := verifyTOTP(secret, "081 804", now, 0); !ok {
+		t.Error("code with space rejected")
+	}
+	if _, ok := verifyTOTP(secret, "081804", now.Add(totpPeriod*time.Second), 0); !ok {
+		t.Error("previous step rejected")
+	}
+	if _, ok := verifyTOTP(secret, "081804", now.Add(2*totpPeriod*time.Second), 0); ok {
+		t.Error("code two steps old accepted")
+	}
+	if _, ok := verifyTOTP(secret, "081804", now, current); ok {
+		t.Error("used code accepted again")
+	}
+	for _, code := range []string{"", "000000", "08180", "0818045"} {
+		if _, ok := verifyTOTP(secret, code, now, 0); ok {
+			t.Errorf("%q accepted", code)
+		}
+	}
+	if _, ok := verifyTOTP("not base32!", "081804", now, 0); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	u, err := url.Parse(totpProvisioningURI("mary", "ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Scheme != "otpauth" || u.Host != "totp" || u.Path != "/Iscogram:mary" {
+		t.Errorf("uri = %s", u)
+	}
+	q := u.Query()
+	if q.Get("secret") != "ABCDEF" || q.Get("issuer") != "Iscogram" || q.Get("digits") != "6" || q.Get("period") != "30" {
+		t.Errorf("query = %v", q)
+	}
+}
+
+func TestTwoFactorEnroll(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+
+	assertRedirect(t, app.newClient().get("/2fa"), "/login")
+
+	other := app.newClient()
+	other.login("mary")
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	res := c.get("/2fa")
+	assertStatus(t, res, http.StatusOK)
+	m := regexp.MustCompile(`class="isu-totp-secret">([A-Z2-7]+)<`).FindStringSubmatch(res.Body)
+	if m == nil {
+		t.Fatal("secret not shown")
+	}
+	secret := m[1]
+	if !strings.Contains(c.get("/2fa").Body, secret) {
+		t.Error("secret changed on reload")
+	}
+
+	assertStatus(t, c.postForm("/2fa/enable", url.Values{"code": {"000000"}}), http.StatusUnprocessableEntity)
+	assertRedirect(t, c.postForm("/2fa/enable", url.Values{"code": {"000000"}, "csrf_token": {token}}), "/2fa")
+	if !strings.Contains(c.get("/2fa").Body, "確認コードが間違っています") {
+		t.Error("flash not shown")
+	}
+
+	res = c.postForm("/2fa/enable", url.Values{"code": {app.nextTOTPCode(mary, secret)}, "csrf_token": {token}})
+	assertStatus(t, res, http.StatusOK)
+	codes := recoveryCodeRegexp.FindAllStringSubmatch(res.Body, -1)
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("recovery codes = %v", codes)
+	}
+	for _, row := range app.fake.tables["recovery_codes"] {
+		if fakeString(row["code_hash"]) == codes[0][1] {
+			t.Error("recovery code is stored in plain text")
+		}
+	}
+	if row := app.fake.findOne("users", "id", int64(mary)); row["totp_enabled"] != true || fakeString(row["totp_secret"]) != secret {
+		t.Errorf("user = %v", row)
+	}
+
+	if !c.loggedIn() {
+		t.Error("current session is logged out")
+	}
+	if other.loggedIn() {
+		t.Error("session without 2FA survived enabling it")
+	}
+	if !strings.Contains(c.get("/2fa").Body, fmt.Sprintf(`class="isu-unused-recovery-codes">%d<`, recoveryCodeCount)) {
+		t.Error("unused recovery code count not shown")
+	}
+
+	// パスワードだけではログインできない
+	fresh := app.newClient()
+	assertRedirect(t, fresh.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}}), "/login/2fa")
+	if fresh.loggedIn() {
+		t.Error("logged in without 2FA")
+	}
+	assertStatus(t, fresh.get("/login/2fa"), http.StatusOK)
+
+	// 回復コードは一度だけ使える
+	assertRedirect(t, fresh.postForm("/login/2fa", url.Values{"code": {strings.ToUpper(codes[0][1])}}), "/")
+	if !fresh.loggedIn() {
+		t.Error("recovery code login failed")
+	}
+	again := app.newClient()
+	assertRedirect(t, again.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}}), "/login/2fa")
+	assertRedirect(t, again.postForm("/login/2fa", url.Values{"code": {codes[0][1]}}), "/login/2fa")
+	if !strings.Contains(again.get("/login/2fa").Body, "確認コードが間違っています") {
+		t.Error("flash not shown")
+	}
+
+	// 無効にするにはパスワードと確認コードの両方が要る
+	assertRedirect(t, c.postForm("/2fa/disable", url.Values{"password": {"wrongpass"}, "code": {app.nextTOTPCode(mary, secret)}, "csrf_token": {token}}), "/2fa")
+	assertRedirect(t, c.postForm("/2fa/disable", url.Values{"password": {"marymary"}, "code": {app.nextTOTPCode(mary, secret)}, "csrf_token": {token}}), "/2fa")
+	if row := app.fake.findOne("users", "id", int64(mary)); row["totp_enabled"] != false || fakeString(row["totp_secret"]) != "" {
+		t.Errorf("user = %v", row)
+	}
+	if n := app.count("recovery_codes"); n != 0 {
+		t.Errorf("recovery_codes = %d", n)
+	}
+	app.newClient().login("mary")
+}
+
+func TestTwoFactorDisableWithoutPassword(t *testing.T) {
+	app := newTestApp(t)
+	m := useMockOIDC(t)
+
+	c := app.newClient()
+	claims := m.claims("sub-1")
+	claims["preferred_username"] = "carol"
+	assertRedirect(t, m.authorize(c, c.get("/auth/mock"), claims), "/")
+	carol := int(fakeInt(app.fake.findOne("users", "account_name", "carol")["id"]))
+	secret := app.enableTOTP(carol)
+	invalidateUser(carol)
+
+	res := c.get("/2fa")
+	if strings.Contains(res.Body, `name="password"`) {
+		t.Error("password is asked")
+	}
+	token := c.csrfToken()
+
+	// パスワードのないユーザーは確認コードだけで無効にできる
+	assertRedirect(t, c.postForm("/2fa/disable", url.Values{"code": {"000000"}, "csrf_token": {token}}), "/2fa")
+	if row := app.fake.findOne("users", "id", int64(carol)); row["totp_enabled"] != true {
+		t.Error("disabled with a wrong code")
+	}
+	assertRedirect(t, c.postForm("/2fa/disable", url.Values{"code": {app.nextTOTPCode(carol, secret)}, "csrf_token": {token}}), "/2fa")
+	if row := app.fake.findOne("users", "id", int64(carol)); row["totp_enabled"] != false {
+		t.Errorf("user = %v", row)
+	}
+}
+
+func TestLogin2FALockout(t *testing.T) {
+	app := newTestApp(t)
+	mary := app.addUser("mary", 0, 0)
+	secret := app.enableTOTP(mary)
+
+	c := app.newClient()
+	assertRedirect(t, c.get("/login/2fa"), "/login")
+	assertRedirect(t, c.postForm("/login/2fa", url.Values{"code": {app.nextTOTPCode(mary, secret)}}), "/login")
+
+	assertRedirect(t, c.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}}), "/login/2fa")
+	for i := 1; i < pending2FAMaxFails; i++ {
+		assertRedirect(t, c.postForm("/login/2fa", url.Values{"code": {"000000"}}), "/login/2fa")
+	}
+	assertRedirect(t, c.postForm("/login/2fa", url.Values{"code": {"000000"}}), "/login")
+
+	// 正しいコードでもパスワードからやり直すまでは通らない
+	assertRedirect(t, c.postForm("/login/2fa", url.Values{"code": {app.nextTOTPCode(mary, secret)}}), "/login")
+	if c.loggedIn() {
+		t.Error("logged in after lockout")
+	}
+	c.loginWith2FA("mary", app.nextTOTPCode(mary, secret))
+
+	// 同じコードの使い回しはできない
+	used := totpCode(mustDecodeTOTPSecret(t, secret), fakeInt(app.fake.findOne("users", "id", int64(mary))["totp_last_step"]))
+	replay := app.newClient()
+	replay.postForm("/login", url.Values{"account_name": {"mary"}, "password": {"marymary"}})
+	assertRedirect(t, replay.postForm("/login/2fa", url.Values{"code": {used}}), "/login/2fa")
+}
+
+func TestAdminRequires2FA(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("admin", 1, 0)
+
+	c := app.newClient()
+	c.login("admin")
+	assertRedirect(t, c.get("/admin/banned"), "/2fa")
+	if !strings.Contains(c.get("/2fa").Body, admin2FARequiredMsg) {
+		t.Error("flash not shown")
+	}
+	assertRedirect(t, c.postForm("/admin/banned", url.Values{"csrf_token": {c.csrfToken()}}), "/2fa")
+}
+
+func mustDecodeTOTPSecret(t *testing.T, secret string) []byte {
+	t.Helper()
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
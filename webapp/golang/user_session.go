@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	sessionKeyUserSessionID = "sid"
+
+	userSessionCacheTTL = 1 * time.Minute
+	// last_active_at を書き込む間隔。毎リクエスト UPDATE しないように間引く
+	userSessionTouchInterval = 1 * time.Minute
+	userAgentMaxLength       = 255
+)
+
+// UserSession はログインごとに作る行。セッションストアの値とは別に持ち、他の端末から消せるようにする
+type UserSession struct {
+	ID           string    `db:"id"`
+	UserID       int       `db:"user_id"`
+	UserAgent    string    `db:"user_agent"`
+	IP           string    `db:"ip"`
+	CreatedAt    time.Time `db:"created_at"`
+	LastActiveAt time.Time `db:"last_active_at"`
+}
+
+var templateSessions = template.Must(template.New("layout.html").Funcs(template.FuncMap{
+	"describeUserAgent": describeUserAgent,
+}).ParseFiles(
+	getTemplPath("layout.html"),
+	getTemplPath("sessions.html"),
+))
+
+func userSessionCacheKey(id string) string {
+	return "user_session:" + id
+}
+
+// clientIP はアクセス元の IP を返す。手前の nginx が付けた X-Real-IP はローカルからの接続のときだけ信じる
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+			return realIP
+		}
+	}
+	return host
+}
+
+// describeUserAgent は一覧に出すためにブラウザと OS をざっくり判定する
+func describeUserAgent(ua string) string {
+	browser := ""
+	switch {
+	case ua == "":
+		return "不明な端末"
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+
+	platform := ""
+	switch {
+	case strings.Contains(ua, "iPhone"), strings.Contains(ua, "iPad"):
+		platform = "iOS"
+	case strings.Contains(ua, "Android"):
+		platform = "Android"
+	case strings.Contains(ua, "Windows"):
+		platform = "Windows"
+	case strings.Contains(ua, "Mac OS X"), strings.Contains(ua, "Macintosh"):
+		platform = "macOS"
+	case strings.Contains(ua, "Linux"):
+		platform = "Linux"
+	}
+
+	switch {
+	case browser != "" && platform != "":
+		return browser + " (" + platform + ")"
+	case browser != "":
+		return browser
+	case platform != "":
+		return platform
+	}
+	if len(ua) > 40 {
+		return ua[:40] + "…"
+	}
+	return ua
+}
+
+// startUserSession はログイン直後に呼び、セッションに紐づく行を作る
+func startUserSession(r *http.Request, userID int) (string, error) {
+	ua := r.UserAgent()
+	if len(ua) > userAgentMaxLength {
+		ua = ua[:userAgentMaxLength]
+	}
+	id := secureRandomStr(32)
+	now := time.Now()
+	_, err := db.Exec(
+		"INSERT INTO `user_sessions` (`id`, `user_id`, `user_agent`, `ip`, `created_at`, `last_active_at`) VALUES (?,?,?,?,?,?)",
+		id, userID, ua, clientIP(r), now, now,
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// loginUser はセッションをログイン済みにする。保存は呼び出し側で行う
+func loginUser(r *http.Request, session *sessions.Session, userID int) error {
+	sid, err := startUserSession(r, userID)
+	if err != nil {
+		return err
+	}
+	session.Values["user_id"] = userID
+	session.Values[sessionKeyUserSessionID] = sid
+	session.Values["csrf_token"] = secureRandomStr(16)
+	return nil
+}
+
+func getUserSession(q sqlx.Queryer, id string) (UserSession, error) {
+	us := UserSession{}
+	err := cacheFetch(userSessionCacheKey(id), userSessionCacheTTL, &us, func() (interface{}, error) {
+		us := UserSession{}
+		err := sqlx.Get(q, &us, "SELECT * FROM `user_sessions` WHERE `id` = ?", id)
+		return us, err
+	})
+	return us, err
+}
+
+// validUserSession はセッションの sid がまだ取り消されていないか確かめ、ついでに最終アクセスを記録する
+func validUserSession(r *http.Request, userID int, sid string) bool {
+	if sid == "" {
+		return false
+	}
+
+	// 取り消し直後に読み込みがレプリカへ行かないようにプライマリを見る
+	us, err := getUserSession(db, sid)
+	if err == sql.ErrNoRows {
+		return false
+	}
+	if err != nil {
+		log.Print(err)
+		return false
+	}
+	if us.UserID != userID {
+		return false
+	}
+
+	if time.Since(us.LastActiveAt) > userSessionTouchInterval {
+		_, err := db.Exec("UPDATE `user_sessions` SET `last_active_at` = ?, `ip` = ? WHERE `id` = ?", time.Now(), clientIP(r), sid)
+		if err != nil {
+			log.Print(err)
+		}
+		invalidateCache(userSessionCacheKey(sid))
+	}
+	return true
+}
+
+func currentUserSessionID(r *http.Request) string {
+	sid, _ := getSession(r).Values[sessionKeyUserSessionID].(string)
+	return sid
+}
+
+func revokeUserSession(userID int, sid string) error {
+	_, err := db.Exec("DELETE FROM `user_sessions` WHERE `id` = ? AND `user_id` = ?", sid, userID)
+	if err != nil {
+		return err
+	}
+	invalidateCache(userSessionCacheKey(sid))
+	return nil
+}
+
+// revokeUserSessions はユーザーのセッションを except 以外すべて取り消す。
+// BAN やパスワード変更のときは except を空にして全部消す
+func revokeUserSessions(userID int, except string) error {
+	ids := []string{}
+	err := db.Select(&ids, "SELECT `id` FROM `user_sessions` WHERE `user_id` = ?", userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM `user_sessions` WHERE `user_id` = ? AND `id` <> ?", userID, except)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != except {
+			keys = append(keys, userSessionCacheKey(id))
+		}
+	}
+	if len(keys) > 0 {
+		invalidateCache(keys...)
+	}
+	return nil
+}
+
+func getSessions(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	userSessions := []UserSession{}
+	err := db.Select(&userSessions, "SELECT * FROM `user_sessions` WHERE `user_id` = ? ORDER BY `last_active_at` DESC", me.ID)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	templateSessions.Execute(w, struct {
+		Sessions  []UserSession
+		CurrentID string
+		Me        User
+		CSRFToken string
+		Flash     string
+	}{userSessions, currentUserSessionID(r), me, getCSRFToken(r), getFlash(w, r, "notice")})
+}
+
+func postSessionsRevoke(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	sid := r.FormValue("session_id")
+	if sid == currentUserSessionID(r) {
+		// 今のセッションはログアウトで消す
+		http.Redirect(w, r, "/logout", http.StatusFound)
+		return
+	}
+
+	err := revokeUserSession(me.ID, sid)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = "セッションをログアウトさせました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+func postSessionsRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+
+	if r.FormValue("csrf_token") != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		return
+	}
+
+	err := revokeUserSessions(me.ID, currentUserSessionID(r))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	session := getSession(r)
+	session.Values["notice"] = "他のセッションをすべてログアウトさせました"
+	session.Save(r, w)
+
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var sessionIDRegexp = regexp.MustCompile(`name="session_id" value="([0-9a-f]+)"`)
+
+func (c *testClient) loggedIn() bool {
+	c.t.Helper()
+	return strings.Contains(c.get("/").Body, `href="/logout"`)
+}
+
+func TestUserSessions(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+
+	laptop := app.newClient()
+	laptop.login("mary")
+	phone := app.newClient()
+	phone.login("mary")
+	tablet := app.newClient()
+	tablet.login("mary")
+	if n := app.count("user_sessions"); n != 3 {
+		t.Fatalf("user_sessions = %d, want 3", n)
+	}
+
+	assertRedirect(t, app.newClient().get("/sessions"), "/login")
+
+	res := laptop.get("/sessions")
+	assertStatus(t, res, http.StatusOK)
+	if n := strings.Count(res.Body, `class="isu-session"`); n != 3 {
+		t.Errorf("sessions shown = %d, want 3", n)
+	}
+	if n := strings.Count(res.Body, "この端末"); n != 1 {
+		t.Errorf("current session marked %d times", n)
+	}
+	others := sessionIDRegexp.FindAllStringSubmatch(res.Body, -1)
+	if len(others) != 2 {
+		t.Fatalf("revocable sessions = %d, want 2", len(others))
+	}
+	token := laptop.csrfToken()
+
+	assertStatus(t, laptop.postForm("/sessions/revoke", url.Values{"session_id": {others[0][1]}, "csrf_token": {"wrong"}}), http.StatusUnprocessableEntity)
+
+	// 1 つだけ取り消す
+	assertRedirect(t, laptop.postForm("/sessions/revoke", url.Values{"session_id": {others[0][1]}, "csrf_token": {token}}), "/sessions")
+	if n := app.count("user_sessions"); n != 2 {
+		t.Fatalf("user_sessions = %d, want 2", n)
+	}
+	if phone.loggedIn() == tablet.loggedIn() {
+		t.Error("exactly one of the other sessions should be logged out")
+	}
+
+	// 残りをまとめて取り消す
+	assertRedirect(t, laptop.postForm("/sessions/revoke_others", url.Values{"csrf_token": {token}}), "/sessions")
+	if phone.loggedIn() || tablet.loggedIn() {
+		t.Error("other sessions are still logged in")
+	}
+	if !laptop.loggedIn() {
+		t.Fatal("current session is logged out")
+	}
+
+	assertRedirect(t, laptop.get("/logout"), "/")
+	if n := app.count("user_sessions"); n != 0 {
+		t.Errorf("user_sessions = %d after logout, want 0", n)
+	}
+}
+
+func TestUserSessionsOfOtherUser(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	app.addUser("bob", 0, 0)
+
+	bob := app.newClient()
+	bob.login("bob")
+	bobSession := fmt.Sprint(app.fake.tables["user_sessions"][0]["id"])
+
+	mary := app.newClient()
+	mary.login("mary")
+	res := mary.postForm("/sessions/revoke", url.Values{"session_id": {bobSession}, "csrf_token": {mary.csrfToken()}})
+	assertRedirect(t, res, "/sessions")
+	if !bob.loggedIn() {
+		t.Error("another user's session was revoked")
+	}
+}
+
+func TestBanRevokesSessions(t *testing.T) {
+	app := newTestApp(t)
+	adminID := app.addUser("admin", 1, 0)
+	bob := app.addUser("bob", 0, 0)
+
+	c := app.newClient()
+	c.login("bob")
+
+	admin := app.newClient()
+	admin.loginAdmin(app, adminID, "admin")
+	assertRedirect(t, admin.postForm("/admin/banned", url.Values{"uid[]": {fmt.Sprint(bob)}, "csrf_token": {admin.csrfToken()}}), "/admin/banned")
+
+	if c.loggedIn() {
+		t.Error("banned user is still logged in")
+	}
+}
+
+func TestDescribeUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want string
+	}{
+		{"", "不明な端末"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36", "Chrome (macOS)"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.0 Mobile/15E148 Safari/604.1", "Safari (iOS)"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.0.0", "Edge (Windows)"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0", "Firefox (Linux)"},
+		{"curl/8.4.0", "curl"},
+		{"Go-http-client/1.1", "Go-http-client/1.1"},
+	}
+	for _, tt := range tests {
+		if got := describeUserAgent(tt.ua); got != tt.want {
+			t.Errorf("describeUserAgent(%q) = %q, want %q", tt.ua, got, tt.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		realIP     string
+		want       string
+	}{
+		{"192.0.2.1:1234", "", "192.0.2.1"},
+		{"127.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		// nginx を通っていなければヘッダーは無視する
+		{"192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("clientIP(%s, %s) = %s, want %s", tt.remoteAddr, tt.realIP, got, tt.want)
+		}
+	}
+}
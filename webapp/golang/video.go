@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"goji.io/pat"
+)
+
+const (
+	VideoUploadLimit        = 30 * 1024 * 1024 // 30mb
+	PosterUploadLimit       = 2 * 1024 * 1024  // 2mb
+	defaultVideoMaxDuration = 60 * time.Second
+	// placeholderPosterSize はポスターを作るときの長辺のピクセル数
+	placeholderPosterSize = 480
+	// posterExtractTimeout は ffmpeg でフレームを取り出すのを待つ長さ
+	posterExtractTimeout = 10 * time.Second
+)
+
+var errVideoFormat = errors.New("unsupported video container")
+
+// PostVideo は動画の投稿の情報。動画そのものは posts の mime と image_hash で、<id>.<ext> に置く
+type PostVideo struct {
+	PostID     int    `db:"post_id"`
+	DurationMs int64  `db:"duration_ms"`
+	Width      int    `db:"width"`
+	Height     int    `db:"height"`
+	PosterMime string `db:"poster_mime"`
+	PosterHash string `db:"poster_hash"`
+}
+
+// DurationLabel は "0:12" のような再生時間の表示
+func (v PostVideo) DurationLabel() string {
+	sec := (v.DurationMs + 500) / 1000
+	return fmt.Sprintf("%d:%02d", sec/60, sec%60)
+}
+
+type videoInfo struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+}
+
+// videoUpload は投稿を書き込む前に確かめ終えた動画とポスター
+type videoUpload struct {
+	Info       videoInfo
+	Poster     []byte
+	PosterMime string
+}
+
+func videoMaxDuration() time.Duration {
+	return getEnvDuration("ISUCONP_VIDEO_MAX_DURATION", defaultVideoMaxDuration)
+}
+
+func videoMimeType(contentType string) string {
+	if strings.Contains(contentType, "mp4") {
+		return "video/mp4"
+	} else if strings.Contains(contentType, "webm") {
+		return "video/webm"
+	}
+	return ""
+}
+
+func isVideo(mime string) bool {
+	return strings.HasPrefix(mime, "video/")
+}
+
+func posterPath(postID int, mime string) string {
+	return fmt.Sprintf("%s/%d_poster.%s", imageDir, postID, getExt(mime))
+}
+
+func posterURL(v *PostVideo) string {
+	return fmt.Sprintf("/image/%d/poster.%s?v=%s", v.PostID, getExt(v.PosterMime), imageVersion(v.PosterHash))
+}
+
+// posterFFmpeg はポスターのフレームを取り出す ffmpeg のパス。空ならサーバーでは取り出さない
+func posterFFmpeg() string {
+	return getEnv("ISUCONP_VIDEO_POSTER_FFMPEG", "")
+}
+
+// prepareVideoUpload は動画のコンテナを読んで長さを確かめ、ポスターを用意する。
+// ISUCONP_VIDEO_POSTER_FFMPEG があれば最初のキーフレームを取り出して使う。
+// 取り出せなければ、ブラウザが canvas で切り出して poster に付けてきたもの、それもなければ縦横比を合わせたプレースホルダにする
+func prepareVideoUpload(r *http.Request, video uploadedImage) (*videoUpload, error) {
+	info, err := probeVideo(video.Data, video.Mime)
+	if err != nil {
+		return nil, uploadError("動画を読み取れませんでした。長さの情報が入ったmp4かwebmにしてください")
+	}
+	if max := videoMaxDuration(); info.Duration > max {
+		return nil, uploadError(fmt.Sprintf("動画は%d秒までです", int(max.Seconds())))
+	}
+
+	if bin := posterFFmpeg(); bin != "" {
+		poster, err := extractPosterFrame(r.Context(), bin, video.Data)
+		if err == nil {
+			return &videoUpload{Info: info, Poster: poster, PosterMime: "image/jpeg"}, nil
+		}
+		log.Printf("extract poster: %v", err)
+	}
+
+	poster, posterMime, err := readUploadedImage(r, "poster", PosterUploadLimit)
+	if err == http.ErrMissingFile {
+		poster, err = placeholderPoster(info.Width, info.Height)
+		posterMime = "image/png"
+	}
+	if ue, ok := err.(uploadError); ok {
+		return nil, uploadError("ポスター: " + string(ue))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &videoUpload{Info: info, Poster: poster, PosterMime: posterMime}, nil
+}
+
+// probeVideo はコンテナのメタデータだけを読み、再生時間と映像の大きさを返す
+func probeVideo(data []byte, mime string) (videoInfo, error) {
+	switch mime {
+	case "video/mp4":
+		return probeMP4(data)
+	case "video/webm":
+		return probeWebM(data)
+	}
+	return videoInfo{}, errVideoFormat
+}
+
+type mp4Box struct {
+	Type string
+	Body []byte
+}
+
+// readMP4Boxes は ISO BMFF のボックスを並びのまま読む。途中で切れたファイルはエラーにする
+func readMP4Boxes(data []byte) ([]mp4Box, error) {
+	boxes := []mp4Box{}
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errVideoFormat
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errVideoFormat
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return nil, errVideoFormat
+		}
+		boxes = append(boxes, mp4Box{Type: string(data[4:8]), Body: data[header:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+func findMP4Box(boxes []mp4Box, typ string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].Type == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+func probeMP4(data []byte) (videoInfo, error) {
+	info := videoInfo{}
+	top, err := readMP4Boxes(data)
+	if err != nil {
+		return info, err
+	}
+	if len(top) == 0 || top[0].Type != "ftyp" {
+		return info, errVideoFormat
+	}
+	moov := findMP4Box(top, "moov")
+	if moov == nil {
+		return info, errVideoFormat
+	}
+	children, err := readMP4Boxes(moov.Body)
+	if err != nil {
+		return info, err
+	}
+
+	mvhd := findMP4Box(children, "mvhd")
+	if mvhd == nil || len(mvhd.Body) < 4 {
+		return info, errVideoFormat
+	}
+	var timescale uint32
+	var duration uint64
+	b := mvhd.Body
+	if b[0] == 1 {
+		if len(b) < 32 {
+			return info, errVideoFormat
+		}
+		timescale, duration = binary.BigEndian.Uint32(b[20:]), binary.BigEndian.Uint64(b[24:])
+	} else {
+		if len(b) < 20 {
+			return info, errVideoFormat
+		}
+		timescale, duration = binary.BigEndian.Uint32(b[12:]), uint64(binary.BigEndian.Uint32(b[16:]))
+	}
+	if timescale == 0 {
+		return info, errVideoFormat
+	}
+	info.Duration = time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+
+	// 映像のトラックだけが tkhd に幅と高さ (16.16 の固定小数点) を持つ
+	for _, trak := range children {
+		if trak.Type != "trak" {
+			continue
+		}
+		boxes, err := readMP4Boxes(trak.Body)
+		if err != nil {
+			return info, err
+		}
+		tkhd := findMP4Box(boxes, "tkhd")
+		if tkhd == nil || len(tkhd.Body) < 84 {
+			continue
+		}
+		offset := 76
+		if tkhd.Body[0] == 1 {
+			offset = 88
+		}
+		if len(tkhd.Body) < offset+8 {
+			continue
+		}
+		w := int(binary.BigEndian.Uint32(tkhd.Body[offset:]) >> 16)
+		h := int(binary.BigEndian.Uint32(tkhd.Body[offset+4:]) >> 16)
+		if w > 0 && h > 0 {
+			info.Width, info.Height = w, h
+			return info, nil
+		}
+	}
+	return info, errVideoFormat
+}
+
+const (
+	ebmlHeaderID             = 0x1A45DFA3
+	ebmlDocTypeID            = 0x4282
+	webmSegmentID            = 0x18538067
+	webmInfoID               = 0x1549A966
+	webmTimecodeScaleID      = 0x2AD7B1
+	webmDurationID           = 0x4489
+	webmTracksID             = 0x1654AE6B
+	webmTrackEntryID         = 0xAE
+	webmVideoID              = 0xE0
+	webmPixelWidthID         = 0xB0
+	webmPixelHeightID        = 0xBA
+	webmClusterID            = 0x1F43B675
+	webmDefaultTimecodeScale = 1000000
+)
+
+// readEBMLVint は EBML の可変長整数を読む。ID は先頭の長さのビットを残したまま使う
+func readEBMLVint(b []byte, keepMarker bool) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errVideoFormat
+	}
+	length, mask := 1, byte(0x80)
+	for length <= 8 && b[0]&mask == 0 {
+		mask >>= 1
+		length++
+	}
+	if length > 8 || len(b) < length {
+		return 0, 0, errVideoFormat
+	}
+	v := uint64(b[0])
+	if !keepMarker {
+		v = uint64(b[0] & (mask - 1))
+	}
+	for i := 1; i < length; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, length, nil
+}
+
+type ebmlElement struct {
+	ID   uint64
+	Body []byte
+}
+
+// readEBML は EBML の要素を並びのまま読む。
+// 長さが不明な要素 (録画しながら書いた Segment や Cluster) と途中で切れた要素は、残りをすべて中身とする
+func readEBML(data []byte) ([]ebmlElement, error) {
+	elements := []ebmlElement{}
+	for len(data) > 0 {
+		id, n, err := readEBMLVint(data, true)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		size, m, err := readEBMLVint(data, false)
+		if err != nil {
+			return nil, err
+		}
+		data = data[m:]
+		if size == 1<<(7*uint(m))-1 || size > uint64(len(data)) {
+			size = uint64(len(data))
+		}
+		elements = append(elements, ebmlElement{ID: id, Body: data[:size]})
+		data = data[size:]
+	}
+	return elements, nil
+}
+
+func ebmlUint(b []byte) uint64 {
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func ebmlFloat(b []byte) (float64, bool) {
+	switch len(b) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), true
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), true
+	}
+	return 0, false
+}
+
+func probeWebM(data []byte) (videoInfo, error) {
+	info := videoInfo{}
+	top, err := readEBML(data)
+	if err != nil {
+		return info, err
+	}
+	if len(top) < 2 || top[0].ID != ebmlHeaderID {
+		return info, errVideoFormat
+	}
+	header, err := readEBML(top[0].Body)
+	if err != nil {
+		return info, err
+	}
+	docType := ""
+	for _, e := range header {
+		if e.ID == ebmlDocTypeID {
+			docType = strings.TrimRight(string(e.Body), "\x00")
+		}
+	}
+	if docType != "webm" || top[1].ID != webmSegmentID {
+		return info, errVideoFormat
+	}
+
+	segment, err := readEBML(top[1].Body)
+	if err != nil {
+		return info, err
+	}
+	scale := uint64(webmDefaultTimecodeScale)
+	duration := -1.0
+	for _, e := range segment {
+		if e.ID == webmClusterID {
+			// Info と Tracks は Cluster より前にある
+			break
+		}
+		switch e.ID {
+		case webmInfoID:
+			children, err := readEBML(e.Body)
+			if err != nil {
+				return info, err
+			}
+			for _, c := range children {
+				switch c.ID {
+				case webmTimecodeScaleID:
+					scale = ebmlUint(c.Body)
+				case webmDurationID:
+					if d, ok := ebmlFloat(c.Body); ok {
+						duration = d
+					}
+				}
+			}
+		case webmTracksID:
+			entries, err := readEBML(e.Body)
+			if err != nil {
+				return info, err
+			}
+			for _, entry := range entries {
+				if entry.ID != webmTrackEntryID || info.Width > 0 {
+					continue
+				}
+				children, err := readEBML(entry.Body)
+				if err != nil {
+					return info, err
+				}
+				for _, c := range children {
+					if c.ID != webmVideoID {
+						continue
+					}
+					video, err := readEBML(c.Body)
+					if err != nil {
+						return info, err
+					}
+					for _, v := range video {
+						switch v.ID {
+						case webmPixelWidthID:
+							info.Width = int(ebmlUint(v.Body))
+						case webmPixelHeightID:
+							info.Height = int(ebmlUint(v.Body))
+						}
+					}
+				}
+			}
+		}
+	}
+	// MediaRecorder で録ったままの webm は Duration を持たないことがあり、そのときは長さを確かめられない
+	if duration < 0 || scale == 0 || info.Width <= 0 || info.Height <= 0 {
+		return info, errVideoFormat
+	}
+	info.Duration = time.Duration(duration * float64(scale))
+	return info, nil
+}
+
+// extractPosterFrame は ffmpeg で最初のキーフレームを長辺 placeholderPosterSize 以下の JPEG にする。
+// mp4 は moov が末尾にあるとパイプからは読めないので、一時ファイルに書いてから渡す
+func extractPosterFrame(ctx context.Context, bin string, video []byte) ([]byte, error) {
+	f, err := os.CreateTemp("", "isuconp-video-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(video)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, posterExtractTimeout)
+	defer cancel()
+	scale := fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease", placeholderPosterSize, placeholderPosterSize)
+	cmd := exec.CommandContext(ctx, bin, "-nostdin", "-loglevel", "error", "-skip_frame", "nokey", "-i", f.Name(),
+		"-frames:v", "1", "-vf", scale, "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	if len(out) == 0 || len(out) > PosterUploadLimit {
+		return nil, fmt.Errorf("ffmpeg wrote %d bytes", len(out))
+	}
+	return out, nil
+}
+
+// placeholderPoster は動画の縦横比に合わせた、暗い背景に再生の三角を描いた PNG を作る
+func placeholderPoster(width, height int) ([]byte, error) {
+	w, h := placeholderPosterSize, placeholderPosterSize*9/16
+	if width > 0 && height > 0 {
+		if width >= height {
+			h = placeholderPosterSize * height / width
+		} else {
+			w, h = placeholderPosterSize*width/height, placeholderPosterSize
+		}
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	bg := color.RGBA{0x22, 0x22, 0x22, 0xff}
+	fg := color.RGBA{0xee, 0xee, 0xee, 0xff}
+	// 三角は短辺の 1/3 の高さで真ん中に置く
+	size := float64(w)
+	if h < w {
+		size = float64(h)
+	}
+	size /= 3
+	cx, cy := float64(w)/2, float64(h)/2
+	left, right := cx-size*0.4, cx+size*0.6
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			px, py := float64(x)+0.5, float64(y)+0.5
+			c := bg
+			if px >= left && px <= right {
+				half := size / 2 * (right - px) / (right - left)
+				if math.Abs(py-cy) <= half {
+					c = fg
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// getPostVideos は動画の投稿の情報をまとめて引く
+func getPostVideos(q sqlx.Queryer, postIDs []int) (map[int]*PostVideo, error) {
+	videos := map[int]*PostVideo{}
+	if len(postIDs) == 0 {
+		return videos, nil
+	}
+	rows := []PostVideo{}
+	err := sqlx.Select(q, &rows, fmt.Sprintf("SELECT `post_id`, `duration_ms`, `width`, `height`, `poster_mime`, `poster_hash` FROM `post_videos` WHERE `post_id` IN (%s)", joinIDs(postIDs)))
+	if err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		videos[rows[i].PostID] = &rows[i]
+	}
+	return videos, nil
+}
+
+func getVideoPoster(w http.ResponseWriter, r *http.Request) {
+	pid, err := strconv.Atoi(pat.Param(r, "id"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rdb := readDB(r)
+	meta, restricted, ok := authorizeImage(w, r, rdb, pid)
+	if !ok {
+		return
+	}
+
+	v := PostVideo{}
+	err = rdb.Get(&v, "SELECT `post_id`, `duration_ms`, `width`, `height`, `poster_mime`, `poster_hash` FROM `post_videos` WHERE `post_id` = ?", pid)
+	if err == sql.ErrNoRows || (err == nil && pat.Param(r, "ext") != getExt(v.PosterMime)) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	path := posterPath(pid, v.PosterMime)
+	serveImage(w, r, v.PosterHash, v.PosterMime, meta.CreatedAt, restricted, path, func() (io.ReadSeeker, error) {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image/png"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMP4Box(typ string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+// testMP4 は ftyp と moov (mvhd と映像の trak) と mdat だけの mp4 を作る
+func testMP4(duration time.Duration, width, height int) []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], uint32(duration.Milliseconds()))
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], uint32(width)<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], uint32(height)<<16)
+	return bytes.Join([][]byte{
+		testMP4Box("ftyp", []byte("isom\x00\x00\x02\x00isommp41")),
+		testMP4Box("moov", testMP4Box("mvhd", mvhd), testMP4Box("trak", testMP4Box("tkhd", tkhd))),
+		testMP4Box("mdat", []byte("frames")),
+	}, nil)
+}
+
+// testEBML は長さを 8 バイトの可変長整数で書いた要素を作る。size が負なら長さ不明にする
+func testEBML(id uint32, size int, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	idBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(idBytes, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	sizeBytes := make([]byte, 8)
+	if size < 0 {
+		binary.BigEndian.PutUint64(sizeBytes, 1<<56-1)
+	} else {
+		binary.BigEndian.PutUint64(sizeBytes, uint64(len(body)))
+	}
+	sizeBytes[0] = 0x01
+	return append(append(idBytes, sizeBytes...), body...)
+}
+
+func testEBMLUint(v uint64, n int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b[8-n:]
+}
+
+// testWebM は EBML ヘッダと Segment (Info, Tracks, Cluster) だけの webm を作る。duration が負なら Duration を書かない
+func testWebM(duration time.Duration, width, height int, unknownSize bool) []byte {
+	info := [][]byte{testEBML(webmTimecodeScaleID, 0, testEBMLUint(webmDefaultTimecodeScale, 3))}
+	if duration >= 0 {
+		d := make([]byte, 8)
+		binary.BigEndian.PutUint64(d, math.Float64bits(float64(duration.Milliseconds())))
+		info = append(info, testEBML(webmDurationID, 0, d))
+	}
+	segmentSize := 0
+	if unknownSize {
+		segmentSize = -1
+	}
+	return bytes.Join([][]byte{
+		testEBML(ebmlHeaderID, 0, testEBML(ebmlDocTypeID, 0, []byte("webm"))),
+		testEBML(webmSegmentID, segmentSize,
+			testEBML(webmInfoID, 0, info...),
+			testEBML(webmTracksID, 0, testEBML(webmTrackEntryID, 0, testEBML(webmVideoID, 0,
+				testEBML(webmPixelWidthID, 0, testEBMLUint(uint64(width), 2)),
+				testEBML(webmPixelHeightID, 0, testEBMLUint(uint64(height), 2)),
+			))),
+			testEBML(webmClusterID, -1, []byte("frames")),
+		),
+	}, nil)
+}
+
+func TestProbeVideo(t *testing.T) {
+	mp4 := testMP4(5*time.Second, 320, 240)
+	tests := []struct {
+		name  string
+		data  []byte
+		mime  string
+		want  videoInfo
+		error bool
+	}{
+		{"mp4", mp4, "video/mp4", videoInfo{5 * time.Second, 320, 240}, false},
+		{"webm", testWebM(12500*time.Millisecond, 640, 360, false), "video/webm", videoInfo{12500 * time.Millisecond, 640, 360}, false},
+		{"webm unknown size", testWebM(3*time.Second, 360, 640, true), "video/webm", videoInfo{3 * time.Second, 360, 640}, false},
+		{"webm without duration", testWebM(-1, 640, 360, false), "video/webm", videoInfo{}, true},
+		{"truncated mp4", mp4[:len(mp4)-3], "video/mp4", videoInfo{}, true},
+		{"webm as mp4", testWebM(time.Second, 640, 360, false), "video/mp4", videoInfo{}, true},
+		{"png as webm", []byte("\x89PNG\r\n\x1a\n"), "video/webm", videoInfo{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := probeVideo(tt.data, tt.mime)
+			if tt.error {
+				if err == nil {
+					t.Errorf("probeVideo = %v, want error", got)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("probeVideo = %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+}
+
+// postVideo は動画とポスターを付けて投稿する。poster が nil ならポスターを付けない
+func (c *testClient) postVideo(csrfToken string, video testUpload, poster *testUpload) *testResponse {
+	c.t.Helper()
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	mw.WriteField("csrf_token", csrfToken)
+	mw.WriteField("body", "video post")
+	files := map[string]*testUpload{"file": &video, "poster": poster}
+	for _, field := range []string{"file", "poster"} {
+		f := files[field]
+		if f == nil {
+			continue
+		}
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="upload"`, field))
+		h.Set("Content-Type", f.contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		part.Write(f.data)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+"/", buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return c.do(req)
+}
+
+func TestVideoPost(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	mp4 := testMP4(12*time.Second, 640, 480)
+	tests := []struct {
+		name   string
+		files  []testUpload
+		notice string
+	}{
+		{"too long", []testUpload{{"video/mp4", testMP4(61*time.Second, 640, 480)}}, "動画は60秒までです"},
+		{"not a video", []testUpload{{"video/webm", []byte("not a video")}}, "動画を読み取れませんでした"},
+		{"with image", []testUpload{{"image/png", []byte("png")}, {"video/mp4", mp4}}, "動画は1本だけで投稿してください"},
+		{"too large", []testUpload{{"video/mp4", make([]byte, VideoUploadLimit+1)}}, "ファイルサイズが大きすぎます"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertRedirect(t, c.postImages(token, map[string]string{"body": "x"}, tt.files...), "/")
+			if res := c.get("/"); !strings.Contains(res.Body, tt.notice) {
+				t.Errorf("flash %q not shown", tt.notice)
+			}
+		})
+	}
+	if n := app.count("posts"); n != 0 {
+		t.Fatalf("posts = %d, want 0", n)
+	}
+
+	// ポスターがなければプレースホルダを作る
+	assertRedirect(t, c.postVideo(token, testUpload{"video/mp4", mp4}, nil), "/posts/1")
+	if n := app.count("post_images"); n != 0 {
+		t.Errorf("post_images = %d, want 0", n)
+	}
+	v := app.fake.findOne("post_videos", "post_id", int64(1))
+	if v == nil || fakeInt(v["duration_ms"]) != 12000 || fakeInt(v["width"]) != 640 || fakeString(v["poster_mime"]) != "image/png" {
+		t.Fatalf("post_videos = %v", v)
+	}
+	if data, err := os.ReadFile(imagePath(1, "video/mp4")); err != nil || !bytes.Equal(data, mp4) {
+		t.Errorf("video file = %d bytes, %v", len(data), err)
+	}
+
+	poster := "/image/1/poster.png?v=" + imageVersion(fakeString(v["poster_hash"]))
+	for _, path := range []string{"/posts/1", "/"} {
+		body := c.get(path).Body
+		if !strings.Contains(body, `<video src="/image/1.mp4?v=`) || !strings.Contains(body, poster) || !strings.Contains(body, "0:12") {
+			t.Errorf("%s does not render the video", path)
+		}
+	}
+
+	res := c.get(poster)
+	assertStatus(t, res, http.StatusOK)
+	img, err := png.Decode(strings.NewReader(res.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 480 || b.Dy() != 360 {
+		t.Errorf("placeholder = %v, want 480x360", b)
+	}
+	assertStatus(t, c.get("/image/1/poster.jpg"), http.StatusNotFound)
+
+	res = c.get("/image/1.mp4", "Range", "bytes=4-7")
+	assertStatus(t, res, http.StatusPartialContent)
+	if res.Body != "ftyp" || res.Header.Get("Content-Type") != "video/mp4" {
+		t.Errorf("range = %q, %q", res.Body, res.Header.Get("Content-Type"))
+	}
+	if got := res.Header.Get("Content-Range"); got != fmt.Sprintf("bytes 4-7/%d", len(mp4)) {
+		t.Errorf("Content-Range = %q", got)
+	}
+
+	// ブラウザが切り出したポスターはそのまま使う
+	webm := testWebM(3*time.Second, 360, 640, true)
+	assertRedirect(t, c.postVideo(token, testUpload{"video/webm", webm}, &testUpload{"image/jpeg", []byte("frame")}), "/posts/2")
+	res = c.get("/image/2/poster.jpg")
+	assertStatus(t, res, http.StatusOK)
+	if res.Body != "frame" || res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("poster = %q, %q", res.Body, res.Header.Get("Content-Type"))
+	}
+	assertStatus(t, c.get("/image/2.webm"), http.StatusOK)
+}
+
+func TestVideoPosterFFmpeg(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+	token := c.csrfToken()
+
+	// 渡された動画のファイルが空でなければフレームの代わりの文字列を書く
+	dir := t.TempDir()
+	ffmpeg := dir + "/ffmpeg"
+	os.WriteFile(ffmpeg, []byte("#!/bin/sh\n[ -s \"$7\" ] || exit 1\nprintf keyframe\n"), 0755)
+	t.Setenv("ISUCONP_VIDEO_POSTER_FFMPEG", ffmpeg)
+
+	assertRedirect(t, c.postVideo(token, testUpload{"video/mp4", testMP4(time.Second, 320, 240)}, &testUpload{"image/jpeg", []byte("canvas")}), "/posts/1")
+	res := c.get("/image/1/poster.jpg")
+	assertStatus(t, res, http.StatusOK)
+	if res.Body != "keyframe" {
+		t.Errorf("poster = %q, want the extracted frame", res.Body)
+	}
+
+	// 取り出せなければブラウザが付けたポスターを使う
+	os.WriteFile(ffmpeg, []byte("#!/bin/sh\nexit 1\n"), 0755)
+	assertRedirect(t, c.postVideo(token, testUpload{"video/mp4", testMP4(time.Second, 320, 240)}, &testUpload{"image/jpeg", []byte("canvas")}), "/posts/2")
+	if res := c.get("/image/2/poster.jpg"); res.Body != "canvas" {
+		t.Errorf("poster = %q, want the uploaded one", res.Body)
+	}
+}
+
+func TestVideoPosterVisibility(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("mary", 0, 0)
+	c := app.newClient()
+	c.login("mary")
+
+	assertRedirect(t, c.postImages(c.csrfToken(), map[string]string{"body": "secret", "visibility": visibilityOnlyMe},
+		testUpload{"video/mp4", testMP4(time.Second, 320, 240)},
+	), "/posts/1")
+	res := c.get("/image/1/poster.png")
+	assertStatus(t, res, http.StatusOK)
+	if got := res.Header.Get("Cache-Control"); got != restrictedImageCacheControl {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	assertStatus(t, app.newClient().get("/image/1/poster.png"), http.StatusNotFound)
+	assertStatus(t, app.newClient().get("/image/1.mp4"), http.StatusNotFound)
+}
@@ -32,10 +32,13 @@ document.addEventListener('DOMContentLoaded', () => {
 
   btn.addEventListener('click', () => {
     postMore.classList.add('loading');
-    const posts = document.querySelectorAll('.isu-post');
+    // ブックマークの一覧では投稿を包んだ要素を並べるので、.isu-posts の直下の要素を続きの単位にする
+    const posts = document.querySelectorAll('.isu-posts > [data-created-at]');
     const lastEl = posts[posts.length-1];
     const maxCreatedAt = lastEl.dataset.createdAt;
-    fetch(`/posts?max_created_at=${encodeURIComponent(maxCreatedAt)}`, {
+    const path = postMore.dataset.path || '/posts';
+    const sep = path.includes('?') ? '&' : '?';
+    fetch(`${path}${sep}max_created_at=${encodeURIComponent(maxCreatedAt)}`, {
       method: 'GET',
     }).then(response => {
       if (!response.ok) {
@@ -45,7 +48,7 @@ document.addEventListener('DOMContentLoaded', () => {
     }).then(text => {
       const parser = new DOMParser();
       const doc = parser.parseFromString(text, "text/html");
-      doc.querySelectorAll('.isu-post').forEach((el) => {
+      doc.querySelectorAll('.isu-posts > [data-created-at]').forEach((el) => {
         const id = el.getAttribute('id');
         if (!document.getElementById(id)) {
           lastEl.parentElement.append(el);
@@ -56,3 +59,46 @@ document.addEventListener('DOMContentLoaded', () => {
     });
   });
 });
+
+// 動画を選んだら最初のほうのフレームを canvas で切り出し、ポスターとして一緒に送る。
+// 切り出せないブラウザではサーバーがプレースホルダを作る
+document.addEventListener('DOMContentLoaded', () => {
+  const fileInput = document.querySelector('input[name="file"]');
+  const posterInput = document.querySelector('input[name="poster"]');
+
+  if (!fileInput || !posterInput) {
+    return;
+  }
+
+  fileInput.addEventListener('change', () => {
+    posterInput.value = '';
+    const file = fileInput.files[0];
+    if (fileInput.files.length !== 1 || !file.type.startsWith('video/')) {
+      return;
+    }
+
+    const url = URL.createObjectURL(file);
+    const video = document.createElement('video');
+    video.muted = true;
+    video.preload = 'auto';
+    video.addEventListener('loadeddata', () => {
+      video.currentTime = Math.min(0.5, video.duration / 2);
+    });
+    video.addEventListener('seeked', () => {
+      const canvas = document.createElement('canvas');
+      canvas.width = video.videoWidth;
+      canvas.height = video.videoHeight;
+      canvas.getContext('2d').drawImage(video, 0, 0);
+      URL.revokeObjectURL(url);
+      canvas.toBlob((blob) => {
+        if (!blob) {
+          return;
+        }
+        const dt = new DataTransfer();
+        dt.items.add(new File([blob], 'poster.jpg', { type: 'image/jpeg' }));
+        posterInput.files = dt.files;
+      }, 'image/jpeg', 0.85);
+    }, { once: true });
+    video.src = url;
+  });
+});